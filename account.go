@@ -0,0 +1,161 @@
+package graval
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Account says when and where a user may log in, for drivers that implement
+// FTPAccountDriver. The zero value places no restrictions.
+type Account struct {
+	// When the account stops working. Zero means never.
+	Expires time.Time
+
+	// The times of day logins are allowed, in Location. Empty means at any
+	// time.
+	AllowedHours []HourRange
+
+	// The time zone AllowedHours are in. Defaults to UTC.
+	Location *time.Location
+
+	// The networks logins are allowed from, in CIDR notation like
+	// "192.0.2.0/24", or single addresses. Empty means from anywhere.
+	// Entries that can't be parsed are logged and match nothing.
+	AllowedNetworks []string
+
+	// The permissions of files and directories the user creates with STOR
+	// and MKD, for drivers that implement FTPCreateModeDriver. FileMode
+	// defaults to 0666 and DirMode to 0777, and the bits in Umask are
+	// cleared from both, so a Umask of 022 gives 0644 and 0755. When all
+	// three are zero the driver's own defaults are used.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	Umask    os.FileMode
+}
+
+// HourRange is a range of hours of the day, from the start of From up to the
+// start of To. Ranges where To is before From run past midnight, so
+// HourRange{22, 6} is overnight.
+type HourRange struct {
+	From int
+	To   int
+}
+
+func (hours HourRange) contains(hour int) bool {
+	if hours.From <= hours.To {
+		return hour >= hours.From && hour < hours.To
+	}
+	return hour >= hours.From || hour < hours.To
+}
+
+// allowedAt reports whether the account may log in at now.
+func (account *Account) allowedAt(now time.Time) bool {
+	if len(account.AllowedHours) == 0 {
+		return true
+	}
+	location := account.Location
+	if location == nil {
+		location = time.UTC
+	}
+	hour := now.In(location).Hour()
+	for _, hours := range account.AllowedHours {
+		if hours.contains(hour) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedFrom reports whether the account may log in from ip, logging any
+// networks that can't be parsed.
+func (account *Account) allowedFrom(ip net.IP, logger *ftpLogger) bool {
+	if len(account.AllowedNetworks) == 0 {
+		return true
+	}
+	for _, network := range account.AllowedNetworks {
+		if !strings.Contains(network, "/") {
+			if allowed := net.ParseIP(network); allowed != nil {
+				if allowed.Equal(ip) {
+					return true
+				}
+				continue
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			logger.Printf("Ignoring account network %q: %s", network, err)
+			continue
+		}
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// createModes returns the permissions for new files and directories, and
+// false if the account leaves them to the driver.
+func (account *Account) createModes() (os.FileMode, os.FileMode, bool) {
+	if account.FileMode == 0 && account.DirMode == 0 && account.Umask == 0 {
+		return 0, 0, false
+	}
+	fileMode, dirMode := account.FileMode, account.DirMode
+	if fileMode == 0 {
+		fileMode = 0666
+	}
+	if dirMode == 0 {
+		dirMode = 0777
+	}
+	return fileMode &^ account.Umask & os.ModePerm, dirMode &^ account.Umask & os.ModePerm, true
+}
+
+// refuseAccount checks the restrictions an FTPAccountDriver places on the
+// user who has just given the right password. If the login isn't allowed,
+// the client is told why and the session ends, and true is returned.
+// Otherwise any permissions the account sets for new files are passed to the
+// driver.
+func (ftpConn *ftpConn) refuseAccount(user string) bool {
+	var driver FTPAccountDriver
+	if !DriverAs(ftpConn.driver, &driver) {
+		return false
+	}
+	account, err := driver.Account(user)
+	reason, message := "", ""
+	switch {
+	case err != nil:
+		ftpConn.logger.Printf("Unable to look up account %s: %s", user, err)
+		reason, message = "unavailable", "Account unavailable, not logged in"
+	case account == nil:
+		return false
+	case !account.Expires.IsZero() && !ftpConn.server.clock.Now().Before(account.Expires):
+		reason, message = "expired", "Account expired, not logged in"
+	case !account.allowedAt(ftpConn.server.clock.Now()):
+		reason, message = "outside allowed hours", "Login not allowed at this time"
+	case !account.allowedFrom(net.ParseIP(ftpConn.remoteIP()), ftpConn.logger):
+		reason, message = "outside allowed networks", "Login not allowed from your address"
+	default:
+		ftpConn.setCreateModes(account)
+		return false
+	}
+	ftpConn.securityEvent(SecurityAccountRestricted, reason)
+	ftpConn.writeMessage(530, message)
+	ftpConn.Close()
+	return true
+}
+
+// setCreateModes passes the permissions account sets for new files and
+// directories to the driver, if it implements FTPCreateModeDriver.
+func (ftpConn *ftpConn) setCreateModes(account *Account) {
+	fileMode, dirMode, ok := account.createModes()
+	if !ok {
+		return
+	}
+	var driver FTPCreateModeDriver
+	if DriverAs(ftpConn.driver, &driver) {
+		driver.SetCreateModes(fileMode, dirMode)
+	} else {
+		ftpConn.logger.Printf("Driver can't set the permissions of new files, using its defaults")
+	}
+}
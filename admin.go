@@ -0,0 +1,225 @@
+package graval
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// the reply sent to sessions ended by Kick or KickSession
+const kickMessage = "Disconnected by administrator"
+
+// SessionState describes a client connected to the server.
+type SessionState struct {
+	SessionId string         `json:"session"`
+	User      string         `json:"user,omitempty"`
+	RemoteIP  string         `json:"remote_ip"`
+	Connected time.Time      `json:"connected"`
+	Transfer  *TransferState `json:"transfer,omitempty"`
+
+	// The account the user belongs to, when an FTPAliasDriver maps them to
+	// another
+	Account string `json:"account,omitempty"`
+
+	// The user's login before this one, when the server has a LoginStore
+	LastLogin *LoginRecord `json:"last_login,omitempty"`
+}
+
+func (ftpConn *ftpConn) state() SessionState {
+	ftpConn.mu.Lock()
+	state := SessionState{
+		SessionId: ftpConn.sessionId,
+		User:      ftpConn.user,
+		Account:   ftpConn.aliasedAccount(),
+		RemoteIP:  ftpConn.remoteIP(),
+		Connected: ftpConn.connected,
+		LastLogin: ftpConn.lastLogin,
+	}
+	current := ftpConn.current
+	ftpConn.mu.Unlock()
+	if current != nil {
+		transfer := current.state()
+		state.Transfer = &transfer
+	}
+	return state
+}
+
+// Sessions returns the state of every client connected to the server.
+func (ftpServer *FTPServer) Sessions() []SessionState {
+	sessions := []SessionState{}
+	for _, conn := range ftpServer.sessionList() {
+		sessions = append(sessions, conn.state())
+	}
+	return sessions
+}
+
+// sessionList returns the established sessions, so they can be worked on
+// without holding mu.
+func (ftpServer *FTPServer) sessionList() []*ftpConn {
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	sessions := make([]*ftpConn, 0, len(ftpServer.sessions))
+	for conn := range ftpServer.sessions {
+		sessions = append(sessions, conn)
+	}
+	return sessions
+}
+
+// Kick ends every session logged in as user with a 421 reply, interrupting
+// any transfers in progress. It returns the number of sessions ended.
+func (ftpServer *FTPServer) Kick(user string) int {
+	kicked := 0
+	for _, conn := range ftpServer.sessionList() {
+		if conn.state().User == user {
+			conn.closeWithMessage(kickMessage)
+			kicked++
+		}
+	}
+	return kicked
+}
+
+// KickSession ends the session with the given ID like Kick, returning false
+// if there's no such session.
+func (ftpServer *FTPServer) KickSession(id string) bool {
+	for _, conn := range ftpServer.sessionList() {
+		if conn.sessionId == id {
+			conn.closeWithMessage(kickMessage)
+			return true
+		}
+	}
+	return false
+}
+
+// SetMaxBandwidth changes MaxBandwidth, including for transfers that are
+// already in progress. 0 means unlimited.
+func (ftpServer *FTPServer) SetMaxBandwidth(bytesPerSecond int64) {
+	ftpServer.bandwidth.setRate(float64(bytesPerSecond))
+}
+
+// SetReadOnly turns read-only mode on or off. While it's on, commands that
+// change files, like STOR, DELE and RNFR, are refused with a 550 reply, for
+// every session and whatever the driver allows. Transfers already in
+// progress are allowed to finish.
+func (ftpServer *FTPServer) SetReadOnly(readOnly bool) {
+	var value int32
+	if readOnly {
+		value = 1
+	}
+	atomic.StoreInt32(&ftpServer.readOnly, value)
+}
+
+// ReadOnly reports whether read-only mode is on.
+func (ftpServer *FTPServer) ReadOnly() bool {
+	return atomic.LoadInt32(&ftpServer.readOnly) == 1
+}
+
+// AdminHandler returns an http.Handler for managing the server while it
+// runs, from scripts or command line tools. It has no authentication of its
+// own, so serve it somewhere only administrators can reach, like a Unix
+// socket:
+//
+//	listener, _ := net.Listen("unix", "/run/graval/admin.sock")
+//	go http.Serve(listener, server.AdminHandler())
+//
+// and then, for example:
+//
+//	curl --unix-socket /run/graval/admin.sock http://graval/sessions
+//
+// It answers these requests, responding with JSON:
+//
+//	GET  /stats                      the same as Stats()
+//	GET  /sessions                   the same as Sessions()
+//	GET  /transfers                  the same as Transfers()
+//	GET  /last-login?user=name       the same as LastLogin()
+//	POST /kick?user=name             Kick, returning the sessions ended
+//	POST /kick?session=id            KickSession
+//	POST /bandwidth?rate=bytes       SetMaxBandwidth
+//	POST /read-only?enabled=true     SetReadOnly
+func (ftpServer *FTPServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", adminGet(func(r *http.Request) (interface{}, int) {
+		return ftpServer.Stats(), http.StatusOK
+	}))
+	mux.HandleFunc("/sessions", adminGet(func(r *http.Request) (interface{}, int) {
+		return ftpServer.Sessions(), http.StatusOK
+	}))
+	mux.HandleFunc("/transfers", adminGet(func(r *http.Request) (interface{}, int) {
+		return ftpServer.Transfers(), http.StatusOK
+	}))
+	mux.HandleFunc("/last-login", adminGet(func(r *http.Request) (interface{}, int) {
+		user := r.FormValue("user")
+		if user == "" {
+			return adminError("user is required"), http.StatusBadRequest
+		}
+		record, err := ftpServer.LastLogin(user)
+		if err != nil {
+			return adminError(err.Error()), http.StatusInternalServerError
+		}
+		if record == nil {
+			return adminError("no login recorded"), http.StatusNotFound
+		}
+		return record, http.StatusOK
+	}))
+	mux.HandleFunc("/kick", adminPost(func(r *http.Request) (interface{}, int) {
+		if id := r.FormValue("session"); id != "" {
+			if !ftpServer.KickSession(id) {
+				return adminError("no such session"), http.StatusNotFound
+			}
+			return map[string]int{"kicked": 1}, http.StatusOK
+		}
+		user := r.FormValue("user")
+		if user == "" {
+			return adminError("user or session is required"), http.StatusBadRequest
+		}
+		return map[string]int{"kicked": ftpServer.Kick(user)}, http.StatusOK
+	}))
+	mux.HandleFunc("/bandwidth", adminPost(func(r *http.Request) (interface{}, int) {
+		rate, err := strconv.ParseInt(r.FormValue("rate"), 10, 64)
+		if err != nil || rate < 0 {
+			return adminError("rate must be a number of bytes per second"), http.StatusBadRequest
+		}
+		ftpServer.SetMaxBandwidth(rate)
+		return map[string]int64{"rate": rate}, http.StatusOK
+	}))
+	mux.HandleFunc("/read-only", adminPost(func(r *http.Request) (interface{}, int) {
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			return adminError("enabled must be true or false"), http.StatusBadRequest
+		}
+		ftpServer.SetReadOnly(enabled)
+		return map[string]bool{"enabled": enabled}, http.StatusOK
+	}))
+	return mux
+}
+
+func adminError(message string) map[string]string {
+	return map[string]string{"error": message}
+}
+
+// adminGet adapts a function answering a GET request to an http.HandlerFunc.
+func adminGet(answer func(*http.Request) (interface{}, int)) http.HandlerFunc {
+	return adminMethod(http.MethodGet, answer)
+}
+
+// adminPost adapts a function answering a POST request to an
+// http.HandlerFunc.
+func adminPost(answer func(*http.Request) (interface{}, int)) http.HandlerFunc {
+	return adminMethod(http.MethodPost, answer)
+}
+
+func adminMethod(method string, answer func(*http.Request) (interface{}, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(adminError("method not allowed"))
+			return
+		}
+		body, status := answer(r)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+}
@@ -0,0 +1,84 @@
+package graval
+
+// AffinityEvent says what happened to a session to make the server call its
+// AffinityHook.
+type AffinityEvent string
+
+const (
+	// The client has connected, before it's sent the welcome
+	AffinityConnect AffinityEvent = "connect"
+
+	// The client has logged in
+	AffinityLogin AffinityEvent = "login"
+
+	// The session has opened a passive listener, before the client is told
+	// its port. It replaces any listener the session opened before.
+	AffinityPassive AffinityEvent = "passive"
+
+	// The session has ended, and its passive listener is closed
+	AffinityEnd AffinityEvent = "end"
+)
+
+// SessionAffinity describes a session to a balancer or proxy in front of
+// several servers, which must send the session's data connections to the
+// same server as its control connection.
+type SessionAffinity struct {
+	Event AffinityEvent `json:"event,omitempty"`
+
+	// The server's InstanceName
+	Instance string `json:"instance,omitempty"`
+
+	SessionId string `json:"session"`
+
+	// Names the session across every instance, for use as a routing key.
+	// It's the session ID, prefixed with the instance name and a colon when
+	// the server has one.
+	Token string `json:"token"`
+
+	// The user the session is logged in as, or empty before login
+	User string `json:"user,omitempty"`
+
+	RemoteIP string `json:"remote_ip"`
+
+	// The port of the session's passive listener, or 0 when it has none.
+	// Data connections from RemoteIP to this port belong to the session.
+	PassivePort int `json:"passive_port,omitempty"`
+}
+
+// AffinityHook is called as sessions start, log in, open passive listeners
+// and end. It's called before the client is told about a passive port, so a
+// proxy can be ready to route the data connection before it arrives, which
+// means it holds up the session until it returns.
+type AffinityHook func(affinity *SessionAffinity)
+
+// affinityToken returns the session's SessionAffinity.Token.
+func (ftpConn *ftpConn) affinityToken() string {
+	if ftpConn.server.instanceName == "" {
+		return ftpConn.sessionId
+	}
+	return ftpConn.server.instanceName + ":" + ftpConn.sessionId
+}
+
+// affinity describes the session as it is now, with the port of its passive
+// listener if it has one.
+func (ftpConn *ftpConn) affinity(event AffinityEvent, passivePort int) *SessionAffinity {
+	ftpConn.mu.Lock()
+	user := ftpConn.user
+	ftpConn.mu.Unlock()
+	return &SessionAffinity{
+		Event:       event,
+		Instance:    ftpConn.server.instanceName,
+		SessionId:   ftpConn.sessionId,
+		Token:       ftpConn.affinityToken(),
+		User:        user,
+		RemoteIP:    ftpConn.remoteIP(),
+		PassivePort: passivePort,
+	}
+}
+
+// announceAffinity passes the session to the server's AffinityHook.
+func (ftpConn *ftpConn) announceAffinity(event AffinityEvent, passivePort int) {
+	if hook := ftpConn.server.affinityHook; hook != nil {
+		hook(ftpConn.affinity(event, passivePort))
+	}
+}
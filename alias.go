@@ -0,0 +1,22 @@
+package graval
+
+// accountName returns the account that user belongs to, asking the driver if
+// it implements FTPAliasDriver.
+func (ftpConn *ftpConn) accountName(user string) string {
+	var driver FTPAliasDriver
+	if DriverAs(ftpConn.driver, &driver) {
+		if account := driver.AccountName(user); account != "" {
+			return account
+		}
+	}
+	return user
+}
+
+// aliasedAccount returns the session's account if it differs from the name
+// the user logged in with, or an empty string. The caller must hold mu.
+func (ftpConn *ftpConn) aliasedAccount() string {
+	if ftpConn.account == ftpConn.user {
+		return ""
+	}
+	return ftpConn.account
+}
@@ -0,0 +1,184 @@
+package graval
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+var errArchiveResume = errors.New("archives can't be resumed")
+
+// archiveFormats maps the suffixes that can be added to a directory's name
+// to the functions that write an archive in that format.
+var archiveFormats = []struct {
+	suffix string
+	write  func(ftpConn *ftpConn, dir string, w io.Writer) error
+}{
+	{".tar.gz", (*ftpConn).writeTarGz},
+	{".tar", (*ftpConn).writeTar},
+	{".zip", (*ftpConn).writeZip},
+}
+
+// openArchive returns a reader for an archive of a directory, if
+// archivePath is the directory's name followed by one of the
+// archiveFormats. The archive is assembled as it's read.
+func (ftpConn *ftpConn) openArchive(archivePath string) (io.ReadCloser, error) {
+	for _, format := range archiveFormats {
+		dir := strings.TrimSuffix(archivePath, format.suffix)
+		if dir == archivePath || dir == "" || strings.HasSuffix(dir, "/") || !ftpConn.driver.ChangeDir(dir) || ftpConn.hiddenDir(dir) {
+			continue
+		}
+		if ftpConn.restOffset > 0 || ftpConn.rangeSet {
+			return nil, errArchiveResume
+		}
+		reader, writer := io.Pipe()
+		done := make(chan struct{})
+		write := format.write
+		go func() {
+			defer close(done)
+			writer.CloseWithError(write(ftpConn, dir, writer))
+		}()
+		return &archiveReader{PipeReader: reader, done: done}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// archiveReader is the reading end of an archive being assembled. Closing it
+// stops the assembly, and waits until the driver is no longer in use.
+type archiveReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (r *archiveReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
+
+// walkArchive calls add for every file and directory beneath dir, with its
+// path relative to dir. Symlinks are skipped, so an archive can't loop or
+// escape the tree, and so are the contents of hidden directories. Files are
+// opened with GetFile and closed after add.
+func (ftpConn *ftpConn) walkArchive(dir string, name string, add func(name string, info os.FileInfo, data io.Reader) error) error {
+	for _, info := range ftpConn.driver.DirContents(path.Join(dir, name)) {
+		childName := path.Join(name, info.Name())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+		case info.IsDir():
+			if err := add(childName, info, nil); err != nil {
+				return err
+			}
+			if ftpConn.hiddenDir(path.Join(dir, childName)) {
+				continue
+			}
+			if err := ftpConn.walkArchive(dir, childName, add); err != nil {
+				return err
+			}
+		default:
+			data, err := ftpConn.driver.GetFile(path.Join(dir, childName))
+			if err != nil {
+				return err
+			}
+			err = add(childName, info, data)
+			data.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveMode returns the mode to store for a file in an archive, filling in
+// the usual permissions for drivers that don't report them.
+func archiveMode(info os.FileInfo) os.FileMode {
+	mode := info.Mode()
+	if mode.Perm() != 0 {
+		return mode
+	}
+	if info.IsDir() {
+		return mode | 0755
+	}
+	return mode | 0644
+}
+
+func (ftpConn *ftpConn) writeTar(dir string, w io.Writer) error {
+	archive := tar.NewWriter(w)
+	err := ftpConn.walkArchive(dir, "", func(name string, info os.FileInfo, data io.Reader) error {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    int64(archiveMode(info).Perm()),
+			ModTime: info.ModTime(),
+		}
+		if data == nil {
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		} else if info.Size() == SizeUnknown {
+			// a tar header needs the size, so a virtual file has to be
+			// generated in full first
+			contents, err := ioutil.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(contents))
+			data = bytes.NewReader(contents)
+		} else {
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if data != nil {
+			// the size in the header has to be right, so a file that
+			// changes while it's being read can't be archived
+			if _, err := io.CopyN(archive, data, header.Size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func (ftpConn *ftpConn) writeTarGz(dir string, w io.Writer) error {
+	compressor := gzip.NewWriter(w)
+	if err := ftpConn.writeTar(dir, compressor); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+func (ftpConn *ftpConn) writeZip(dir string, w io.Writer) error {
+	archive := zip.NewWriter(w)
+	err := ftpConn.walkArchive(dir, "", func(name string, info os.FileInfo, data io.Reader) error {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()}
+		header.SetMode(archiveMode(info))
+		if data == nil {
+			header.Name += "/"
+			header.Method = zip.Store
+		}
+		entry, err := archive.CreateHeader(header)
+		if err != nil || data == nil {
+			return err
+		}
+		_, err = io.Copy(entry, data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
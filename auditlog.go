@@ -0,0 +1,112 @@
+package graval
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes a single action taken by an authenticated client.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	SessionId string    `json:"session"`
+	User      string    `json:"user"`
+	RemoteIP  string    `json:"remote_ip"`
+	Verb      string    `json:"verb"`
+	Path      string    `json:"path,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Code      int       `json:"code"`
+}
+
+// AuditLogger is the destination for audit records. Provide an
+// implementation via FTPServerOpts to persist the records somewhere durable.
+// Log will be called concurrently from many client connections.
+type AuditLogger interface {
+	Log(*AuditRecord)
+}
+
+type jsonAuditLogger struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONAuditLogger returns an AuditLogger that appends each record to w as
+// a single line of JSON.
+func NewJSONAuditLogger(w io.Writer) AuditLogger {
+	l := new(jsonAuditLogger)
+	l.encoder = json.NewEncoder(w)
+	return l
+}
+
+func (logger *jsonAuditLogger) Log(record *AuditRecord) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.encoder.Encode(record)
+}
+
+// countingReader wraps an io.Reader and keeps a tally of the bytes read
+// through it. If tally is set, it's also called with the size of each read
+// as it happens. Any error other than io.EOF is kept in err, so it can be
+// told apart from errors writing the data elsewhere.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+	tally  func(int64)
+	err    error
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.count += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	if r.tally != nil && n > 0 {
+		r.tally(int64(n))
+	}
+	return
+}
+
+// CommandRecord describes a command as a client sent it, given to a
+// CommandHook.
+type CommandRecord struct {
+	Time      time.Time
+	SessionId string
+	RemoteIP  string
+
+	// The user the session is logged in as, or empty before login
+	User string
+
+	// The values stored for the session
+	Values *SessionValues
+
+	Command string
+
+	// The parameter exactly as sent, including the passwords of PASS and
+	// SITE PSWD
+	Param string
+}
+
+// CommandHook is called with every command a client sends, whether or not
+// it's logged in and whether or not the command is valid, before it's run.
+// Unlike an AuditLogger it sees passwords, so take care where the records
+// go.
+type CommandHook func(command *CommandRecord)
+
+// commandReceived passes a command to the server's CommandHook, if it has
+// one.
+func (ftpConn *ftpConn) commandReceived(command string, param string) {
+	if ftpConn.server.commandHook == nil {
+		return
+	}
+	ftpConn.server.commandHook(&CommandRecord{
+		Time:      ftpConn.server.clock.Now().UTC(),
+		SessionId: ftpConn.sessionId,
+		RemoteIP:  ftpConn.remoteIP(),
+		User:      ftpConn.user,
+		Values:    ftpConn.values,
+		Command:   command,
+		Param:     param,
+	})
+}
@@ -0,0 +1,37 @@
+package graval
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestJSONAuditLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := NewJSONAuditLogger(buf)
+	logger.Log(&AuditRecord{
+		Time:      time.Unix(1566738000, 0).UTC(),
+		SessionId: "abc",
+		User:      "test",
+		RemoteIP:  "127.0.0.1",
+		Verb:      "RETR",
+		Path:      "/one.txt",
+		Bytes:     99,
+		Code:      226,
+	})
+	logger.Log(&AuditRecord{
+		Time:      time.Unix(1566738000, 0).UTC(),
+		SessionId: "abc",
+		User:      "test",
+		RemoteIP:  "127.0.0.1",
+		Verb:      "TYPE",
+		Code:      200,
+	})
+	Convey("The JSON audit logger", t, func() {
+		Convey("Will write one record per line", func() {
+			So(buf.String(), ShouldEqual, `{"time":"2019-08-25T13:00:00Z","session":"abc","user":"test","remote_ip":"127.0.0.1","verb":"RETR","path":"/one.txt","bytes":99,"code":226}`+"\n"+
+				`{"time":"2019-08-25T13:00:00Z","session":"abc","user":"test","remote_ip":"127.0.0.1","verb":"TYPE","bytes":0,"code":200}`+"\n")
+		})
+	})
+}
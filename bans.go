@@ -0,0 +1,114 @@
+package graval
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// banList holds the client IPs that aren't allowed to connect, and when each
+// ban expires.
+type banList struct {
+	clock Clock
+	mu    sync.Mutex
+	bans  map[string]time.Time
+}
+
+func newBanList(clock Clock) *banList {
+	return &banList{clock: clock, bans: map[string]time.Time{}}
+}
+
+func (list *banList) add(ip string, until time.Time) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if current, ok := list.bans[ip]; !ok || until.After(current) {
+		list.bans[ip] = until
+	}
+}
+
+func (list *banList) remove(ip string) {
+	list.mu.Lock()
+	delete(list.bans, ip)
+	list.mu.Unlock()
+}
+
+func (list *banList) banned(ip string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	until, ok := list.bans[ip]
+	if ok && !list.clock.Now().Before(until) {
+		delete(list.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// active returns a copy of the bans that haven't expired, removing the rest.
+func (list *banList) active() map[string]time.Time {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	now := list.clock.Now()
+	bans := map[string]time.Time{}
+	for ip, until := range list.bans {
+		if now.Before(until) {
+			bans[ip] = until
+		} else {
+			delete(list.bans, ip)
+		}
+	}
+	return bans
+}
+
+// canonicalIP returns ip in the form used for the client IP of a session, so
+// the same address written differently matches.
+func canonicalIP(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("graval: %q is not an IP address", ip)
+	}
+	return parsed.String(), nil
+}
+
+// Ban stops the given client IP from connecting for duration. Any sessions
+// already open from the IP are disconnected. If the IP is already banned, the
+// later of the two expiry times is kept.
+func (ftpServer *FTPServer) Ban(ip string, duration time.Duration) error {
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return err
+	}
+	ftpServer.ban(ip, duration, nil)
+	return nil
+}
+
+// ban adds a ban and disconnects the sessions from ip, apart from except,
+// which is left to finish replying to its client.
+func (ftpServer *FTPServer) ban(ip string, duration time.Duration, except *ftpConn) {
+	ftpServer.bans.add(ip, ftpServer.clock.Now().Add(duration))
+	ftpServer.logger.Printf("Banned %s for %s", ip, duration)
+	ftpServer.notify(&SecurityEvent{Type: SecurityBanned, RemoteIP: ip, Detail: duration.String()})
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	for conn := range ftpServer.sessions {
+		if conn != except && conn.remoteIP() == ip {
+			conn.conn.Close()
+		}
+	}
+}
+
+// Unban lets a banned client IP connect again.
+func (ftpServer *FTPServer) Unban(ip string) error {
+	ip, err := canonicalIP(ip)
+	if err != nil {
+		return err
+	}
+	ftpServer.bans.remove(ip)
+	return nil
+}
+
+// Bans returns the client IPs that are currently banned, and when each ban
+// expires.
+func (ftpServer *FTPServer) Bans() map[string]time.Time {
+	return ftpServer.bans.active()
+}
@@ -0,0 +1,50 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	list := newBanList(systemClock{})
+	list.add("192.0.2.1", time.Now().Add(time.Hour))
+	list.add("192.0.2.2", time.Now().Add(-time.Second))
+	list.add("192.0.2.3", time.Now().Add(time.Hour))
+	list.add("192.0.2.3", time.Now().Add(time.Minute))
+	list.add("192.0.2.4", time.Now().Add(time.Hour))
+	list.remove("192.0.2.4")
+	active := list.active()
+
+	Convey("The ban list", t, func() {
+		Convey("Will ban an IP until the ban expires", func() {
+			So(list.banned("192.0.2.1"), ShouldBeTrue)
+			So(list.banned("192.0.2.2"), ShouldBeFalse)
+		})
+
+		Convey("Will keep the later of two bans", func() {
+			So(active["192.0.2.3"], ShouldHappenAfter, time.Now().Add(50*time.Minute))
+		})
+
+		Convey("Will lift removed bans", func() {
+			So(list.banned("192.0.2.4"), ShouldBeFalse)
+		})
+
+		Convey("Will only list active bans", func() {
+			So(len(active), ShouldEqual, 2)
+		})
+	})
+
+	Convey("IPs to ban", t, func() {
+		Convey("Will be written the same way as client IPs", func() {
+			ip, err := canonicalIP("::ffff:192.0.2.1")
+			So(err, ShouldBeNil)
+			So(ip, ShouldEqual, "192.0.2.1")
+		})
+
+		Convey("Will be checked", func() {
+			_, err := canonicalIP("example.com")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
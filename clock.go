@@ -0,0 +1,72 @@
+package graval
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock is where the server gets the time from, and how it runs its idle and
+// data connection timeouts. Tests can supply their own to make timeouts
+// happen instantly, at a time of their choosing, rather than waiting for
+// them. gravaltest.FakeClock is one.
+type Clock interface {
+	// returns the current time
+	Now() time.Time
+
+	// calls f in its own goroutine once d has passed, unless the returned
+	// timer is stopped first
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// ClockTimer is a timer started by a Clock. *time.Timer is one.
+type ClockTimer interface {
+	// stops the timer, and returns false if it had already fired or been
+	// stopped
+	Stop() bool
+}
+
+// systemClock is the Clock used by default.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// clockAfter is like time.After, but uses clock.
+func clockAfter(clock Clock, d time.Duration) (<-chan struct{}, ClockTimer) {
+	fired := make(chan struct{})
+	timer := clock.AfterFunc(d, func() { close(fired) })
+	return fired, timer
+}
+
+// clockSleep is like time.Sleep, but uses clock.
+func clockSleep(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	fired, _ := clockAfter(clock, d)
+	<-fired
+}
+
+// lockedRand shares a rand.Rand between sessions, since one can't be used by
+// more than one goroutine at a time. Without one it uses the math/rand
+// functions, which are safe to share.
+type lockedRand struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// intn returns a random number from 0 up to, but not including, n.
+func (r *lockedRand) intn(n int) int {
+	if r == nil || r.rand == nil {
+		return rand.Intn(n)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Intn(n)
+}
@@ -0,0 +1,221 @@
+// gravald is a small FTP server that serves a directory on the local
+// filesystem. It's a demonstration of graval and a quick way to evaluate it,
+// rather than a hardened production server.
+//
+// USAGE:
+//
+//	go install github.com/royallthefourth/graval/cmd/gravald
+//	gravald -root /srv/ftp -users users.txt -port 2121
+//
+// The users file has one "username:password" pair per line. Blank lines and
+// lines starting with # are ignored.
+//
+// Alternatively, all settings including per-user home directories can be read
+// from a TOML file. See the config package for the format.
+//
+//	gravald -config gravald.toml
+//
+// Sending gravald a SIGHUP rereads the users file, or the config file, and
+// the TLS certificate. New sessions use the new users, limits and
+// certificate, while established sessions carry on as they were. Listening addresses and ports only change on restart.
+//
+// With -admin-socket, gravald serves graval's admin API on a Unix socket, for
+// listing sessions, kicking users, changing the bandwidth limit and switching
+// to read-only mode while it runs:
+//
+//	gravald -config gravald.toml -admin-socket /run/gravald.sock
+//	curl --unix-socket /run/gravald.sock http://gravald/sessions
+//	curl --unix-socket /run/gravald.sock -X POST http://gravald/read-only?enabled=true
+//
+// With -tls-cert and -tls-key, clients can protect their sessions with AUTH
+// TLS and PROT P. -require-tls refuses logins and transfers that aren't
+// protected. The TLS flags apply with -config too, and the certificate is
+// read again on SIGHUP, so a renewed one can be served without a restart.
+//
+//	gravald -config gravald.toml -tls-cert cert.pem -tls-key key.pem -require-tls
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/config"
+	"github.com/royallthefourth/graval/osdriver"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	root := flag.String("root", ".", "directory to serve")
+	hostname := flag.String("host", "::", "hostname or IP to listen on")
+	port := flag.Int("port", 2121, "port to listen on")
+	pasvMin := flag.Int("pasv-min", 0, "lowest port for passive data connections")
+	pasvMax := flag.Int("pasv-max", 0, "highest port for passive data connections")
+	pasvIp := flag.String("pasv-ip", "", "IP address to advertise in PASV replies")
+	usersFile := flag.String("users", "", "file of username:password lines (required)")
+	readOnly := flag.Bool("read-only", false, "refuse uploads, deletes, renames and new directories")
+	name := flag.String("name", "gravald", "server name for the welcome message")
+	idleTimeout := flag.Duration("idle-timeout", 5*time.Minute, "disconnect clients idle for this long, 0 to disable")
+	configFile := flag.String("config", "", "TOML config file, used instead of the other flags except -admin-socket and the TLS flags")
+	adminSocket := flag.String("admin-socket", "", "Unix socket to serve the admin API on")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file, to allow AUTH TLS")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for -tls-cert")
+	requireTLS := flag.Bool("require-tls", false, "refuse logins and transfers that aren't protected by TLS")
+	flag.Parse()
+
+	if *tlsCert == "" && *tlsKey == "" && *requireTLS {
+		log.Fatal("-require-tls needs -tls-cert and -tls-key")
+	}
+	withTLS := tlsOpts(*tlsCert, *tlsKey, *requireTLS)
+
+	if *configFile != "" {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatalf("Error reading config: %s", err)
+		}
+		opts, err := withTLS(cfg.ServerOpts())
+		if err != nil {
+			log.Fatalf("Error setting up TLS: %s", err)
+		}
+		serve(opts, *adminSocket, func() (*graval.FTPServerOpts, error) {
+			cfg, err := config.Load(*configFile)
+			if err != nil {
+				return nil, err
+			}
+			return withTLS(cfg.ServerOpts())
+		})
+		return
+	}
+
+	if *usersFile == "" {
+		log.Fatal("the -users flag is required")
+	}
+	users, err := readUsers(*usersFile)
+	if err != nil {
+		log.Fatalf("Error reading users file: %s", err)
+	}
+	info, err := os.Stat(*root)
+	if err != nil || !info.IsDir() {
+		log.Fatalf("Root %s is not a directory", *root)
+	}
+
+	opts := func(users map[string]string) (*graval.FTPServerOpts, error) {
+		return withTLS(&graval.FTPServerOpts{
+			Factory: &osdriver.DriverFactory{
+				Root:     *root,
+				ReadOnly: *readOnly,
+				Authenticate: func(user string, pass string) bool {
+					expected, ok := users[user]
+					return ok && expected == pass
+				},
+			},
+			ServerName:       *name,
+			Hostname:         *hostname,
+			Port:             *port,
+			PasvMinPort:      *pasvMin,
+			PasvMaxPort:      *pasvMax,
+			PasvAdvertisedIp: *pasvIp,
+			IdleTimeout:      *idleTimeout,
+		})
+	}
+	initial, err := opts(users)
+	if err != nil {
+		log.Fatalf("Error setting up TLS: %s", err)
+	}
+	serve(initial, *adminSocket, func() (*graval.FTPServerOpts, error) {
+		users, err := readUsers(*usersFile)
+		if err != nil {
+			return nil, err
+		}
+		return opts(users)
+	})
+}
+
+// serve runs the server, calling reload for new options whenever a SIGHUP is
+// received. If adminSocket isn't empty, the admin API is served on a Unix
+// socket at that path.
+func serve(opts *graval.FTPServerOpts, adminSocket string, reload func() (*graval.FTPServerOpts, error)) {
+	ftpServer := graval.NewFTPServer(opts)
+	if adminSocket != "" {
+		// a socket left behind by an earlier run would stop us listening
+		os.Remove(adminSocket)
+		listener, err := net.Listen("unix", adminSocket)
+		if err != nil {
+			log.Fatalf("Error opening admin socket: %s", err)
+		}
+		go http.Serve(listener, ftpServer.AdminHandler())
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			opts, err := reload()
+			if err == nil {
+				err = ftpServer.Reload(opts)
+			}
+			if err != nil {
+				log.Printf("Error reloading, keeping the old settings: %s", err)
+				continue
+			}
+			log.Print("Reloaded settings")
+		}
+	}()
+	err := ftpServer.ListenAndServe()
+	if err != nil {
+		log.Print(err)
+		log.Fatal("Error starting server!")
+	}
+}
+
+// tlsOpts returns a function that adds TLS to a server's options, if a
+// certificate and key are given. The certificate and key are read each time
+// it's called, so a reload picks up a renewed certificate.
+func tlsOpts(certFile string, keyFile string, require bool) func(*graval.FTPServerOpts) (*graval.FTPServerOpts, error) {
+	return func(opts *graval.FTPServerOpts) (*graval.FTPServerOpts, error) {
+		if certFile == "" && keyFile == "" {
+			return opts, nil
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		opts.RequireTLSLogin = require
+		opts.RequireTLSData = require
+		return opts, nil
+	}
+}
+
+// readUsers parses a file of username:password lines.
+func readUsers(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("malformed line %d", lineNo)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, scanner.Err()
+}
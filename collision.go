@@ -0,0 +1,98 @@
+package graval
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CollisionPolicy says what STOR does when the file it names already exists.
+// Resumed uploads always continue the existing file.
+type CollisionPolicy int
+
+const (
+	// OverwriteExisting replaces the existing file.
+	OverwriteExisting CollisionPolicy = iota
+
+	// RejectExisting refuses the upload with a 553 reply, leaving the
+	// existing file alone.
+	RejectExisting
+
+	// RenameUpload stores the upload under the first free name made by
+	// adding a number before the extension, like report.1.pdf, and tells
+	// the client the name in the 150 reply, as STOU does.
+	RenameUpload
+
+	// VersionExisting moves the existing file into UploadArchiveDir, at its
+	// path with the time appended, like /archive/docs/report.pdf.20191016120000,
+	// before the upload replaces it. With AtomicUploads it's only moved once
+	// the upload has succeeded, and it's moved back if the upload then can't
+	// be put in its place, as it is when SITE HASH content can't be stored.
+	VersionExisting
+)
+
+// the most numbered names RenameUpload tries before refusing an upload
+const maxRenameAttempts = 1000
+
+// fileExists reports whether the driver has a file at filePath.
+func (ftpConn *ftpConn) fileExists(filePath string) bool {
+	return isFileSize(ftpConn.driver.Bytes(filePath))
+}
+
+// resolveCollision applies the server's CollisionPolicy to a new upload to
+// filePath, returning the path to store it at. If the upload can't go ahead
+// the client is told, and false is returned.
+func (ftpConn *ftpConn) resolveCollision(filePath string) (string, bool) {
+	policy := ftpConn.server.collisions
+	if policy == OverwriteExisting || policy == VersionExisting || !ftpConn.fileExists(filePath) {
+		return filePath, true
+	}
+	if policy == RejectExisting {
+		ftpConn.writeMessage(553, "File exists, not overwritten")
+		return "", false
+	}
+	ext := path.Ext(filePath)
+	if ext == path.Base(filePath) {
+		// a name like .profile is all extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(filePath, ext)
+	for i := 1; i <= maxRenameAttempts; i++ {
+		candidate := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if !ftpConn.fileExists(candidate) {
+			return candidate, true
+		}
+	}
+	ftpConn.writeMessage(553, "File exists, no free name to store it as")
+	return "", false
+}
+
+// archiveExisting moves the file at filePath into the server's
+// UploadArchiveDir, if its CollisionPolicy is VersionExisting and there's a
+// file there. It returns the path the file was moved to, which is empty if
+// nothing was moved, and false if the file couldn't be moved.
+func (ftpConn *ftpConn) archiveExisting(filePath string) (string, bool) {
+	if ftpConn.server.collisions != VersionExisting || !ftpConn.fileExists(filePath) {
+		return "", true
+	}
+	archived := path.Join(ftpConn.server.archiveDir, filePath) + "." + ftpConn.server.clock.Now().UTC().Format("20060102150405")
+	// two versions archived in the same second are numbered
+	candidate := archived
+	for i := 1; ftpConn.fileExists(candidate); i++ {
+		candidate = fmt.Sprintf("%s.%d", archived, i)
+	}
+	if !ftpConn.makeParentDirs(candidate) || !ftpConn.driver.Rename(filePath, candidate) {
+		ftpConn.logger.Printf("Unable to archive %s to %s", filePath, candidate)
+		return "", false
+	}
+	return candidate, true
+}
+
+// restoreArchived moves a file set aside by archiveExisting, or to make way
+// for an upload, back to filePath after whatever was to replace it couldn't
+// be stored.
+func (ftpConn *ftpConn) restoreArchived(archived string, filePath string) {
+	if archived != "" && !ftpConn.driver.Rename(archived, filePath) {
+		ftpConn.logger.Printf("Unable to restore %s from %s", filePath, archived)
+	}
+}
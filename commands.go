@@ -1,9 +1,12 @@
 package graval
 
 import (
+	"errors"
 	"fmt"
-	"github.com/jehiah/go-strftime"
+	"net"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -18,8 +21,12 @@ type commandMap map[string]ftpCommand
 
 var (
 	commands = commandMap{
+		"ADAT": commandAdat{},
 		"ALLO": commandAllo{},
+		"AUTH": commandAuth{},
+		"AVBL": commandAvbl{},
 		"CDUP": commandCdup{},
+		"CCC":  commandCcc{},
 		"CWD":  commandCwd{},
 		"DELE": commandDele{},
 		"EPRT": commandEprt{},
@@ -28,20 +35,32 @@ var (
 		"LIST": commandList{},
 		"NLST": commandNlst{},
 		"MDTM": commandMdtm{},
+		"MFCT": commandMfct{},
+		"MFF":  commandMff{},
+		"MFMT": commandMfmt{},
 		"MKD":  commandMkd{},
+		"MLSD": commandMlsd{},
+		"MLST": commandMlst{},
 		"MODE": commandMode{},
 		"NOOP": commandNoop{},
 		"OPTS": commandOpts{},
 		"PASS": commandPass{},
 		"PASV": commandPasv{},
+		"PBSZ": commandPbsz{},
 		"PORT": commandPort{},
+		"PROT": commandProt{},
 		"PWD":  commandPwd{},
 		"QUIT": commandQuit{},
+		"RANG": commandRang{},
+		"REST": commandRest{},
 		"RETR": commandRetr{},
 		"RNFR": commandRnfr{},
 		"RNTO": commandRnto{},
 		"RMD":  commandRmd{},
+		"SITE": commandSite{},
 		"SIZE": commandSize{},
+		"SSCN": commandSscn{},
+		"STAT": commandStat{},
 		"STOR": commandStor{},
 		"STRU": commandStru{},
 		"SYST": commandSyst{},
@@ -53,6 +72,83 @@ var (
 		"XRMD": commandRmd{},
 	}
 
+	// The commands whose parameter is a path, which is subject to the
+	// server's FilenamePolicy
+	pathCommands = map[string]bool{
+		"AVBL": true,
+		"CWD":  true,
+		"DELE": true,
+		"LIST": true,
+		"MDTM": true,
+		"MKD":  true,
+		"MLSD": true,
+		"MLST": true,
+		"NLST": true,
+		"RETR": true,
+		"RMD":  true,
+		"RNFR": true,
+		"RNTO": true,
+		"SIZE": true,
+		"STAT": true,
+		"STOR": true,
+		"XCWD": true,
+		"XRMD": true,
+	}
+
+	// The commands whose parameter is a time or a list of facts, then a path
+	// that's subject to the server's FilenamePolicy
+	factCommands = map[string]bool{
+		"MFCT": true,
+		"MFF":  true,
+		"MFMT": true,
+	}
+
+	// The commands that change files, which are refused while the server is
+	// read-only
+	writeCommands = map[string]bool{
+		"DELE": true,
+		"MFCT": true,
+		"MFF":  true,
+		"MFMT": true,
+		"MKD":  true,
+		"RMD":  true,
+		"RNFR": true,
+		"RNTO": true,
+		"STOR": true,
+		"XRMD": true,
+	}
+
+	// The subcommands of SITE
+	siteCommands = commandMap{
+		"CPFR":  commandSiteCpfr{},
+		"CPTO":  commandSiteCpto{},
+		"CPWD":  commandSitePswd{},
+		"HASH":  commandSiteHash{},
+		"HELP":  commandSiteHelp{},
+		"PSWD":  commandSitePswd{},
+		"QUOTA": commandSiteQuota{},
+		"RMDIR": commandSiteRmdir{},
+		"XCRC":  commandSiteXcrc{},
+	}
+
+	// The SITE commands whose parameter is a path
+	sitePathCommands = map[string]bool{
+		"CPFR":  true,
+		"CPTO":  true,
+		"RMDIR": true,
+	}
+
+	// The SITE commands that change files
+	siteWriteCommands = map[string]bool{
+		"CPTO":  true,
+		"RMDIR": true,
+	}
+
+	// How STAT describes the transfer modes and file structures set with
+	// MODE and STRU
+	modeNames      = map[string]string{"S": "Stream"}
+	structureNames = map[string]string{"F": "File"}
+
 	// Some FTP clients send flags to the LIST and NLST commands. Server support for these varies,
 	// and implementing them all would be a lot of work with uncertain payoff. For now, we ignore them
 	listFlagsRegexp = `^-[alt]+$`
@@ -76,6 +172,40 @@ func (cmd commandAllo) Execute(conn *ftpConn, param string) {
 	conn.writeMessage(202, "Obsolete")
 }
 
+// commandAvbl responds to the AVBL FTP command from
+// draft-peterson-streamlined-ftp-command-extensions. It reports the space
+// available for uploads to a directory, or the current directory if no path
+// is given, so clients can check before sending a large file. It needs a
+// driver that implements FTPSpaceDriver.
+type commandAvbl struct{}
+
+func (cmd commandAvbl) RequireParam() bool {
+	return false
+}
+
+func (cmd commandAvbl) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandAvbl) Execute(conn *ftpConn, param string) {
+	var spaceDriver FTPSpaceDriver
+	if !DriverAs(conn.driver, &spaceDriver) {
+		conn.writeMessage(502, "Command not implemented")
+		return
+	}
+	path := conn.buildPath(param)
+	if !conn.driver.ChangeDir(path) {
+		conn.writeMessage(550, "Not a directory")
+		return
+	}
+	available, err := spaceDriver.AvailableSpace(path)
+	if err != nil {
+		conn.writeMessage(550, "Available space unknown")
+		return
+	}
+	conn.writeMessage(213, strconv.FormatInt(available, 10))
+}
+
 // commandCdup responds to the CDUP FTP command.
 //
 // Allows the client change their current directory to the parent.
@@ -112,7 +242,7 @@ func (cmd commandCwd) Execute(conn *ftpConn, param string) {
 		conn.namePrefix = path
 		conn.writeMessage(250, "Directory changed to "+path)
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeDriverError(conn.lastDriverError(), 550, "Action not taken")
 	}
 }
 
@@ -133,7 +263,7 @@ func (cmd commandDele) Execute(conn *ftpConn, param string) {
 	if conn.driver.DeleteFile(path) {
 		conn.writeMessage(250, "File deleted")
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeDriverError(conn.lastDriverError(), 550, "Action not taken")
 	}
 }
 
@@ -151,17 +281,35 @@ func (cmd commandEprt) RequireAuth() bool {
 }
 
 func (cmd commandEprt) Execute(conn *ftpConn, param string) {
+	if conn.epsvAll {
+		conn.writeMessage(503, "Bad sequence of commands: EPSV ALL in effect")
+		return
+	}
 	delim := string(param[0:1])
 	parts := strings.Split(param, delim)
+	if len(parts) != 5 {
+		conn.writeMessage(501, "Syntax error in parameters")
+		return
+	}
 	addressFamily, err := strconv.Atoi(parts[1])
 	host := parts[2]
-	port, err := strconv.Atoi(parts[3])
+	port, portErr := strconv.Atoi(parts[3])
+	if err != nil || portErr != nil || net.ParseIP(host) == nil {
+		conn.writeMessage(501, "Syntax error in parameters")
+		return
+	}
 
-	if addressFamily != 1 && addressFamily != 2 {
-		conn.writeMessage(522, "Network protocol not supported, use (1,2)")
+	// the data connection must use the same address family as the control
+	// connection
+	if addressFamily != conn.addressFamily() {
+		conn.writeMessage(522, fmt.Sprintf("Network protocol not supported, use (%d)", conn.addressFamily()))
 		return
 	}
 
+	if !conn.checkBounce(host, port) {
+		conn.writeMessage(504, "Command not implemented for that parameter")
+		return
+	}
 	_, err = conn.newActiveSocket(host, port)
 
 	if err != nil {
@@ -173,7 +321,11 @@ func (cmd commandEprt) Execute(conn *ftpConn, param string) {
 
 // commandEpsv responds to the EPSV FTP command. It allows the client to
 // request a passive data socket with more options than the original PASV
-// command. It mainly adds ipv6 support, although we don't support that yet.
+// command. It mainly adds ipv6 support.
+//
+// The optional param is the address family the client wants (1 for IPv4, 2
+// for IPv6), which must match the control connection, or "ALL" to promise
+// that no other data connection setup commands will be used.
 type commandEpsv struct{}
 
 func (cmd commandEpsv) RequireParam() bool {
@@ -185,6 +337,21 @@ func (cmd commandEpsv) RequireAuth() bool {
 }
 
 func (cmd commandEpsv) Execute(conn *ftpConn, param string) {
+	switch strings.ToUpper(param) {
+	case "":
+	case "ALL":
+		conn.epsvAll = true
+		conn.writeMessage(200, "EPSV ALL ok")
+		return
+	case "1", "2":
+		if param != strconv.Itoa(conn.addressFamily()) {
+			conn.writeMessage(522, fmt.Sprintf("Network protocol not supported, use (%d)", conn.addressFamily()))
+			return
+		}
+	default:
+		conn.writeMessage(501, "Syntax error in parameters")
+		return
+	}
 	socket, err := conn.newPassiveSocket()
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -208,15 +375,34 @@ func (cmd commandFeat) RequireAuth() bool {
 }
 
 func (cmd commandFeat) Execute(conn *ftpConn, param string) {
-	conn.writeLines(211,
-		"211-Features supported:",
+	if conn.server.stealth {
+		conn.writeLines(211, stealthFeatures(conn.driver, conn.server.tlsConfig != nil)...)
+		return
+	}
+	lines := []string{"211-Features supported:"}
+	lines = append(lines, securityFeatures(conn.server)...)
+	if DriverAs(conn.driver, new(FTPSpaceDriver)) {
+		lines = append(lines, " AVBL")
+	}
+	lines = append(lines,
 		" EPRT",
 		" EPSV",
 		" MDTM",
+	)
+	lines = append(lines, settableFactsFeatures(conn.driver)...)
+	lines = append(lines,
+		" MLST type*;size*;modify*;UNIX.ownername*;UNIX.groupname*;",
+		" RANG STREAM",
+	)
+	if DriverAs(conn.driver, new(FTPResumableDriver)) {
+		lines = append(lines, " REST STREAM")
+	}
+	lines = append(lines,
 		" SIZE",
 		" UTF8",
 		"211 End FEAT.",
 	)
+	conn.writeLines(211, lines...)
 }
 
 // commandList responds to the LIST FTP command. It allows the client to retreive
@@ -232,15 +418,16 @@ func (cmd commandList) RequireAuth() bool {
 }
 
 func (cmd commandList) Execute(conn *ftpConn, param string) {
+	if !conn.requireDataConn() {
+		return
+	}
 	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 	matched, _ := regexp.MatchString(listFlagsRegexp, param)
 	if matched {
 		param = ""
 	}
 	path := conn.buildPath(param)
-	files := conn.driver.DirContents(path)
-	formatter := newListFormatter(files)
-	conn.sendOutofbandData(formatter.Detailed())
+	conn.sendListing(path, conn.listFormatter(nil).DetailedLine, "\r\n", false)
 }
 
 // commandNlst responds to the NLST FTP command. It allows the client to
@@ -256,15 +443,16 @@ func (cmd commandNlst) RequireAuth() bool {
 }
 
 func (cmd commandNlst) Execute(conn *ftpConn, param string) {
+	if !conn.requireDataConn() {
+		return
+	}
 	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
 	matched, _ := regexp.MatchString(listFlagsRegexp, param)
 	if matched {
 		param = ""
 	}
 	path := conn.buildPath(param)
-	files := conn.driver.DirContents(path)
-	formatter := newListFormatter(files)
-	conn.sendOutofbandData(formatter.Short())
+	conn.sendListing(path, newListFormatter(nil).ShortLine, "\r\n", false)
 }
 
 // commandMdtm responds to the MDTM FTP command. It allows the client to
@@ -283,10 +471,73 @@ func (cmd commandMdtm) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
 	time, err := conn.driver.ModifiedTime(path)
 	if err == nil {
-		conn.writeMessage(213, strftime.Format("%Y%m%d%H%M%S", time))
+		conn.writeMessage(213, machineTime(time, conn.server.subsecondTimes))
 	} else {
-		conn.writeMessage(450, "File not available")
+		conn.writeDriverError(err, 450, "File not available")
+	}
+}
+
+// commandMfct responds to the MFCT FTP command from draft-somers-ftp-mfxx. It
+// sets the creation time of a file.
+type commandMfct struct{}
+
+func (cmd commandMfct) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfct) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfct) Execute(conn *ftpConn, param string) {
+	params := strings.SplitN(param, " ", 2)
+	if len(params) != 2 || params[1] == "" {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	conn.changeFacts(params[1], []factChange{{name: "Create", value: params[0]}})
+}
+
+// commandMff responds to the MFF FTP command from draft-somers-ftp-mfxx. It
+// changes any number of facts about a file, in the same format as MLSD.
+type commandMff struct{}
+
+func (cmd commandMff) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMff) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMff) Execute(conn *ftpConn, param string) {
+	changes, path, ok := parseFactChanges(param)
+	if !ok {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	conn.changeFacts(path, changes)
+}
+
+// commandMfmt responds to the MFMT FTP command from draft-somers-ftp-mfxx. It
+// sets the last modified time of a file.
+type commandMfmt struct{}
+
+func (cmd commandMfmt) RequireParam() bool {
+	return true
+}
+
+func (cmd commandMfmt) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMfmt) Execute(conn *ftpConn, param string) {
+	params := strings.SplitN(param, " ", 2)
+	if len(params) != 2 || params[1] == "" {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
 	}
+	conn.changeFacts(params[1], []factChange{{name: "Modify", value: params[0]}})
 }
 
 // commandMkd responds to the MKD FTP command. It allows the client to create
@@ -306,10 +557,66 @@ func (cmd commandMkd) Execute(conn *ftpConn, param string) {
 	if conn.driver.MakeDir(path) {
 		conn.writeMessage(257, "Directory created")
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeDriverError(conn.lastDriverError(), 550, "Action not taken")
 	}
 }
 
+// commandMlsd responds to the MLSD FTP command from RFC 3659. It sends a
+// listing of a directory in a format that's easier for clients to parse than
+// LIST.
+type commandMlsd struct{}
+
+func (cmd commandMlsd) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlsd) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlsd) Execute(conn *ftpConn, param string) {
+	if !conn.requireDataConn() {
+		return
+	}
+	path := conn.buildPath(param)
+	if !conn.driver.ChangeDir(path) {
+		conn.writeMessage(501, "Not a directory")
+		return
+	}
+	conn.writeMessage(150, "Opening ASCII mode data connection for file list")
+	conn.sendListing(path, conn.listFormatter(nil).MachineLine, "", true)
+}
+
+// commandMlst responds to the MLST FTP command from RFC 3659. It describes a
+// single file or directory over the control connection, in the same format
+// as MLSD.
+type commandMlst struct{}
+
+func (cmd commandMlst) RequireParam() bool {
+	return false
+}
+
+func (cmd commandMlst) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandMlst) Execute(conn *ftpConn, param string) {
+	path := conn.buildPath(param)
+	var info os.FileInfo
+	if modTime, err := conn.driver.ModifiedTime(path); err == nil {
+		if conn.driver.ChangeDir(path) {
+			info = NewDirItem(path, modTime)
+		} else if size := conn.driver.Bytes(path); isFileSize(size) {
+			info = NewFileItem(path, size, modTime)
+		}
+	}
+	if info == nil {
+		conn.writeMessage(550, "File not available")
+		return
+	}
+	conn.writeLines(250, "250-Listing "+path, " "+machineFacts(info, conn.server.subsecondTimes)+" "+path, "250 End")
+}
+
 // commandMode responds to the MODE FTP command.
 //
 // the original FTP spec had various options for hosts to negotiate how data
@@ -327,10 +634,14 @@ func (cmd commandMode) RequireAuth() bool {
 }
 
 func (cmd commandMode) Execute(conn *ftpConn, param string) {
-	if strings.ToUpper(param) == "S" {
-		conn.writeMessage(200, "OK")
-	} else {
-		conn.writeMessage(504, "MODE is an obsolete command")
+	switch strings.ToUpper(param) {
+	case "S":
+		conn.transferMode = "S"
+		conn.writeMessage(200, "Mode set to stream")
+	case "B", "C":
+		conn.writeMessage(504, "Only stream mode is supported")
+	default:
+		conn.writeMessage(501, "Unknown mode")
 	}
 }
 
@@ -371,6 +682,10 @@ func (cmd commandOpts) Execute(conn *ftpConn, param string) {
 		conn.writeMessage(200, "OK")
 		return
 	}
+	if fields := strings.Fields(param); len(fields) > 0 && strings.ToUpper(fields[0]) == "HASH" {
+		conn.optsHash(fields[1:])
+		return
+	}
 
 	conn.writeMessage(500, "Command not found")
 }
@@ -388,13 +703,42 @@ func (cmd commandPass) RequireAuth() bool {
 }
 
 func (cmd commandPass) Execute(conn *ftpConn, param string) {
+	if conn.reqUser == "" && conn.outOfSequence("USER") {
+		return
+	}
+	if conn.refuseLogin() || conn.refusePlaintextLogin() {
+		return
+	}
 	if conn.driver.Authenticate(conn.reqUser, param) {
+		if conn.refuseAccount(conn.reqUser) {
+			return
+		}
+		// Sessions reads the user from other goroutines
+		conn.mu.Lock()
 		conn.user = conn.reqUser
+		conn.account = conn.accountName(conn.user)
+		conn.mu.Unlock()
+		if conn.account != conn.user {
+			conn.logger.Printf("%s logged in to account %s", conn.user, conn.account)
+		}
 		conn.reqUser = ""
-		conn.writeMessage(230, "Password ok, continue")
+		conn.priority = 0
+		if conn.settings.userPriority != nil {
+			if priority := conn.settings.userPriority(conn.account); priority > 0 {
+				conn.priority = priority
+			}
+		}
+		conn.server.loginFailures.reset(conn.remoteIP())
+		conn.tlsLogin = conn.tlsConn != nil
+		conn.collectStaleUploads()
+		conn.provisionHome()
+		conn.recordLogin()
+		conn.announceAffinity(AffinityLogin, 0)
+		conn.writeLoginReply()
 	} else {
+		conn.securityEvent(SecurityAuthFailure, conn.reqUser)
+		conn.authFailed()
 		conn.writeMessage(530, "Incorrect password, not logged in")
-		conn.writeMessage(221, "Goodbye.")
 		conn.Close()
 	}
 }
@@ -414,6 +758,16 @@ func (cmd commandPasv) RequireAuth() bool {
 }
 
 func (cmd commandPasv) Execute(conn *ftpConn, param string) {
+	if conn.epsvAll {
+		conn.writeMessage(503, "Bad sequence of commands: EPSV ALL in effect")
+		return
+	}
+	// the 227 reply can only describe an IPv4 address, and the passive socket
+	// is always opened on the same address as the control connection
+	if conn.addressFamily() != 1 {
+		conn.writeMessage(522, "Network protocol not supported, use EPSV")
+		return
+	}
 	socket, err := conn.newPassiveSocket()
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -430,6 +784,11 @@ func (cmd commandPasv) Execute(conn *ftpConn, param string) {
 		host = socket.Host()
 	}
 	quads := strings.Split(host, ".")
+	if len(quads) != 4 {
+		conn.logger.Printf("Unable to advertise %s in a PASV reply", host)
+		conn.writeMessage(425, "Data connection failed")
+		return
+	}
 	target := fmt.Sprintf("(%s,%s,%s,%s,%d,%d)", quads[0], quads[1], quads[2], quads[3], p1, p2)
 	msg := "Entering Passive Mode " + target
 	conn.writeMessage(227, msg)
@@ -450,12 +809,24 @@ func (cmd commandPort) RequireAuth() bool {
 }
 
 func (cmd commandPort) Execute(conn *ftpConn, param string) {
+	if conn.epsvAll {
+		conn.writeMessage(503, "Bad sequence of commands: EPSV ALL in effect")
+		return
+	}
 	nums := strings.Split(param, ",")
+	if len(nums) != 6 {
+		conn.writeMessage(501, "Syntax error in parameters")
+		return
+	}
 	portOne, _ := strconv.Atoi(nums[4])
 	portTwo, _ := strconv.Atoi(nums[5])
 	port := (portOne * 256) + portTwo
 	host := nums[0] + "." + nums[1] + "." + nums[2] + "." + nums[3]
 
+	if !conn.checkBounce(host, port) {
+		conn.writeMessage(504, "Command not implemented for that parameter")
+		return
+	}
 	_, err := conn.newActiveSocket(host, port)
 
 	if err != nil {
@@ -495,9 +866,78 @@ func (cmd commandQuit) RequireAuth() bool {
 }
 
 func (cmd commandQuit) Execute(conn *ftpConn, param string) {
+	conn.writeMessage(221, "Goodbye.")
 	conn.Close()
 }
 
+// commandRang responds to the RANG FTP command from draft-bryan-ftp-range. It
+// limits the next RETR to an inclusive range of bytes, which segmented
+// download tools use to fetch parts of a file in parallel. "RANG 1 0" clears
+// the range. Drivers can serve ranges efficiently by implementing
+// FTPRangeDriver.
+type commandRang struct{}
+
+func (cmd commandRang) RequireParam() bool {
+	return true
+}
+
+func (cmd commandRang) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandRang) Execute(conn *ftpConn, param string) {
+	parts := strings.Fields(param)
+	if len(parts) != 2 {
+		conn.writeMessage(501, "Syntax error, expected RANG start end")
+		return
+	}
+	start, err1 := strconv.ParseInt(parts[0], 10, 64)
+	end, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < 0 {
+		conn.writeMessage(501, "Invalid byte range")
+		return
+	}
+	if start == 1 && end == 0 {
+		conn.rangeSet = false
+		conn.writeMessage(350, "Byte range cleared")
+		return
+	}
+	if start > end {
+		conn.writeMessage(501, "Invalid byte range")
+		return
+	}
+	conn.rangeSet = true
+	conn.rangeStart = start
+	conn.rangeEnd = end
+	conn.restOffset = 0
+	conn.writeMessage(350, fmt.Sprintf("Restarting at %d. End byte range at %d", start, end))
+}
+
+// commandRest responds to the REST FTP command. It sets the offset the next
+// transfer should start at, so clients can resume interrupted transfers.
+// Downloads can be resumed with any driver, while a STOR that follows REST is
+// refused unless the driver implements FTPResumableDriver.
+type commandRest struct{}
+
+func (cmd commandRest) RequireParam() bool {
+	return true
+}
+
+func (cmd commandRest) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandRest) Execute(conn *ftpConn, param string) {
+	offset, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || offset < 0 {
+		conn.writeMessage(501, "Invalid restart offset")
+		return
+	}
+	conn.restOffset = offset
+	conn.rangeSet = false
+	conn.writeMessage(350, fmt.Sprintf("Restarting at %d. Send STOR or RETR to resume transfer", offset))
+}
+
 // commandRetr responds to the RETR FTP command. It allows the client to
 // download a file.
 type commandRetr struct{}
@@ -512,13 +952,30 @@ func (cmd commandRetr) RequireAuth() bool {
 
 func (cmd commandRetr) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
-	reader, err := conn.driver.GetFile(path)
+	if !conn.requireDataConn() || conn.overTransferCap() {
+		return
+	}
+	if !conn.server.acquireTransfer(conn.priority) {
+		conn.writeMessage(450, "Too many transfers in progress, try again later")
+		return
+	}
+	defer conn.server.releaseTransfer()
+	reader, err := conn.openDownload(path)
+	if err != nil && err != errUnknownSizeResume && conn.server.archives {
+		reader, err = conn.openArchive(path)
+	}
 	if err == nil {
 		defer reader.Close()
 		conn.writeMessage(150, "Data connection open. Transfer starting.")
-		conn.sendOutofbandReader(reader)
+		xfer := conn.beginTransfer(transferDownload, path)
+		err = conn.sendOutofbandReader(reader)
+		xfer.finish(err)
+	} else if err == errArchiveResume {
+		conn.writeMessage(550, "Archives can't be resumed")
+	} else if err == errUnknownSizeResume {
+		conn.writeMessage(554, "Can't resume a file of unknown size")
 	} else {
-		conn.writeMessage(551, "File not available")
+		conn.writeDriverError(err, 551, "File not available")
 	}
 }
 
@@ -557,11 +1014,13 @@ func (cmd commandRnto) Execute(conn *ftpConn, param string) {
 		return
 	}
 
+	fromPath := conn.renameFrom
+	conn.renameFrom = ""
 	toPath := conn.buildPath(param)
-	if conn.driver.Rename(conn.renameFrom, toPath) {
+	if conn.driver.Rename(fromPath, toPath) {
 		conn.writeMessage(250, "File renamed")
 	} else {
-		conn.writeMessage(550, "Action not taken")
+		conn.writeDriverError(conn.lastDriverError(), 550, "Action not taken")
 	}
 }
 
@@ -581,6 +1040,203 @@ func (cmd commandRmd) Execute(conn *ftpConn, param string) {
 	path := conn.buildPath(param)
 	if conn.driver.DeleteDir(path) {
 		conn.writeMessage(250, "Directory deleted")
+	} else {
+		conn.writeDriverError(conn.lastDriverError(), 550, "Action not taken")
+	}
+}
+
+// commandSite responds to the SITE FTP command, passing the rest of the line
+// to one of the siteCommands.
+type commandSite struct{}
+
+func (cmd commandSite) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSite) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSite) Execute(conn *ftpConn, param string) {
+	params := strings.SplitN(param, " ", 2)
+	name := strings.ToUpper(params[0])
+	subcommand := siteCommands[name]
+	if subcommand == nil {
+		conn.writeMessage(504, "Unknown SITE command")
+		return
+	}
+	subparam := ""
+	if len(params) > 1 {
+		subparam = strings.TrimSpace(params[1])
+	}
+	if subcommand.RequireParam() && subparam == "" {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	if siteWriteCommands[name] && conn.server.ReadOnly() {
+		conn.writeMessage(550, "Server is read-only")
+		return
+	}
+	if policy := conn.server.filenamePolicy; policy != nil && sitePathCommands[name] {
+		cleaned, ok := policy.Apply(subparam)
+		if !ok {
+			conn.writeMessage(553, "Filename not allowed")
+			return
+		}
+		subparam = cleaned
+	}
+	if sitePathCommands[name] && !conn.allowedPath(conn.absPath(subparam), siteReadCommands[name], siteWriteCommands[name]) {
+		conn.writeMessage(550, "Permission denied")
+		return
+	}
+	subcommand.Execute(conn, subparam)
+}
+
+// commandSiteCpfr responds to SITE CPFR, from proftpd's mod_copy. It's the
+// first of two commands required for a client to copy a file or directory on
+// the server, without downloading it and uploading it again.
+type commandSiteCpfr struct{}
+
+func (cmd commandSiteCpfr) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSiteCpfr) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSiteCpfr) Execute(conn *ftpConn, param string) {
+	path := conn.buildPath(param)
+	if !isFileSize(conn.driver.Bytes(path)) && !conn.driver.ChangeDir(path) {
+		conn.writeMessage(550, "File not available")
+		return
+	}
+	conn.copyFrom = path
+	conn.writeMessage(350, "File exists, ready for destination name")
+}
+
+// commandSiteCpto responds to SITE CPTO, the second of two commands required
+// to copy a file or directory. The destination must not already exist.
+type commandSiteCpto struct{}
+
+func (cmd commandSiteCpto) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSiteCpto) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSiteCpto) Execute(conn *ftpConn, param string) {
+	if conn.copyFrom == "" {
+		conn.writeMessage(503, "Bad sequence of commands: use SITE CPFR first.")
+		return
+	}
+	fromPath := conn.copyFrom
+	conn.copyFrom = ""
+	if conn.copyPath(fromPath, conn.buildPath(param)) {
+		conn.writeMessage(250, "Copy successful")
+	} else {
+		conn.writeMessage(550, "Action not taken")
+	}
+}
+
+// commandSiteHash responds to SITE HASH, which gives the hash of the file the
+// next STOR will upload, in the algorithm chosen with OPTS HASH. If the
+// driver is an FTPDedupDriver that already has the content, the upload
+// completes without the data being sent.
+type commandSiteHash struct{}
+
+func (cmd commandSiteHash) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSiteHash) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSiteHash) Execute(conn *ftpConn, param string) {
+	hash := strings.ToLower(param)
+	if !validHash(conn.hashAlgorithm, hash) {
+		conn.writeMessage(501, "Not a valid "+conn.hashAlgorithm+" hash")
+		return
+	}
+	conn.uploadHash = hash
+	conn.writeMessage(200, "Hash noted for the next upload")
+}
+
+// commandSiteHelp responds to SITE HELP, listing the SITE commands.
+type commandSiteHelp struct{}
+
+func (cmd commandSiteHelp) RequireParam() bool {
+	return false
+}
+
+func (cmd commandSiteHelp) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSiteHelp) Execute(conn *ftpConn, param string) {
+	if conn.server.stealth {
+		conn.writeMessage(214, "Help OK.")
+		return
+	}
+	names := make([]string, 0, len(siteCommands))
+	for name := range siteCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conn.writeLines(214, "214-The following SITE commands are recognized:", " "+strings.Join(names, " "), "214 Help OK.")
+}
+
+// commandSiteQuota responds to SITE QUOTA, reporting the space available in
+// the current directory and the user's upload size limit, if there is one.
+type commandSiteQuota struct{}
+
+func (cmd commandSiteQuota) RequireParam() bool {
+	return false
+}
+
+func (cmd commandSiteQuota) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSiteQuota) Execute(conn *ftpConn, param string) {
+	lines := []string{"200-Quota for " + conn.namePrefix + ":"}
+	available := "unknown"
+	var spaceDriver FTPSpaceDriver
+	if DriverAs(conn.driver, &spaceDriver) {
+		if bytes, err := spaceDriver.AvailableSpace(conn.namePrefix); err == nil {
+			available = fmt.Sprintf("%d bytes", bytes)
+		}
+	}
+	lines = append(lines, " Available space: "+available)
+	if max := conn.maxUploadSize(); max > 0 {
+		lines = append(lines, fmt.Sprintf(" Maximum upload size: %d bytes", max))
+	}
+	conn.writeLines(200, append(lines, "200 End of quota")...)
+}
+
+// commandSiteRmdir responds to SITE RMDIR, deleting a directory and
+// everything in it, which would otherwise take a DELE or RMD for every entry.
+// Only users allowed by the server's UserRecursiveDelete can use it.
+type commandSiteRmdir struct{}
+
+func (cmd commandSiteRmdir) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSiteRmdir) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSiteRmdir) Execute(conn *ftpConn, param string) {
+	if !conn.canDeleteTree() {
+		conn.writeMessage(550, "Permission denied")
+		return
+	}
+	if conn.deleteTree(conn.buildPath(param)) {
+		conn.writeMessage(250, "Directory removed")
 	} else {
 		conn.writeMessage(550, "Action not taken")
 	}
@@ -603,11 +1259,79 @@ func (cmd commandSize) Execute(conn *ftpConn, param string) {
 	bytes := conn.driver.Bytes(path)
 	if bytes >= 0 {
 		conn.writeMessage(213, fmt.Sprintf("%d", bytes))
+	} else if bytes == SizeUnknown {
+		conn.writeMessage(550, "Size not known")
 	} else {
 		conn.writeMessage(450, "file not available")
 	}
 }
 
+// commandStat responds to the STAT FTP command. Without a parameter it
+// reports on the session, including any transfer in progress. With a path it
+// lists the directory over the control connection, like LIST without a data
+// connection.
+//
+// A STAT sent while a transfer is running is answered by the command reader
+// rather than here, since commands are otherwise run one at a time.
+type commandStat struct{}
+
+func (cmd commandStat) RequireParam() bool {
+	return false
+}
+
+func (cmd commandStat) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandStat) Execute(conn *ftpConn, param string) {
+	if param == "" {
+		conn.writeLines(211, conn.statusLines(nil)...)
+		return
+	}
+	path := conn.buildPath(param)
+	if !conn.driver.ChangeDir(path) {
+		conn.writeMessage(450, "directory not available")
+		return
+	}
+	lines := []string{"213-Status of " + path + ":"}
+	for _, line := range strings.Split(conn.listFormatter(conn.dirContents(path)).Detailed(), "\r\n") {
+		if line != "" {
+			lines = append(lines, " "+line)
+		}
+	}
+	lines = append(lines, "213 End of status")
+	conn.writeLines(213, lines...)
+}
+
+// commandSiteXcrc responds to SITE XCRC, which gives the CRC-32 of the part of
+// a file the client already has, before it resumes uploading the rest with
+// REST and STOR. The resumed upload is refused if the data the server already
+// has doesn't match, rather than appending to a file that's diverged.
+//
+// The order is SITE XCRC, REST, then STOR, since REST only applies to the
+// command straight after it. The CRC applies to the next STOR, which is
+// refused with 503 if it isn't resuming, so a CRC sent after REST can't be
+// skipped by replacing the whole file instead.
+type commandSiteXcrc struct{}
+
+func (cmd commandSiteXcrc) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSiteXcrc) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSiteXcrc) Execute(conn *ftpConn, param string) {
+	crc, ok := parseCRC(param)
+	if !ok {
+		conn.writeMessage(501, "Not a valid CRC-32")
+		return
+	}
+	conn.resumeCRC = crc
+	conn.writeMessage(200, "CRC noted for the next resumed upload")
+}
+
 // commandStor responds to the STOR FTP command. It allows the user to upload a
 // new file.
 type commandStor struct{}
@@ -622,12 +1346,166 @@ func (cmd commandStor) RequireAuth() bool {
 
 func (cmd commandStor) Execute(conn *ftpConn, param string) {
 	targetPath := conn.buildPath(param)
-	conn.writeMessage(150, "Data transfer starting")
-	if ok := conn.driver.PutFile(targetPath, conn.dataConn); ok {
-		conn.writeMessage(226, "Transfer complete.")
+	offset := conn.restOffset
+	// a hash from SITE HASH or SITE XCRC only applies to the next STOR
+	uploadHash := conn.uploadHash
+	conn.uploadHash = ""
+	resumeCRC := conn.resumeCRC
+	conn.resumeCRC = ""
+	if conn.rangeSet {
+		conn.writeMessage(504, "RANG is only supported for downloads")
+		return
+	}
+	if resumeCRC != "" && offset == 0 {
+		conn.writeMessage(503, "Bad sequence of commands: SITE XCRC must be followed by REST, then STOR.")
+		return
+	}
+	var resumableDriver FTPResumableDriver
+	if offset > 0 && !DriverAs(conn.driver, &resumableDriver) {
+		conn.writeMessage(554, "Resuming uploads is not supported")
+		return
+	}
+	var resumed *uploadRecord
+	if offset > 0 && conn.server.atomicUploads {
+		// only an interrupted upload whose temporary file was kept can be
+		// resumed
+		if conn.server.uploadState == nil {
+			conn.writeMessage(550, "Resuming uploads is not available")
+			return
+		}
+		if resumed = conn.server.uploadState.find(conn.account, targetPath); resumed == nil {
+			conn.writeMessage(550, "No interrupted upload to resume")
+			return
+		}
+	}
+	if !conn.requireDataConn() || conn.overTransferCap() {
+		return
+	}
+	renamed := false
+	if offset == 0 {
+		storeAs, ok := conn.resolveCollision(targetPath)
+		if !ok {
+			return
+		}
+		renamed = storeAs != targetPath
+		targetPath = storeAs
+	}
+	if offset == 0 && conn.storeExisting(targetPath, uploadHash) {
+		return
+	}
+	if !conn.server.acquireTransfer(conn.priority) {
+		conn.writeMessage(450, "Too many transfers in progress, try again later")
+		return
+	}
+	defer conn.server.releaseTransfer()
+	// a data connection carries a single transfer
+	defer conn.setDataConn(nil)
+	storePath := targetPath
+	if resumed != nil {
+		storePath = resumed.TempPath
+	} else if conn.server.atomicUploads {
+		storePath = conn.uploadTempPath(targetPath)
+		// a fresh upload replaces an interrupted one
+		if previous := conn.server.uploadState.find(conn.account, targetPath); previous != nil && previous.TempPath != storePath {
+			conn.driver.DeleteFile(previous.TempPath)
+		}
+	}
+	if offset > 0 && resumeCRC != "" && !conn.resumeMatches(storePath, offset, resumeCRC) {
+		conn.writeMessage(554, "Resume refused: the data already uploaded doesn't match")
+		return
+	}
+	if conn.server.createUploadDirs && !(conn.makeParentDirs(targetPath) && conn.makeParentDirs(storePath)) {
+		conn.writeMessage(553, "Unable to create directory")
+		return
+	}
+	archived := ""
+	if storePath != targetPath {
+		conn.server.uploadState.update(conn.account, targetPath, storePath)
+	} else if offset == 0 {
+		var ok bool
+		if archived, ok = conn.archiveExisting(targetPath); !ok {
+			conn.writeMessage(451, "Requested action aborted: unable to archive existing file")
+			return
+		}
+	}
+	if renamed {
+		conn.writeMessage(150, "FILE: "+targetPath)
+	} else {
+		conn.writeMessage(150, "Data transfer starting")
+	}
+	xfer := conn.beginTransfer(transferUpload, targetPath)
+	limit := &uploadLimitReader{reader: conn.dataConn, remaining: -1}
+	if max := conn.maxUploadSize(); max > 0 {
+		limit.remaining = max - offset
+		if limit.remaining < 0 {
+			limit.remaining = 0
+		}
+	}
+	reader := &countingReader{reader: xfer.pace(xfer.meter(limit)), tally: xfer.tally}
+	data, verdicts := conn.interceptUpload(targetPath, reader)
+	var ok bool
+	if offset > 0 {
+		ok = resumableDriver.PutFileAt(storePath, offset, data)
 	} else {
-		conn.writeMessage(450, "error during transfer")
+		ok = conn.driver.PutFile(storePath, data)
+	}
+	conn.cmdBytes += reader.count
+	if limit.exceeded {
+		kept := false
+		if offset > 0 {
+			// keep what was uploaded before the REST, cutting off what was
+			// appended to it, so the upload can still be resumed
+			if kept = resumableDriver.PutFileAt(storePath, offset, strings.NewReader("")); !kept {
+				conn.logger.Printf("Unable to truncate %s back to %d bytes", storePath, offset)
+			}
+		}
+		// a file resumed in place holds data from before this STOR, so it's
+		// left alone even if it couldn't be cut back
+		if !kept && (offset == 0 || storePath != targetPath) {
+			conn.driver.DeleteFile(storePath)
+			conn.restoreArchived(archived, targetPath)
+			conn.server.uploadState.remove(conn.account, targetPath)
+		}
+		conn.dataConn.Close()
+		xfer.finish(errUploadTooLarge)
+		conn.writeMessage(552, "Exceeded storage allocation")
+		return
+	}
+	if !ok {
+		if storePath != targetPath {
+			conn.discardUpload(targetPath, storePath, reader.err != nil)
+		} else if archived != "" {
+			// the version that was set aside takes the place of the partial
+			// upload, so there's nothing left to resume
+			conn.driver.DeleteFile(targetPath)
+			conn.restoreArchived(archived, targetPath)
+			xfer.discarded = true
+		}
+		if reader.err != nil {
+			xfer.finish(reader.err)
+			conn.writeTransferError(xfer, reader.err, false)
+			return
+		}
+		if err := conn.lastDriverError(); driverError(err) != nil {
+			xfer.finish(err)
+			conn.writeDriverError(err, 451, "")
+			return
+		}
+		xfer.finish(errors.New("driver rejected upload"))
+		conn.writeTransferError(xfer, nil, true)
+		return
 	}
+	if storePath != targetPath {
+		code, err := conn.commitUpload(storePath, targetPath, reader.count, verdicts)
+		conn.server.uploadState.remove(conn.account, targetPath)
+		if err != nil {
+			xfer.finish(err)
+			conn.writeMessage(code, "Upload rejected: "+err.Error())
+			return
+		}
+	}
+	xfer.finish(nil)
+	conn.writeMessage(226, conn.completeMessage(xfer))
 }
 
 // commandStru responds to the STRU FTP command.
@@ -650,10 +1528,14 @@ func (cmd commandStru) RequireAuth() bool {
 }
 
 func (cmd commandStru) Execute(conn *ftpConn, param string) {
-	if strings.ToUpper(param) == "F" {
-		conn.writeMessage(200, "OK")
-	} else {
-		conn.writeMessage(504, "STRU is an obsolete command")
+	switch strings.ToUpper(param) {
+	case "F":
+		conn.structure = "F"
+		conn.writeMessage(200, "Structure set to file")
+	case "R", "P":
+		conn.writeMessage(504, "Only file structure is supported")
+	default:
+		conn.writeMessage(501, "Unknown structure")
 	}
 }
 
@@ -694,8 +1576,10 @@ func (cmd commandType) RequireAuth() bool {
 
 func (cmd commandType) Execute(conn *ftpConn, param string) {
 	if strings.ToUpper(param) == "A" {
+		conn.transferType = "A"
 		conn.writeMessage(200, "Type set to ASCII")
 	} else if strings.ToUpper(param) == "I" {
+		conn.transferType = "I"
 		conn.writeMessage(200, "Type set to binary")
 	} else {
 		conn.writeMessage(500, "Invalid type")
@@ -714,6 +1598,9 @@ func (cmd commandUser) RequireAuth() bool {
 }
 
 func (cmd commandUser) Execute(conn *ftpConn, param string) {
+	if conn.refuseLogin() || conn.refusePlaintextLogin() {
+		return
+	}
 	conn.reqUser = param
 	conn.writeMessage(331, "User name ok, password required")
 }
@@ -40,3 +40,19 @@ func TestStringMapsToCorrectCommands(t *testing.T) {
 		So(commands["XRMD"], ShouldHaveSameTypeAs, commandRmd{})
 	})
 }
+
+func TestParseCommandLine(t *testing.T) {
+	Convey("Parsing a command line", t, func() {
+		Convey("Will split the command from its parameter", func() {
+			command, param := parseCommandLine("STOR  my file.txt \r\n")
+			So(command, ShouldEqual, "STOR")
+			So(param, ShouldEqual, "my file.txt")
+		})
+
+		Convey("Will accept a command with no parameter or line ending", func() {
+			command, param := parseCommandLine("NOOP")
+			So(command, ShouldEqual, "NOOP")
+			So(param, ShouldEqual, "")
+		})
+	})
+}
@@ -0,0 +1,66 @@
+package graval
+
+import (
+	"strings"
+)
+
+// Compliance controls how strictly the server holds clients to the command
+// sequences in RFC 959.
+type Compliance int
+
+const (
+	// Lenient tolerates the sloppiness common in real clients: PASS without
+	// USER is tried as a login with an empty user name, a transfer with no
+	// data connection is refused with 425 like any other failure to open
+	// one, and other commands may come between RNFR and RNTO or SITE CPFR
+	// and SITE CPTO. A REST or RANG that isn't followed by a transfer is
+	// quietly forgotten.
+	Lenient Compliance = iota
+
+	// Strict refuses commands sent out of sequence with 503, as RFC 959
+	// describes, which is useful for testing clients. That's PASS without
+	// USER, a transfer without PORT or PASV, and anything other than QUIT or
+	// ABOR between RNFR and RNTO, SITE CPFR and SITE CPTO, or REST or RANG
+	// and the transfer it applies to. A sequence that's broken is abandoned.
+	Strict
+)
+
+// outOfSequence replies 503 if the server is Strict and the command needed
+// another to be sent first, and returns true. The message says what that
+// command is.
+func (ftpConn *ftpConn) outOfSequence(wanted string) bool {
+	if ftpConn.server.compliance != Strict {
+		return false
+	}
+	ftpConn.writeMessage(503, "Bad sequence of commands: use "+wanted+" first.")
+	return true
+}
+
+// breaksSequence replies 503 if the server is Strict and the command comes
+// after one that must be followed straight away by another, like RNFR, and
+// returns true. The unfinished sequence is abandoned.
+func (ftpConn *ftpConn) breaksSequence(command string, param string) bool {
+	if ftpConn.server.compliance != Strict || command == "QUIT" || command == "ABOR" {
+		return false
+	}
+	if command == "SITE" {
+		command += " " + strings.ToUpper(strings.SplitN(strings.TrimSpace(param), " ", 2)[0])
+	}
+	var pending, wanted string
+	switch {
+	case ftpConn.renameFrom != "" && command != "RNTO":
+		pending, wanted = "RNFR", "RNTO"
+	case ftpConn.copyFrom != "" && command != "SITE CPTO":
+		pending, wanted = "SITE CPFR", "SITE CPTO"
+	case ftpConn.restOffset > 0 && command != "RETR" && command != "STOR" && command != "REST" && command != "RANG":
+		pending, wanted = "REST", "RETR or STOR"
+	case ftpConn.rangeSet && command != "RETR" && command != "REST" && command != "RANG":
+		pending, wanted = "RANG", "RETR"
+	default:
+		return false
+	}
+	ftpConn.renameFrom = ""
+	ftpConn.copyFrom = ""
+	ftpConn.writeMessage(503, "Bad sequence of commands: "+pending+" must be followed by "+wanted+".")
+	return true
+}
@@ -0,0 +1,337 @@
+// Package config loads graval server settings from a TOML file, so a server
+// like gravald can be deployed without writing any Go.
+//
+// Only the subset of TOML needed for the settings below is supported: tables,
+// arrays of tables, comments, bare keys, and single line string, integer or
+// boolean values. Files using anything else, like floats, arrays or dotted
+// keys, are rejected rather than read differently than intended.
+//
+//	[server]
+//	name = "My FTP Server"
+//	hostname = "::"
+//	port = 2121
+//	pasv_min_port = 60000
+//	pasv_max_port = 60100
+//	pasv_advertised_ip = "203.0.113.10"
+//	idle_timeout = "5m"
+//	keepalive = "1m"   # TCP keepalive on control connections
+//	root = "/srv/ftp"
+//	read_only = false
+//	max_upload_size = 104857600   # bytes
+//	create_homes = true   # create missing home directories at login
+//	stealth = true   # don't tell clients which FTP server this is
+//
+//	[[users]]
+//	name = "alice"
+//	password = "secret"
+//	home = "alice"     # relative to the server root
+//	read_only = true
+//	max_upload_size = 0   # overrides the server limit, 0 means no limit
+//	priority = 1          # a larger share of the server when it's busy
+//	recursive_delete = false   # allow SITE RMDIR to delete whole trees
+//
+// Passwords are stored in plain text, so protect the file accordingly.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/osdriver"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config is the contents of a configuration file.
+type Config struct {
+	Server Server
+	Users  []User
+}
+
+// Server holds the settings from the [server] table.
+type Server struct {
+	Name             string
+	Hostname         string
+	Port             int
+	PasvMinPort      int
+	PasvMaxPort      int
+	PasvAdvertisedIp string
+	IdleTimeout      time.Duration
+	KeepAlive        time.Duration
+
+	// The directory containing every user's home directory
+	Root string
+
+	// Create a user's home directory when they log in if it doesn't exist
+	// yet, so new accounts need no other setup
+	CreateHomes bool
+
+	// Refuse modifications for all users, regardless of their own setting
+	ReadOnly bool
+
+	// The largest file a user can upload, in bytes, unless they have their
+	// own limit. 0 means unlimited.
+	MaxUploadSize int64
+
+	// Give away as little as possible about which FTP server this is
+	Stealth bool
+}
+
+// User holds the settings from a single [[users]] table.
+type User struct {
+	Name     string
+	Password string
+
+	// The user's home directory, relative to the server root. Defaults to
+	// the root itself.
+	Home string
+
+	ReadOnly bool
+
+	// The largest file the user can upload, in bytes, overriding the server
+	// limit. Nil if the user has no limit of their own; 0 means unlimited.
+	MaxUploadSize *int64
+
+	// The user's priority class. See graval.FTPServerOpts.UserPriority.
+	Priority int
+
+	// Whether the user can delete whole directory trees with SITE RMDIR.
+	RecursiveDelete bool
+}
+
+// Load reads the configuration file at path.
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Parse reads a configuration file from r.
+func Parse(r io.Reader) (*Config, error) {
+	tables, err := parseTOML(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	for _, t := range tables {
+		switch {
+		case t.name == "" && len(t.values) == 0:
+			continue
+		case t.name == "server" && !t.array:
+			err = config.Server.load(t)
+		case t.name == "users" && t.array:
+			var user User
+			err = user.load(t)
+			config.Users = append(config.Users, user)
+		case t.name == "":
+			err = errors.New("settings must be inside a [server] or [[users]] table")
+		default:
+			err = fmt.Errorf("line %d: unknown table %s", t.line, t.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (server *Server) load(t *table) error {
+	err := t.checkKeys("name", "hostname", "port", "pasv_min_port", "pasv_max_port",
+		"pasv_advertised_ip", "idle_timeout", "keepalive", "root", "read_only", "max_upload_size",
+		"create_homes", "stealth")
+	if err != nil {
+		return err
+	}
+	var idleTimeout, keepAlive string
+	for _, err := range []error{
+		t.String("name", &server.Name),
+		t.String("hostname", &server.Hostname),
+		t.Int("port", &server.Port),
+		t.Int("pasv_min_port", &server.PasvMinPort),
+		t.Int("pasv_max_port", &server.PasvMaxPort),
+		t.String("pasv_advertised_ip", &server.PasvAdvertisedIp),
+		t.String("idle_timeout", &idleTimeout),
+		t.String("keepalive", &keepAlive),
+		t.String("root", &server.Root),
+		t.Bool("read_only", &server.ReadOnly),
+		t.Int64("max_upload_size", &server.MaxUploadSize),
+		t.Bool("create_homes", &server.CreateHomes),
+		t.Bool("stealth", &server.Stealth),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if idleTimeout != "" {
+		server.IdleTimeout, err = time.ParseDuration(idleTimeout)
+		if err != nil {
+			return fmt.Errorf("line %d: idle_timeout: %s", t.lines["idle_timeout"], err)
+		}
+	}
+	if keepAlive != "" {
+		server.KeepAlive, err = time.ParseDuration(keepAlive)
+		if err != nil {
+			return fmt.Errorf("line %d: keepalive: %s", t.lines["keepalive"], err)
+		}
+	}
+	return nil
+}
+
+func (user *User) load(t *table) error {
+	if err := t.checkKeys("name", "password", "home", "read_only", "max_upload_size", "priority",
+		"recursive_delete"); err != nil {
+		return err
+	}
+	if _, ok := t.values["max_upload_size"]; ok {
+		user.MaxUploadSize = new(int64)
+	}
+	for _, err := range []error{
+		t.String("name", &user.Name),
+		t.String("password", &user.Password),
+		t.String("home", &user.Home),
+		t.Bool("read_only", &user.ReadOnly),
+		t.Int64("max_upload_size", user.MaxUploadSize),
+		t.Int("priority", &user.Priority),
+		t.Bool("recursive_delete", &user.RecursiveDelete),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if user.Name == "" {
+		return fmt.Errorf("line %d: user is missing a name", t.line)
+	}
+	if user.MaxUploadSize != nil && *user.MaxUploadSize < 0 {
+		return fmt.Errorf("line %d: max_upload_size must not be negative", t.lines["max_upload_size"])
+	}
+	return nil
+}
+
+func (config *Config) validate() error {
+	if config.Server.Root == "" {
+		return errors.New("server root is required")
+	}
+	if config.Server.MaxUploadSize < 0 {
+		return errors.New("max_upload_size must not be negative")
+	}
+	seen := map[string]bool{}
+	for _, user := range config.Users {
+		if seen[user.Name] {
+			return fmt.Errorf("user %s is listed more than once", user.Name)
+		}
+		seen[user.Name] = true
+	}
+	return nil
+}
+
+// ServerOpts builds the options for graval.NewFTPServer. The Factory serves
+// each user's home directory from the local filesystem using osdriver.
+func (config *Config) ServerOpts() *graval.FTPServerOpts {
+	return &graval.FTPServerOpts{
+		ServerName:       config.Server.Name,
+		Hostname:         config.Server.Hostname,
+		Port:             config.Server.Port,
+		PasvMinPort:      config.Server.PasvMinPort,
+		PasvMaxPort:      config.Server.PasvMaxPort,
+		PasvAdvertisedIp: config.Server.PasvAdvertisedIp,
+		IdleTimeout:      config.Server.IdleTimeout,
+		KeepAlivePeriod:  config.Server.KeepAlive,
+		MaxUploadSize:    config.Server.MaxUploadSize,
+		Stealth:          config.Server.Stealth,
+		Factory:          &driverFactory{config: config},
+		UserMaxUploadSize: func(name string) int64 {
+			user := config.user(name)
+			if user == nil || user.MaxUploadSize == nil {
+				return 0
+			}
+			if *user.MaxUploadSize == 0 {
+				return -1
+			}
+			return *user.MaxUploadSize
+		},
+		UserPriority: func(name string) int {
+			if user := config.user(name); user != nil {
+				return user.Priority
+			}
+			return 0
+		},
+		UserRecursiveDelete: func(name string) bool {
+			user := config.user(name)
+			return user != nil && user.RecursiveDelete
+		},
+	}
+}
+
+// user returns the settings for the named user, or nil if there's no such
+// user.
+func (config *Config) user(name string) *User {
+	for i := range config.Users {
+		if config.Users[i].Name == name {
+			return &config.Users[i]
+		}
+	}
+	return nil
+}
+
+// driverFactory creates drivers that authenticate against the users in the
+// config, then serve the home directory of whoever logged in.
+type driverFactory struct {
+	config *Config
+}
+
+func (factory *driverFactory) NewDriver() (graval.FTPDriver, error) {
+	// until someone logs in, the driver is read-only and rooted at the
+	// server root, so the optional methods graval may call before login,
+	// like SettableFacts for FEAT, have a root to work with
+	inner, err := (&osdriver.DriverFactory{Root: factory.config.Server.Root, ReadOnly: true}).NewDriver()
+	if err != nil {
+		return nil, err
+	}
+	return &userDriver{config: factory.config, Driver: inner.(*osdriver.Driver)}, nil
+}
+
+// userDriver delegates to an osdriver.Driver rooted in the home directory of
+// the authenticated user. It embeds the osdriver.Driver itself, rather than
+// graval.FTPDriver, so every optional interface osdriver implements, like
+// resumed uploads, MFMT and MFF, error reporting, streamed listings and the
+// permissions for new files, is passed through as well.
+type userDriver struct {
+	*osdriver.Driver
+	config *Config
+}
+
+func (driver *userDriver) Authenticate(name string, pass string) bool {
+	user := driver.config.user(name)
+	if user == nil || user.Password != pass {
+		return false
+	}
+	home := filepath.Join(driver.config.Server.Root, filepath.FromSlash(filepath.Clean("/"+user.Home)))
+	if driver.config.Server.CreateHomes {
+		if err := os.MkdirAll(home, 0755); err != nil {
+			return false
+		}
+	}
+	factory := &osdriver.DriverFactory{
+		Root:     home,
+		ReadOnly: driver.config.Server.ReadOnly || user.ReadOnly,
+	}
+	inner, err := factory.NewDriver()
+	if err != nil {
+		return false
+	}
+	driver.Driver = inner.(*osdriver.Driver)
+	return true
+}
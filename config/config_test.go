@@ -0,0 +1,244 @@
+package config
+
+import (
+	"github.com/royallthefourth/graval"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sample = `
+# a sample config
+[server]
+name = "Test # Server"
+port = 2121
+pasv_min_port = 60000
+pasv_max_port = 60100
+idle_timeout = "5m"
+keepalive = "45s"
+root = '/srv/ftp'
+max_upload_size = 1_000
+create_homes = true
+stealth = true
+
+[[users]]
+name = "alice"
+password = "s3cr\"et"
+home = "alice"
+read_only = true
+
+[[users]]
+name = "bob"
+password = "hunter2" # not a great password
+max_upload_size = 5000
+priority = 2
+recursive_delete = true
+
+[[users]]
+name = "carol"
+max_upload_size = 0
+`
+
+func TestParse(t *testing.T) {
+	config, err := Parse(strings.NewReader(sample))
+	Convey("Parsing a config file", t, func() {
+		Convey("Will succeed", func() {
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Will read the server settings", func() {
+			So(config.Server.Name, ShouldEqual, "Test # Server")
+			So(config.Server.Port, ShouldEqual, 2121)
+			So(config.Server.PasvMinPort, ShouldEqual, 60000)
+			So(config.Server.PasvMaxPort, ShouldEqual, 60100)
+			So(config.Server.IdleTimeout, ShouldEqual, 5*time.Minute)
+			So(config.Server.KeepAlive, ShouldEqual, 45*time.Second)
+			So(config.Server.Root, ShouldEqual, "/srv/ftp")
+			So(config.Server.MaxUploadSize, ShouldEqual, 1000)
+			So(config.Server.CreateHomes, ShouldBeTrue)
+			So(config.Server.Stealth, ShouldBeTrue)
+		})
+
+		Convey("Will read the users", func() {
+			So(len(config.Users), ShouldEqual, 3)
+			So(config.Users[0], ShouldResemble, User{Name: "alice", Password: `s3cr"et`, Home: "alice", ReadOnly: true})
+			So(config.Users[1].Name, ShouldEqual, "bob")
+			So(config.Users[1].Password, ShouldEqual, "hunter2")
+			So(*config.Users[1].MaxUploadSize, ShouldEqual, 5000)
+		})
+
+		Convey("Will build server options", func() {
+			opts := config.ServerOpts()
+			So(opts.ServerName, ShouldEqual, "Test # Server")
+			So(opts.Stealth, ShouldBeTrue)
+			So(opts.Validate(), ShouldBeNil)
+		})
+
+		Convey("Will apply per-user upload limits", func() {
+			opts := config.ServerOpts()
+			So(opts.MaxUploadSize, ShouldEqual, 1000)
+			So(opts.UserMaxUploadSize("alice"), ShouldEqual, 0)
+			So(opts.UserMaxUploadSize("bob"), ShouldEqual, 5000)
+			So(opts.UserMaxUploadSize("carol"), ShouldEqual, -1)
+		})
+
+		Convey("Will apply user priorities", func() {
+			opts := config.ServerOpts()
+			So(opts.UserPriority("bob"), ShouldEqual, 2)
+			So(opts.UserPriority("alice"), ShouldEqual, 0)
+		})
+
+		Convey("Will allow recursive deletes for chosen users", func() {
+			opts := config.ServerOpts()
+			So(opts.UserRecursiveDelete("bob"), ShouldBeTrue)
+			So(opts.UserRecursiveDelete("alice"), ShouldBeFalse)
+			So(opts.UserRecursiveDelete("nobody"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	Convey("Parsing an invalid config file", t, func() {
+		Convey("Will reject unknown keys", func() {
+			_, err := Parse(strings.NewReader("[server]\nroot = \"/\"\nprot = 21\n"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "line 3: unknown key prot")
+		})
+
+		Convey("Will reject values of the wrong type", func() {
+			_, err := Parse(strings.NewReader("[server]\nroot = \"/\"\nport = \"21\"\n"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Will require a root", func() {
+			_, err := Parse(strings.NewReader("[server]\nport = 21\n"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Will reject duplicate users", func() {
+			_, err := Parse(strings.NewReader("[server]\nroot = \"/\"\n[[users]]\nname = \"a\"\n[[users]]\nname = \"a\"\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestParseTOML(t *testing.T) {
+	value := func(raw string) (interface{}, error) {
+		tables, err := parseTOML(strings.NewReader("key = " + raw + "\n"))
+		if err != nil {
+			return nil, err
+		}
+		return tables[0].values["key"], nil
+	}
+	parsed := func(raw string) interface{} {
+		v, err := value(raw)
+		So(err, ShouldBeNil)
+		return v
+	}
+
+	Convey("Parsing TOML", t, func() {
+		Convey("Will decode basic strings with TOML's escapes", func() {
+			So(parsed(`"a\tb\"c\\d"`), ShouldEqual, "a\tb\"c\\d")
+			So(parsed(`"\u00e9\U0001F600"`), ShouldEqual, "\u00e9\U0001F600")
+			So(parsed(`"a # b" # comment`), ShouldEqual, "a # b")
+		})
+
+		Convey("Will reject escapes TOML doesn't have", func() {
+			for _, raw := range []string{`"\x41"`, `"\101"`, `"\a"`, `"\uD800"`, `"\U00110000"`, `"\u12"`} {
+				_, err := value(raw)
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("Will take literal strings as they are, up to the next quote", func() {
+			So(parsed(`'C:\path\x'`), ShouldEqual, `C:\path\x`)
+			_, err := value(`'a'b'`)
+			So(err, ShouldNotBeNil)
+			_, err = value(`"a"b"`)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Will decode integers in each base", func() {
+			So(parsed("1_000"), ShouldEqual, int64(1000))
+			So(parsed("-17"), ShouldEqual, int64(-17))
+			So(parsed("+5"), ShouldEqual, int64(5))
+			So(parsed("0xff"), ShouldEqual, int64(255))
+			So(parsed("0o17"), ShouldEqual, int64(15))
+			So(parsed("0b1010"), ShouldEqual, int64(10))
+		})
+
+		Convey("Will reject malformed integers", func() {
+			for _, raw := range []string{"012", "1__0", "_1", "1_", "-0x1", "0x", "++1", "1 2"} {
+				_, err := value(raw)
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("Will reject TOML outside the supported subset", func() {
+			for _, raw := range []string{"1.5", "1979-05-27", "[1, 2]", "{ a = 1 }", `"""multi"""`, "inf", "True"} {
+				_, err := value(raw)
+				So(err, ShouldNotBeNil)
+			}
+			for _, doc := range []string{"a.b = 1\n", "\"a\" = 1\n", "[a.b]\n", "[\"a\"]\n"} {
+				_, err := parseTOML(strings.NewReader(doc))
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestUserDriver(t *testing.T) {
+	root, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.Mkdir(filepath.Join(root, "alice"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "alice", "one.txt"), []byte("hello"), 0644)
+
+	config := &Config{
+		Server: Server{Root: root},
+		Users:  []User{{Name: "alice", Password: "secret", Home: "alice", ReadOnly: true}, {Name: "bob", Password: "secret", Home: "new/bob"}},
+	}
+	driver, _ := config.ServerOpts().Factory.NewDriver()
+	factsBeforeLogin := driver.(graval.FTPFactsDriver).SettableFacts()
+	bobDriver, _ := config.ServerOpts().Factory.NewDriver()
+	bobMissing := bobDriver.Authenticate("bob", "secret") && bobDriver.ChangeDir("/")
+	config.Server.CreateHomes = true
+	bobDriver, _ = config.ServerOpts().Factory.NewDriver()
+	bobCreated := bobDriver.Authenticate("bob", "secret") && bobDriver.ChangeDir("/")
+
+	Convey("A driver built from config", t, func() {
+		Convey("Will reject bad passwords", func() {
+			So(driver.Authenticate("alice", "wrong"), ShouldBeFalse)
+			So(driver.Authenticate("mallory", "secret"), ShouldBeFalse)
+		})
+
+		Convey("Will serve the user's home directory", func() {
+			So(driver.Authenticate("alice", "secret"), ShouldBeTrue)
+			So(driver.Bytes("/one.txt"), ShouldEqual, 5)
+		})
+
+		Convey("Will respect read only users", func() {
+			So(driver.MakeDir("/new"), ShouldBeFalse)
+		})
+
+		Convey("Will create missing home directories when asked", func() {
+			So(bobMissing, ShouldBeFalse)
+			So(bobCreated, ShouldBeTrue)
+		})
+
+		Convey("Will pass through the optional interfaces of osdriver", func() {
+			So(driver, ShouldImplement, (*graval.FTPResumableDriver)(nil))
+			So(driver, ShouldImplement, (*graval.FTPErrorDriver)(nil))
+			So(driver, ShouldImplement, (*graval.FTPFactsDriver)(nil))
+			So(driver, ShouldImplement, (*graval.FTPDirIterDriver)(nil))
+			So(driver, ShouldImplement, (*graval.FTPCreateModeDriver)(nil))
+			So(factsBeforeLogin, ShouldBeEmpty)
+		})
+	})
+}
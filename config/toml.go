@@ -0,0 +1,308 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// table is a single [name] or [[name]] section from a TOML file, with the
+// key/value pairs that follow it.
+type table struct {
+	name   string
+	array  bool
+	line   int
+	values map[string]interface{}
+	lines  map[string]int
+}
+
+// parseTOML reads the subset of TOML needed for server configuration, and
+// rejects anything outside it rather than guessing:
+//
+//   - [name] tables and [[name]] arrays of tables, with bare names
+//   - key = value pairs, with bare keys of letters, digits, _ and -
+//   - # comments, on their own line or after a value
+//   - single line basic "strings" with TOML's escapes, and 'literal' strings
+//   - decimal, 0x hexadecimal, 0o octal and 0b binary integers, with _
+//     between digits
+//   - true and false
+//
+// Floats, dates, arrays, inline tables, multi-line strings and dotted or
+// quoted keys aren't supported. Keys before the first table belong to a
+// table with an empty name.
+func parseTOML(r io.Reader) ([]*table, error) {
+	current := &table{values: map[string]interface{}{}, lines: map[string]int{}}
+	tables := []*table{current}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			array := strings.HasPrefix(line, "[[")
+			name := line[1 : len(line)-1]
+			if array {
+				name = strings.TrimSuffix(name[1:], "]")
+			}
+			name = strings.TrimSpace(name)
+			if !strings.HasSuffix(line, "]") || (array && !strings.HasSuffix(line, "]]")) || !bareKey(name) {
+				return nil, fmt.Errorf("line %d: malformed table header", lineNo)
+			}
+			current = &table{name: name, array: array, line: lineNo, values: map[string]interface{}{}, lines: map[string]int{}}
+			tables = append(tables, current)
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", lineNo)
+		}
+		if !bareKey(key) {
+			return nil, fmt.Errorf("line %d: unsupported key %s", lineNo, key)
+		}
+		if _, ok := current.values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", lineNo, key)
+		}
+		value, rest, err := parseValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %d: unexpected %s after value", lineNo, rest)
+		}
+		current.values[key] = value
+		current.lines[key] = lineNo
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// bareKey reports whether name is a TOML bare key.
+func bareKey(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue parses the value at the start of raw, returning it and what
+// follows it on the line.
+func parseValue(raw string) (interface{}, string, error) {
+	switch {
+	case raw == "" || strings.HasPrefix(raw, "#"):
+		return nil, "", fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, `"""`) || strings.HasPrefix(raw, "'''"):
+		return nil, "", fmt.Errorf("multi-line strings aren't supported")
+	case strings.HasPrefix(raw, `"`):
+		return parseBasicString(raw)
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		value := raw[1 : end+1]
+		if strings.IndexFunc(value, func(c rune) bool { return c < 0x20 && c != '\t' || c == 0x7f }) >= 0 {
+			return nil, "", fmt.Errorf("control character in string")
+		}
+		return value, raw[end+2:], nil
+	}
+	token := raw
+	if end := strings.IndexAny(raw, " \t#"); end >= 0 {
+		token = raw[:end]
+	}
+	rest := raw[len(token):]
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	value, err := parseInteger(token)
+	if err != nil {
+		return nil, "", err
+	}
+	return value, rest, nil
+}
+
+// parseBasicString parses the "string" at the start of raw, returning it and
+// what follows it.
+func parseBasicString(raw string) (interface{}, string, error) {
+	var value strings.Builder
+	for i := 1; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			return value.String(), raw[i+1:], nil
+		case c < 0x20 && c != '\t' || c == 0x7f:
+			return nil, "", fmt.Errorf("control character in string")
+		case c != '\\':
+			value.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(raw) {
+			break
+		}
+		switch raw[i] {
+		case 'b':
+			value.WriteByte('\b')
+		case 't':
+			value.WriteByte('\t')
+		case 'n':
+			value.WriteByte('\n')
+		case 'f':
+			value.WriteByte('\f')
+		case 'r':
+			value.WriteByte('\r')
+		case '"':
+			value.WriteByte('"')
+		case '\\':
+			value.WriteByte('\\')
+		case 'u', 'U':
+			digits := 4
+			if raw[i] == 'U' {
+				digits = 8
+			}
+			if i+digits >= len(raw) {
+				return nil, "", fmt.Errorf("malformed escape in string")
+			}
+			code, err := strconv.ParseUint(raw[i+1:i+1+digits], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return nil, "", fmt.Errorf("malformed escape in string")
+			}
+			value.WriteRune(rune(code))
+			i += digits
+		default:
+			return nil, "", fmt.Errorf("malformed escape in string")
+		}
+	}
+	return nil, "", fmt.Errorf("unterminated string")
+}
+
+// parseInteger parses a TOML integer: decimal with an optional sign, or
+// unsigned hexadecimal, octal or binary with a 0x, 0o or 0b prefix. An
+// underscore must have a digit on each side.
+func parseInteger(token string) (int64, error) {
+	unsupported := fmt.Errorf("unsupported value %s", token)
+	digits, base := token, 10
+	if len(token) > 2 && token[0] == '0' {
+		switch token[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+		if base != 10 {
+			digits = token[2:]
+		}
+	}
+	unsigned := strings.TrimLeft(digits, "+-")
+	if base != 10 && unsigned != digits || len(digits)-len(unsigned) > 1 {
+		return 0, unsupported
+	}
+	if unsigned == "" || unsigned[0] == '_' || unsigned[len(unsigned)-1] == '_' || strings.Contains(unsigned, "__") {
+		return 0, unsupported
+	}
+	if base == 10 && len(unsigned) > 1 && unsigned[0] == '0' {
+		// leading zeros aren't allowed
+		return 0, unsupported
+	}
+	value, err := strconv.ParseInt(strings.Replace(digits, "_", "", -1), base, 64)
+	if err != nil {
+		return 0, unsupported
+	}
+	return value, nil
+}
+
+func (t *table) String(key string, dest *string) error {
+	value, ok := t.values[key]
+	if !ok {
+		return nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("line %d: %s must be a string", t.lines[key], key)
+	}
+	*dest = s
+	return nil
+}
+
+func (t *table) Int(key string, dest *int) error {
+	value, ok := t.values[key]
+	if !ok {
+		return nil
+	}
+	i, ok := value.(int64)
+	if !ok {
+		return fmt.Errorf("line %d: %s must be an integer", t.lines[key], key)
+	}
+	*dest = int(i)
+	return nil
+}
+
+func (t *table) Int64(key string, dest *int64) error {
+	value, ok := t.values[key]
+	if !ok {
+		return nil
+	}
+	i, ok := value.(int64)
+	if !ok {
+		return fmt.Errorf("line %d: %s must be an integer", t.lines[key], key)
+	}
+	*dest = i
+	return nil
+}
+
+func (t *table) Bool(key string, dest *bool) error {
+	value, ok := t.values[key]
+	if !ok {
+		return nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return fmt.Errorf("line %d: %s must be true or false", t.lines[key], key)
+	}
+	*dest = b
+	return nil
+}
+
+// checkKeys returns an error naming the first key that isn't in known, so
+// typos in the config file don't go unnoticed.
+func (t *table) checkKeys(known ...string) error {
+	for key := range t.values {
+		found := false
+		for _, k := range known {
+			if k == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("line %d: unknown key %s", t.lines[key], key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package graval
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// copyPath copies a file, or a directory and everything in it, using the
+// driver's own Copy if it has one. Symlinks inside a directory are skipped.
+// It returns false if the destination already exists, the source contains a
+// directory hidden by a DirPolicy or the driver, or anything fails to copy.
+func (ftpConn *ftpConn) copyPath(fromPath string, toPath string) bool {
+	if fromPath == toPath || strings.HasPrefix(toPath, strings.TrimSuffix(fromPath, "/")+"/") {
+		return false
+	}
+	if ftpConn.containsHiddenDir(fromPath) {
+		return false
+	}
+	if isFileSize(ftpConn.driver.Bytes(toPath)) || ftpConn.driver.ChangeDir(toPath) {
+		return false
+	}
+	var copier FTPCopyDriver
+	if DriverAs(ftpConn.driver, &copier) {
+		return copier.Copy(fromPath, toPath)
+	}
+	return copyTree(ftpConn.driver, fromPath, toPath)
+}
+
+// copyTree copies fromPath to toPath by reading and writing through driver.
+func copyTree(driver FTPDriver, fromPath string, toPath string) bool {
+	if !driver.ChangeDir(fromPath) {
+		reader, err := driver.GetFile(fromPath)
+		if err != nil {
+			return false
+		}
+		defer reader.Close()
+		return driver.PutFile(toPath, reader)
+	}
+	if !driver.MakeDir(toPath) {
+		return false
+	}
+	for _, file := range driver.DirContents(fromPath) {
+		if file.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if !copyTree(driver, path.Join(fromPath, file.Name()), path.Join(toPath, file.Name())) {
+			return false
+		}
+	}
+	return true
+}
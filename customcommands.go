@@ -0,0 +1,147 @@
+package graval
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Command is a command added to a server with RegisterCommand.
+type Command struct {
+	// Runs the command. It must send exactly one completion reply.
+	Handler CommandHandler
+
+	// Whether the command needs a parameter. Without one the client gets a
+	// 553 reply and Handler isn't called.
+	RequireParam bool
+
+	// Whether the client must be logged in to use the command.
+	RequireAuth bool
+
+	// Whether the command changes files, so it's refused while the server is
+	// read-only.
+	Write bool
+}
+
+// CommandHandler runs a command added with RegisterCommand.
+type CommandHandler func(ctx *CommandContext)
+
+// CommandContext is the session a command added with RegisterCommand runs in.
+type CommandContext struct {
+	SessionId string
+	RemoteIP  string
+
+	// The user who's logged in, or an empty string before login
+	User string
+
+	// The values stored for the session
+	Values *SessionValues
+
+	// The session the command was sent on
+	Session *Session
+
+	// The command as the client sent it, and its parameter
+	Command string
+	Param   string
+
+	conn *ftpConn
+}
+
+// Context returns the context of the command, which carries its trace span
+// and is cancelled if the session ends.
+func (ctx *CommandContext) Context() context.Context {
+	return ctx.conn.cmdCtx
+}
+
+// Driver returns the session's driver.
+func (ctx *CommandContext) Driver() FTPDriver {
+	return ctx.conn.driver
+}
+
+// Dir returns the session's working directory.
+func (ctx *CommandContext) Dir() string {
+	return ctx.conn.namePrefix
+}
+
+// Path turns a path sent by the client into an absolute path, relative to the
+// working directory.
+func (ctx *CommandContext) Path(param string) string {
+	return ctx.conn.buildPath(param)
+}
+
+// Reply sends a single line reply.
+func (ctx *CommandContext) Reply(code int, message string) {
+	ctx.conn.writeMessage(code, message)
+}
+
+// ReplyLines sends a multiline reply. The first and last lines must start
+// with the code, like "211-Status" and "211 End".
+func (ctx *CommandContext) ReplyLines(code int, lines ...string) {
+	ctx.conn.writeLines(code, lines...)
+}
+
+// customCommand runs a Command as one of the server's commands.
+type customCommand struct {
+	verb    string
+	command Command
+}
+
+func (cmd customCommand) RequireParam() bool {
+	return cmd.command.RequireParam
+}
+
+func (cmd customCommand) RequireAuth() bool {
+	return cmd.command.RequireAuth
+}
+
+func (cmd customCommand) Execute(conn *ftpConn, param string) {
+	cmd.command.Handler(&CommandContext{
+		SessionId: conn.sessionId,
+		RemoteIP:  conn.remoteIP(),
+		User:      conn.user,
+		Values:    conn.values,
+		Session:   &Session{conn: conn},
+		Command:   cmd.verb,
+		Param:     param,
+		conn:      conn,
+	})
+}
+
+// customCommands are the commands added to a server, which take precedence
+// over the built in ones.
+type customCommands struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+}
+
+// RegisterCommand adds a command to the server, or replaces one of graval's
+// own, so applications can support commands of their own without changing
+// graval. Like graval's commands, verb is upper case. It's safe to call
+// while the server is running; sessions use the new command from the next
+// time it's sent.
+func (ftpServer *FTPServer) RegisterCommand(verb string, command Command) {
+	custom := &ftpServer.custom
+	custom.mu.Lock()
+	defer custom.mu.Unlock()
+	if custom.commands == nil {
+		custom.commands = map[string]Command{}
+	}
+	custom.commands[strings.ToUpper(verb)] = command
+}
+
+// command looks up the command a client sent, returning whether it changes
+// files.
+func (ftpServer *FTPServer) command(verb string) (ftpCommand, bool) {
+	custom := &ftpServer.custom
+	custom.mu.RLock()
+	command, ok := custom.commands[verb]
+	custom.mu.RUnlock()
+	if ok {
+		return customCommand{verb: verb, command: command}, command.Write
+	}
+	cmdObj, ok := commands[verb]
+	if !ok {
+		return nil, false
+	}
+	return cmdObj, writeCommands[verb]
+}
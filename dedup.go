@@ -0,0 +1,67 @@
+package graval
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// the algorithm SITE HASH uses until the client chooses another with
+// OPTS HASH
+const defaultHashAlgorithm = "SHA-256"
+
+// hashAlgorithms are the algorithms that can be chosen with OPTS HASH, from
+// draft-bryan-ftp-hash, and the length of their hashes in bytes.
+var hashAlgorithms = map[string]int{
+	"MD5":     16,
+	"SHA-1":   20,
+	"SHA-256": 32,
+	"SHA-512": 64,
+}
+
+// optsHash responds to OPTS HASH, which reports the algorithm used by SITE
+// HASH, or chooses another.
+func (ftpConn *ftpConn) optsHash(params []string) {
+	if len(params) > 0 {
+		algorithm := strings.ToUpper(params[0])
+		if _, ok := hashAlgorithms[algorithm]; !ok || len(params) > 1 {
+			ftpConn.writeMessage(501, "Unknown hash algorithm")
+			return
+		}
+		ftpConn.hashAlgorithm = algorithm
+		ftpConn.uploadHash = ""
+	}
+	ftpConn.writeMessage(200, ftpConn.hashAlgorithm)
+}
+
+// validHash reports whether hash is a lower case hex hash made with
+// algorithm.
+func validHash(algorithm string, hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == hashAlgorithms[algorithm]
+}
+
+// storeExisting asks an FTPDedupDriver to store the content with the hash
+// given by SITE HASH at path. If it can, the STOR is answered without
+// reading the data, and it returns true. If it can't, a file archived to
+// make way for it is put back.
+func (ftpConn *ftpConn) storeExisting(path string, hash string) bool {
+	var driver FTPDedupDriver
+	if hash == "" || !DriverAs(ftpConn.driver, &driver) {
+		return false
+	}
+	archived, ok := ftpConn.archiveExisting(path)
+	if !ok {
+		return false
+	}
+	if !driver.StoreExisting(path, ftpConn.hashAlgorithm, hash) {
+		ftpConn.restoreArchived(archived, path)
+		return false
+	}
+	xfer := ftpConn.beginTransfer(transferUpload, path)
+	// the client may already be sending the data, which isn't needed
+	ftpConn.setDataConn(nil)
+	ftpConn.writeMessage(150, "Content already stored, no data needed")
+	xfer.finish(nil)
+	ftpConn.writeMessage(226, ftpConn.completeMessage(xfer))
+	return true
+}
@@ -0,0 +1,43 @@
+package graval
+
+import (
+	"os"
+	"path"
+)
+
+// deleteTree deletes a directory and everything in it, using the driver's
+// own DeleteTree if it has one. The root directory is never deleted. It
+// returns false if anything couldn't be deleted, in which case part of the
+// tree may already be gone.
+func (ftpConn *ftpConn) deleteTree(dir string) bool {
+	if dir == "/" || !ftpConn.driver.ChangeDir(dir) {
+		return false
+	}
+	var deleter FTPTreeDeleteDriver
+	if DriverAs(ftpConn.driver, &deleter) {
+		return deleter.DeleteTree(dir)
+	}
+	return deleteTreeContents(ftpConn.driver, dir) && ftpConn.driver.DeleteDir(dir)
+}
+
+// deleteTreeContents deletes everything inside dir through driver. Symlinks
+// are deleted rather than followed.
+func deleteTreeContents(driver FTPDriver, dir string) bool {
+	for _, file := range driver.DirContents(dir) {
+		child := path.Join(dir, file.Name())
+		if file.IsDir() && file.Mode()&os.ModeSymlink == 0 {
+			if !deleteTreeContents(driver, child) || !driver.DeleteDir(child) {
+				return false
+			}
+		} else if !driver.DeleteFile(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// canDeleteTree reports whether the logged in user may use SITE RMDIR.
+func (ftpConn *ftpConn) canDeleteTree() bool {
+	allowed := ftpConn.settings.userTreeDelete
+	return allowed != nil && allowed(ftpConn.account)
+}
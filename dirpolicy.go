@@ -0,0 +1,237 @@
+package graval
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// DirPolicy restricts what clients may do in a directory and everything
+// beneath it, whatever the driver would allow. It's enough to model the
+// classic drop box layout, where /incoming takes uploads that can't be seen,
+// /outgoing has files to download that can't be changed, and /tmp is
+// cleared out regularly. Commands refused by a policy get a 550 reply.
+type DirPolicy struct {
+	// The directory the policy applies to, as an absolute path. When
+	// policies are nested, only the policy for the deepest directory
+	// applies.
+	Dir string
+
+	// Refuse commands that change files, like STOR, DELE, MKD and RNFR.
+	ReadOnly bool
+
+	// Refuse commands that read files or list directories, like RETR, LIST,
+	// MLSD and SIZE, so uploads can't be seen by other users. The directory
+	// is also left out of archives, and directories containing it can't be
+	// copied.
+	WriteOnly bool
+
+	// Make the directory a blind drop box: like WriteOnly, except that
+	// listings succeed and are empty rather than being refused, which some
+	// clients cope with better after an upload.
+	Blind bool
+
+	// When set, files that haven't been modified for this long are deleted.
+	// Directories are kept. Files are checked twice in each period while the
+	// server is serving.
+	Expire time.Duration
+}
+
+// The commands that read a file or list a directory, which are refused in a
+// WriteOnly directory
+var readCommands = map[string]bool{
+	"LIST": true,
+	"MDTM": true,
+	"MLSD": true,
+	"MLST": true,
+	"NLST": true,
+	"RETR": true,
+	"RNFR": true,
+	"SIZE": true,
+	"STAT": true,
+}
+
+// The commands that list a directory, which succeed with an empty listing in
+// a Blind directory
+var listCommands = map[string]bool{
+	"LIST": true,
+	"MLSD": true,
+	"NLST": true,
+	"STAT": true,
+}
+
+// The SITE commands that read a file
+var siteReadCommands = map[string]bool{
+	"CPFR": true,
+}
+
+func (policy *DirPolicy) validate() error {
+	if !strings.HasPrefix(policy.Dir, "/") {
+		return fmt.Errorf("graval: DirPolicy directory %q must be an absolute path", policy.Dir)
+	}
+	if policy.ReadOnly && (policy.WriteOnly || policy.Blind) {
+		return fmt.Errorf("graval: DirPolicy for %s can't be both ReadOnly and WriteOnly or Blind", policy.Dir)
+	}
+	if policy.Expire < 0 {
+		return fmt.Errorf("graval: DirPolicy for %s must not have a negative Expire", policy.Dir)
+	}
+	return nil
+}
+
+// dirPolicy returns the policy that applies to filePath, or nil.
+func (ftpServer *FTPServer) dirPolicy(filePath string) *DirPolicy {
+	var found *DirPolicy
+	for i := range ftpServer.dirPolicies {
+		policy := &ftpServer.dirPolicies[i]
+		if !inDir(policy.Dir, filePath) {
+			continue
+		}
+		if found == nil || len(policy.Dir) > len(found.Dir) {
+			found = policy
+		}
+	}
+	return found
+}
+
+// inDir reports whether filePath is dir or is beneath it.
+func inDir(dir string, filePath string) bool {
+	return dir == "/" || filePath == dir || strings.HasPrefix(filePath, dir+"/")
+}
+
+// blindDrop reports whether filePath is in a blind drop box, set up by a
+// DirPolicy or the driver.
+func (ftpConn *ftpConn) blindDrop(filePath string) bool {
+	if policy := ftpConn.server.dirPolicy(filePath); policy != nil && policy.Blind {
+		return true
+	}
+	var driver FTPBlindDropDriver
+	return DriverAs(ftpConn.driver, &driver) && driver.IsBlindDrop(filePath)
+}
+
+// hiddenDir reports whether the contents of dir are kept from clients, by a
+// WriteOnly DirPolicy or a blind drop box, so features like archives that
+// read whole trees can leave it out.
+func (ftpConn *ftpConn) hiddenDir(dir string) bool {
+	return !ftpConn.allowedByDirPolicy(dir, true, false) || ftpConn.blindDrop(dir)
+}
+
+// containsHiddenDir reports whether a DirPolicy or the driver hides a
+// directory beneath dir, which would be revealed by copying dir.
+func (ftpConn *ftpConn) containsHiddenDir(dir string) bool {
+	for _, policy := range ftpConn.server.dirPolicies {
+		if (policy.WriteOnly || policy.Blind) && inDir(dir, policy.Dir) {
+			return true
+		}
+	}
+	var driver FTPBlindDropDriver
+	if !DriverAs(ftpConn.driver, &driver) || !ftpConn.driver.ChangeDir(dir) {
+		return false
+	}
+	var walk func(dir string) bool
+	walk = func(dir string) bool {
+		if driver.IsBlindDrop(dir) {
+			return true
+		}
+		for _, file := range ftpConn.driver.DirContents(dir) {
+			if file.IsDir() && file.Mode()&os.ModeSymlink == 0 && walk(path.Join(dir, file.Name())) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(dir)
+}
+
+// allowedByDirPolicy reports whether a command may act on filePath. read
+// and write say whether the command reads or changes it.
+func (ftpConn *ftpConn) allowedByDirPolicy(filePath string, read bool, write bool) bool {
+	policy := ftpConn.server.dirPolicy(filePath)
+	if policy == nil {
+		return true
+	}
+	return !(read && (policy.WriteOnly || policy.Blind)) && !(write && policy.ReadOnly)
+}
+
+// allowedPath reports whether a command may act on filePath, given the
+// DirPolicies and any blind drop boxes the driver has. read and write say
+// whether the command reads or changes it.
+func (ftpConn *ftpConn) allowedPath(filePath string, read bool, write bool) bool {
+	return ftpConn.allowedByDirPolicy(filePath, read, write) && !(read && ftpConn.blindDrop(filePath))
+}
+
+// commandAllowedByDirPolicy checks a command and its parameter, after any
+// FilenamePolicy has been applied, against the DirPolicies.
+func (ftpConn *ftpConn) commandAllowedByDirPolicy(command string, param string) bool {
+	read, write := readCommands[command], writeCommands[command]
+	if !(read || write) {
+		return true
+	}
+	if len(ftpConn.server.dirPolicies) == 0 && !DriverAs(ftpConn.driver, new(FTPBlindDropDriver)) {
+		return true
+	}
+	if factCommands[command] {
+		params := strings.SplitN(param, " ", 2)
+		if len(params) < 2 {
+			return true
+		}
+		param = params[1]
+	} else if command == "LIST" || command == "NLST" || command == "STAT" {
+		if strings.HasPrefix(param, "-") {
+			param = ""
+		} else if command == "STAT" && param == "" {
+			// STAT on its own reports on the session, not a directory
+			return true
+		}
+	}
+	filePath := ftpConn.absPath(param)
+	if listCommands[command] && ftpConn.blindDrop(filePath) {
+		// the listing itself is emptied by dirContents
+		return true
+	}
+	return ftpConn.allowedPath(filePath, read, write)
+}
+
+// SweepExpiredFiles deletes the files in directories with a DirPolicy Expire
+// that haven't been modified for that long, and returns how many were
+// deleted. It's run in the background while the server is serving, but can
+// also be called directly.
+func (ftpServer *FTPServer) SweepExpiredFiles() int {
+	var driver FTPDriver
+	deleted := 0
+	for i := range ftpServer.dirPolicies {
+		policy := &ftpServer.dirPolicies[i]
+		if policy.Expire <= 0 {
+			continue
+		}
+		if driver == nil {
+			var err error
+			if driver, err = ftpServer.currentSettings().driverFactory.NewDriver(); err != nil {
+				ftpServer.logger.Printf("Unable to sweep expired files: %s", err)
+				return deleted
+			}
+		}
+		cutoff := ftpServer.clock.Now().Add(-policy.Expire)
+		var walk func(dir string)
+		walk = func(dir string) {
+			for _, file := range driver.DirContents(dir) {
+				filePath := path.Join(dir, file.Name())
+				if ftpServer.dirPolicy(filePath) != policy {
+					// a nested policy has its own expiry
+					continue
+				}
+				switch {
+				case file.Mode()&os.ModeSymlink != 0:
+				case file.IsDir():
+					walk(filePath)
+				case file.ModTime().Before(cutoff) && driver.DeleteFile(filePath):
+					ftpServer.logger.Printf("Deleted expired file %s", filePath)
+					deleted++
+				}
+			}
+		}
+		walk(policy.Dir)
+	}
+	return deleted
+}
@@ -0,0 +1,69 @@
+package graval
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errUnknownSizeResume = errors.New("can't resume a file of unknown size")
+
+// openDownload opens path for RETR, starting at the offset given by REST or
+// limited to the byte range given by RANG, as part of a DownloadGroup if the
+// driver implements FTPSegmentDriver. A virtual file, whose size is
+// SizeUnknown, can only be sent from the start, since its contents may be
+// different each time.
+func (ftpConn *ftpConn) openDownload(path string) (io.ReadCloser, error) {
+	offset := ftpConn.restOffset
+	length := int64(-1)
+	if ftpConn.rangeSet {
+		offset = ftpConn.rangeStart
+		length = ftpConn.rangeEnd - ftpConn.rangeStart + 1
+	}
+	var segmentDriver FTPSegmentDriver
+	var rangeDriver FTPRangeDriver
+	segmented := DriverAs(ftpConn.driver, &segmentDriver)
+	if ftpConn.rangeSet && !segmented && DriverAs(ftpConn.driver, &rangeDriver) {
+		return rangeDriver.ReadRange(path, offset, length)
+	}
+
+	if offset > 0 && ftpConn.driver.Bytes(path) == SizeUnknown {
+		return nil, errUnknownSizeResume
+	}
+	if segmented {
+		return ftpConn.openSegment(segmentDriver, path, offset, length)
+	}
+	reader, err := ftpConn.driver.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if err := skipTo(reader, offset); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	if length >= 0 {
+		return &limitedReadCloser{Reader: io.LimitReader(reader, length), closer: reader}, nil
+	}
+	return reader, nil
+}
+
+// skipTo moves reader forward to offset, seeking if possible.
+func skipTo(reader io.Reader, offset int64) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, reader, offset)
+	return err
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *limitedReadCloser) Close() error {
+	return r.closer.Close()
+}
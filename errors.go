@@ -0,0 +1,102 @@
+package graval
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Errors a driver can return, or wrap, to tell graval why a request failed.
+// Each one gets its own reply, so clients see more than "Action not taken".
+// Errors from the os package are recognised too, so drivers backed by a
+// filesystem can return them as they are.
+var (
+	ErrNotFound   = errors.New("no such file or directory")
+	ErrPermission = errors.New("permission denied")
+	ErrExists     = errors.New("file exists")
+	ErrNoSpace    = errors.New("insufficient storage space")
+	ErrNotDir     = errors.New("not a directory")
+
+	// The request may succeed if it's tried again later, for example
+	// because a backend is overloaded
+	ErrUnavailable = errors.New("temporarily unavailable")
+
+	// The backend is down or didn't answer in time, so the request was
+	// abandoned
+	ErrBackendDown = errors.New("backend unavailable")
+)
+
+// driverError returns which of the exported errors err is, following the
+// Unwrap method of wrapped errors, or nil if it's none of them.
+func driverError(err error) error {
+	for err != nil {
+		switch err {
+		case ErrNotFound, ErrPermission, ErrExists, ErrNoSpace, ErrNotDir, ErrUnavailable, ErrBackendDown:
+			return err
+		case syscall.ENOSPC:
+			return ErrNoSpace
+		case syscall.ENOTDIR:
+			return ErrNotDir
+		}
+		switch e := err.(type) {
+		case *os.PathError:
+			err = e.Err
+			continue
+		case *os.LinkError:
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		}
+		switch {
+		case os.IsNotExist(err):
+			return ErrNotFound
+		case os.IsPermission(err):
+			return ErrPermission
+		case os.IsExist(err):
+			return ErrExists
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+	return nil
+}
+
+// lastDriverError returns the reason the driver's most recent call failed, if
+// it's an FTPErrorDriver.
+func (ftpConn *ftpConn) lastDriverError() error {
+	var errorDriver FTPErrorDriver
+	if DriverAs(ftpConn.driver, &errorDriver) {
+		return errorDriver.LastError()
+	}
+	return nil
+}
+
+// writeDriverError replies to a command the driver couldn't carry out. If err
+// is one of the exported errors the message says which, otherwise it's
+// message. The code stays the command's usual one, so clients that only look
+// at codes see no change, except that running out of space is always 452,
+// temporary failures are always 450 and a backend that's down is always 451.
+func (ftpConn *ftpConn) writeDriverError(err error, code int, message string) {
+	switch driverError(err) {
+	case ErrNotFound:
+		message = "No such file or directory"
+	case ErrPermission:
+		message = "Permission denied"
+	case ErrExists:
+		message = "File exists"
+	case ErrNotDir:
+		message = "Not a directory"
+	case ErrNoSpace:
+		code, message = 452, "Insufficient storage space"
+	case ErrUnavailable:
+		code, message = 450, "Temporarily unavailable, try again later"
+	case ErrBackendDown:
+		code, message = 451, "Requested action aborted: backend unavailable"
+	}
+	ftpConn.writeMessage(code, message)
+}
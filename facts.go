@@ -0,0 +1,126 @@
+package graval
+
+import (
+	"strings"
+	"time"
+)
+
+// the layout of times in MDTM, MLSD and the MFxx commands, without the
+// optional fraction of a second
+const machineTimeLayout = "20060102150405"
+
+// the way fact names are written in FEAT and replies, by lower case name
+var factNames = map[string]string{
+	"create":     "Create",
+	"modify":     "Modify",
+	"unix.group": "UNIX.group",
+	"unix.mode":  "UNIX.mode",
+	"unix.owner": "UNIX.owner",
+}
+
+// ParseFactTime reads a time in the format used by MDTM, MLSD and the Modify
+// and Create facts: YYYYMMDDHHMMSS in UTC, with an optional fraction of a
+// second.
+func ParseFactTime(value string) (time.Time, error) {
+	layout := machineTimeLayout
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		layout += "." + strings.Repeat("0", len(value)-i-1)
+	}
+	return time.ParseInLocation(layout, value, time.UTC)
+}
+
+// factName returns how a fact is written in FEAT and replies.
+func factName(name string) string {
+	if canonical, ok := factNames[strings.ToLower(name)]; ok {
+		return canonical
+	}
+	return name
+}
+
+// factChange is a single fact to change, from MFMT, MFCT or MFF.
+type factChange struct {
+	name  string
+	value string
+}
+
+// parseFactChanges splits the parameter of MFF, like
+// "Modify=20190825130000;UNIX.mode=0644; file.txt", into the facts to change
+// and the path. It returns false if the parameter is malformed.
+func parseFactChanges(param string) ([]factChange, string, bool) {
+	parts := strings.SplitN(param, " ", 2)
+	if len(parts) != 2 || parts[1] == "" || !strings.HasSuffix(parts[0], ";") {
+		return nil, "", false
+	}
+	var changes []factChange
+	for _, pair := range strings.Split(strings.TrimSuffix(parts[0], ";"), ";") {
+		nameValue := strings.SplitN(pair, "=", 2)
+		if len(nameValue) != 2 || nameValue[0] == "" {
+			return nil, "", false
+		}
+		changes = append(changes, factChange{name: nameValue[0], value: nameValue[1]})
+	}
+	return changes, parts[1], true
+}
+
+// changeFacts asks the driver to change facts about the file at param, and
+// replies with the facts that were changed.
+func (ftpConn *ftpConn) changeFacts(param string, changes []factChange) {
+	var driver FTPFactsDriver
+	if !DriverAs(ftpConn.driver, &driver) {
+		ftpConn.writeMessage(502, "Command not implemented")
+		return
+	}
+	settable := map[string]bool{}
+	for _, name := range driver.SettableFacts() {
+		settable[strings.ToLower(name)] = true
+	}
+	facts := map[string]string{}
+	reply := ""
+	for _, change := range changes {
+		name := strings.ToLower(change.name)
+		if !settable[name] {
+			ftpConn.writeMessage(504, "Fact not supported: "+change.name)
+			return
+		}
+		if name == "modify" || name == "create" {
+			if _, err := ParseFactTime(change.value); err != nil {
+				ftpConn.writeMessage(501, "Invalid time: "+change.value)
+				return
+			}
+		}
+		facts[name] = change.value
+		reply += factName(name) + "=" + change.value + ";"
+	}
+	if err := driver.SetFacts(ftpConn.buildPath(param), facts); err != nil {
+		ftpConn.writeDriverError(err, 550, "Could not change facts")
+		return
+	}
+	ftpConn.writeMessage(213, reply+" "+param)
+}
+
+// settableFactsFeatures returns the FEAT lines for the facts the driver can
+// change.
+func settableFactsFeatures(driver FTPDriver) []string {
+	var factsDriver FTPFactsDriver
+	if !DriverAs(driver, &factsDriver) {
+		return nil
+	}
+	var lines []string
+	names := ""
+	settable := map[string]bool{}
+	for _, name := range factsDriver.SettableFacts() {
+		settable[strings.ToLower(name)] = true
+		names += factName(name) + ";"
+	}
+	if names == "" {
+		return nil
+	}
+	if settable["create"] {
+		lines = append(lines, " MFCT")
+	}
+	lines = append(lines, " MFF "+names)
+	if settable["modify"] {
+		lines = append(lines, " MFMT")
+	}
+	return lines
+}
@@ -0,0 +1,46 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestParseFactTime(t *testing.T) {
+	whole, wholeErr := ParseFactTime("20190825130000")
+	fraction, fractionErr := ParseFactTime("20190825130000.25")
+	_, badErr := ParseFactTime("2019-08-25")
+	Convey("Parsing fact times", t, func() {
+		Convey("Will read whole seconds in UTC", func() {
+			So(wholeErr, ShouldBeNil)
+			So(whole.Equal(time.Unix(1566738000, 0)), ShouldBeTrue)
+		})
+
+		Convey("Will read fractions of a second", func() {
+			So(fractionErr, ShouldBeNil)
+			So(fraction.Equal(time.Unix(1566738000, 250000000)), ShouldBeTrue)
+		})
+
+		Convey("Will reject other formats", func() {
+			So(badErr, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestParseFactChanges(t *testing.T) {
+	changes, path, ok := parseFactChanges("Modify=20190825130000;UNIX.mode=0644; my file.txt")
+	_, _, noPath := parseFactChanges("Modify=20190825130000;")
+	_, _, noValue := parseFactChanges("Modify; file.txt")
+	Convey("Parsing MFF parameters", t, func() {
+		Convey("Will split the facts from the path", func() {
+			So(ok, ShouldBeTrue)
+			So(path, ShouldEqual, "my file.txt")
+			So(changes, ShouldResemble, []factChange{{name: "Modify", value: "20190825130000"}, {name: "UNIX.mode", value: "0644"}})
+		})
+
+		Convey("Will reject malformed parameters", func() {
+			So(noPath, ShouldBeFalse)
+			So(noValue, ShouldBeFalse)
+		})
+	})
+}
@@ -3,52 +3,123 @@ package graval
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 )
 
 type ftpConn struct {
 	conn             net.Conn
+	rawReader        *bufio.Reader
 	controlReader    *bufio.Reader
 	controlWriter    *bufio.Writer
+	tlsConn          *tls.Conn
+	tlsLogin         bool
+	resumeReading    chan struct{}
 	dataConn         ftpDataSocket
 	driver           FTPDriver
 	logger           *ftpLogger
-	serverName       string
 	sessionId        string
+	connected        time.Time
 	namePrefix       string
 	reqUser          string
 	user             string
+	account          string
+	priority         int
 	renameFrom       string
+	copyFrom         string
 	minDataPort      int
 	maxDataPort      int
 	pasvAdvertisedIp string
+	server           *FTPServer
+	settings         *sessionSettings
+	cmdPath          string
+	cmdBytes         int64
+	cmdCode          int
+	transferType     string
+	transferMode     string
+	structure        string
+	sessionCtx       context.Context
+	values           *SessionValues
+	cmdCtx           context.Context
+	transcript       *transcriptWriter
+	tap              *wireTap
+	epsvAll          bool
+	restOffset       int64
+	hashAlgorithm    string
+	uploadHash       string
+	resumeCRC        string
+	rangeSet         bool
+	rangeStart       int64
+	rangeEnd         int64
+	lifecycle        FTPLifecycleDriver
+	listCursor       listCursor
+	security         *securityState
+
+	// guards the fields below, which are read by the goroutine reading
+	// commands while a transfer is in progress
+	mu         sync.Mutex
+	current    *transfer
+	lastLogin  *LoginRecord
+	busy       bool
+	lastActive time.Time
+	closing    string
+
+	// makes sure only one 421 reply is sent when the server ends the session
+	goodbye sync.Once
+
+	// serialises replies, since STAT can be answered during a transfer
+	replyMu    sync.Mutex
+	replySeq   replySequence
+	protection ProtectionLevel
 }
 
 // NewftpConn constructs a new object that will handle the FTP protocol over
 // an active net.TCPConn. The TCP connection should already be open before
 // it is handed to this functions. driver is an instance of FTPDriver that
-// will handle all auth and persistence details.
-func newftpConn(tcpConn net.Conn, driver FTPDriver, serverName string, minPort int, maxPort int, pasvAdvertisedIp string) *ftpConn {
+// will handle all auth and persistence details. server is the FTPServer that
+// accepted the connection and provides the configuration for this session.
+func newftpConn(tcpConn net.Conn, driver FTPDriver, server *FTPServer, settings *sessionSettings) *ftpConn {
 	c := new(ftpConn)
 	c.namePrefix = "/"
+	c.transferType = "A"
+	c.transferMode = "S"
+	c.structure = "F"
 	c.conn = tcpConn
-	c.controlReader = bufio.NewReader(tcpConn)
+	c.rawReader = bufio.NewReader(tcpConn)
+	c.controlReader = c.rawReader
+	c.resumeReading = make(chan struct{}, 1)
 	c.controlWriter = bufio.NewWriter(tcpConn)
 	c.driver = driver
 	c.sessionId = newSessionId()
-	c.logger = newFtpLogger(c.sessionId)
-	c.serverName = serverName
-	c.minDataPort = minPort
-	c.maxDataPort = maxPort
-	c.pasvAdvertisedIp = pasvAdvertisedIp
+	c.logger = newFtpLogger(c.sessionId, server.logger.out)
+	c.server = server
+	c.connected = server.clock.Now()
+	c.settings = settings
+	c.hashAlgorithm = defaultHashAlgorithm
+	c.minDataPort = server.pasvMinPort
+	c.maxDataPort = server.pasvMaxPort
+	c.pasvAdvertisedIp = server.pasvAdvertisedIp
+	var sessionDriver FTPSessionDriver
+	if DriverAs(driver, &sessionDriver) {
+		sessionDriver.SetSession(c.sessionId, c.remoteIP())
+	}
+	c.values = newSessionValues()
+	var valuesDriver FTPValuesDriver
+	if DriverAs(driver, &valuesDriver) {
+		valuesDriver.SetSessionValues(c.values)
+	}
 	return c
 }
 
@@ -72,54 +143,444 @@ func newSessionId() string {
 func (ftpConn *ftpConn) Serve() {
 	defer func() {
 		if r := recover(); r != nil {
-			ftpConn.logger.Printf("Recovered in ftpConn Serve: %s", r)
+			ftpConn.logger.Printf("Recovered in ftpConn Serve: %s\n%s", r, debug.Stack())
 		}
 
-		ftpConn.Close()
+		ftpConn.teardown()
+		ftpConn.announceAffinity(AffinityEnd, 0)
+		ftpConn.endSession()
+		ftpConn.server.sessionClosed(ftpConn)
 	}()
 
 	ftpConn.logger.Printf("Connection Established (local: %s, remote: %s)", ftpConn.localIP(), ftpConn.remoteIP())
+	ctx := context.WithValue(context.Background(), sessionValuesKey{}, ftpConn.values)
+	ctx = context.WithValue(ctx, sessionKey{}, &Session{conn: ftpConn})
+	ctx, span := ftpConn.server.tracer.Start(ctx, "ftp.session")
+	span.SetAttribute("ftp.session_id", ftpConn.sessionId)
+	span.SetAttribute("net.peer.ip", ftpConn.remoteIP())
+	defer span.End(nil)
+	ftpConn.sessionCtx = ctx
+	if ftpConn.server.transcriptDir != "" {
+		file, err := openSessionTranscript(ftpConn.server.transcriptDir, ftpConn.sessionId)
+		if err != nil {
+			ftpConn.logger.Printf("Unable to record transcript: %s", err)
+		} else {
+			defer file.Close()
+			ftpConn.transcript = newTranscriptWriter(file)
+		}
+	}
+	if ftpConn.server.wireTap != nil {
+		if writer := ftpConn.server.wireTap(ftpConn.sessionId, ftpConn.remoteIP()); writer != nil {
+			ftpConn.tap = &wireTap{writer: writer}
+			defer ftpConn.tap.close()
+		}
+	}
+	ftpConn.announceAffinity(AffinityConnect, 0)
+	if !ftpConn.startSession() {
+		return
+	}
 	// send welcome
-	ftpConn.writeMessage(220, ftpConn.serverName)
+	ftpConn.writeMessage(220, ftpConn.settings.welcomeMessage)
 	// read commands
-	for {
-		line, err := ftpConn.controlReader.ReadString('\n')
-		if err != nil {
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go ftpConn.readCommands(lines, done)
+	for line := range lines {
+		ftpConn.setBusy(true)
+		if message := ftpConn.closingMessage(); message != "" {
+			ftpConn.closeWithMessage(message)
+			break
+		}
+		if !ftpConn.throttle() {
+			ftpConn.logger.Printf("Command rate limit exceeded by %s", ftpConn.remoteIP())
+			ftpConn.writeMessage(421, "Too many commands, closing control connection")
+			ftpConn.securityEvent(SecurityRateLimited, "")
+			if ftpConn.server.banRateLimited {
+				ftpConn.server.ban(ftpConn.remoteIP(), ftpConn.server.banDuration, ftpConn)
+			}
+			break
+		}
+		if !ftpConn.runCommand(line) {
+			break
+		}
+		if pausesReading(line) {
+			ftpConn.resumeReading <- struct{}{}
+		}
+		ftpConn.setBusy(false)
+		if message := ftpConn.closingMessage(); message != "" {
+			ftpConn.closeWithMessage(message)
 			break
 		}
-		ftpConn.receiveLine(line)
 	}
 	ftpConn.logger.Print("Connection Terminated")
 }
 
+// runCommand runs a single command line. A panic in the command or the
+// driver is recovered and logged with its stack trace, and any transfer in
+// progress is aborted. It returns false if that happened and the session
+// should end.
+func (ftpConn *ftpConn) runCommand(line string) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ftpConn.logger.Printf("Recovered from panic: %s\n%s", r, debug.Stack())
+			if xfer := ftpConn.currentTransfer(); xfer != nil {
+				xfer.finish(fmt.Errorf("panic: %v", r))
+				ftpConn.writeMessage(451, "Requested action aborted: local error in processing")
+			}
+			ftpConn.writeMessage(421, "Service not available, closing control connection")
+			ok = false
+		}
+	}()
+	line, level, ok := ftpConn.unprotect(line)
+	if ok {
+		ftpConn.setProtection(level)
+		ftpConn.receiveLine(line)
+		ftpConn.setProtection(ProtectionClear)
+	}
+	ftpConn.endReplies()
+	return true
+}
+
+// readCommands reads lines from the control connection and passes them to the
+// command loop in Serve until the connection closes or times out. Clients may
+// pipeline several commands without waiting for replies; they're passed on one
+// at a time, in order, and each is answered before the next runs. The command
+// loop is busy for the whole of a file transfer, so a STAT that arrives during
+// a transfer is answered here instead. The idle timeout only counts time spent
+// waiting for the client, not time spent running commands.
+func (ftpConn *ftpConn) readCommands(lines chan<- string, done <-chan struct{}) {
+	defer close(lines)
+	defer func() {
+		if r := recover(); r != nil {
+			ftpConn.logger.Printf("Recovered in ftpConn readCommands: %s\n%s", r, debug.Stack())
+		}
+	}()
+	idleTimeout := ftpConn.settings.idleTimeout
+	clock := ftpConn.server.clock
+	ftpConn.mu.Lock()
+	ftpConn.lastActive = clock.Now()
+	ftpConn.mu.Unlock()
+	// the timeout is timed by the server's clock, which interrupts the read
+	// when it fires
+	var idleTimer ClockTimer
+	defer func() {
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+	}()
+	partial := ""
+	for {
+		if idleTimeout > 0 {
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+			ftpConn.conn.SetReadDeadline(time.Time{})
+			ftpConn.mu.Lock()
+			wait := ftpConn.lastActive.Add(idleTimeout).Sub(clock.Now())
+			ftpConn.mu.Unlock()
+			idleTimer = clock.AfterFunc(wait, func() {
+				ftpConn.conn.SetReadDeadline(time.Now())
+			})
+		}
+		chunk, err := ftpConn.controlReader.ReadSlice('\n')
+		// past the limit the rest of the line is dropped, and the line is
+		// refused once it ends
+		if len(partial) <= maxCommandLine {
+			partial += string(chunk)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && partial != "" {
+			// the client closed its side after a final command with no line
+			// ending; run it rather than losing it
+			ftpConn.tap.client(partial)
+			select {
+			case lines <- partial:
+			case <-done:
+			}
+			return
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				ftpConn.mu.Lock()
+				if ftpConn.busy {
+					ftpConn.lastActive = clock.Now()
+				}
+				idle := clock.Now().Sub(ftpConn.lastActive) >= idleTimeout
+				ftpConn.mu.Unlock()
+				if !idle {
+					continue
+				}
+				ftpConn.writeMessage(421, "Timeout, closing control connection")
+			}
+			return
+		}
+		line := partial
+		partial = ""
+		ftpConn.tap.client(line)
+
+		if xfer := ftpConn.currentTransfer(); xfer != nil {
+			if command, param := parseCommandLine(line); strings.ToUpper(command) == "STAT" && param == "" {
+				ftpConn.statDuringTransfer(xfer)
+				continue
+			}
+		}
+		select {
+		case lines <- line:
+		case <-done:
+			return
+		}
+		// the command may start or stop TLS, so nothing more can be read
+		// until it has run
+		if pausesReading(line) {
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+			select {
+			case <-ftpConn.resumeReading:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// statusLines builds the reply to STAT without a parameter. xfer is the
+// transfer in progress, if any.
+func (ftpConn *ftpConn) statusLines(xfer *transfer) []string {
+	transferType := "ASCII"
+	if ftpConn.transferType == "I" {
+		transferType = "BINARY"
+	}
+	lines := []string{
+		"211-" + ftpConn.settings.serverName + " status:",
+		" Connected to " + ftpConn.remoteIP(),
+		" Logged in as " + ftpConn.user,
+		" TYPE: " + transferType,
+		" STRU: " + structureNames[ftpConn.structure],
+		" MODE: " + modeNames[ftpConn.transferMode],
+	}
+	if xfer == nil {
+		lines = append(lines, " No data transfer in progress")
+	} else {
+		state := xfer.state()
+		lines = append(lines, fmt.Sprintf(" %s of %s in progress, %d bytes in %s",
+			strings.Title(state.Direction), state.Path, state.Bytes, ftpConn.server.clock.Now().Sub(state.Started).Round(time.Second)))
+	}
+	return append(lines, "211 End of status")
+}
+
+// statDuringTransfer answers a STAT received while xfer is running. The reply
+// isn't recorded as the reply to the command that started the transfer.
+func (ftpConn *ftpConn) statDuringTransfer(xfer *transfer) {
+	ftpConn.logger.PrintCommand("STAT", "")
+	ftpConn.replyMu.Lock()
+	defer ftpConn.replyMu.Unlock()
+	ftpConn.transcript.Command("STAT", "")
+	code, _, lines := ftpConn.filterReply("STAT", 211, "", ftpConn.statusLines(xfer))
+	ftpConn.sendLines(code, lines)
+}
+
+// setBusy records whether the command loop is running a command.
+func (ftpConn *ftpConn) setBusy(busy bool) {
+	ftpConn.mu.Lock()
+	ftpConn.busy = busy
+	ftpConn.lastActive = ftpConn.server.clock.Now()
+	ftpConn.mu.Unlock()
+}
+
 // Close will manually close this connection, even if the client isn't ready.
+// Closing the data socket too interrupts any transfer in progress. It's safe
+// to call more than once, and from any goroutine.
 func (ftpConn *ftpConn) Close() {
 	ftpConn.conn.Close()
+	ftpConn.mu.Lock()
 	if ftpConn.dataConn != nil {
 		ftpConn.dataConn.Close()
 	}
+	ftpConn.mu.Unlock()
+}
+
+// setDataConn closes the current data socket, if there is one, and replaces
+// it with socket. Only the goroutine running commands changes the data
+// socket, but Close may read it from another goroutine, hence the lock.
+func (ftpConn *ftpConn) setDataConn(socket ftpDataSocket) {
+	ftpConn.mu.Lock()
+	defer ftpConn.mu.Unlock()
+	if ftpConn.dataConn != nil {
+		ftpConn.dataConn.Close()
+	}
+	ftpConn.dataConn = socket
+}
+
+// teardown releases everything held by the session once Serve has finished
+// running commands, however the session ended: the control connection, any
+// passive listener or data connection, an unfinished transfer and the state
+// carried between commands. It's only called by Serve, so it runs exactly
+// once.
+func (ftpConn *ftpConn) teardown() {
+	ftpConn.setDataConn(nil)
+	if xfer := ftpConn.currentTransfer(); xfer != nil {
+		xfer.finish(errSessionClosed)
+	}
+	ftpConn.renameFrom = ""
+	ftpConn.copyFrom = ""
+	ftpConn.restOffset = 0
+	ftpConn.uploadHash = ""
+	ftpConn.resumeCRC = ""
+	ftpConn.rangeSet = false
+	ftpConn.listCursor = listCursor{}
+	// closed last, so a client sees the data sockets closed by the time the
+	// control connection is
+	ftpConn.conn.Close()
+}
+
+// shutdown ends the session from another goroutine when the server shuts
+// down, telling the client why.
+func (ftpConn *ftpConn) shutdown() {
+	ftpConn.closeWithMessage("Server shutting down, closing control connection")
+}
+
+// closeWithMessage sends a 421 reply and closes the session. Only the first
+// call has any effect, so a client is never told twice.
+func (ftpConn *ftpConn) closeWithMessage(message string) {
+	ftpConn.goodbye.Do(func() {
+		ftpConn.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		ftpConn.writeMessage(421, message)
+		ftpConn.Close()
+	})
 }
 
 // receiveLine accepts a single line FTP command and co-ordinates an
 // appropriate response.
 func (ftpConn *ftpConn) receiveLine(line string) {
-	command, param := ftpConn.parseLine(line)
+	command, param := parseCommandLine(line)
 	ftpConn.logger.PrintCommand(command, param)
-	cmdObj := commands[command]
+	ftpConn.transcript.Command(command, param)
+	ftpConn.commandReceived(command, param)
+	ftpConn.beginReplies(command)
+	defer ftpConn.commandFinished(command)
+	if len(line) > maxCommandLine {
+		ftpConn.writeMessage(500, "Command line too long")
+		return
+	}
+	if strings.ContainsRune(line, 0) {
+		ftpConn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	ftpConn.intercept(command, param)
+}
+
+// commandFinished clears the state that only carries over to the next
+// command, whether or not the line was accepted.
+func (ftpConn *ftpConn) commandFinished(command string) {
+	// a restart offset or byte range only applies to the command immediately
+	// after REST or RANG
+	if command != "REST" && command != "RANG" {
+		ftpConn.restOffset = 0
+		ftpConn.rangeSet = false
+	}
+	if !continuesListing[command] {
+		ftpConn.listCursor = listCursor{}
+	}
+}
+
+// dispatch checks a command may be run, then runs it.
+func (ftpConn *ftpConn) dispatch(command string, param string) {
+	cmdObj, write := ftpConn.server.command(command)
 	if cmdObj == nil {
 		ftpConn.writeMessage(500, "Command not found")
 		return
 	}
+	if ftpConn.breaksSequence(command, param) {
+		return
+	}
 	if cmdObj.RequireParam() && param == "" {
 		ftpConn.writeMessage(553, "action aborted, required param missing")
 	} else if cmdObj.RequireAuth() && ftpConn.user == "" {
 		ftpConn.writeMessage(530, "not logged in")
+	} else if write && ftpConn.server.ReadOnly() {
+		ftpConn.writeMessage(550, "Server is read-only")
+	} else if !ftpConn.applyFilenamePolicy(command, &param) {
+		ftpConn.writeMessage(553, "Filename not allowed")
+	} else if !ftpConn.commandAllowedByDirPolicy(command, param) {
+		ftpConn.writeMessage(550, "Permission denied")
 	} else {
+		ftpConn.cmdPath = ""
+		ftpConn.cmdBytes = 0
+		ctx, span := ftpConn.server.tracer.Start(ftpConn.sessionCtx, "ftp.command "+command)
+		ftpConn.cmdCtx = ctx
+		var traced FTPTracedDriver
+		if DriverAs(ftpConn.driver, &traced) {
+			traced.SetTraceContext(ctx)
+		}
 		cmdObj.Execute(ftpConn, param)
+		if ftpConn.user != "" {
+			span.SetAttribute("ftp.user", ftpConn.user)
+		}
+		if ftpConn.cmdPath != "" {
+			span.SetAttribute("ftp.path", ftpConn.cmdPath)
+		}
+		span.SetAttribute("ftp.reply_code", ftpConn.cmdCode)
+		span.End(replyError(ftpConn.cmdCode))
+		ftpConn.audit(command)
+	}
+}
+
+// applyFilenamePolicy cleans up the parameter of a command that takes a path,
+// or the path at the end of a command that sets facts, if the server has a
+// FilenamePolicy. It returns false if the path isn't
+// allowed.
+func (ftpConn *ftpConn) applyFilenamePolicy(command string, param *string) bool {
+	policy := ftpConn.server.filenamePolicy
+	if policy != nil && factCommands[command] {
+		// only the path after the time or facts is cleaned up
+		params := strings.SplitN(*param, " ", 2)
+		if len(params) < 2 {
+			return true
+		}
+		cleaned, ok := policy.Apply(params[1])
+		*param = params[0] + " " + cleaned
+		return ok
+	}
+	if policy == nil || !pathCommands[command] || *param == "" {
+		return true
+	}
+	if matched, _ := regexp.MatchString(listFlagsRegexp, *param); matched {
+		return true
+	}
+	cleaned, ok := policy.Apply(*param)
+	*param = cleaned
+	return ok
+}
+
+// audit sends a record of the command that was just executed to the audit log,
+// if one is configured. Only actions by authenticated users are recorded.
+func (ftpConn *ftpConn) audit(command string) {
+	if ftpConn.server.auditLog == nil || ftpConn.user == "" {
+		return
 	}
+	ftpConn.server.auditLog.Log(&AuditRecord{
+		Time:      ftpConn.server.clock.Now().UTC(),
+		SessionId: ftpConn.sessionId,
+		User:      ftpConn.user,
+		RemoteIP:  ftpConn.remoteIP(),
+		Verb:      command,
+		Path:      ftpConn.cmdPath,
+		Bytes:     ftpConn.cmdBytes,
+		Code:      ftpConn.cmdCode,
+	})
 }
 
-func (ftpConn *ftpConn) parseLine(line string) (string, string) {
+// the longest command line accepted, including the line ending. It's long
+// enough for any path a filesystem allows.
+const maxCommandLine = 8192
+
+// parseCommandLine splits a line from the client into the command and its
+// parameter.
+func parseCommandLine(line string) (string, string) {
 	params := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
 	if len(params) == 1 {
 		return params[0], ""
@@ -129,8 +590,15 @@ func (ftpConn *ftpConn) parseLine(line string) (string, string) {
 
 // writeMessage will send a standard FTP response back to the client.
 func (ftpConn *ftpConn) writeMessage(code int, message string) (wrote int, err error) {
+	ftpConn.replyMu.Lock()
+	defer ftpConn.replyMu.Unlock()
+	code, message, _ = ftpConn.filterReply(ftpConn.replySeq.command, code, message, nil)
+	ftpConn.checkReply(code)
+	ftpConn.cmdCode = code
 	ftpConn.logger.PrintResponse(code, message)
-	line := fmt.Sprintf("%d %s\r\n", code, message)
+	ftpConn.transcript.Reply(code, message)
+	line := ftpConn.protectReply(formatReply(code, message))
+	ftpConn.tap.server(line)
 	wrote, err = ftpConn.controlWriter.WriteString(line)
 	ftpConn.controlWriter.Flush()
 	return
@@ -138,13 +606,53 @@ func (ftpConn *ftpConn) writeMessage(code int, message string) (wrote int, err e
 
 // writeLines will send a multiline FTP response back to the client.
 func (ftpConn *ftpConn) writeLines(code int, lines ...string) (wrote int, err error) {
-	message := strings.Join(lines, "\r\n") + "\r\n"
+	ftpConn.replyMu.Lock()
+	defer ftpConn.replyMu.Unlock()
+	code, _, lines = ftpConn.filterReply(ftpConn.replySeq.command, code, "", lines)
+	ftpConn.checkReply(code)
+	ftpConn.cmdCode = code
+	return ftpConn.sendLines(code, lines)
+}
+
+// sendLines writes a multiline response without recording it as the reply to
+// the current command. The caller must hold replyMu.
+func (ftpConn *ftpConn) sendLines(code int, lines []string) (wrote int, err error) {
+	message := formatReplyLines(lines)
 	ftpConn.logger.PrintResponse(code, message)
+	ftpConn.transcript.ReplyLines(lines)
+	message = ftpConn.protectReply(message)
+	ftpConn.tap.server(message)
 	wrote, err = ftpConn.controlWriter.WriteString(message)
 	ftpConn.controlWriter.Flush()
 	return
 }
 
+// writeLoginReply sends the 230 reply to a successful PASS, including the
+// user's last login and any message from an FTPLoginMessageDriver.
+func (ftpConn *ftpConn) writeLoginReply() {
+	var message []string
+	ftpConn.mu.Lock()
+	lastLogin := ftpConn.lastLogin
+	ftpConn.mu.Unlock()
+	if lastLogin != nil {
+		message = append(message, "Last login: "+lastLogin.Time.Format(time.ANSIC)+" from "+lastLogin.RemoteIP)
+	}
+	var messageDriver FTPLoginMessageDriver
+	if DriverAs(ftpConn.driver, &messageDriver) {
+		message = append(message, messageDriver.LoginMessage(ftpConn.user)...)
+	}
+	if len(message) == 0 {
+		ftpConn.writeMessage(230, "Password ok, continue")
+		return
+	}
+	lines := make([]string, 0, len(message)+1)
+	for _, line := range message {
+		// a line break from the driver would end the reply early
+		lines = append(lines, "230-"+strings.NewReplacer("\r", " ", "\n", " ").Replace(line))
+	}
+	ftpConn.writeLines(230, append(lines, "230 Password ok, continue")...)
+}
+
 // buildPath takes a client supplied path or filename and generates a safe
 // absolute path within their account sandbox.
 //
@@ -162,7 +670,19 @@ func (ftpConn *ftpConn) writeLines(code int, lines ...string) (wrote int, err er
 // The driver implementation is responsible for deciding how to treat this path.
 // Obviously they MUST NOT just read the path off disk. The probably want to
 // prefix the path with something to scope the users access to a sandbox.
+//
+// The result is also remembered as the path the current command acts on, so
+// it can be included in the audit log.
 func (ftpConn *ftpConn) buildPath(filename string) (fullPath string) {
+	ftpConn.checkTraversal(filename)
+	fullPath = ftpConn.absPath(filename)
+	ftpConn.cmdPath = fullPath
+	return
+}
+
+// absPath turns a path from the client into an absolute path, relative to
+// the current directory.
+func (ftpConn *ftpConn) absPath(filename string) (fullPath string) {
 	if len(filename) > 0 && filename[0:1] == "/" {
 		fullPath = filepath.Clean(filename)
 	} else if len(filename) > 0 {
@@ -177,33 +697,117 @@ func (ftpConn *ftpConn) buildPath(filename string) (fullPath string) {
 // the server IP that is being used for this connection. May be the same for all connections,
 // or may vary if the server is listening on 0.0.0.0
 func (ftpConn *ftpConn) localIP() string {
-	lAddr := ftpConn.conn.LocalAddr().(*net.TCPAddr)
-	return lAddr.IP.String()
+	return addrIP(ftpConn.conn.LocalAddr())
 }
 
 // the client IP address
 func (ftpConn *ftpConn) remoteIP() string {
-	rAddr := ftpConn.conn.RemoteAddr().(*net.TCPAddr)
-	return rAddr.IP.String()
+	return addrIP(ftpConn.conn.RemoteAddr())
+}
+
+// addressFamily returns the RFC 2428 address family number of the control
+// connection: 1 for IPv4 and 2 for IPv6. IPv4 clients connected to an IPv6
+// socket are reported as IPv4.
+func (ftpConn *ftpConn) addressFamily() int {
+	ip := net.ParseIP(ftpConn.localIP())
+	if ip != nil && ip.To4() == nil {
+		return 2
+	}
+	return 1
+}
+
+// addrIP extracts the IP from a network address. Connections accepted from a
+// custom net.Listener may not be TCP, in which case the closest equivalent is
+// returned - the host part of a host:port address, or the whole address
+// otherwise.
+func addrIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
 
 // sendOutofbandData will copy data from reader to the client via the currently
-// open data socket. Assumes the socket is open and ready to be used.
-func (ftpConn *ftpConn) sendOutofbandReader(reader io.Reader) {
-	defer ftpConn.dataConn.Close()
+// open data socket. Assumes the socket is open and ready to be used. The error
+// from the copy is returned so callers can record the outcome of the transfer.
+func (ftpConn *ftpConn) sendOutofbandReader(reader io.Reader) error {
+	return ftpConn.sendOutofband(reader, ftpConn.completeMessage)
+}
 
-	_, err := io.Copy(ftpConn.dataConn, reader)
+// sendOutofband is sendOutofbandReader, with message giving the text of the
+// 226 reply once the data has been sent.
+func (ftpConn *ftpConn) sendOutofband(reader io.Reader, message func(xfer *transfer) string) error {
+	// a data connection carries a single transfer
+	defer ftpConn.setDataConn(nil)
+
+	tally := ftpConn.server.stats.addSent
+	xfer := ftpConn.currentTransfer()
+	if xfer != nil {
+		tally = xfer.tally
+		reader = xfer.pace(xfer.meter(reader))
+	}
+	source := &countingReader{reader: reader, tally: tally}
+	copied, err := io.Copy(ftpConn.dataConn, source)
+	ftpConn.cmdBytes += copied
 
 	if err != nil {
 		ftpConn.logger.Printf("sendOutofbandReader copy error %s", err)
-		ftpConn.writeMessage(550, "Action not taken")
-		return
+		ftpConn.writeTransferError(xfer, err, source.err != nil)
+		return err
 	}
 
-	ftpConn.writeMessage(226, "Transfer complete.")
+	ftpConn.writeMessage(226, message(xfer))
 
 	// Chrome dies on localhost if we close connection to soon
 	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+// writeTransferError sends the completion reply for a transfer that failed
+// after the 150 reply. local is true if the fault was reading or writing the
+// file, rather than the data connection. For a file transfer, xfer is the
+// transfer that failed, and the reply says how far it got and whether it can
+// be resumed.
+func (ftpConn *ftpConn) writeTransferError(xfer *transfer, err error, local bool) {
+	detail := ""
+	if xfer != nil {
+		detail = xfer.failureDetail(err)
+	}
+	switch {
+	case err == errTransferCapExceeded:
+		ftpConn.writeMessage(552, "Transfer cap exceeded")
+	case xfer != nil && xfer.tooSlow():
+		ftpConn.writeMessage(426, "Transfer aborted: below the minimum transfer rate"+detail)
+	case local:
+		ftpConn.writeMessage(451, "Requested action aborted: local error in processing"+detail)
+	case err == errDataSocketUnavailable:
+		ftpConn.writeMessage(425, "Can't open data connection")
+	case err == errDataProtection:
+		ftpConn.writeMessage(522, "Data connection cannot be opened with this PROT setting")
+	default:
+		ftpConn.writeMessage(426, "Connection closed; transfer aborted"+detail)
+	}
+}
+
+// requireDataConn checks there's a data connection for a transfer, replying
+// 425 if PASV or PORT hasn't been used to set one up. If the client chose
+// PROT P, the data connection is protected with TLS.
+func (ftpConn *ftpConn) requireDataConn() bool {
+	if ftpConn.dataConn == nil {
+		if !ftpConn.outOfSequence("PORT or PASV") {
+			ftpConn.writeMessage(425, "Use PORT or PASV first")
+		}
+		return false
+	}
+	if ftpConn.refusePlaintextData() {
+		return false
+	}
+	ftpConn.protectDataConn()
+	return true
 }
 
 // sendOutofbandData will send a string to the client via the currently open
@@ -212,31 +816,30 @@ func (ftpConn *ftpConn) sendOutofbandData(data string) {
 	ftpConn.sendOutofbandReader(bytes.NewReader([]byte(data)))
 }
 
+// newPassiveSocket opens a passive data socket for the next transfer. Clients
+// often send PASV before every transfer without using the previous socket, so
+// any existing data socket is closed first. That caps each session at a
+// single pending passive listener.
 func (ftpConn *ftpConn) newPassiveSocket() (socket *ftpPassiveSocket, err error) {
-	if ftpConn.dataConn != nil {
-		ftpConn.dataConn.Close()
-		ftpConn.dataConn = nil
-	}
+	ftpConn.setDataConn(nil)
 
-	socket, err = newPassiveSocket(ftpConn.localIP(), ftpConn.minDataPort, ftpConn.maxDataPort, ftpConn.logger)
+	socket, err = newPassiveSocket(ftpConn.localIP(), ftpConn.remoteIP(), ftpConn.minDataPort, ftpConn.maxDataPort, ftpConn.settings.dataConnTimeout, ftpConn.server.clock, ftpConn.server.rand, ftpConn.server.portAllocator, ftpConn.server.dataBufferSize, ftpConn.server.pasvPool, ftpConn.logger)
 
 	if err == nil {
-		ftpConn.dataConn = socket
+		ftpConn.setDataConn(socket)
+		ftpConn.announceAffinity(AffinityPassive, socket.Port())
 	}
 
 	return
 }
 
 func (ftpConn *ftpConn) newActiveSocket(host string, port int) (socket *ftpActiveSocket, err error) {
-	if ftpConn.dataConn != nil {
-		ftpConn.dataConn.Close()
-		ftpConn.dataConn = nil
-	}
+	ftpConn.setDataConn(nil)
 
-	socket, err = newActiveSocket(host, port, ftpConn.logger)
+	socket, err = newActiveSocket(host, port, ftpConn.server.dataBufferSize, ftpConn.logger)
 
 	if err == nil {
-		ftpConn.dataConn = socket
+		ftpConn.setDataConn(socket)
 	}
 
 	return
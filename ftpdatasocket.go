@@ -2,9 +2,9 @@ package graval
 
 import (
 	"errors"
-	"fmt"
-	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -32,7 +32,7 @@ type ftpActiveSocket struct {
 	logger *ftpLogger
 }
 
-func newActiveSocket(host string, port int, logger *ftpLogger) (*ftpActiveSocket, error) {
+func newActiveSocket(host string, port int, bufferSize int, logger *ftpLogger) (*ftpActiveSocket, error) {
 	connectTo := buildTcpString(host, port)
 	logger.Print("Opening active data connection to " + connectTo)
 	raddr, err := net.ResolveTCPAddr("tcp", connectTo)
@@ -45,6 +45,7 @@ func newActiveSocket(host string, port int, logger *ftpLogger) (*ftpActiveSocket
 		logger.Print(err)
 		return nil, err
 	}
+	tuneDataConn(tcpConn, bufferSize)
 	socket := new(ftpActiveSocket)
 	socket.conn = tcpConn
 	socket.host = host
@@ -74,26 +75,71 @@ func (socket *ftpActiveSocket) Close() error {
 }
 
 type ftpPassiveSocket struct {
+	listener *net.TCPListener
 	conn     *net.TCPConn
+	accepted chan struct{}
 	port     int
 	listenIP string
+	remoteIP string
+	timeout  time.Duration
+	clock    Clock
+	pool     *passivePool
 	logger   *ftpLogger
+
+	// where the listener's port came from, when it isn't pooled
+	allocator PortAllocator
+
+	// socket buffer size for the data connection, or 0 for the default
+	bufferSize int
+
+	// guards the listener once it may have gone back to the pool
+	mu       sync.Mutex
+	released bool
 }
 
-func newPassiveSocket(listenIP string, minPort int, maxPort int, logger *ftpLogger) (*ftpPassiveSocket, error) {
+// newPassiveSocket starts listening for a data connection from the client.
+// timeout is how long reads and writes will wait for the client to connect
+// before failing, as measured by clock. Ports are chosen using random.
+//
+// If pool is not nil, a listener is borrowed from it rather than opening a new
+// one, and returned afterwards. Since a pooled listener outlives a single
+// transfer, only connections from remoteIP are accepted on it, so a late
+// connection from a previous transfer can't be mistaken for this one.
+func newPassiveSocket(listenIP string, remoteIP string, minPort int, maxPort int, timeout time.Duration, clock Clock, random *lockedRand, allocator PortAllocator, bufferSize int, pool *passivePool, logger *ftpLogger) (*ftpPassiveSocket, error) {
 	socket := new(ftpPassiveSocket)
 	socket.logger = logger
+	socket.bufferSize = bufferSize
 	socket.listenIP = listenIP
-	go socket.ListenAndServe(minPort, maxPort)
-	for {
-		if socket.Port() > 0 {
-			break
+	socket.remoteIP = remoteIP
+	socket.timeout = timeout
+	socket.clock = clock
+	socket.allocator = allocator
+	var listener *net.TCPListener
+	var err error
+	if pool != nil {
+		listener, err = pool.get(listenIP)
+		if err == nil {
+			socket.pool = pool
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
+	if socket.pool == nil {
+		listener, err = listenInRange(listenIP, minPort, maxPort, random, allocator)
+	}
+	if err != nil {
+		logger.Print(err)
+		return nil, err
+	}
+	socket.listener = listener
+	socket.port = listener.Addr().(*net.TCPAddr).Port
+	socket.accepted = make(chan struct{})
+	go socket.acceptConnection()
 	return socket, nil
 }
 
+// errDataSocketUnavailable is returned by a passive socket the client never
+// connected to.
+var errDataSocketUnavailable = errors.New("data socket unavailable")
+
 func (socket *ftpPassiveSocket) Host() string {
 	return socket.listenIP
 }
@@ -104,64 +150,101 @@ func (socket *ftpPassiveSocket) Port() int {
 
 func (socket *ftpPassiveSocket) Read(p []byte) (n int, err error) {
 	if socket.waitForOpenSocket() == false {
-		return 0, errors.New("data socket unavailable")
+		return 0, errDataSocketUnavailable
 	}
 	return socket.conn.Read(p)
 }
 
 func (socket *ftpPassiveSocket) Write(p []byte) (n int, err error) {
 	if socket.waitForOpenSocket() == false {
-		return 0, errors.New("data socket unavailable")
+		return 0, errDataSocketUnavailable
 	}
 	return socket.conn.Write(p)
 }
 
+// Close stops listening, if the client hasn't connected yet, and closes the
+// data connection if it has.
 func (socket *ftpPassiveSocket) Close() error {
 	socket.logger.Print("closing passive data socket")
+	socket.mu.Lock()
+	if !socket.released {
+		if socket.pool != nil {
+			// interrupt a pending accept without closing the pooled listener
+			socket.listener.SetDeadline(time.Now())
+		} else {
+			socket.listener.Close()
+		}
+	}
+	socket.mu.Unlock()
+	<-socket.accepted
 	if socket.conn != nil {
 		return socket.conn.Close()
 	}
 	return nil
 }
 
-func (socket *ftpPassiveSocket) ListenAndServe(minPort int, maxPort int) {
-	listener, err := socket.netListenerInRange(minPort, maxPort)
-	if err != nil {
-		socket.logger.Print(err)
+// acceptConnection waits for a single connection from the client, then stops
+// listening. The accepted channel is closed once it's done, whether or not a
+// connection was made.
+func (socket *ftpPassiveSocket) acceptConnection() {
+	defer close(socket.accepted)
+	defer socket.releaseListener()
+	for {
+		tcpConn, err := socket.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		if socket.pool != nil && addrIP(tcpConn.RemoteAddr()) != socket.remoteIP {
+			socket.logger.Printf("rejecting data connection from unexpected address %s", tcpConn.RemoteAddr())
+			tcpConn.Close()
+			continue
+		}
+		tuneDataConn(tcpConn, socket.bufferSize)
+		socket.conn = tcpConn
 		return
 	}
-	defer listener.Close()
-	add := listener.Addr().(*net.TCPAddr)
-	socket.port = add.Port
-	tcpConn, err := listener.AcceptTCP()
-	if err != nil {
-		socket.logger.Print(err)
+}
+
+// releaseListener closes the listener, or returns it to the pool it was
+// borrowed from.
+func (socket *ftpPassiveSocket) releaseListener() {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+	socket.released = true
+	if socket.pool == nil {
+		closeListener(socket.listener, socket.allocator)
 		return
 	}
-	socket.conn = tcpConn
+	socket.listener.SetDeadline(time.Time{})
+	socket.pool.put(socket.listenIP, socket.listener)
 }
 
 func (socket *ftpPassiveSocket) waitForOpenSocket() bool {
-	retries := 0
-	for {
-		if socket.conn != nil {
-			break
-		}
-		if retries > 3 {
-			return false
-		}
-		socket.logger.Print("sleeping, socket isn't open")
-		sleepMs := time.Duration(500 * (retries + 1))
-		time.Sleep(sleepMs * time.Millisecond)
-		retries += 1
+	select {
+	case <-socket.accepted:
+		return socket.conn != nil
+	default:
+	}
+	socket.logger.Print("waiting for the client to open the data socket")
+	timedOut, timer := clockAfter(socket.clock, socket.timeout)
+	defer timer.Stop()
+	select {
+	case <-socket.accepted:
+		return socket.conn != nil
+	case <-timedOut:
+		return false
 	}
-	return true
 }
 
-func (socket *ftpPassiveSocket) netListenerInRange(min, max int) (*net.TCPListener, error) {
+// listenInRange opens a listener on host, using a random free port between min
+// and max, or a port from allocator if there is one.
+func listenInRange(host string, min, max int, random *lockedRand, allocator PortAllocator) (*net.TCPListener, error) {
+	if allocator != nil {
+		return listenAllocated(host, allocator)
+	}
 	for retries := 1; retries < 100; retries++ {
-		port := randomPort(min, max)
-		l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", socket.Host(), port))
+		port := randomPort(min, max, random)
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 		if err == nil {
 			return l.(*net.TCPListener), nil
 		}
@@ -169,10 +252,10 @@ func (socket *ftpPassiveSocket) netListenerInRange(min, max int) (*net.TCPListen
 	return nil, errors.New("Unable to find available port to listen on")
 }
 
-func randomPort(min, max int) int {
+func randomPort(min, max int, random *lockedRand) int {
 	if min == 0 && max == 0 {
 		return 0
 	} else {
-		return min + rand.Intn(max-min-1)
+		return min + random.intn(max-min+1)
 	}
 }
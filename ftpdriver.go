@@ -1,8 +1,10 @@
 package graval
 
 import (
+	"context"
 	"io"
 	"os"
+	"reflect"
 	"time"
 )
 
@@ -22,7 +24,8 @@ type FTPDriver interface {
 
 	// params  - a file path
 	// returns - an int with the number of bytes in the file or -1 if the file
-	//           doesn't exist
+	//           doesn't exist. SizeUnknown for a file whose contents are
+	//           generated when it's downloaded.
 	Bytes(string) int64
 
 	// params  - a file path
@@ -65,3 +68,279 @@ type FTPDriver interface {
 	// returns - true if the data was successfully persisted
 	PutFile(string, io.Reader) bool
 }
+
+// FTPResumableDriver is an optional interface for drivers that can resume an
+// interrupted upload. When it's implemented, REST STREAM is advertised in
+// FEAT and a STOR that follows REST is passed to PutFileAt with the offset
+// the client asked for, rather than replacing the whole file. Without it,
+// such a STOR is refused, though REST still works for downloads.
+type FTPResumableDriver interface {
+	// params  - destination path, the offset to start writing at, an
+	//           io.Reader containing the rest of the file data
+	// returns - true if the data was successfully persisted. The file should
+	//           end where the new data ends, and the call should fail if the
+	//           offset is beyond the end of the existing file.
+	PutFileAt(string, int64, io.Reader) bool
+}
+
+// FTPRangeDriver is an optional interface for drivers that can read part of a
+// file without reading everything before it, such as object stores with
+// ranged GETs. It's used for RETR after RANG. Without it, the start of the
+// file is read from GetFile and discarded.
+type FTPRangeDriver interface {
+	// params  - a file path, the offset of the first byte, the number of
+	//           bytes to read
+	// returns - a Reader that will return at most that many bytes of the
+	//           file, starting at the offset
+	ReadRange(string, int64, int64) (io.ReadCloser, error)
+}
+
+// FTPSegmentDriver is an optional interface for drivers that can serve
+// segmented downloads, where a client fetches ranges of one file over several
+// connections at once, more cheaply than by opening the file for each one.
+// It's used for every RETR in place of GetFile and ReadRange. The
+// DownloadGroup says which other downloads of the file the same user has
+// running, and can hold a handle they share.
+type FTPSegmentDriver interface {
+	// params  - a file path, the offset of the first byte, the number of
+	//           bytes to read or -1 for the rest of the file, and the group of
+	//           downloads this one belongs to
+	// returns - a Reader that will return at most that many bytes of the
+	//           file, starting at the offset
+	GetFileSegment(string, int64, int64, *DownloadGroup) (io.ReadCloser, error)
+}
+
+// FTPSpaceDriver is an optional interface for drivers that can report how
+// much space is left for uploads. When it's implemented, AVBL is advertised
+// in FEAT and SITE QUOTA includes the available space.
+type FTPSpaceDriver interface {
+	// params  - a directory path
+	// returns - the number of bytes that can still be written to the
+	//           directory, or an error if it can't be determined
+	AvailableSpace(string) (int64, error)
+}
+
+// FTPFactsDriver is an optional interface for drivers that can change a
+// file's metadata, for the MFMT, MFCT and MFF commands from
+// draft-somers-ftp-mfxx. Backup and sync clients use them to keep times and
+// permissions after uploading. The commands are advertised in FEAT for the
+// facts the driver can change.
+type FTPFactsDriver interface {
+	// returns - the names of the facts that can be changed, in lower case,
+	//           such as "modify", "create", "unix.mode", "unix.owner" or
+	//           "unix.group"
+	SettableFacts() []string
+
+	// params  - a path, the facts to change keyed by lower case name. The
+	//           values are as sent by the client; times have already been
+	//           checked and can be read with ParseFactTime.
+	// returns - an error if the facts couldn't all be changed
+	SetFacts(string, map[string]string) error
+}
+
+// FTPCopyDriver is an optional interface for drivers that can copy files
+// without reading them through graval, for SITE CPFR and SITE CPTO. Without
+// it, files are copied by reading them with GetFile and writing them with
+// PutFile.
+type FTPCopyDriver interface {
+	// params  - from_path, to_path
+	// returns - true if the file, or the directory and everything in it,
+	//           was copied
+	Copy(string, string) bool
+}
+
+// FTPBlindDropDriver is an optional interface for drivers that decide for
+// themselves which directories are blind drop boxes, for example from a
+// flag stored with each directory. It works alongside any DirPolicies.
+type FTPBlindDropDriver interface {
+	// params  - the path of a file or directory
+	// returns - true if it's in a directory that clients can upload to but
+	//           not see into: listings are empty and downloads are refused
+	IsBlindDrop(string) bool
+}
+
+// FTPDedupDriver is an optional interface for drivers that store files by
+// their content, like backup stores. A client can send the hash of a file
+// with SITE HASH before uploading it, and if the driver already has that
+// content, the STOR completes without the data being sent. Upload hooks and
+// interceptors don't run for such uploads, since there's no data to check.
+type FTPDedupDriver interface {
+	// params  - destination path, the hash algorithm chosen with OPTS HASH
+	//           (MD5, SHA-1, SHA-256 or SHA-512), the hash as lower case hex
+	// returns - true if the driver already had content with that hash and
+	//           has stored it at the destination path. false means the file
+	//           will be uploaded as usual.
+	StoreExisting(string, string, string) bool
+}
+
+// FTPLoginMessageDriver is an optional interface for drivers that have
+// something to tell users when they log in, like the quota they have left,
+// when they last logged in or a policy notice. The lines are sent as part of
+// the 230 reply to PASS.
+type FTPLoginMessageDriver interface {
+	// params  - the user who has just logged in
+	// returns - lines of text to add to the reply, without line endings.
+	//           Returning none sends the usual single line reply.
+	LoginMessage(string) []string
+}
+
+// FTPAccountDriver is an optional interface for drivers that restrict when
+// and where users may log in. Once a user has given the right password,
+// graval refuses the login with a 530 reply saying why if their account has
+// expired, or it's outside their allowed hours or networks.
+type FTPAccountDriver interface {
+	// params  - the user
+	// returns - the user's restrictions, or nil for none, and an error if
+	//           they can't be looked up, which refuses the login
+	Account(string) (*Account, error)
+}
+
+// FTPCreateModeDriver is an optional interface for drivers that can create
+// files and directories with given permissions, for users whose Account from
+// an FTPAccountDriver sets a FileMode, DirMode or Umask.
+type FTPCreateModeDriver interface {
+	// params  - the permissions for files created by PutFile and directories
+	//           created by MakeDir for the rest of the session. Files that
+	//           already exist keep their permissions.
+	SetCreateModes(os.FileMode, os.FileMode)
+}
+
+// FTPAliasDriver is an optional interface for drivers where several login
+// names share one account, like aliases of a user or the members of a guest
+// group. Limits, usage, priority, interrupted uploads, SITE RMDIR permission
+// and the home template follow the account, while logs, hooks, Sessions and
+// last logins report the name the user logged in with, so it's clear who did
+// what.
+type FTPAliasDriver interface {
+	// params  - the name the user has just logged in with
+	// returns - the account it belongs to, or an empty string if it's an
+	//           account of its own
+	AccountName(string) string
+}
+
+// FTPPasswordDriver is an optional interface for drivers that let users
+// change their own password, with SITE PSWD. graval checks the old password
+// with Authenticate and the new one against the server's PasswordPolicy
+// before calling it.
+type FTPPasswordDriver interface {
+	// params  - the user, their old password and their new password
+	// returns - an error if the password wasn't changed, like ErrPermission
+	//           for users who may not change it
+	ChangePassword(string, string, string) error
+}
+
+// FTPTreeDeleteDriver is an optional interface for drivers that can delete a
+// directory and everything in it in one go, for SITE RMDIR. Without it, the
+// tree is deleted one file and directory at a time.
+type FTPTreeDeleteDriver interface {
+	// params  - path
+	// returns - true if the directory and everything in it was deleted
+	DeleteTree(string) bool
+}
+
+// FTPErrorDriver is an optional interface for drivers that can say why a call
+// that returns a bool failed, so the client gets a reply that explains it.
+// Return ErrNotFound, ErrPermission, ErrExists, ErrNoSpace, ErrNotDir,
+// ErrUnavailable, ErrBackendDown, an error wrapping one of them or an error
+// from the os package. graval calls it straight after the call that failed.
+type FTPErrorDriver interface {
+	// returns - the reason the most recent call failed, or nil if it's not
+	//           known
+	LastError() error
+}
+
+// FTPSessionDriver is an optional interface for drivers that want to know
+// which session they serve, for example to include it in their own logs.
+type FTPSessionDriver interface {
+	// params  - the session ID, as used in graval's logs and Sessions, and
+	//           the client's IP address. It's called once, before the driver
+	//           is used.
+	SetSession(string, string)
+}
+
+// FTPValuesDriver is an optional interface for drivers that share values with
+// hooks and middleware during a session, like a tenant ID found when the user
+// logged in.
+type FTPValuesDriver interface {
+	// params  - the session's values. It's called once, before the driver is
+	//           used.
+	SetSessionValues(*SessionValues)
+}
+
+// FTPLifecycleDriver is an optional interface for drivers that hold backend
+// resources, like database connections or object store clients, for the
+// length of a session. Take them from a pool shared by the factory in
+// SessionStart and return them in SessionEnd, rather than connecting to the
+// backend for each command. The context carries the session's Session and
+// SessionValues.
+type FTPLifecycleDriver interface {
+	// params  - the session's context. It's called once, before the welcome
+	//           message is sent.
+	// returns - an error if the session can't be served, in which case the
+	//           client gets a 421 reply and is disconnected
+	SessionStart(context.Context) error
+
+	// params  - the session's context. It's called once the session has
+	//           ended and any transfer in progress has stopped, only if
+	//           SessionStart succeeded.
+	SessionEnd(context.Context)
+}
+
+// FTPPingDriver is an optional interface for checking that a backend is up,
+// which FTPServer.Health uses to report whether the server is ready for
+// clients. Implement it on the driver factory to check with a connection the
+// factory already holds. Implemented on the driver, a new driver is created
+// for each check, and started and ended with SessionStart and SessionEnd if
+// it's an FTPLifecycleDriver. A factory that may or may not be able to ping,
+// like one wrapping another, can implement FTPSupportDriver to say which.
+type FTPPingDriver interface {
+	// params  - a context that's cancelled if the check takes too long
+	// returns - an error if the backend can't serve requests
+	Ping(context.Context) error
+}
+
+// FTPDirIterDriver is an optional interface for drivers with directories too
+// large to return from DirContents all at once. LIST, NLST and MLSD send each
+// entry to the client as the driver finds it, so memory use doesn't grow
+// with the size of the directory. DirContents is still used elsewhere, for
+// example by SITE RMDIR.
+type FTPDirIterDriver interface {
+	// params  - path, and a function to call with each entry in turn. It
+	//           returns false when no more entries are wanted, after which
+	//           the driver should stop and return nil. graval may call the
+	//           driver's other methods from within it.
+	// returns - an error if the directory couldn't be listed
+	DirContentsIter(string, func(os.FileInfo) bool) error
+}
+
+// FTPSupportDriver is an optional interface for drivers that have the methods
+// of optional interfaces they can't always serve, like a driver that passes
+// calls on to another driver, which may or may not implement them. graval
+// asks it before using any optional interface the driver implements, and
+// leaves the interface's command out of FEAT when it isn't supported.
+type FTPSupportDriver interface {
+	// params  - a pointer to a variable of an optional interface type, like
+	//           *FTPSpaceDriver, as passed to DriverAs
+	// returns - true if the driver can serve the interface
+	Supports(interface{}) bool
+}
+
+// DriverAs reports whether driver can serve an optional interface, in the
+// way errors.As finds an error of a given type. target must be a non-nil
+// pointer to a variable of an optional interface type. If driver implements
+// the interface and, when it's an FTPSupportDriver, supports it, target is
+// set to driver and true is returned.
+func DriverAs(driver FTPDriver, target interface{}) bool {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Interface {
+		panic("graval: DriverAs target must be a non-nil pointer to an interface")
+	}
+	if driver == nil || !reflect.TypeOf(driver).Implements(value.Elem().Type()) {
+		return false
+	}
+	if support, ok := driver.(FTPSupportDriver); ok && !support.Supports(target) {
+		return false
+	}
+	value.Elem().Set(reflect.ValueOf(driver))
+	return true
+}
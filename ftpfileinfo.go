@@ -59,3 +59,125 @@ func NewFileItem(name string, bytes int64, modtime time.Time) os.FileInfo {
 	f.modtime = modtime
 	return f
 }
+
+// SizeUnknown is the size of a virtual file, whose contents are generated
+// each time it's downloaded, like a live status report or a database export.
+// Drivers return it from Bytes, and it's the Size of the os.FileInfo returned
+// by NewVirtualItem. Listings show such files with a size of 0, or no size at
+// all in MLSD, SIZE is refused, and so is resuming a download with REST.
+const SizeUnknown int64 = -2
+
+// isFileSize reports whether size, as returned by FTPDriver.Bytes, means
+// there's a file, including a virtual one.
+func isFileSize(size int64) bool {
+	return size >= 0 || size == SizeUnknown
+}
+
+// NewVirtualItem creates a new os.FileInfo that represents a virtual file,
+// with a size of SizeUnknown. Use this function to build the response to
+// DirContents() in your FTPDriver implementation.
+func NewVirtualItem(name string, modtime time.Time) os.FileInfo {
+	f := new(ftpFileInfo)
+	f.name = name
+	f.bytes = SizeUnknown
+	f.mode = 0444
+	f.modtime = modtime
+	return f
+}
+
+// FTPSymlinkInfo is an optional interface for the os.FileInfo values returned
+// by DirContents. Entries with os.ModeSymlink set that implement it are listed
+// with their targets, like "name -> target". NewSymlinkItem returns one.
+type FTPSymlinkInfo interface {
+	os.FileInfo
+
+	// returns - the path the link points to, as the client should see it,
+	//           either absolute or relative to the link's directory. Empty
+	//           if it's unknown.
+	SymlinkTarget() string
+}
+
+type ftpSymlinkInfo struct {
+	ftpFileInfo
+	target string
+}
+
+func (info *ftpSymlinkInfo) SymlinkTarget() string {
+	return info.target
+}
+
+// NewSymlinkItem creates a new os.FileInfo that represents a symlink to
+// target. Use this function to build the response to DirContents() in your
+// FTPDriver implementation.
+func NewSymlinkItem(name string, target string, modtime time.Time) os.FileInfo {
+	l := new(ftpSymlinkInfo)
+	l.name = name
+	l.bytes = int64(len(target))
+	l.mode = os.ModeSymlink | 0777
+	l.modtime = modtime
+	l.target = target
+	return l
+}
+
+// symlinkTarget returns the target of info if it's a symlink with a known
+// target.
+func symlinkTarget(info os.FileInfo) (string, bool) {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+	link, ok := info.(FTPSymlinkInfo)
+	if !ok || link.SymlinkTarget() == "" {
+		return "", false
+	}
+	return link.SymlinkTarget(), true
+}
+
+// FTPOwnerInfo is an optional interface for the os.FileInfo values returned
+// by DirContents, supplying the owner and group shown in listings. Entries
+// that don't implement it, or return empty strings, are shown with the
+// server's ListOwner and ListGroup. WithOwner adds them to any os.FileInfo.
+type FTPOwnerInfo interface {
+	os.FileInfo
+
+	// returns - the name of the user that owns the file
+	Owner() string
+
+	// returns - the name of the group that owns the file
+	Group() string
+}
+
+type ownedFileInfo struct {
+	os.FileInfo
+	owner string
+	group string
+}
+
+func (info *ownedFileInfo) Owner() string {
+	return info.owner
+}
+
+func (info *ownedFileInfo) Group() string {
+	return info.group
+}
+
+func (info *ownedFileInfo) SymlinkTarget() string {
+	if link, ok := info.FileInfo.(FTPSymlinkInfo); ok {
+		return link.SymlinkTarget()
+	}
+	return ""
+}
+
+// WithOwner returns a copy of info that reports the given owner and group.
+// Use this function to build the response to DirContents() in your FTPDriver
+// implementation.
+func WithOwner(info os.FileInfo, owner string, group string) os.FileInfo {
+	return &ownedFileInfo{FileInfo: info, owner: owner, group: group}
+}
+
+// fileOwner returns the owner and group supplied for info, if any.
+func fileOwner(info os.FileInfo) (string, string) {
+	if owned, ok := info.(FTPOwnerInfo); ok {
+		return owned.Owner(), owned.Group()
+	}
+	return "", ""
+}
@@ -58,3 +58,21 @@ func TestNewFileInfo(t *testing.T) {
 		})
 	})
 }
+
+func TestNewSymlinkInfo(t *testing.T) {
+	modTime := time.Unix(1566738000, 0) // 2019-08-25 13:00:00 UTC
+	linkInfo := NewSymlinkItem("link", "target.txt", modTime)
+	Convey("New Symlink Info", t, func() {
+		Convey("Will display the correct Mode", func() {
+			So(linkInfo.Mode(), ShouldEqual, os.ModeSymlink|0777)
+		})
+
+		Convey("Will display the target", func() {
+			So(linkInfo.(FTPSymlinkInfo).SymlinkTarget(), ShouldEqual, "target.txt")
+		})
+
+		Convey("Will not be a directory", func() {
+			So(linkInfo.IsDir(), ShouldBeFalse)
+		})
+	})
+}
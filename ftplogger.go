@@ -8,16 +8,28 @@ import (
 // Use an instance of this to log in a standard format
 type ftpLogger struct {
 	sessionId string
+	out       *log.Logger
 }
 
-func newFtpLogger(id string) *ftpLogger {
+// newFtpLogger returns a logger that prefixes every line with id. Lines are
+// written to out, or the standard logger if out is nil.
+func newFtpLogger(id string, out *log.Logger) *ftpLogger {
 	l := new(ftpLogger)
 	l.sessionId = id
+	l.out = out
 	return l
 }
 
+func (logger *ftpLogger) output(format string, v ...interface{}) {
+	if logger.out == nil {
+		log.Printf(format, v...)
+	} else {
+		logger.out.Printf(format, v...)
+	}
+}
+
 func (logger *ftpLogger) Print(message interface{}) {
-	log.Printf("%s   %s", logger.sessionId, message)
+	logger.output("%s   %s", logger.sessionId, message)
 }
 
 func (logger *ftpLogger) Printf(format string, v ...interface{}) {
@@ -25,13 +37,9 @@ func (logger *ftpLogger) Printf(format string, v ...interface{}) {
 }
 
 func (logger *ftpLogger) PrintCommand(command string, params string) {
-	if command == "PASS" {
-		log.Printf("%s > PASS ****", logger.sessionId)
-	} else {
-		log.Printf("%s > %s %s", logger.sessionId, command, params)
-	}
+	logger.output("%s > %s %s", logger.sessionId, command, redactParam(command, params))
 }
 
 func (logger *ftpLogger) PrintResponse(code int, message string) {
-	log.Printf("%s < %d %s", logger.sessionId, code, message)
+	logger.output("%s < %d %s", logger.sessionId, code, message)
 }
@@ -0,0 +1,243 @@
+package graval
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// how long a client has to complete a TLS handshake on the control
+// connection
+const tlsHandshakeTimeout = 30 * time.Second
+
+// errDataProtection is returned by a protected data socket whose TLS
+// handshake failed, including when the client offered less than the data
+// connection policy allows.
+var errDataProtection = errors.New("data connection TLS negotiation failed")
+
+// tlsMechanism reports whether name is an AUTH mechanism that negotiates TLS
+// on the control connection, as described in RFC 4217.
+func tlsMechanism(name string) bool {
+	return name == "TLS" || name == "SSL"
+}
+
+// pausesReading reports whether line is a command that may change what
+// protects the control connection, so the next line mustn't be read until
+// it has run.
+func pausesReading(line string) bool {
+	command, _ := parseCommandLine(line)
+	command = strings.ToUpper(command)
+	return command == "AUTH" || command == "CCC"
+}
+
+// recordConn feeds a TLS connection from a buffered reader one TLS record at
+// a time. Anything the client sent before the handshake started stays in the
+// reader, and nothing the client sends after the last record is read, so the
+// control connection can go back to the clear after CCC.
+type recordConn struct {
+	net.Conn
+	reader *bufio.Reader
+	left   int
+}
+
+func (conn *recordConn) Read(p []byte) (int, error) {
+	if conn.left == 0 {
+		header, err := conn.reader.Peek(5)
+		if err != nil {
+			return 0, err
+		}
+		conn.left = len(header) + int(binary.BigEndian.Uint16(header[3:5]))
+	}
+	if len(p) > conn.left {
+		p = p[:conn.left]
+	}
+	n, err := conn.reader.Read(p)
+	conn.left -= n
+	return n, err
+}
+
+// startTLS negotiates TLS on the control connection after a 234 reply to
+// AUTH TLS, and reads and writes the rest of the session through it. If the
+// handshake fails the session is closed.
+func (ftpConn *ftpConn) startTLS() bool {
+	tlsConn := tls.Server(&recordConn{Conn: ftpConn.conn, reader: ftpConn.rawReader}, ftpConn.settings.tlsConfig)
+	ftpConn.conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	ftpConn.conn.SetDeadline(time.Time{})
+	if err != nil {
+		ftpConn.logger.Printf("TLS handshake failed: %s", err)
+		ftpConn.securityEvent(SecurityTLSFailure, "control: "+err.Error())
+		ftpConn.Close()
+		return false
+	}
+	ftpConn.replyMu.Lock()
+	ftpConn.tlsConn = tlsConn
+	ftpConn.controlReader = bufio.NewReader(tlsConn)
+	ftpConn.controlWriter = bufio.NewWriter(tlsConn)
+	ftpConn.replyMu.Unlock()
+	ftpConn.logger.Printf("TLS negotiated, version %x", tlsConn.ConnectionState().Version)
+	return true
+}
+
+// stopTLS returns the control connection to the clear after a 200 reply to
+// CCC. Each end sends a TLS close_notify, and the rest of the session is read
+// and written in the clear on the same TCP connection. If the client doesn't
+// close its side of TLS the session is closed.
+func (ftpConn *ftpConn) stopTLS() bool {
+	ftpConn.conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := ftpConn.tlsConn.CloseWrite()
+	if err == nil {
+		// anything the client sent before its close_notify is dropped
+		_, err = io.Copy(ioutil.Discard, ftpConn.controlReader)
+	}
+	ftpConn.conn.SetDeadline(time.Time{})
+	if err != nil {
+		ftpConn.logger.Printf("Unable to clear the control connection: %s", err)
+		ftpConn.Close()
+		return false
+	}
+	ftpConn.replyMu.Lock()
+	ftpConn.tlsConn = nil
+	ftpConn.controlReader = ftpConn.rawReader
+	ftpConn.controlWriter = bufio.NewWriter(ftpConn.conn)
+	ftpConn.replyMu.Unlock()
+	ftpConn.logger.Print("Control connection cleared")
+	return true
+}
+
+// refusePlaintextLogin replies 550, and returns true, if the server requires
+// TLS for logins and the control connection isn't protected by it.
+func (ftpConn *ftpConn) refusePlaintextLogin() bool {
+	if !ftpConn.server.requireTLSLogin || ftpConn.tlsConn != nil {
+		return false
+	}
+	ftpConn.writeMessage(550, "Use AUTH TLS before logging in")
+	return true
+}
+
+// refusePlaintextData replies 521, closes the data socket and returns true,
+// if the server requires TLS for data connections and the client hasn't
+// chosen PROT P.
+func (ftpConn *ftpConn) refusePlaintextData() bool {
+	security := ftpConn.security
+	if !ftpConn.server.requireTLSData || (security != nil && security.dataPrivate) {
+		return false
+	}
+	ftpConn.setDataConn(nil)
+	ftpConn.writeMessage(521, "Data connections must be protected, use PROT P")
+	return true
+}
+
+// protectDataConn wraps the data socket in TLS if the client chose PROT P,
+// and it isn't already.
+func (ftpConn *ftpConn) protectDataConn() {
+	security := ftpConn.security
+	if security == nil || !security.dataPrivate {
+		return
+	}
+	ftpConn.mu.Lock()
+	defer ftpConn.mu.Unlock()
+	if _, ok := ftpConn.dataConn.(*ftpTLSSocket); !ok && ftpConn.dataConn != nil {
+		ftpConn.dataConn = newTLSSocket(ftpConn.dataConn, ftpConn.settings.dataTLS, security.clientMethod, ftpConn)
+	}
+}
+
+// ftpTLSSocket protects a data socket with TLS. The handshake happens when
+// the socket is first read or written, once the client has connected.
+type ftpTLSSocket struct {
+	ftpDataSocket
+	conn    *tls.Conn
+	session *ftpConn
+	failed  bool
+}
+
+// newTLSSocket protects socket with TLS. If clientMethod is true the server
+// is the TLS client, as chosen with SSCN ON. The other end is then another
+// server in a server to server transfer, known only by its address, so its
+// certificate is only verified if config names the server to expect.
+// Handshake failures are logged and reported for session.
+func newTLSSocket(socket ftpDataSocket, config *tls.Config, clientMethod bool, session *ftpConn) *ftpTLSSocket {
+	var conn *tls.Conn
+	if clientMethod {
+		config = config.Clone()
+		config.InsecureSkipVerify = config.ServerName == ""
+		conn = tls.Client(dataSocketConn{socket}, config)
+	} else {
+		conn = tls.Server(dataSocketConn{socket}, config)
+	}
+	return &ftpTLSSocket{
+		ftpDataSocket: socket,
+		conn:          conn,
+		session:       session,
+	}
+}
+
+func (socket *ftpTLSSocket) Read(p []byte) (n int, err error) {
+	if err := socket.handshake(); err != nil {
+		return 0, err
+	}
+	return socket.conn.Read(p)
+}
+
+func (socket *ftpTLSSocket) Write(p []byte) (n int, err error) {
+	if err := socket.handshake(); err != nil {
+		return 0, err
+	}
+	return socket.conn.Write(p)
+}
+
+// Close sends a TLS close_notify, if the handshake is complete, then closes
+// the data socket.
+func (socket *ftpTLSSocket) Close() error {
+	return socket.conn.Close()
+}
+
+// handshake negotiates TLS, or returns the error from an earlier attempt.
+// A failed handshake is reported as errDataProtection, unless the client
+// never connected at all, and sent to the security notifier once.
+func (socket *ftpTLSSocket) handshake() error {
+	if socket.failed {
+		return errDataProtection
+	}
+	err := socket.conn.Handshake()
+	if err == nil || err == errDataSocketUnavailable {
+		return err
+	}
+	socket.failed = true
+	socket.session.logger.Printf("Data connection TLS handshake failed: %s", err)
+	socket.session.securityEvent(SecurityTLSFailure, "data: "+err.Error())
+	return errDataProtection
+}
+
+// dataSocketConn lets a data socket be used as the net.Conn under a TLS
+// connection. Data sockets have their own timeouts, so deadlines are
+// ignored.
+type dataSocketConn struct {
+	ftpDataSocket
+}
+
+func (conn dataSocketConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (conn dataSocketConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(conn.Host()), Port: conn.Port()}
+}
+
+func (conn dataSocketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn dataSocketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn dataSocketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
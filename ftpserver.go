@@ -9,9 +9,18 @@
 package graval
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
 	"net"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // serverOpts contains parameters for graval.NewFTPServer()
@@ -19,6 +28,10 @@ type FTPServerOpts struct {
 	// Server name will be used for welcome message
 	ServerName string
 
+	// The message sent to clients when they first connect. Optional, defaults
+	// to the ServerName.
+	WelcomeMessage string
+
 	// The factory that will be used to create a new FTPDriver instance for
 	// each client connection. This is a mandatory option.
 	Factory FTPDriverFactory
@@ -31,6 +44,16 @@ type FTPServerOpts struct {
 	// a production environment you will probably want to change this to 21.
 	Port int
 
+	// A list of "host:port" addresses to listen on simultaneously, for
+	// example to serve both IPv4 and IPv6 or several network interfaces from
+	// the same server. Optional, when set Hostname and Port are ignored.
+	ListenAddrs []string
+
+	// The maximum number of clients that can be connected at once, across all
+	// listening addresses. Additional clients receive a 421 reply and are
+	// disconnected. Defaults to 0, which means unlimited.
+	MaxConnections int
+
 	// The lower bound of port numbers that can be used for passive-mode data sockets
 	// Defaults to 0, which allows the server to pick any free port
 	PasvMinPort int
@@ -44,6 +67,372 @@ type FTPServerOpts struct {
 	// the FTP server is behind a NAT gateway or load balancer and the public IP used by
 	// clients is different to the IP the server is directly listening on
 	PasvAdvertisedIp string
+
+	// The number of passive-mode listeners to keep open and reuse for each
+	// local IP, rather than binding and closing a socket for every PASV. This
+	// reduces TIME_WAIT churn on servers doing many short transfers. When all
+	// pooled listeners are busy, a one-off listener is used as normal.
+	// Defaults to 0, which disables pooling.
+	PasvListenerPoolSize int
+
+	// Chooses the ports for passive data connections, so servers sharing a
+	// public IP don't hand out the same ones. PasvMinPort and PasvMaxPort
+	// are ignored when it's set. Optional, see FilePortAllocator.
+	PortAllocator PortAllocator
+
+	// How long a client can leave the control connection idle between
+	// commands before it's disconnected. Defaults to 0, which never
+	// disconnects idle clients.
+	IdleTimeout time.Duration
+
+	// How long to wait for a client to connect to a passive data socket
+	// before giving up on the transfer. Defaults to 5 seconds.
+	DataConnTimeout time.Duration
+
+	// How often to send TCP keepalive probes on control connections, so
+	// sessions that sit idle through a NAT gateway aren't dropped silently.
+	// Defaults to 0, which leaves the operating system's setting alone. A
+	// negative value turns keepalives off.
+	KeepAlivePeriod time.Duration
+
+	// The size in bytes of the socket send and receive buffers for data
+	// connections. Larger buffers help fast transfers over long distances.
+	// Defaults to 0, which leaves the operating system's setting alone.
+	// Nagle's algorithm is always disabled on data connections.
+	DataConnBufferSize int
+
+	// The destination for debug logging. Optional, defaults to the standard
+	// logger from the log package.
+	Logger *log.Logger
+
+	// An optional destination for audit records. When set, every action taken
+	// by an authenticated client is recorded along with the user, path, bytes
+	// transferred and the result code. This is separate from the debug logging
+	// and is intended for deployments with compliance requirements.
+	AuditLog AuditLogger
+
+	// An optional destination for a transfer log in the xferlog format used by
+	// wu-ftpd and vsftpd. A line is written for every upload and download, so
+	// existing log analysis tools can continue to be used.
+	XferLog io.Writer
+
+	// An optional Tracer that will receive a span for each session, command
+	// and data transfer.
+	Tracer Tracer
+
+	// An optional directory to record a transcript of the control channel for
+	// every session, one file per session named after the session ID.
+	// Passwords are redacted. Transcripts can be replayed with gravaltest to
+	// reproduce problems reported with particular clients.
+	TranscriptDir string
+
+	// Chooses where to mirror each session's control channel, byte for
+	// byte, for debugging. Optional.
+	WireTap WireTap
+
+	// An optional policy for cleaning up the paths sent by clients, for
+	// example to strip control characters or refuse names that Windows can't
+	// store. It applies to every command that takes a path.
+	FilenamePolicy *FilenamePolicy
+
+	// What new passwords must be like for users to set them with SITE PSWD,
+	// when the driver implements FTPPasswordDriver. Optional, defaults to
+	// passwords of at least 8 characters.
+	PasswordPolicy *PasswordPolicy
+
+	// How symlinks reported by the driver are shown in directory listings.
+	// Defaults to ListSymlinks.
+	Symlinks SymlinkMode
+
+	// What STOR does when the file it names already exists. Defaults to
+	// OverwriteExisting.
+	UploadCollisions CollisionPolicy
+
+	// The directory existing files are moved into when UploadCollisions is
+	// VersionExisting, like "/.versions". Mandatory for VersionExisting.
+	UploadArchiveDir string
+
+	// The owner and group shown in LIST for files whose driver doesn't
+	// supply them. Optional, default to "owner" and "group".
+	ListOwner string
+	ListGroup string
+
+	// The time zone LIST shows modification times in. Optional, defaults to
+	// UTC. MDTM and MLSD always use UTC, as RFC 3659 requires.
+	ListLocation *time.Location
+
+	// When true, MDTM, MLSD and MLST include milliseconds in modification
+	// times, like 20190825130000.123, for clients that sync by timestamp.
+	SubsecondTimes bool
+
+	// The most entries, and the most bytes of entries, sent for a single
+	// LIST, NLST or MLSD, so a huge directory can't tie up the server or an
+	// object-store backend. A truncated listing is reported in the 226 reply,
+	// and for MLSD, sending MLSD for the same directory again continues where
+	// it stopped, which relies on the driver listing the directory in the same
+	// order each time. Default to 0, which means unlimited.
+	MaxListEntries int
+	MaxListBytes   int64
+
+	// The most file transfers that can run at once across all sessions, so a
+	// burst of downloads can't exhaust file descriptors or backend
+	// connections. Further RETR and STOR commands get a 450 reply asking the
+	// client to try again. Defaults to 0, which means unlimited.
+	MaxTransfers int
+
+	// The number of the MaxTransfers slots kept for users with a priority
+	// above zero, so they can still transfer files when the server is busy.
+	ReservedTransfers int
+
+	// The most bytes per second to send and receive across all transfers.
+	// Transfers share it in proportion to their user's priority plus one.
+	// Defaults to 0, which means unlimited.
+	MaxBandwidth int64
+
+	// The slowest a transfer may go, in bytes per second, before it's
+	// aborted with a 426 reply, so stalled clients can't hold on to
+	// transfer slots. Set it well below MaxBandwidth's share of a busy
+	// server. Defaults to 0, which means no minimum.
+	MinTransferRate int64
+
+	// How long a transfer may stay below MinTransferRate before it's
+	// aborted. Defaults to 30 seconds.
+	MinTransferRatePeriod time.Duration
+
+	// An optional function returning the priority class of a user, which
+	// decides their share of MaxBandwidth and whether they can use the
+	// ReservedTransfers slots. Higher numbers are more important. Users
+	// default to 0, as do negative priorities.
+	UserPriority func(user string) int
+
+	// The most commands per second accepted from each client IP, and from
+	// each user once logged in, to slow down clients scraping listings or
+	// guessing passwords. Clients that go over the rate are slowed down, and
+	// those that get more than CommandBurst commands ahead of it are sent a
+	// 421 reply and disconnected. Defaults to 0, which means unlimited.
+	CommandRateLimit float64
+
+	// The number of commands a client can send in a quick burst before
+	// CommandRateLimit applies. Defaults to 10.
+	CommandBurst int
+
+	// How long to wait before replying to a failed login, which slows down
+	// password guessing. Defaults to 0, which means no delay.
+	AuthFailureDelay time.Duration
+
+	// When set, the wait after a failed login doubles with each failure from
+	// the same IP in the last 15 minutes, up to this limit, tying up clients
+	// that keep guessing. Ignored unless AuthFailureDelay is set.
+	AuthTarpitMax time.Duration
+
+	// Ban a client IP after this many failed logins in 15 minutes. Defaults
+	// to 0, which means never.
+	BanAfterFailedLogins int
+
+	// When true, ban client IPs that are disconnected for going over
+	// CommandRateLimit.
+	BanRateLimited bool
+
+	// How long automatic bans last. Defaults to an hour. Bans can also be
+	// managed with FTPServer.Ban and FTPServer.Unban.
+	BanDuration time.Duration
+
+	// An optional destination for security events like failed logins and
+	// path traversal attempts, for forwarding to an IDS or SIEM.
+	SecurityNotifier SecurityNotifier
+
+	// The largest file, in bytes, that can be uploaded. An upload that goes
+	// over the limit is aborted with a 552 reply and the partial file is
+	// deleted. Defaults to 0, which means unlimited.
+	MaxUploadSize int64
+
+	// An optional function returning the largest upload allowed for a
+	// particular user, overriding MaxUploadSize. Return 0 to fall back to
+	// MaxUploadSize, or -1 for no limit.
+	UserMaxUploadSize func(user string) int64
+
+	// An optional function reporting whether a user may delete a directory
+	// and everything in it with SITE RMDIR. It's refused for everyone if
+	// this isn't set, so it's best kept to administrative users.
+	UserRecursiveDelete func(user string) bool
+
+	// An optional function returning the most bytes a user may upload and
+	// download in total, as counted by FTPServer.Usage. Once they reach it,
+	// new transfers are refused and any in progress are cut off with a 552
+	// reply, until FTPServer.ResetUsage is called. Return 0 for no cap.
+	UserTransferCap func(user string) int64
+
+	// When true, uploading a file into a directory that doesn't exist creates
+	// the directory and any missing parents first, like mkdir -p. Many
+	// cameras and other devices expect this.
+	CreateUploadDirs bool
+
+	// When true, uploads are written to a temporary name and only renamed to
+	// the name the client asked for once the whole file has been received and
+	// any UploadHooks have approved it, so other clients never see a partial
+	// file. An existing file with the same name is replaced at that point.
+	AtomicUploads bool
+
+	// The suffix added to the temporary name of an upload when AtomicUploads
+	// is enabled, unless the driver implements FTPTempUploadDriver. Defaults
+	// to ".in-progress".
+	UploadTempSuffix string
+
+	// A file to keep a record of atomic uploads in, so that an upload
+	// interrupted by a lost connection or a server restart keeps its
+	// temporary file, and the client can resume it with REST and STOR.
+	// Optional, interrupted uploads are deleted if it's empty. Ignored unless
+	// AtomicUploads is in effect. UploadInterceptors only see the data sent
+	// after a resume.
+	UploadStateFile string
+
+	// How long the temporary file of an interrupted upload is kept for when
+	// UploadStateFile is set. Stale files are deleted the next time their
+	// user logs in. Defaults to 24 hours.
+	UploadStateExpiry time.Duration
+
+	// When set, a janitor deletes the temporary files of uploads that
+	// haven't been written to for this long, so clients that disconnect
+	// part way through an upload don't fill up the disk. It checks twice in
+	// each period while the server is serving. Drivers can list the files
+	// themselves by implementing FTPPartialUploadDriver, otherwise it only
+	// finds the files of AtomicUploads. Defaults to 0, which means never.
+	PartialUploadMaxAge time.Duration
+
+	// Called whenever a file transfer fails part way through, with how much
+	// was moved and whether the client can resume it. Optional.
+	TransferFailureHook TransferFailureHook
+
+	// Called whenever a file transfer finishes successfully, with how long
+	// it took and how fast it went. Optional.
+	TransferCompleteHook TransferCompleteHook
+
+	// When true, the 226 reply to a file transfer says how much was moved
+	// and how fast, like "Transfer complete. 10.4 MB in 2.1 s, 4.95 MB/s".
+	TransferStatsInReplies bool
+
+	// Called with every command a client sends, before it's run. Optional.
+	CommandHook CommandHook
+
+	// Names this server among others behind a balancer or proxy, in the
+	// SessionAffinity passed to AffinityHook. Optional.
+	InstanceName string
+
+	// Called as sessions start, log in, open passive listeners and end, so a
+	// balancer or proxy can send each session's data connections to this
+	// server. Optional.
+	AffinityHook AffinityHook
+
+	// Called with every reply before it's sent, and can change it. Optional.
+	ReplyFilter ReplyFilter
+
+	// When true, the server gives away as little as it can about what
+	// software it is, for operators who don't want scanners to identify it.
+	// The default ServerName is "FTP server" rather than one naming graval,
+	// FEAT lists only the features most servers have and SITE HELP doesn't
+	// list the SITE commands. SYST always gives the reply most servers do,
+	// so it's unchanged.
+	Stealth bool
+
+	// Security mechanisms clients can choose with AUTH, keyed by the name
+	// they give it, like "GSSAPI". Once a mechanism's security data exchange
+	// is complete, clients can protect commands with MIC, CONF and ENC, and
+	// the replies to them are protected in turn, as described in RFC 2228.
+	// These mechanisms don't protect data connections, so only PROT C is
+	// accepted with them. Optional.
+	SecurityMechanisms map[string]SecurityMechanism
+
+	// When set, clients can protect the control connection with TLS using
+	// AUTH TLS, and their data connections with PROT P, as described in RFC
+	// 4217. The configuration needs a certificate. Optional.
+	TLSConfig *tls.Config
+
+	// The TLS configuration for data connections protected with PROT P, so
+	// they can be held to a different policy than the control connection,
+	// like a higher MinVersion, fewer CipherSuites or particular NextProtos
+	// for ALPN. A transfer whose handshake falls short of the policy is
+	// refused with a 522 reply. If it has no certificate, the ones in
+	// TLSConfig are used. Optional, defaults to TLSConfig.
+	DataTLSConfig *tls.Config
+
+	// Allows server to server transfers, known as FXP: PORT and EPRT to an
+	// address other than the client's own, and SSCN ON, which makes the
+	// server the TLS client on protected data connections. Without it such
+	// PORT and EPRT commands are refused, as RFC 2577 recommends against FTP
+	// bounce attacks, though they're still reported as security events.
+	// Optional, defaults to false.
+	AllowFXP bool
+
+	// When true, clients that logged in over TLS can use CCC to return the
+	// control connection to the clear, so NAT devices can see the addresses
+	// in PORT and PASV. Data connections keep their PROT level. Optional.
+	AllowCCC bool
+
+	// When true, USER and PASS are refused with a 550 reply until the
+	// client has protected the control connection with AUTH TLS, so
+	// credentials are never sent in the clear. Optional.
+	RequireTLSLogin bool
+
+	// When true, transfers and listings are refused with a 521 reply unless
+	// the client has chosen PROT P, so no file contents cross in the clear.
+	// Optional.
+	RequireTLSData bool
+
+	// Where to keep each user's last login, which is reported when they log
+	// in again and by Sessions. Optional, see NewLoginStore.
+	LoginStore LoginStore
+
+	// Directories and files to create in each user's tree when they first
+	// log in. Optional.
+	HomeTemplate *HomeTemplate
+
+	// Restrictions on what clients may do in particular directories, like
+	// a write-only drop box for uploads. Optional.
+	DirPolicies []DirPolicy
+
+	// When true, downloading a directory's name followed by .zip, .tar or
+	// .tar.gz, when there's no file by that name, downloads an archive of the
+	// directory and everything in it, assembled as it's sent. This lets
+	// users of plain FTP clients fetch whole folders. Archives can't be
+	// resumed, and symlinks are left out of them.
+	ArchiveDownloads bool
+
+	// Functions to run, in order, on every completed upload before it's
+	// committed. Any of them can reject the upload. Setting hooks implies
+	// AtomicUploads.
+	UploadHooks []UploadHook
+
+	// Decides whether each upload may be committed, based on the type of
+	// file detected from its first bytes. Setting a policy implies
+	// AtomicUploads.
+	ContentTypePolicy ContentTypePolicy
+
+	// Interceptors that every upload streams through, in order, on its way to
+	// the driver. Each can transform or inspect the data and veto the upload
+	// once it's complete, which makes them suitable for virus scanning
+	// without changes to the driver. Setting interceptors implies
+	// AtomicUploads.
+	UploadInterceptors []UploadInterceptor
+
+	// Interceptors that every command passes through, in order, before it's
+	// run. Each can refuse the command, change its parameter or act on its
+	// reply, which makes them suitable for custom authorisation and
+	// auditing without changes to graval's commands.
+	CommandInterceptors []CommandInterceptor
+
+	// Where the server gets the time from and how it runs idle and data
+	// connection timeouts. Optional, defaults to the system clock. Tests can
+	// set a fake one, like gravaltest.FakeClock, so timeouts happen without
+	// waiting for them.
+	Clock Clock
+
+	// The source of randomness for choosing passive ports. Optional, set it
+	// to make tests repeatable.
+	Rand *rand.Rand
+
+	// How strictly clients are held to the command sequences in RFC 959.
+	// Defaults to Lenient.
+	Compliance Compliance
 }
 
 // FTPServer is the root of your FTP application. You should instantiate one
@@ -51,13 +440,86 @@ type FTPServerOpts struct {
 //
 // Always use the NewFTPServer() method to create a new FTPServer.
 type FTPServer struct {
-	serverName       string
-	listenTo         string
-	driverFactory    FTPDriverFactory
+	listenAddrs      []string
 	logger           *ftpLogger
 	pasvMinPort      int
 	pasvMaxPort      int
 	pasvAdvertisedIp string
+	pasvPool         *passivePool
+	portAllocator    PortAllocator
+	keepAlive        time.Duration
+	dataBufferSize   int
+	optsErr          error
+	auditLog         AuditLogger
+	xferLog          *xferLogger
+	tracer           Tracer
+	transcriptDir    string
+	wireTap          WireTap
+	clock            Clock
+	rand             *lockedRand
+	filenamePolicy   *FilenamePolicy
+	passwordPolicy   *PasswordPolicy
+	symlinks         SymlinkMode
+	collisions       CollisionPolicy
+	archiveDir       string
+	compliance       Compliance
+	listOwner        string
+	listGroup        string
+	listLocation     *time.Location
+	subsecondTimes   bool
+	maxListEntries   int
+	maxListBytes     int64
+	createUploadDirs bool
+	transferSlots    *transferSlots
+	bandwidth        *bandwidthShare
+	minRate          int64
+	minRatePeriod    time.Duration
+	cmdLimiter       *rateLimiter
+	loginFailures    *loginFailures
+	bans             *banList
+	notifier         SecurityNotifier
+	banAfterFails    int
+	banRateLimited   bool
+	banDuration      time.Duration
+	atomicUploads    bool
+	uploadTempSuffix string
+	uploadState      *uploadState
+	downloads        *downloadGroups
+	partialMaxAge    time.Duration
+	janitorStop      chan struct{}
+	dirPolicies      []DirPolicy
+	homeTemplate     *HomeTemplate
+	loginStore       LoginStore
+	failureHook      TransferFailureHook
+	completeHook     TransferCompleteHook
+	statsInReplies   bool
+	commandHook      CommandHook
+	instanceName     string
+	affinityHook     AffinityHook
+	replyFilter      ReplyFilter
+	stealth          bool
+	mechanisms       map[string]SecurityMechanism
+	tlsConfig        *tls.Config
+	allowFXP         bool
+	allowCCC         bool
+	requireTLSLogin  bool
+	requireTLSData   bool
+	archives         bool
+	uploadHooks      []UploadHook
+	cmdInterceptors  []CommandInterceptor
+	uploadIntercepts []UploadInterceptor
+	typePolicy       ContentTypePolicy
+	settings         *sessionSettings
+	readOnly         int32
+	stats            serverStats
+	usage            usageCounters
+	mu               sync.Mutex
+	listeners        []net.Listener
+	sessions         map[*ftpConn]struct{}
+	sessionsDone     sync.WaitGroup
+	maintenance      *maintenance
+	closed           bool
+	custom           customCommands
 }
 
 // serverOptsWithDefaults copies an FTPServerOpts struct into a new struct,
@@ -65,36 +527,204 @@ type FTPServer struct {
 func serverOptsWithDefaults(opts *FTPServerOpts) *FTPServerOpts {
 	var newOpts FTPServerOpts
 
-	if opts == nil {
-		opts = &FTPServerOpts{}
+	if opts != nil {
+		newOpts = *opts
 	}
 
-	if opts.ServerName == "" {
+	if newOpts.ServerName == "" && newOpts.Stealth {
+		newOpts.ServerName = "FTP server"
+	} else if newOpts.ServerName == "" {
 		newOpts.ServerName = "Go FTP Server"
-	} else {
-		newOpts.ServerName = opts.ServerName
 	}
 
-	if opts.Hostname == "" {
+	if newOpts.WelcomeMessage == "" {
+		newOpts.WelcomeMessage = newOpts.ServerName
+	}
+
+	if newOpts.ListOwner == "" {
+		newOpts.ListOwner = "owner"
+	}
+
+	if newOpts.ListGroup == "" {
+		newOpts.ListGroup = "group"
+	}
+
+	if newOpts.ListLocation == nil {
+		newOpts.ListLocation = time.UTC
+	}
+
+	if newOpts.Hostname == "" {
 		newOpts.Hostname = "::"
-	} else {
-		newOpts.Hostname = opts.Hostname
 	}
 
-	if opts.Port == 0 {
+	if newOpts.Port == 0 {
 		newOpts.Port = 3000
-	} else {
-		newOpts.Port = opts.Port
 	}
 
-	newOpts.PasvMinPort = opts.PasvMinPort
-	newOpts.PasvMaxPort = opts.PasvMaxPort
-	newOpts.PasvAdvertisedIp = opts.PasvAdvertisedIp
-	newOpts.Factory = opts.Factory
+	if newOpts.DataConnTimeout == 0 {
+		newOpts.DataConnTimeout = 5 * time.Second
+	}
+
+	if newOpts.MinTransferRatePeriod == 0 {
+		newOpts.MinTransferRatePeriod = 30 * time.Second
+	}
+
+	if newOpts.CommandBurst == 0 {
+		newOpts.CommandBurst = 10
+	}
+
+	if newOpts.BanDuration == 0 {
+		newOpts.BanDuration = time.Hour
+	}
+
+	if newOpts.UploadTempSuffix == "" {
+		newOpts.UploadTempSuffix = defaultUploadTempSuffix
+	}
+
+	if newOpts.UploadStateExpiry == 0 {
+		newOpts.UploadStateExpiry = 24 * time.Hour
+	}
 
 	return &newOpts
 }
 
+// Validate checks the options for mistakes, after applying the defaults for
+// anything that's missing. The same checks are made by ListenAndServe, so
+// calling this is only necessary to catch errors earlier.
+func (opts *FTPServerOpts) Validate() error {
+	opts = serverOptsWithDefaults(opts)
+
+	if opts.Factory == nil {
+		return errors.New("graval: Factory is required")
+	}
+	if opts.Port < 1 || opts.Port > 65535 {
+		return fmt.Errorf("graval: Port %d is out of range", opts.Port)
+	}
+	for _, addr := range opts.ListenAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("graval: ListenAddrs entry %q is not a host:port address", addr)
+		}
+	}
+	if opts.MaxConnections < 0 {
+		return errors.New("graval: MaxConnections must not be negative")
+	}
+	if opts.PasvMinPort != 0 || opts.PasvMaxPort != 0 {
+		if opts.PasvMinPort < 1 || opts.PasvMaxPort > 65535 {
+			return fmt.Errorf("graval: passive port range %d-%d is out of range", opts.PasvMinPort, opts.PasvMaxPort)
+		}
+		if opts.PasvMinPort > opts.PasvMaxPort {
+			return fmt.Errorf("graval: PasvMinPort %d is greater than PasvMaxPort %d", opts.PasvMinPort, opts.PasvMaxPort)
+		}
+	}
+	if opts.PasvAdvertisedIp != "" {
+		ip := net.ParseIP(opts.PasvAdvertisedIp)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("graval: PasvAdvertisedIp %q is not an IPv4 address", opts.PasvAdvertisedIp)
+		}
+	}
+	for name, mechanism := range opts.SecurityMechanisms {
+		if name == "" || name != strings.ToUpper(name) || strings.ContainsAny(name, " \r\n") {
+			return fmt.Errorf("graval: SecurityMechanisms name %q must be upper case with no spaces", name)
+		}
+		if mechanism == nil {
+			return fmt.Errorf("graval: SecurityMechanisms entry %q is nil", name)
+		}
+		if tlsMechanism(name) && opts.TLSConfig != nil {
+			return fmt.Errorf("graval: SecurityMechanisms entry %q conflicts with TLSConfig", name)
+		}
+	}
+	if (opts.DataTLSConfig != nil || opts.AllowCCC || opts.RequireTLSLogin || opts.RequireTLSData) && opts.TLSConfig == nil {
+		return errors.New("graval: DataTLSConfig, AllowCCC, RequireTLSLogin and RequireTLSData need TLSConfig")
+	}
+	if policy := opts.PasswordPolicy; policy != nil && (policy.MinLength < 0 || policy.MinCharClasses < 0 || policy.MinCharClasses > 4) {
+		return errors.New("graval: PasswordPolicy MinLength must not be negative and MinCharClasses must be 0 to 4")
+	}
+	if opts.PasvListenerPoolSize < 0 {
+		return errors.New("graval: PasvListenerPoolSize must not be negative")
+	}
+	if opts.IdleTimeout < 0 {
+		return errors.New("graval: IdleTimeout must not be negative")
+	}
+	if opts.DataConnTimeout < 0 {
+		return errors.New("graval: DataConnTimeout must not be negative")
+	}
+	if opts.Symlinks < ListSymlinks || opts.Symlinks > HideSymlinks {
+		return fmt.Errorf("graval: Symlinks %d is not a SymlinkMode", opts.Symlinks)
+	}
+	if opts.UploadCollisions < OverwriteExisting || opts.UploadCollisions > VersionExisting {
+		return fmt.Errorf("graval: UploadCollisions %d is not a CollisionPolicy", opts.UploadCollisions)
+	}
+	if opts.UploadCollisions == VersionExisting && !strings.HasPrefix(opts.UploadArchiveDir, "/") {
+		return errors.New("graval: UploadArchiveDir must be an absolute path for VersionExisting")
+	}
+	if opts.Compliance < Lenient || opts.Compliance > Strict {
+		return fmt.Errorf("graval: Compliance %d is not a Compliance", opts.Compliance)
+	}
+	if strings.ContainsAny(opts.ListOwner, " \t") || strings.ContainsAny(opts.ListGroup, " \t") {
+		return errors.New("graval: ListOwner and ListGroup must not contain spaces")
+	}
+	if opts.MaxListEntries < 0 || opts.MaxListBytes < 0 {
+		return errors.New("graval: MaxListEntries and MaxListBytes must not be negative")
+	}
+	if opts.MinTransferRate < 0 || opts.MinTransferRatePeriod < 0 {
+		return errors.New("graval: MinTransferRate and MinTransferRatePeriod must not be negative")
+	}
+	if opts.MaxTransfers < 0 {
+		return errors.New("graval: MaxTransfers must not be negative")
+	}
+	if opts.ReservedTransfers < 0 || (opts.ReservedTransfers > 0 && opts.ReservedTransfers >= opts.MaxTransfers) {
+		return errors.New("graval: ReservedTransfers must be less than MaxTransfers")
+	}
+	if opts.MaxBandwidth < 0 {
+		return errors.New("graval: MaxBandwidth must not be negative")
+	}
+	if opts.CommandRateLimit < 0 {
+		return errors.New("graval: CommandRateLimit must not be negative")
+	}
+	if opts.CommandBurst < 0 {
+		return errors.New("graval: CommandBurst must not be negative")
+	}
+	if opts.AuthFailureDelay < 0 {
+		return errors.New("graval: AuthFailureDelay must not be negative")
+	}
+	if opts.AuthTarpitMax < 0 {
+		return errors.New("graval: AuthTarpitMax must not be negative")
+	}
+	if opts.BanAfterFailedLogins < 0 {
+		return errors.New("graval: BanAfterFailedLogins must not be negative")
+	}
+	if opts.BanDuration < 0 {
+		return errors.New("graval: BanDuration must not be negative")
+	}
+	if opts.DataConnBufferSize < 0 {
+		return errors.New("graval: DataConnBufferSize must not be negative")
+	}
+	if opts.MaxUploadSize < 0 {
+		return errors.New("graval: MaxUploadSize must not be negative")
+	}
+	if strings.Contains(opts.UploadTempSuffix, "/") {
+		return errors.New("graval: UploadTempSuffix must not contain a slash")
+	}
+	if opts.UploadStateExpiry < 0 {
+		return errors.New("graval: UploadStateExpiry must not be negative")
+	}
+	if opts.PartialUploadMaxAge < 0 {
+		return errors.New("graval: PartialUploadMaxAge must not be negative")
+	}
+	dirs := map[string]bool{}
+	for i := range opts.DirPolicies {
+		policy := &opts.DirPolicies[i]
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		if dirs[path.Clean(policy.Dir)] {
+			return fmt.Errorf("graval: more than one DirPolicy for %s", policy.Dir)
+		}
+		dirs[path.Clean(policy.Dir)] = true
+	}
+	return nil
+}
+
 // NewFTPServer initialises a new FTP server. Configuration options are provided
 // via an instance of FTPServerOpts. Calling this function in your code will
 // probably look something like this:
@@ -113,15 +743,108 @@ func serverOptsWithDefaults(opts *FTPServerOpts) *FTPServerOpts {
 //     server  := graval.NewFTPServer(opts)
 //
 func NewFTPServer(opts *FTPServerOpts) *FTPServer {
-	opts = serverOptsWithDefaults(opts)
 	s := new(FTPServer)
-	s.listenTo = buildTcpString(opts.Hostname, opts.Port)
-	s.serverName = opts.ServerName
-	s.driverFactory = opts.Factory
-	s.logger = newFtpLogger("")
+	s.optsErr = opts.Validate()
+	s.sessions = map[*ftpConn]struct{}{}
+	opts = serverOptsWithDefaults(opts)
+	if len(opts.ListenAddrs) > 0 {
+		s.listenAddrs = opts.ListenAddrs
+	} else {
+		s.listenAddrs = []string{buildTcpString(opts.Hostname, opts.Port)}
+	}
+	s.settings = newSessionSettings(opts)
+	s.logger = newFtpLogger("", opts.Logger)
 	s.pasvMinPort = opts.PasvMinPort
+	s.portAllocator = opts.PortAllocator
 	s.pasvMaxPort = opts.PasvMaxPort
 	s.pasvAdvertisedIp = opts.PasvAdvertisedIp
+	if opts.Clock != nil {
+		s.clock = opts.Clock
+	} else {
+		s.clock = systemClock{}
+	}
+	s.rand = &lockedRand{rand: opts.Rand}
+	if opts.PasvListenerPoolSize > 0 {
+		s.pasvPool = newPassivePool(opts.PasvMinPort, opts.PasvMaxPort, opts.PasvListenerPoolSize, s.rand, opts.PortAllocator)
+	}
+	s.keepAlive = opts.KeepAlivePeriod
+	s.dataBufferSize = opts.DataConnBufferSize
+	s.auditLog = opts.AuditLog
+	if opts.XferLog != nil {
+		s.xferLog = newXferLogger(opts.XferLog)
+	}
+	s.transcriptDir = opts.TranscriptDir
+	s.wireTap = opts.WireTap
+	s.filenamePolicy = opts.FilenamePolicy
+	s.passwordPolicy = opts.PasswordPolicy
+	s.symlinks = opts.Symlinks
+	s.collisions = opts.UploadCollisions
+	s.archiveDir = opts.UploadArchiveDir
+	s.compliance = opts.Compliance
+	s.listOwner = opts.ListOwner
+	s.listGroup = opts.ListGroup
+	s.listLocation = opts.ListLocation
+	s.subsecondTimes = opts.SubsecondTimes
+	s.maxListEntries = opts.MaxListEntries
+	s.maxListBytes = opts.MaxListBytes
+	s.createUploadDirs = opts.CreateUploadDirs
+	if opts.MaxTransfers > 0 {
+		s.transferSlots = &transferSlots{max: opts.MaxTransfers, reserved: opts.ReservedTransfers}
+	}
+	s.bandwidth = &bandwidthShare{rate: float64(opts.MaxBandwidth)}
+	s.minRate = opts.MinTransferRate
+	s.minRatePeriod = opts.MinTransferRatePeriod
+	if opts.CommandRateLimit > 0 {
+		s.cmdLimiter = newRateLimiter(opts.CommandRateLimit, opts.CommandBurst, s.clock)
+	}
+	s.loginFailures = newLoginFailures(s.clock)
+	s.downloads = newDownloadGroups()
+	s.bans = newBanList(s.clock)
+	s.stats.clock = s.clock
+	s.notifier = opts.SecurityNotifier
+	s.banAfterFails = opts.BanAfterFailedLogins
+	s.banRateLimited = opts.BanRateLimited
+	s.banDuration = opts.BanDuration
+	s.atomicUploads = opts.AtomicUploads || len(opts.UploadHooks) > 0 || len(opts.UploadInterceptors) > 0 || opts.ContentTypePolicy != nil
+	s.uploadTempSuffix = opts.UploadTempSuffix
+	if s.atomicUploads && opts.UploadStateFile != "" {
+		state, err := loadUploadState(opts.UploadStateFile, opts.UploadStateExpiry, s.clock)
+		if err != nil && s.optsErr == nil {
+			s.optsErr = fmt.Errorf("graval: reading UploadStateFile: %s", err)
+		}
+		s.uploadState = state
+	}
+	s.partialMaxAge = opts.PartialUploadMaxAge
+	s.homeTemplate = opts.HomeTemplate
+	s.loginStore = opts.LoginStore
+	s.failureHook = opts.TransferFailureHook
+	s.completeHook = opts.TransferCompleteHook
+	s.statsInReplies = opts.TransferStatsInReplies
+	s.commandHook = opts.CommandHook
+	s.instanceName = opts.InstanceName
+	s.affinityHook = opts.AffinityHook
+	s.replyFilter = opts.ReplyFilter
+	s.stealth = opts.Stealth
+	s.mechanisms = opts.SecurityMechanisms
+	s.tlsConfig = opts.TLSConfig
+	s.allowFXP = opts.AllowFXP
+	s.allowCCC = opts.AllowCCC
+	s.requireTLSLogin = opts.RequireTLSLogin
+	s.requireTLSData = opts.RequireTLSData
+	for _, policy := range opts.DirPolicies {
+		policy.Dir = path.Clean(policy.Dir)
+		s.dirPolicies = append(s.dirPolicies, policy)
+	}
+	s.archives = opts.ArchiveDownloads
+	s.uploadHooks = opts.UploadHooks
+	s.uploadIntercepts = opts.UploadInterceptors
+	s.cmdInterceptors = opts.CommandInterceptors
+	s.typePolicy = opts.ContentTypePolicy
+	if opts.Tracer != nil {
+		s.tracer = opts.Tracer
+	} else {
+		s.tracer = noopTracer{}
+	}
 	return s
 }
 
@@ -130,37 +853,208 @@ func NewFTPServer(opts *FTPServerOpts) *FTPServer {
 // function.
 //
 // If the server fails to start for any reason, an error will be returned. Common
-// errors are trying to bind to a privileged port or something else is already
-// listening on the same port.
+// errors are invalid options, trying to bind to a privileged port or something
+// else is already listening on the same port.
 //
 func (ftpServer *FTPServer) ListenAndServe() error {
-	laddr, err := net.ResolveTCPAddr("tcp", ftpServer.listenTo)
-	if err != nil {
-		return err
+	if ftpServer.optsErr != nil {
+		return ftpServer.optsErr
+	}
+	var listeners []net.Listener
+	for _, addr := range ftpServer.listenAddrs {
+		listener, err := listenTCP(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 1 {
+		return ftpServer.Serve(listeners[0])
 	}
-	listener, err := net.ListenTCP("tcp", laddr)
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- ftpServer.Serve(listener)
+		}(listener)
+	}
+	var firstErr error
+	for range listeners {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func listenTCP(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return net.ListenTCP("tcp", laddr)
+}
+
+// Serve accepts client connections from an existing listener, which allows
+// the server to be used with transports other than a TCP socket it creates
+// itself - systemd socket activation, Unix sockets in tests, or a listener
+// wrapped with custom accept logic. The Hostname and Port options are ignored.
+//
+// Passive data sockets are opened on the local IP of each control
+// connection, so clients that connect over a transport without IP addresses
+// must use active mode or set PasvAdvertisedIp.
+//
+// Serve always closes the listener before returning.
+func (ftpServer *FTPServer) Serve(listener net.Listener) error {
+	if ftpServer.optsErr != nil {
+		listener.Close()
+		return ftpServer.optsErr
+	}
+	ftpServer.mu.Lock()
+	if ftpServer.closed {
+		ftpServer.mu.Unlock()
+		listener.Close()
+		return nil
 	}
+	ftpServer.listeners = append(ftpServer.listeners, listener)
+	ftpServer.startJanitor()
+	ftpServer.mu.Unlock()
+	defer ftpServer.stopListening(listener)
 	ftpServer.logger.Printf("listening on %s", listener.Addr().String())
 
 	for {
-		tcpConn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
 			ftpServer.logger.Print("listening error")
 			break
 		}
-		driver, err := ftpServer.driverFactory.NewDriver()
+		settings := ftpServer.currentSettings()
+		if settings.maxConnections > 0 && ftpServer.stats.active() >= settings.maxConnections {
+			ftpServer.logger.Printf("Too many connections, rejecting client %s", conn.RemoteAddr())
+			conn.Write([]byte("421 Too many connections, try again later\r\n"))
+			conn.Close()
+			continue
+		}
+		if ip := addrIP(conn.RemoteAddr()); ftpServer.bans.banned(ip) {
+			ftpServer.logger.Printf("Rejecting banned client %s", ip)
+			conn.Write([]byte("421 Service not available\r\n"))
+			conn.Close()
+			continue
+		}
+		ftpServer.mu.Lock()
+		refused, stop := ftpServer.refuseConn(conn)
+		ftpServer.mu.Unlock()
+		if stop {
+			break
+		}
+		if refused {
+			continue
+		}
+		tuneControlConn(conn, ftpServer.keepAlive)
+		driver, err := settings.driverFactory.NewDriver()
 		if err != nil {
 			ftpServer.logger.Print("Error creating driver, aborting client connection")
+			conn.Close()
 		} else {
-			ftpConn := newftpConn(tcpConn, driver, ftpServer.serverName, ftpServer.pasvMinPort, ftpServer.pasvMaxPort, ftpServer.pasvAdvertisedIp)
+			ftpConn := newftpConn(conn, driver, ftpServer, settings)
+			ftpServer.mu.Lock()
+			// the server may have closed, or gone into maintenance, while the
+			// driver was being created
+			if refused, stop := ftpServer.refuseConn(conn); refused {
+				ftpServer.mu.Unlock()
+				if stop {
+					break
+				}
+				continue
+			}
+			ftpServer.stats.connectionOpened()
+			ftpServer.sessions[ftpConn] = struct{}{}
+			ftpServer.sessionsDone.Add(1)
+			ftpServer.mu.Unlock()
 			go ftpConn.Serve()
 		}
 	}
 	return nil
 }
 
+// stopListening closes a listener Serve has finished with, and forgets it.
+func (ftpServer *FTPServer) stopListening(listener net.Listener) {
+	listener.Close()
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	for i, l := range ftpServer.listeners {
+		if l == listener {
+			ftpServer.listeners = append(ftpServer.listeners[:i], ftpServer.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// refuseConn closes a new client connection if the server has been closed or
+// a maintenance window has started, telling the client why in the latter
+// case. stop reports whether Serve should stop accepting connections. The
+// caller must hold mu.
+func (ftpServer *FTPServer) refuseConn(conn net.Conn) (refused bool, stop bool) {
+	if ftpServer.closed {
+		conn.Close()
+		return true, true
+	}
+	if m := ftpServer.maintenance; m != nil && m.started {
+		conn.Write([]byte("421 " + m.message + "\r\n"))
+		conn.Close()
+		return true, false
+	}
+	return false, false
+}
+
+// Close stops the server from accepting new client connections on any of its
+// listeners, which causes ListenAndServe or Serve to return. Connections that
+// are already established are not affected.
+func (ftpServer *FTPServer) Close() error {
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	ftpServer.closed = true
+	ftpServer.stopJanitor()
+	if ftpServer.pasvPool != nil {
+		ftpServer.pasvPool.close()
+	}
+	var firstErr error
+	for _, listener := range ftpServer.listeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	ftpServer.listeners = nil
+	return firstErr
+}
+
+// Shutdown closes the server like Close, then ends every established session
+// with a 421 reply, interrupting any transfers in progress. It returns once
+// every session has finished cleaning up.
+func (ftpServer *FTPServer) Shutdown() error {
+	err := ftpServer.Close()
+	for _, conn := range ftpServer.sessionList() {
+		conn.shutdown()
+	}
+	ftpServer.sessionsDone.Wait()
+	return err
+}
+
+// sessionClosed forgets a client connection once its session has ended.
+func (ftpServer *FTPServer) sessionClosed(conn *ftpConn) {
+	ftpServer.mu.Lock()
+	delete(ftpServer.sessions, conn)
+	if m := ftpServer.maintenance; m != nil && m.started && len(ftpServer.sessions) == 0 {
+		m.drain()
+	}
+	ftpServer.mu.Unlock()
+	ftpServer.stats.connectionClosed()
+	ftpServer.sessionsDone.Done()
+}
+
 func buildTcpString(hostname string, port int) (result string) {
 	if strings.Contains(hostname, ":") {
 		// ipv6
@@ -0,0 +1,198 @@
+package graval
+
+import (
+	"bufio"
+	"crypto/tls"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type nullDriverFactory struct{}
+
+func (factory nullDriverFactory) NewDriver() (FTPDriver, error) {
+	return nil, nil
+}
+
+func TestServerOptsValidate(t *testing.T) {
+	Convey("Validating server options", t, func() {
+		Convey("Will accept the defaults with a factory", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Will require a factory", func() {
+			So((&FTPServerOpts{}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject an out of range port", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, Port: 70000}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject an inverted passive port range", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PasvMinPort: 6000, PasvMaxPort: 5000}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a half configured passive port range", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PasvMaxPort: 5000}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject an advertised IP that isn't IPv4", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PasvAdvertisedIp: "::1"}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PasvAdvertisedIp: "example.com"}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PasvAdvertisedIp: "10.0.0.1"}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Will reject an upload suffix containing a slash", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, UploadTempSuffix: "/tmp"}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a negative upload state expiry", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, UploadStateExpiry: -time.Hour}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a negative partial upload age", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PartialUploadMaxAge: -time.Hour}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject invalid directory policies", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DirPolicies: []DirPolicy{{Dir: "incoming"}}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DirPolicies: []DirPolicy{{Dir: "/incoming", ReadOnly: true, WriteOnly: true}}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DirPolicies: []DirPolicy{{Dir: "/incoming", ReadOnly: true, Blind: true}}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DirPolicies: []DirPolicy{{Dir: "/tmp", Expire: -time.Hour}}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DirPolicies: []DirPolicy{{Dir: "/tmp"}, {Dir: "/tmp/"}}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DirPolicies: []DirPolicy{{Dir: "/incoming", WriteOnly: true}}}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Will reject a negative data connection buffer size", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DataConnBufferSize: -1}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a negative transfer cap", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, MaxTransfers: -1}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject reserving every transfer slot", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, MaxTransfers: 2, ReservedTransfers: 2}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, ReservedTransfers: 1}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, MaxTransfers: 2, ReservedTransfers: 1}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Will reject a negative command rate limit", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, CommandRateLimit: -1}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, CommandRateLimit: 5, CommandBurst: -1}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a negative auth failure delay", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, AuthFailureDelay: -time.Second}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject negative ban settings", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, BanAfterFailedLogins: -1}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, BanDuration: -time.Hour}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject an unknown symlink mode", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, Symlinks: SymlinkMode(7)}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a negative listing limit", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, MaxListEntries: -1}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, MaxListBytes: -1}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a negative minimum transfer rate", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, MinTransferRate: -1}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject an unknown compliance mode", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, Compliance: Compliance(7)}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a listing owner containing spaces", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, ListOwner: "ftp user"}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, ListGroup: "ftp\tusers"}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject an unknown collision policy, or versioning without an archive", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, UploadCollisions: CollisionPolicy(7)}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, UploadCollisions: VersionExisting}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, UploadCollisions: VersionExisting, UploadArchiveDir: "/.versions"}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Will reject an impossible password policy", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PasswordPolicy: &PasswordPolicy{MinLength: -1}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, PasswordPolicy: &PasswordPolicy{MinCharClasses: 5}}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject a badly named or nil security mechanism", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, SecurityMechanisms: map[string]SecurityMechanism{"gssapi": nil}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, SecurityMechanisms: map[string]SecurityMechanism{"GSSAPI": nil}}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("Will reject TLS options without a TLSConfig", func() {
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, DataTLSConfig: &tls.Config{}}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, AllowCCC: true}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, RequireTLSLogin: true}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, RequireTLSData: true}).Validate(), ShouldNotBeNil)
+			So((&FTPServerOpts{Factory: nullDriverFactory{}, TLSConfig: &tls.Config{}, RequireTLSData: true}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Will refuse to serve a DataTLSConfig without a TLSConfig", func() {
+			server := NewFTPServer(&FTPServerOpts{Factory: nullDriverFactory{}, DataTLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}})
+			So(server.ListenAndServe(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestServerOptsDefaults(t *testing.T) {
+	opts := serverOptsWithDefaults(&FTPServerOpts{ServerName: "test server"})
+	Convey("Server options with defaults", t, func() {
+		Convey("Will use the server name as the welcome message", func() {
+			So(opts.WelcomeMessage, ShouldEqual, "test server")
+		})
+
+		Convey("Will listen on port 3000", func() {
+			So(opts.Port, ShouldEqual, 3000)
+		})
+	})
+}
+
+func TestServeUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "ftp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewFTPServer(&FTPServerOpts{Factory: nullDriverFactory{}, WelcomeMessage: "hello unix"})
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "ftp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	welcome, _ := bufio.NewReader(conn).ReadString('\n')
+	server.Close()
+
+	Convey("Serving from a unix socket listener", t, func() {
+		Convey("Will send the welcome message", func() {
+			So(welcome, ShouldEqual, "220 hello unix\r\n")
+		})
+
+		Convey("Will return once the server is closed", func() {
+			So(<-done, ShouldBeNil)
+		})
+	})
+}
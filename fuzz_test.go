@@ -0,0 +1,73 @@
+//go:build go1.18
+// +build go1.18
+
+package graval
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// Run these with go test -fuzz, one at a time, to look for input from
+// clients that the parser or the reply formatter mishandle.
+
+func FuzzParseCommandLine(f *testing.F) {
+	for _, seed := range []string{"USER test\r\n", "STOR  a file.txt \r\n", "NOOP", "\x00\r\n", "CWD a\rb\r\n", strings.Repeat("A", 10000)} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		// lines from the client end at their first \n
+		if i := strings.Index(line, "\n"); i >= 0 && i < len(line)-1 {
+			return
+		}
+		command, param := parseCommandLine(line)
+		if strings.Contains(command, " ") {
+			t.Errorf("command %q contains a space", command)
+		}
+		if param != strings.TrimSpace(param) {
+			t.Errorf("param %q isn't trimmed", param)
+		}
+		if strings.HasSuffix(command, "\n") || strings.HasSuffix(param, "\n") {
+			t.Errorf("line ending left in %q %q", command, param)
+		}
+	})
+}
+
+func FuzzFormatReply(f *testing.F) {
+	f.Add(250, "Directory changed to /pub")
+	f.Add(550, "a\r\n226 injected")
+	f.Add(200, "\x00")
+	f.Fuzz(func(t *testing.T, code int, message string) {
+		if code < 100 || code > 599 {
+			return
+		}
+		reply := formatReply(code, message)
+		reader := textproto.NewReader(bufio.NewReader(strings.NewReader(reply)))
+		if _, _, err := reader.ReadResponse(code); err != nil {
+			t.Fatalf("%q doesn't parse: %s", reply, err)
+		}
+		if rest, _ := ioutil.ReadAll(reader.R); len(rest) > 0 {
+			t.Fatalf("%q is more than one reply", reply)
+		}
+	})
+}
+
+func FuzzFormatReplyLines(f *testing.F) {
+	f.Add(" one\n two")
+	f.Add("211 End\n x")
+	f.Add("\r\n211 x\x00")
+	f.Fuzz(func(t *testing.T, body string) {
+		lines := append([]string{"211-Start"}, strings.Split(body, "\n")...)
+		reply := formatReplyLines(append(lines, "211 End"))
+		reader := textproto.NewReader(bufio.NewReader(strings.NewReader(reply)))
+		if _, _, err := reader.ReadResponse(211); err != nil {
+			t.Fatalf("%q doesn't parse: %s", reply, err)
+		}
+		if rest, _ := ioutil.ReadAll(reader.R); len(rest) > 0 {
+			t.Fatalf("%q ends early", reply)
+		}
+	})
+}
@@ -5,4 +5,5 @@ go 1.12
 require (
 	github.com/jehiah/go-strftime v0.0.0-20171201141054-1d33003b3869
 	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337
+	go.uber.org/goleak v1.1.12
 )
@@ -0,0 +1,116 @@
+package gravaltest
+
+import (
+	"bytes"
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/osdriver"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// the size of the file moved by the transfer benchmarks
+const benchmarkFileSize = 1 << 20
+
+// newBenchmarkServer starts a server that doesn't log, since logging every
+// command would swamp what's being measured.
+func newBenchmarkServer(factory graval.FTPDriverFactory) *Server {
+	return NewServer(&graval.FTPServerOpts{
+		Factory: factory,
+		Logger:  log.New(ioutil.Discard, "", 0),
+	})
+}
+
+// benchmarkDrivers runs bench against the memory driver and the os driver.
+func benchmarkDrivers(b *testing.B, bench func(b *testing.B, factory graval.FTPDriverFactory)) {
+	b.Run("mem", func(b *testing.B) {
+		bench(b, NewMemDriverFactory())
+	})
+	b.Run("os", func(b *testing.B) {
+		root, err := ioutil.TempDir("", "gravaltest")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		bench(b, &osdriver.DriverFactory{
+			Root: root,
+			Authenticate: func(user string, pass string) bool {
+				return user == "test" && pass == "1234"
+			},
+		})
+	})
+}
+
+func BenchmarkCommands(b *testing.B) {
+	server := newBenchmarkServer(NewMemDriverFactory())
+	defer server.Close()
+	client := server.Client(b)
+	defer client.Close()
+	client.Login(b, "test", "1234")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reply, err := client.Cmd("NOOP"); err != nil || reply.Code != 200 {
+			b.Fatalf("NOOP: %v %v", reply, err)
+		}
+	}
+}
+
+func BenchmarkConcurrentSessions(b *testing.B) {
+	server := newBenchmarkServer(NewMemDriverFactory())
+	defer server.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		client := server.Client(b)
+		defer client.Close()
+		client.Login(b, "test", "1234")
+		for pb.Next() {
+			if reply, err := client.Cmd("PWD"); err != nil || reply.Code != 257 {
+				b.Errorf("PWD: %v %v", reply, err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkDownload(b *testing.B) {
+	benchmarkDrivers(b, func(b *testing.B, factory graval.FTPDriverFactory) {
+		server := newBenchmarkServer(factory)
+		defer server.Close()
+		client := server.Client(b)
+		defer client.Close()
+		client.Login(b, "test", "1234")
+		if err := client.Store("/bench.bin", bytes.Repeat([]byte("x"), benchmarkFileSize)); err != nil {
+			b.Fatal(err)
+		}
+
+		b.SetBytes(benchmarkFileSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if data, err := client.Retrieve("/bench.bin"); err != nil || len(data) != benchmarkFileSize {
+				b.Fatalf("RETR: %d bytes, %v", len(data), err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpload(b *testing.B) {
+	benchmarkDrivers(b, func(b *testing.B, factory graval.FTPDriverFactory) {
+		server := newBenchmarkServer(factory)
+		defer server.Close()
+		client := server.Client(b)
+		defer client.Close()
+		client.Login(b, "test", "1234")
+		data := bytes.Repeat([]byte("x"), benchmarkFileSize)
+
+		b.SetBytes(benchmarkFileSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := client.Store("/bench.bin", data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
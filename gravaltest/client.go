@@ -0,0 +1,344 @@
+package gravaltest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var pasvRegexp = regexp.MustCompile(`\((\d+),(\d+),(\d+),(\d+),(\d+),(\d+)\)`)
+
+// Reply is a single response from the server. Message contains all lines of
+// a multiline reply, separated by "\n".
+type Reply struct {
+	Code    int
+	Message string
+}
+
+func (reply *Reply) String() string {
+	return fmt.Sprintf("%d %s", reply.Code, reply.Message)
+}
+
+// Step is a single exchange in a scripted conversation: a line to send and
+// the reply code expected in response. If Send is empty, nothing is sent and
+// the next reply is read, which is useful for the second reply of a transfer.
+type Step struct {
+	Send   string
+	Expect int
+}
+
+// Client is a minimal FTP client that speaks the control protocol line by
+// line, so tests can drive the exact conversation they're interested in.
+type Client struct {
+	conn *textproto.Conn
+	raw  net.Conn
+
+	// the configuration for TLS on the control connection, and on data
+	// connections once they're protected
+	tlsConn   *tls.Conn
+	tlsConfig *tls.Config
+	dataTLS   *tls.Config
+}
+
+// Dial connects to an FTP server and reads the welcome message.
+func Dial(addr string) (*Client, error) {
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := textproto.NewConn(raw)
+	client := &Client{conn: conn, raw: raw}
+	reply, err := client.ReadReply()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply.Code != 220 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected welcome: %s", reply)
+	}
+	return client, nil
+}
+
+// Close closes the control connection without sending QUIT.
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+// Send writes a single line to the server without waiting for a reply.
+func (client *Client) Send(format string, args ...interface{}) error {
+	return client.conn.PrintfLine(format, args...)
+}
+
+// ReadReply reads the next reply from the server.
+func (client *Client) ReadReply() (*Reply, error) {
+	code, message, err := client.conn.ReadResponse(0)
+	if err != nil {
+		return nil, err
+	}
+	return &Reply{Code: code, Message: message}, nil
+}
+
+// Cmd sends a line to the server and reads the reply.
+func (client *Client) Cmd(format string, args ...interface{}) (*Reply, error) {
+	if err := client.Send(format, args...); err != nil {
+		return nil, err
+	}
+	return client.ReadReply()
+}
+
+// Expect sends a line to the server and fails the test unless the reply has
+// the expected code.
+func (client *Client) Expect(t testing.TB, code int, format string, args ...interface{}) *Reply {
+	t.Helper()
+	line := fmt.Sprintf(format, args...)
+	reply, err := client.Cmd("%s", line)
+	if err != nil {
+		t.Fatalf("gravaltest: %s: %s", line, err)
+	}
+	if reply.Code != code {
+		t.Fatalf("gravaltest: %s: expected %d, got %s", line, code, reply)
+	}
+	return reply
+}
+
+// ExpectReply reads the next reply and fails the test unless it has the
+// expected code.
+func (client *Client) ExpectReply(t testing.TB, code int) *Reply {
+	t.Helper()
+	reply, err := client.ReadReply()
+	if err != nil {
+		t.Fatalf("gravaltest: reading reply: %s", err)
+	}
+	if reply.Code != code {
+		t.Fatalf("gravaltest: expected %d, got %s", code, reply)
+	}
+	return reply
+}
+
+// Run plays a scripted conversation, failing the test at the first reply that
+// doesn't match.
+func (client *Client) Run(t testing.TB, steps ...Step) {
+	t.Helper()
+	for _, step := range steps {
+		if step.Send == "" {
+			client.ExpectReply(t, step.Expect)
+		} else {
+			client.Expect(t, step.Expect, "%s", step.Send)
+		}
+	}
+}
+
+// Login authenticates with the server, failing the test if it's refused.
+func (client *Client) Login(t testing.TB, user string, pass string) {
+	t.Helper()
+	client.Run(t,
+		Step{"USER " + user, 331},
+		Step{"PASS " + pass, 230},
+	)
+}
+
+// Passive sends PASV and opens a connection to the data port the server
+// advertises. Once Protect has been used, the connection is protected with
+// TLS.
+func (client *Client) Passive() (net.Conn, error) {
+	reply, err := client.Cmd("PASV")
+	if err != nil {
+		return nil, err
+	}
+	if reply.Code != 227 {
+		return nil, fmt.Errorf("PASV failed: %s", reply)
+	}
+	match := pasvRegexp.FindStringSubmatch(reply.Message)
+	if match == nil {
+		return nil, fmt.Errorf("PASV reply could not be parsed: %s", reply)
+	}
+	p1, _ := strconv.Atoi(match[5])
+	p2, _ := strconv.Atoi(match[6])
+	addr := fmt.Sprintf("%s.%s.%s.%s:%d", match[1], match[2], match[3], match[4], p1*256+p2)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil || client.dataTLS == nil {
+		return conn, err
+	}
+	return tls.Client(conn, client.dataTLS), nil
+}
+
+// Retrieve downloads a file over a passive data connection.
+func (client *Client) Retrieve(path string) ([]byte, error) {
+	return client.readData("RETR " + path)
+}
+
+// List fetches a detailed directory listing over a passive data connection.
+func (client *Client) List(path string) (string, error) {
+	data, err := client.readData("LIST " + path)
+	return string(data), err
+}
+
+// NameList fetches a list of names over a passive data connection.
+func (client *Client) NameList(path string) (string, error) {
+	data, err := client.readData("NLST " + path)
+	return string(data), err
+}
+
+// RetrieveFrom downloads a file over a passive data connection, starting at
+// offset, using REST.
+func (client *Client) RetrieveFrom(path string, offset int64) ([]byte, error) {
+	return client.readDataFrom("RETR "+path, offset)
+}
+
+// Store uploads a file over a passive data connection.
+func (client *Client) Store(path string, data []byte) error {
+	return client.StoreAt(path, 0, data)
+}
+
+// StoreAt resumes an upload over a passive data connection, using REST to
+// have the server write data starting at offset. An offset of 0 is the same
+// as Store.
+func (client *Client) StoreAt(path string, offset int64, data []byte) error {
+	dataConn, err := client.Passive()
+	if err != nil {
+		return err
+	}
+	if err := client.restart(offset); err != nil {
+		dataConn.Close()
+		return err
+	}
+	reply, err := client.Cmd("STOR %s", path)
+	if err != nil {
+		dataConn.Close()
+		return err
+	}
+	if reply.Code != 150 {
+		dataConn.Close()
+		return fmt.Errorf("STOR failed: %s", reply)
+	}
+	_, err = dataConn.Write(data)
+	dataConn.Close()
+	if err != nil {
+		return err
+	}
+	return client.expectComplete("STOR")
+}
+
+func (client *Client) readData(line string) ([]byte, error) {
+	return client.readDataFrom(line, 0)
+}
+
+func (client *Client) readDataFrom(line string, offset int64) ([]byte, error) {
+	dataConn, err := client.Passive()
+	if err != nil {
+		return nil, err
+	}
+	defer dataConn.Close()
+	if err := client.restart(offset); err != nil {
+		return nil, err
+	}
+	reply, err := client.Cmd("%s", line)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Code != 150 {
+		return nil, fmt.Errorf("%s failed: %s", line, reply)
+	}
+	data, err := ioutil.ReadAll(dataConn)
+	if err != nil {
+		return nil, err
+	}
+	return data, client.expectComplete(line)
+}
+
+// restart sends REST for a non-zero offset.
+func (client *Client) restart(offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	reply, err := client.Cmd("REST %d", offset)
+	if err != nil {
+		return err
+	}
+	if reply.Code != 350 {
+		return fmt.Errorf("REST failed: %s", reply)
+	}
+	return nil
+}
+
+func (client *Client) expectComplete(line string) error {
+	reply, err := client.ReadReply()
+	if err != nil {
+		return err
+	}
+	if reply.Code != 226 {
+		return fmt.Errorf("%s failed: %s", line, reply)
+	}
+	return nil
+}
+
+// AuthTLS sends AUTH TLS and protects the control connection with TLS using
+// config, as described in RFC 4217.
+func (client *Client) AuthTLS(config *tls.Config) error {
+	reply, err := client.Cmd("AUTH TLS")
+	if err != nil {
+		return err
+	}
+	if reply.Code != 234 {
+		return fmt.Errorf("AUTH TLS failed: %s", reply)
+	}
+	tlsConn := tls.Client(client.raw, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	client.conn = textproto.NewConn(tlsConn)
+	client.tlsConn = tlsConn
+	client.tlsConfig = config
+	return nil
+}
+
+// ClearCommandChannel sends CCC and returns the control connection to the
+// clear once both ends have closed their side of TLS. Data connections keep
+// their protection.
+func (client *Client) ClearCommandChannel() error {
+	reply, err := client.Cmd("CCC")
+	if err != nil {
+		return err
+	}
+	if reply.Code != 200 {
+		return fmt.Errorf("CCC failed: %s", reply)
+	}
+	if err := client.tlsConn.CloseWrite(); err != nil {
+		return err
+	}
+	client.raw.SetWriteDeadline(time.Time{})
+	if _, err := io.Copy(ioutil.Discard, client.conn.R); err != nil {
+		return err
+	}
+	client.conn = textproto.NewConn(client.raw)
+	client.tlsConn = nil
+	return nil
+}
+
+// Protect sends PBSZ 0 and PROT P, so later data connections are protected
+// with TLS. config is used for them, or if it's nil, the configuration given
+// to AuthTLS.
+func (client *Client) Protect(config *tls.Config) error {
+	for _, line := range []string{"PBSZ 0", "PROT P"} {
+		reply, err := client.Cmd("%s", line)
+		if err != nil {
+			return err
+		}
+		if reply.Code != 200 {
+			return fmt.Errorf("%s failed: %s", line, reply)
+		}
+	}
+	if config == nil {
+		config = client.tlsConfig
+	}
+	client.dataTLS = config
+	return nil
+}
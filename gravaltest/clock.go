@@ -0,0 +1,84 @@
+package gravaltest
+
+import (
+	"github.com/royallthefourth/graval"
+	"sync"
+	"time"
+)
+
+// FakeClock is a graval.Clock whose time only moves when Advance is called,
+// so tests of idle and data connection timeouts can make them happen at once
+// instead of waiting for them.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a clock that starts at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) AfterFunc(d time.Duration, f func()) graval.ClockTimer {
+	clock.mu.Lock()
+	timer := &fakeTimer{clock: clock, at: clock.now.Add(d), f: f}
+	clock.timers = append(clock.timers, timer)
+	clock.mu.Unlock()
+	if d <= 0 {
+		clock.Advance(0)
+	}
+	return timer
+}
+
+// Advance moves the clock forward by d and runs every timer that's due, each
+// in its own goroutine.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	clock.now = clock.now.Add(d)
+	var due, pending []*fakeTimer
+	for _, timer := range clock.timers {
+		if timer.at.After(clock.now) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	clock.timers = pending
+	clock.mu.Unlock()
+	for _, timer := range due {
+		go timer.f()
+	}
+}
+
+// Timers returns how many timers are waiting to fire, which lets a test wait
+// until the server has started the one it's about to trigger.
+func (clock *FakeClock) Timers() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	f     func()
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.mu.Lock()
+	defer timer.clock.mu.Unlock()
+	for i, pending := range timer.clock.timers {
+		if pending == timer {
+			timer.clock.timers = append(timer.clock.timers[:i], timer.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package gravaltest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/royallthefourth/graval"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestDriver runs a conformance suite against the drivers created by
+// factory, in the spirit of testing/fstest.TestFS. A real server is started
+// and every check is made through a client session, so it covers the whole
+// path from the protocol down to the persistence layer.
+//
+// The user must be able to create a directory in the root of the tree. All
+// work happens inside a uniquely named scratch directory, which is removed
+// again at the end.
+//
+//	func TestMyDriver(t *testing.T) {
+//		gravaltest.TestDriver(t, &MyDriverFactory{}, "user", "secret")
+//	}
+func TestDriver(t *testing.T, factory graval.FTPDriverFactory, user string, pass string) {
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+
+	t.Run("RejectsBadPassword", func(t *testing.T) {
+		client := server.Client(t)
+		defer client.Close()
+		client.Run(t,
+			Step{"USER " + user, 331},
+			Step{"PASS wrong-" + pass, 530},
+		)
+	})
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, user, pass)
+
+	scratch := "/gravaltest-" + randomSuffix()
+	client.Expect(t, 257, "MKD %s", scratch)
+	defer client.Cmd("RMD %s", scratch)
+
+	t.Run("ChangeDir", func(t *testing.T) {
+		client.Expect(t, 250, "CWD %s", scratch)
+		reply := client.Expect(t, 257, "PWD")
+		if !strings.Contains(reply.Message, `"`+scratch+`"`) {
+			t.Errorf("PWD reported %q after CWD %s", reply.Message, scratch)
+		}
+		client.Expect(t, 550, "CWD %s/missing", scratch)
+		client.Expect(t, 250, "CWD /")
+	})
+
+	names := []string{
+		"plain.txt",
+		"with spaces.txt",
+		"ünïcödé ☃.txt",
+		"empty.txt",
+		"large.bin",
+	}
+	contents := map[string][]byte{
+		"plain.txt":       []byte("hello world\n"),
+		"with spaces.txt": []byte("spaced out\r\n"),
+		"ünïcödé ☃.txt":   []byte("snowman ☃\n"),
+		"empty.txt":       {},
+		"large.bin":       randomBytes(1 << 20),
+	}
+
+	for _, name := range names {
+		name := name
+		filePath := path.Join(scratch, name)
+		t.Run("RoundTrip "+name, func(t *testing.T) {
+			if err := client.Store(filePath, contents[name]); err != nil {
+				t.Fatalf("STOR %s: %s", filePath, err)
+			}
+			reply := client.Expect(t, 213, "SIZE %s", filePath)
+			if reply.Message != strconv.Itoa(len(contents[name])) {
+				t.Errorf("SIZE %s: expected %d, got %s", filePath, len(contents[name]), reply.Message)
+			}
+			client.Expect(t, 213, "MDTM %s", filePath)
+			data, err := client.Retrieve(filePath)
+			if err != nil {
+				t.Fatalf("RETR %s: %s", filePath, err)
+			}
+			if !bytes.Equal(data, contents[name]) {
+				t.Errorf("RETR %s: got %d bytes that differ from the %d uploaded", filePath, len(data), len(contents[name]))
+			}
+		})
+	}
+
+	t.Run("Resume", func(t *testing.T) {
+		filePath := path.Join(scratch, "resumed.txt")
+		if err := client.Store(filePath, []byte("hello wor")); err != nil {
+			t.Fatalf("STOR %s: %s", filePath, err)
+		}
+		defer client.Cmd("DELE %s", filePath)
+		data, err := client.RetrieveFrom(filePath, 6)
+		if err != nil || string(data) != "wor" {
+			t.Errorf("REST 6, RETR %s: expected %q, got %q (%v)", filePath, "wor", data, err)
+		}
+		err = client.StoreAt(filePath, 6, []byte("world!"))
+		if err != nil && strings.HasPrefix(err.Error(), "STOR failed: 554") {
+			t.Skip("driver doesn't support resuming uploads")
+		}
+		if err != nil {
+			t.Fatalf("REST 6, STOR %s: %s", filePath, err)
+		}
+		data, err = client.Retrieve(filePath)
+		if err != nil || string(data) != "hello world!" {
+			t.Errorf("RETR %s: expected %q after resuming, got %q (%v)", filePath, "hello world!", data, err)
+		}
+	})
+
+	t.Run("NameList", func(t *testing.T) {
+		listing, err := client.NameList(scratch)
+		if err != nil {
+			t.Fatalf("NLST %s: %s", scratch, err)
+		}
+		for _, name := range names {
+			if !containsLine(listing, name) {
+				t.Errorf("NLST %s: missing %q in %q", scratch, name, listing)
+			}
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		listing, err := client.List(scratch)
+		if err != nil {
+			t.Fatalf("LIST %s: %s", scratch, err)
+		}
+		for _, name := range names {
+			if !strings.Contains(listing, " "+name+"\r\n") {
+				t.Errorf("LIST %s: missing %q in %q", scratch, name, listing)
+			}
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		from := path.Join(scratch, "plain.txt")
+		to := path.Join(scratch, "renamed.txt")
+		client.Run(t,
+			Step{"RNFR " + from, 350},
+			Step{"RNTO " + to, 250},
+			Step{"SIZE " + from, 450},
+			Step{"SIZE " + to, 213},
+		)
+		client.Run(t,
+			Step{"RNFR " + path.Join(scratch, "missing.txt"), 350},
+			Step{"RNTO " + path.Join(scratch, "other.txt"), 550},
+		)
+		client.Run(t,
+			Step{"RNFR " + to, 350},
+			Step{"RNTO " + from, 250},
+		)
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		missing := path.Join(scratch, "missing.txt")
+		client.Expect(t, 450, "SIZE %s", missing)
+		client.Expect(t, 450, "MDTM %s", missing)
+		client.Expect(t, 550, "DELE %s", missing)
+		if _, err := client.Retrieve(missing); err == nil {
+			t.Errorf("RETR %s: expected an error", missing)
+		}
+	})
+
+	t.Run("Directories", func(t *testing.T) {
+		dir := path.Join(scratch, "subdir")
+		client.Expect(t, 257, "MKD %s", dir)
+		client.Expect(t, 550, "MKD %s", dir)
+		client.Expect(t, 250, "CWD %s", dir)
+		client.Expect(t, 250, "CDUP")
+		client.Expect(t, 250, "RMD %s", dir)
+		client.Expect(t, 550, "CWD %s", dir)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		for _, name := range names {
+			filePath := path.Join(scratch, name)
+			client.Expect(t, 250, "DELE %s", filePath)
+			client.Expect(t, 450, "SIZE %s", filePath)
+		}
+	})
+
+	t.Run("ReplySequence", func(t *testing.T) {
+		if errors := server.FTPServer().Stats().ReplyErrors; errors != 0 {
+			t.Errorf("%d replies were sent out of sequence", errors)
+		}
+	})
+}
+
+func containsLine(listing string, line string) bool {
+	for _, l := range strings.Split(listing, "\r\n") {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func randomSuffix() string {
+	return hex.EncodeToString(randomBytes(6))
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return buf
+}
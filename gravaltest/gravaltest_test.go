@@ -0,0 +1,5754 @@
+package gravaltest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/osdriver"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.uber.org/goleak"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerSession(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/files/one.txt", []byte("hello"))
+
+	client := server.Client(t)
+	defer client.Close()
+
+	Convey("A client session", t, func() {
+		Convey("Will require a login", func() {
+			client.Expect(t, 530, "PWD")
+			client.Login(t, "test", "1234")
+			client.Expect(t, 257, "PWD")
+		})
+
+		Convey("Will download a file", func() {
+			data, err := client.Retrieve("/files/one.txt")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "hello")
+		})
+
+		Convey("Will upload a file", func() {
+			So(client.Store("/files/two.txt", []byte("world")), ShouldBeNil)
+			data, ok := factory.ReadFile("/files/two.txt")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "world")
+		})
+
+		Convey("Will list a directory", func() {
+			names, err := client.NameList("/files")
+			So(err, ShouldBeNil)
+			So(names, ShouldEqual, "one.txt\r\ntwo.txt\r\n\r\n")
+		})
+
+		Convey("Will follow a script", func() {
+			client.Run(t,
+				Step{"RNFR /files/two.txt", 350},
+				Step{"RNTO /files/three.txt", 250},
+				Step{"SIZE /files/three.txt", 213},
+				Step{"DELE /files/three.txt", 250},
+				Step{"SIZE /files/three.txt", 450},
+			)
+		})
+	})
+}
+
+func TestMemDriverConformance(t *testing.T) {
+	TestDriver(t, NewMemDriverFactory(), "test", "1234")
+}
+
+func TestTranscriptReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gravaltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recording := NewServer(&graval.FTPServerOpts{TranscriptDir: dir})
+	recording.Factory.(*MemDriverFactory).WriteFile("/one.txt", []byte("hello"))
+	client := recording.Client(t)
+	client.Login(t, "test", "1234")
+	client.Expect(t, 211, "FEAT")
+	client.Retrieve("/one.txt")
+	client.Store("/two.txt", []byte("world"))
+	client.Expect(t, 450, "SIZE /missing.txt")
+	client.Close()
+	recording.Close()
+
+	// the transcript is closed once the server notices the client has gone
+	var files []string
+	for i := 0; i < 50 && len(files) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		files, _ = filepath.Glob(filepath.Join(dir, "*.txt"))
+	}
+
+	var transcript *Transcript
+	for _, name := range files {
+		data, _ := ioutil.ReadFile(name)
+		if strings.Contains(string(data), "> PASS ****") {
+			transcript, err = ParseTranscript(strings.NewReader(string(data)))
+		}
+	}
+
+	Convey("A recorded transcript", t, func() {
+		Convey("Will be parsed", func() {
+			So(err, ShouldBeNil)
+			So(transcript, ShouldNotBeNil)
+			So(transcript.Steps[0], ShouldResemble, TranscriptStep{Send: "USER test", Replies: []int{331}})
+			So(transcript.Steps[1], ShouldResemble, TranscriptStep{Send: "PASS ****", Replies: []int{230}})
+			So(transcript.Steps[2], ShouldResemble, TranscriptStep{Send: "FEAT", Replies: []int{211}})
+		})
+
+		Convey("Will replay against a fresh server", func() {
+			replaying := NewServer(nil)
+			defer replaying.Close()
+			replaying.Factory.(*MemDriverFactory).WriteFile("/one.txt", []byte("hello"))
+			client := replaying.Client(t)
+			defer client.Close()
+			transcript.Replay(t, client, "1234")
+			data, ok := replaying.Factory.(*MemDriverFactory).ReadFile("/two.txt")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "")
+		})
+	})
+}
+
+func TestMaxConnections(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{MaxConnections: 1})
+	defer server.Close()
+
+	first := server.Client(t)
+	defer first.Close()
+	_, err := Dial(server.Addr)
+
+	Convey("A server with a connection limit", t, func() {
+		Convey("Will reject clients over the limit", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "421")
+		})
+	})
+}
+
+func TestExtendedPassiveMode(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	Convey("Extended passive mode on an IPv4 connection", t, func() {
+		Convey("Will accept the IPv4 address family", func() {
+			client.Expect(t, 229, "EPSV 1")
+		})
+
+		Convey("Will refuse the IPv6 address family", func() {
+			reply := client.Expect(t, 522, "EPSV 2")
+			So(reply.Message, ShouldContainSubstring, "(1)")
+		})
+
+		Convey("Will refuse an active connection in the wrong address family", func() {
+			client.Expect(t, 522, "EPRT |2|::1|6000|")
+			client.Expect(t, 501, "EPRT |1|nonsense|")
+		})
+
+		Convey("Will refuse other data commands after EPSV ALL", func() {
+			client.Expect(t, 200, "EPSV ALL")
+			client.Expect(t, 503, "PASV")
+			client.Expect(t, 503, "PORT 127,0,0,1,20,0")
+			client.Expect(t, 229, "EPSV")
+		})
+	})
+}
+
+func TestRepeatedPassive(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	server.Factory.(*MemDriverFactory).WriteFile("/one.txt", []byte("hello"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	first := client.Expect(t, 229, "EPSV")
+	client.Expect(t, 229, "EPSV")
+	firstPort := strings.Trim(first.Message[strings.Index(first.Message, "|||"):], "|()")
+	_, err := net.Dial("tcp", "127.0.0.1:"+firstPort)
+
+	Convey("Sending PASV repeatedly", t, func() {
+		Convey("Will close the previous unused listener", func() {
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Will still allow a transfer on the newest listener", func() {
+			data, err := client.Retrieve("/one.txt")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "hello")
+		})
+	})
+}
+
+func TestPassiveListenerPool(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{PasvListenerPoolSize: 1})
+	defer server.Close()
+	server.Factory.(*MemDriverFactory).WriteFile("/one.txt", []byte("hello"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	retrieve := func() string {
+		conn, err := client.Passive()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		client.Expect(t, 150, "RETR /one.txt")
+		data, err := ioutil.ReadAll(conn)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "hello")
+		client.ExpectReply(t, 226)
+		return conn.RemoteAddr().String()
+	}
+
+	Convey("A server with a passive listener pool", t, func() {
+		Convey("Will reuse the same listener for consecutive transfers", func() {
+			first := retrieve()
+			second := retrieve()
+			So(second, ShouldEqual, first)
+		})
+	})
+}
+
+func TestStatDuringTransfer(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	large := make([]byte, 32<<20)
+	server.Factory.(*MemDriverFactory).WriteFile("/large.bin", large)
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	idle := client.Expect(t, 211, "STAT")
+
+	// the download stalls once the socket buffers fill, since nothing is
+	// reading the data connection yet
+	conn, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client.Expect(t, 150, "RETR /large.bin")
+	busy := client.Expect(t, 211, "STAT")
+	transfers := server.FTPServer().Transfers()
+	data, err := ioutil.ReadAll(conn)
+	client.ExpectReply(t, 226)
+
+	Convey("STAT with no transfer running", t, func() {
+		So(idle.Message, ShouldContainSubstring, "No data transfer in progress")
+	})
+
+	Convey("STAT while a download is running", t, func() {
+		Convey("Will report the transfer in progress", func() {
+			So(busy.Message, ShouldContainSubstring, "Download of /large.bin in progress")
+		})
+
+		Convey("Will be listed by the server", func() {
+			So(len(transfers), ShouldEqual, 1)
+			So(transfers[0].Path, ShouldEqual, "/large.bin")
+			So(transfers[0].Direction, ShouldEqual, "download")
+			So(transfers[0].User, ShouldEqual, "test")
+		})
+
+		Convey("Will not disturb the transfer", func() {
+			So(err, ShouldBeNil)
+			So(len(data), ShouldEqual, len(large))
+			So(server.FTPServer().Transfers(), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{IdleTimeout: 200 * time.Millisecond})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+
+	Convey("An idle client", t, func() {
+		reply, err := client.ReadReply()
+		So(err, ShouldBeNil)
+		So(reply.Code, ShouldEqual, 421)
+	})
+}
+
+// waitForTimers waits until the server has started at least n timers on
+// clock.
+func waitForTimers(t *testing.T, clock *FakeClock, n int) {
+	for deadline := time.Now().Add(5 * time.Second); clock.Timers() < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d timers started", clock.Timers(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/file.txt", []byte("data"))
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:         factory,
+		IdleTimeout:     time.Hour,
+		DataConnTimeout: time.Minute,
+		Clock:           clock,
+	})
+	defer server.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	waitForTimers(t, clock, 1)
+	clock.Advance(59 * time.Minute)
+	noop, noopErr := client.Cmd("NOOP")
+
+	client.Expect(t, 227, "PASV")
+	client.Send("RETR /file.txt")
+	waitForTimers(t, clock, 2)
+	clock.Advance(time.Minute)
+	var retr *Reply
+	var retrErr error
+	for retr == nil || retr.Code < 200 {
+		if retr, retrErr = client.ReadReply(); retrErr != nil {
+			break
+		}
+	}
+
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Hour)
+	timeout, timeoutErr := client.ReadReply()
+
+	Convey("A server with a fake clock", t, func() {
+		Convey("Will keep a session that's been idle for less than the timeout", func() {
+			So(noopErr, ShouldBeNil)
+			So(noop.Code, ShouldEqual, 200)
+		})
+
+		Convey("Will give up on a data connection when the clock says so", func() {
+			So(retrErr, ShouldBeNil)
+			So(retr.Code, ShouldEqual, 425)
+		})
+
+		Convey("Will end a session once the clock passes the idle timeout", func() {
+			So(timeoutErr, ShouldBeNil)
+			So(timeout.Code, ShouldEqual, 421)
+		})
+	})
+}
+
+func TestFakeClockPolicies(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	var mu sync.Mutex
+	var events []graval.SecurityEvent
+	server := NewServer(&graval.FTPServerOpts{
+		IdleTimeout:      time.Hour,
+		AuthFailureDelay: time.Minute,
+		Clock:            clock,
+		SecurityNotifier: graval.SecurityNotifierFunc(func(event *graval.SecurityEvent) {
+			mu.Lock()
+			events = append(events, *event)
+			mu.Unlock()
+		}),
+	})
+	defer server.Close()
+
+	client := server.Client(t)
+	client.Expect(t, 331, "USER test")
+	waitForTimers(t, clock, 1)
+	client.Send("PASS wrong")
+	waitForTimers(t, clock, 2)
+	clock.Advance(time.Minute)
+	pass, passErr := client.ReadReply()
+	client.Close()
+
+	server.FTPServer().Ban("127.0.0.1", time.Minute)
+	_, bannedErr := Dial(server.Addr)
+	clock.Advance(2 * time.Minute)
+	unbanned, unbannedErr := Dial(server.Addr)
+	if unbannedErr == nil {
+		unbanned.Close()
+	}
+	mu.Lock()
+	var banTime time.Time
+	for _, event := range events {
+		if event.Type == graval.SecurityBanned {
+			banTime = event.Time
+		}
+	}
+	mu.Unlock()
+
+	Convey("A server with a fake clock", t, func() {
+		Convey("Will delay failed logins by the clock", func() {
+			So(passErr, ShouldBeNil)
+			So(pass.Code, ShouldEqual, 530)
+		})
+
+		Convey("Will expire bans by the clock", func() {
+			So(bannedErr, ShouldNotBeNil)
+			So(unbannedErr, ShouldBeNil)
+		})
+
+		Convey("Will time security events by the clock", func() {
+			So(banTime, ShouldEqual, start.Add(time.Minute))
+		})
+	})
+}
+
+func TestRandomPassivePorts(t *testing.T) {
+	ports := func() []string {
+		server := NewServer(&graval.FTPServerOpts{
+			PasvMinPort: 42000,
+			PasvMaxPort: 42999,
+			Rand:        rand.New(rand.NewSource(7)),
+		})
+		defer server.Close()
+		client := server.Client(t)
+		defer client.Close()
+		client.Login(t, "test", "1234")
+		var ports []string
+		for i := 0; i < 3; i++ {
+			reply := client.Expect(t, 229, "EPSV")
+			ports = append(ports, reply.Message)
+		}
+		return ports
+	}
+	first := ports()
+	second := ports()
+
+	Convey("Passive ports chosen with the same random source", t, func() {
+		So(second, ShouldResemble, first)
+	})
+}
+
+func TestAtomicUploads(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/existing.txt", []byte("old"))
+	var seen []graval.CompletedUpload
+	var visibleDuringHook bool
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: factory,
+		UploadHooks: []graval.UploadHook{
+			func(upload *graval.CompletedUpload) error {
+				seen = append(seen, *upload)
+				_, visibleDuringHook = factory.ReadFile(upload.Path)
+				if strings.HasSuffix(upload.Path, ".exe") {
+					return errors.New("executables are not allowed")
+				}
+				return nil
+			},
+		},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	storeErr := client.Store("/new.txt", []byte("hello"))
+	replaceErr := client.Store("/existing.txt", []byte("new"))
+	rejectErr := client.Store("/virus.exe", []byte("MZ"))
+
+	Convey("Uploads with a hook configured", t, func() {
+		Convey("Will be written to a temporary name first", func() {
+			So(storeErr, ShouldBeNil)
+			So(len(seen), ShouldEqual, 3)
+			So(seen[0].TempPath, ShouldEqual, "/new.txt.in-progress")
+			So(seen[0].Bytes, ShouldEqual, 5)
+			So(visibleDuringHook, ShouldBeFalse)
+		})
+
+		Convey("Will be renamed to the final name once approved", func() {
+			data, ok := factory.ReadFile("/new.txt")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "hello")
+			_, ok = factory.ReadFile("/new.txt.in-progress")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Will replace an existing file", func() {
+			So(replaceErr, ShouldBeNil)
+			data, _ := factory.ReadFile("/existing.txt")
+			So(string(data), ShouldEqual, "new")
+		})
+
+		Convey("Will be discarded if a hook rejects them", func() {
+			So(rejectErr, ShouldNotBeNil)
+			So(rejectErr.Error(), ShouldContainSubstring, "451")
+			_, ok := factory.ReadFile("/virus.exe")
+			So(ok, ShouldBeFalse)
+			_, ok = factory.ReadFile("/virus.exe.in-progress")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+type failingCommitDriver struct {
+	*MemDriver
+}
+
+func (driver failingCommitDriver) Rename(fromPath string, toPath string) bool {
+	if strings.HasSuffix(fromPath, ".in-progress") {
+		return false
+	}
+	return driver.MemDriver.Rename(fromPath, toPath)
+}
+
+type failingCommitDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory failingCommitDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return failingCommitDriver{MemDriver: driver.(*MemDriver)}, nil
+}
+
+func TestAtomicUploadCommitFailure(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/existing.txt", []byte("old"))
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:       failingCommitDriverFactory{MemDriverFactory: factory},
+		AtomicUploads: true,
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	replaceErr := client.Store("/existing.txt", []byte("new"))
+	existing, existingOk := factory.ReadFile("/existing.txt")
+	_, tempOk := factory.ReadFile("/existing.txt.in-progress")
+	factory.mu.Lock()
+	listing := factory.children("/")
+	factory.mu.Unlock()
+
+	Convey("An upload that can't be moved into place", t, func() {
+		Convey("Will be rejected", func() {
+			So(replaceErr, ShouldNotBeNil)
+			So(replaceErr.Error(), ShouldContainSubstring, "451")
+		})
+
+		Convey("Will leave the existing file in place", func() {
+			So(existingOk, ShouldBeTrue)
+			So(string(existing), ShouldEqual, "old")
+			So(listing, ShouldResemble, []string{"/existing.txt"})
+		})
+
+		Convey("Will have its temporary file deleted", func() {
+			So(tempOk, ShouldBeFalse)
+		})
+	})
+}
+
+// scanner is an UploadInterceptor that rejects uploads containing a
+// signature, in the manner of a virus scanner.
+type scanner struct {
+	signature string
+}
+
+func (s scanner) Intercept(path string, data io.Reader) (io.Reader, func() error) {
+	var seen bytes.Buffer
+	return io.TeeReader(data, &seen), func() error {
+		if strings.Contains(seen.String(), s.signature) {
+			return errors.New("infected file")
+		}
+		return nil
+	}
+}
+
+func TestUploadInterceptors(t *testing.T) {
+	factory := NewMemDriverFactory()
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:            factory,
+		UploadInterceptors: []graval.UploadInterceptor{scanner{signature: "EICAR"}},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	cleanErr := client.Store("/clean.txt", []byte("hello"))
+	infectedErr := client.Store("/infected.txt", []byte("X5O!P%@AP EICAR"))
+
+	Convey("Uploads passing through an interceptor", t, func() {
+		Convey("Will be committed if it approves", func() {
+			So(cleanErr, ShouldBeNil)
+			data, _ := factory.ReadFile("/clean.txt")
+			So(string(data), ShouldEqual, "hello")
+		})
+
+		Convey("Will be rejected with a 451 and removed if it vetoes", func() {
+			So(infectedErr, ShouldNotBeNil)
+			So(infectedErr.Error(), ShouldContainSubstring, "451")
+			So(infectedErr.Error(), ShouldContainSubstring, "infected file")
+			_, ok := factory.ReadFile("/infected.txt")
+			So(ok, ShouldBeFalse)
+			_, ok = factory.ReadFile("/infected.txt.in-progress")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	factory := NewMemDriverFactory()
+	var hookTypes []string
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: factory,
+		ContentTypePolicy: func(upload *graval.CompletedUpload) error {
+			if upload.ContentType == "application/x-executable" {
+				return errors.New("executables are not allowed")
+			}
+			return nil
+		},
+		UploadHooks: []graval.UploadHook{func(upload *graval.CompletedUpload) error {
+			hookTypes = append(hookTypes, upload.ContentType)
+			return nil
+		}},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	pngErr := client.Store("/image.png", []byte("\x89PNG\r\n\x1a\nrest of the image"))
+	elfErr := client.Store("/program", []byte("\x7fELF\x02\x01\x01 rest of the program"))
+
+	Convey("Uploads checked by a content type policy", t, func() {
+		Convey("Will be committed if it allows the detected type", func() {
+			So(pngErr, ShouldBeNil)
+			_, ok := factory.ReadFile("/image.png")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Will be rejected with a 550 and removed if it refuses the type", func() {
+			So(elfErr, ShouldNotBeNil)
+			So(elfErr.Error(), ShouldContainSubstring, "550")
+			So(elfErr.Error(), ShouldContainSubstring, "executables are not allowed")
+			_, ok := factory.ReadFile("/program")
+			So(ok, ShouldBeFalse)
+			_, ok = factory.ReadFile("/program.in-progress")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Will pass the detected type on to upload hooks", func() {
+			So(hookTypes, ShouldResemble, []string{"image/png"})
+		})
+	})
+}
+
+func TestRestart(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/one.txt", []byte("hello"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	feat := client.Expect(t, 211, "FEAT")
+	client.Run(t,
+		Step{"REST -1", 501},
+		Step{"REST abc", 501},
+		Step{"REST 3", 350},
+		Step{"NOOP", 200},
+	)
+	err := client.Store("/one.txt", []byte("replaced"))
+	data, _ := factory.ReadFile("/one.txt")
+
+	Convey("A driver that supports resuming uploads", t, func() {
+		Convey("Will be advertised in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, "REST STREAM")
+		})
+
+		Convey("Will only apply an offset to the next command", func() {
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "replaced")
+		})
+	})
+}
+
+func TestModeAndStructure(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	Convey("MODE and STRU", t, func() {
+		Convey("Will accept stream mode and file structure", func() {
+			client.Run(t,
+				Step{"MODE S", 200},
+				Step{"MODE s", 200},
+				Step{"STRU F", 200},
+			)
+		})
+
+		Convey("Will refuse the modes and structures that aren't supported", func() {
+			client.Run(t,
+				Step{"MODE B", 504},
+				Step{"MODE C", 504},
+				Step{"STRU R", 504},
+				Step{"STRU P", 504},
+			)
+		})
+
+		Convey("Will reject values that don't exist", func() {
+			client.Run(t,
+				Step{"MODE X", 501},
+				Step{"STRU X", 501},
+			)
+		})
+
+		Convey("Will be reported by STAT", func() {
+			stat := client.Expect(t, 211, "STAT")
+			So(stat.Message, ShouldContainSubstring, "STRU: File")
+			So(stat.Message, ShouldContainSubstring, "MODE: Stream")
+		})
+	})
+}
+
+func TestCompliance(t *testing.T) {
+	lenient := NewServer(nil)
+	defer lenient.Close()
+	lenient.Factory.(*MemDriverFactory).WriteFile("/file.txt", []byte("data"))
+	strict := NewServer(&graval.FTPServerOpts{Compliance: graval.Strict})
+	defer strict.Close()
+	strict.Factory.(*MemDriverFactory).WriteFile("/file.txt", []byte("data"))
+	strict.Factory.(*MemDriverFactory).WriteFile("/rename.txt", []byte("data"))
+
+	Convey("A lenient server", t, func() {
+		client := lenient.Client(t)
+		defer client.Close()
+
+		Convey("Will try PASS without USER as a login", func() {
+			client.Expect(t, 530, "PASS 1234")
+		})
+
+		Convey("Will refuse a transfer without a data connection with 425", func() {
+			client.Login(t, "test", "1234")
+			client.Expect(t, 425, "LIST")
+		})
+
+		Convey("Will allow other commands between RNFR and RNTO", func() {
+			client.Login(t, "test", "1234")
+			client.Run(t,
+				Step{"RNFR /file.txt", 350},
+				Step{"NOOP", 200},
+				Step{"RNTO /renamed.txt", 250},
+				Step{"RNTO /again.txt", 503},
+			)
+		})
+	})
+
+	Convey("A strict server", t, func() {
+		client := strict.Client(t)
+		defer client.Close()
+
+		Convey("Will need USER before PASS", func() {
+			reply := client.Expect(t, 503, "PASS 1234")
+			So(reply.Message, ShouldContainSubstring, "USER")
+			client.Login(t, "test", "1234")
+		})
+
+		Convey("Will need PORT or PASV before a transfer", func() {
+			client.Login(t, "test", "1234")
+			client.Run(t,
+				Step{"LIST", 503},
+				Step{"RETR /missing.txt", 503},
+				Step{"STOR /new.txt", 503},
+			)
+		})
+
+		Convey("Will need RNTO straight after RNFR", func() {
+			client.Login(t, "test", "1234")
+			client.Expect(t, 350, "RNFR /rename.txt")
+			reply := client.Expect(t, 503, "NOOP")
+			So(reply.Message, ShouldContainSubstring, "RNFR must be followed by RNTO")
+			client.Run(t,
+				Step{"RNTO /renamed.txt", 503},
+				Step{"RNFR /rename.txt", 350},
+				Step{"RNTO /renamed.txt", 250},
+				Step{"NOOP", 200},
+			)
+		})
+
+		Convey("Will need SITE CPTO straight after SITE CPFR", func() {
+			client.Login(t, "test", "1234")
+			client.Run(t,
+				Step{"SITE CPFR /file.txt", 350},
+				Step{"PWD", 503},
+				Step{"SITE CPTO /copy.txt", 503},
+			)
+		})
+
+		Convey("Will need a transfer straight after REST or RANG", func() {
+			client.Login(t, "test", "1234")
+			client.Run(t,
+				Step{"REST 2", 350},
+				Step{"SIZE /file.txt", 503},
+				Step{"RANG 0 1", 350},
+				Step{"MDTM /file.txt", 503},
+				Step{"NOOP", 200},
+			)
+		})
+
+		Convey("Will let QUIT end a sequence", func() {
+			client.Login(t, "test", "1234")
+			client.Expect(t, 350, "RNFR /file.txt")
+			client.Expect(t, 221, "QUIT")
+		})
+	})
+}
+
+func TestCommandInterceptors(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/keep/file.txt", []byte("data"))
+	factory.WriteFile("/old.txt", []byte("data"))
+	var mu sync.Mutex
+	var seen []string
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: factory,
+		CommandInterceptors: []graval.CommandInterceptor{
+			func(call *graval.CommandCall, next func()) {
+				next()
+				mu.Lock()
+				defer mu.Unlock()
+				seen = append(seen, fmt.Sprintf("%s %s %d", call.User, call.Command, call.Code))
+			},
+			func(call *graval.CommandCall, next func()) {
+				switch {
+				case call.Command == "DELE" && strings.HasPrefix(call.Param, "/keep/"):
+					call.Reply(550, "Files in /keep can't be deleted")
+				case call.Command == "XHELLO":
+					call.Reply(200, "Hello "+call.Param)
+				case call.Command == "CWD" && call.Param == "~":
+					call.Param = "/keep"
+					next()
+				case call.Command == "MKD":
+				default:
+					next()
+				}
+			},
+		},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	refused := client.Expect(t, 550, "DELE /keep/file.txt")
+	_, kept := factory.ReadFile("/keep/file.txt")
+	client.Expect(t, 250, "DELE /old.txt")
+	hello := client.Expect(t, 200, "XHELLO world")
+	client.Expect(t, 250, "CWD ~")
+	pwd := client.Expect(t, 257, "PWD")
+	client.Expect(t, 550, "MKD /new")
+
+	Convey("Command interceptors", t, func() {
+		Convey("Can refuse commands", func() {
+			So(refused.Message, ShouldContainSubstring, "can't be deleted")
+			So(kept, ShouldBeTrue)
+		})
+
+		Convey("Can answer commands graval doesn't know", func() {
+			So(hello.Message, ShouldEqual, "Hello world")
+		})
+
+		Convey("Can change a command's parameter", func() {
+			So(pwd.Message, ShouldContainSubstring, `"/keep"`)
+		})
+
+		Convey("Will refuse a command that an interceptor neither runs nor answers", func() {
+			_, made := factory.ReadFile("/new")
+			So(made, ShouldBeFalse)
+		})
+
+		Convey("See each command's reply once it's run", func() {
+			mu.Lock()
+			defer mu.Unlock()
+			So(seen, ShouldContain, " USER 331")
+			So(seen, ShouldContain, "test DELE 550")
+			So(seen, ShouldContain, "test DELE 250")
+			So(seen, ShouldContain, "test XHELLO 200")
+		})
+	})
+}
+
+func TestRegisterCommand(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.MakeDir("/docs")
+	server.FTPServer().RegisterCommand("XTOUCH", graval.Command{
+		RequireParam: true,
+		RequireAuth:  true,
+		Write:        true,
+		Handler: func(ctx *graval.CommandContext) {
+			if ctx.Driver().PutFile(ctx.Path(ctx.Param), strings.NewReader("")) {
+				ctx.Reply(250, "Touched "+ctx.Path(ctx.Param)+" for "+ctx.User)
+			} else {
+				ctx.Reply(550, "Unable to touch file")
+			}
+		},
+	})
+	server.FTPServer().RegisterCommand("syst", graval.Command{
+		Handler: func(ctx *graval.CommandContext) {
+			ctx.ReplyLines(215, "215-Custom system", "215 "+ctx.Command+" done")
+		},
+	})
+	client := server.Client(t)
+	defer client.Close()
+
+	anonymous := client.Expect(t, 530, "XTOUCH new.txt")
+	syst := client.Expect(t, 215, "SYST")
+	client.Login(t, "test", "1234")
+	client.Expect(t, 553, "XTOUCH")
+	client.Expect(t, 250, "CWD /docs")
+	touched := client.Expect(t, 250, "XTOUCH new.txt")
+	_, exists := factory.ReadFile("/docs/new.txt")
+	server.FTPServer().SetReadOnly(true)
+	readOnly := client.Expect(t, 550, "XTOUCH other.txt")
+	server.FTPServer().SetReadOnly(false)
+
+	Convey("A registered command", t, func() {
+		Convey("Will run in the session that sent it", func() {
+			So(touched.Message, ShouldEqual, "Touched /docs/new.txt for test")
+			So(exists, ShouldBeTrue)
+		})
+
+		Convey("Can replace one of graval's commands", func() {
+			So(syst.Message, ShouldContainSubstring, "Custom system")
+			So(syst.Message, ShouldContainSubstring, "SYST done")
+		})
+
+		Convey("Will need a login if it asks for one", func() {
+			So(anonymous.Message, ShouldContainSubstring, "not logged in")
+		})
+
+		Convey("Will be refused while the server is read-only if it writes", func() {
+			So(readOnly.Message, ShouldContainSubstring, "read-only")
+		})
+	})
+}
+
+// recordingTracer keeps every span it starts, with the span it was started
+// under.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer     *recordingTracer
+	name       string
+	parent     *recordedSpan
+	attributes map[string]interface{}
+	ended      bool
+	err        error
+}
+
+type recordedSpanKey struct{}
+
+func (tracer *recordingTracer) Start(ctx context.Context, name string) (context.Context, graval.Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	span := &recordedSpan{tracer: tracer, name: name, parent: parent, attributes: map[string]interface{}{}}
+	tracer.mu.Lock()
+	tracer.spans = append(tracer.spans, span)
+	tracer.mu.Unlock()
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+// find returns the first span with the given name, or nil.
+func (tracer *recordingTracer) find(name string) *recordedSpan {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	for _, span := range tracer.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func (span *recordedSpan) SetAttribute(key string, value interface{}) {
+	span.tracer.mu.Lock()
+	span.attributes[key] = value
+	span.tracer.mu.Unlock()
+}
+
+func (span *recordedSpan) End(err error) {
+	span.tracer.mu.Lock()
+	span.ended, span.err = true, err
+	span.tracer.mu.Unlock()
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/file.txt", []byte("data"))
+	server := NewServer(&graval.FTPServerOpts{Factory: factory, Tracer: tracer})
+	defer server.Close()
+	client := server.Client(t)
+	client.Login(t, "test", "1234")
+	_, retrieveErr := client.Retrieve("/file.txt")
+	client.Expect(t, 550, "DELE /missing.txt")
+	client.Close()
+
+	session := tracer.find("ftp.session")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		tracer.mu.Lock()
+		ended := session != nil && session.ended
+		tracer.mu.Unlock()
+		if ended {
+			break
+		}
+	}
+	retr := tracer.find("ftp.command RETR")
+	xfer := tracer.find("ftp.transfer")
+	dele := tracer.find("ftp.command DELE")
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	Convey("A server with a tracer", t, func() {
+		So(retrieveErr, ShouldBeNil)
+		So(session, ShouldNotBeNil)
+		So(retr, ShouldNotBeNil)
+		So(xfer, ShouldNotBeNil)
+		So(dele, ShouldNotBeNil)
+
+		Convey("Will start a root span for each session", func() {
+			So(session.parent, ShouldBeNil)
+			So(session.attributes["ftp.session_id"], ShouldNotBeEmpty)
+			So(session.ended, ShouldBeTrue)
+		})
+
+		Convey("Will start a span for each command under its session", func() {
+			So(retr.parent, ShouldEqual, session)
+			So(retr.attributes["ftp.user"], ShouldEqual, "test")
+			So(retr.attributes["ftp.reply_code"], ShouldEqual, 226)
+			So(retr.err, ShouldBeNil)
+		})
+
+		Convey("Will start a span for each transfer under its command", func() {
+			So(xfer.parent, ShouldEqual, retr)
+			So(xfer.attributes["ftp.path"], ShouldEqual, "/file.txt")
+			So(xfer.ended, ShouldBeTrue)
+			So(xfer.err, ShouldBeNil)
+		})
+
+		Convey("Will end the spans of failed commands with an error", func() {
+			So(dele.parent, ShouldEqual, session)
+			So(dele.attributes["ftp.reply_code"], ShouldEqual, 550)
+			So(dele.err, ShouldNotBeNil)
+		})
+	})
+}
+
+// sessionDriver records the session it finds in the context of each command.
+type sessionDriver struct {
+	*MemDriver
+	sessions chan<- *graval.Session
+}
+
+func (driver sessionDriver) SetTraceContext(ctx context.Context) {
+	driver.sessions <- graval.SessionFromContext(ctx)
+}
+
+type sessionDriverFactory struct {
+	*MemDriverFactory
+	sessions chan<- *graval.Session
+}
+
+func (factory sessionDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return sessionDriver{MemDriver: driver.(*MemDriver), sessions: factory.sessions}, nil
+}
+
+func TestSessionAccessors(t *testing.T) {
+	sessions := make(chan *graval.Session, 100)
+	factory := sessionDriverFactory{MemDriverFactory: NewMemDriverFactory(), sessions: sessions}
+	factory.MakeDir("/docs")
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+	server.FTPServer().RegisterCommand("XWHO", graval.Command{
+		Handler: func(ctx *graval.CommandContext) {
+			session := ctx.Session
+			ctx.Reply(200, fmt.Sprintf("%s %s %s %s", session.User(), session.CWD(), session.RemoteAddr(), session.LocalAddr()))
+		},
+	})
+	client := server.Client(t)
+	defer client.Close()
+	before := client.Expect(t, 200, "XWHO")
+	client.Login(t, "test", "1234")
+	client.Expect(t, 250, "CWD /docs")
+	after := client.Expect(t, 200, "XWHO")
+	var fromContext *graval.Session
+	for len(sessions) > 0 {
+		fromContext = <-sessions
+	}
+
+	Convey("A session", t, func() {
+		Convey("Will report who's logged in and where they are", func() {
+			So(before.Message, ShouldStartWith, " / 127.0.0.1:")
+			So(after.Message, ShouldStartWith, "test /docs 127.0.0.1:")
+			So(after.Message, ShouldEndWith, " "+server.Addr)
+		})
+
+		Convey("Can be found from the context given to the driver", func() {
+			So(fromContext, ShouldNotBeNil)
+			So(fromContext.User(), ShouldEqual, "test")
+			So(fromContext.Id(), ShouldNotBeEmpty)
+			So(fromContext.Values(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestTransferStats(t *testing.T) {
+	var mu sync.Mutex
+	var completed []*graval.CompletedTransfer
+	server := NewServer(&graval.FTPServerOpts{
+		TransferStatsInReplies: true,
+		TransferCompleteHook: func(transfer *graval.CompletedTransfer) {
+			mu.Lock()
+			defer mu.Unlock()
+			completed = append(completed, transfer)
+		},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	conn, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Expect(t, 150, "STOR /upload.txt")
+	conn.Write([]byte("hello"))
+	conn.Close()
+	stored := client.ExpectReply(t, 226)
+	conn, err = client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Expect(t, 150, "RETR /upload.txt")
+	ioutil.ReadAll(conn)
+	conn.Close()
+	retrieved := client.ExpectReply(t, 226)
+	conn, err = client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Expect(t, 150, "LIST")
+	ioutil.ReadAll(conn)
+	conn.Close()
+	listed := client.ExpectReply(t, 226)
+
+	Convey("Transfer stats", t, func() {
+		Convey("Will be added to the replies to transfers", func() {
+			So(stored.Message, ShouldStartWith, "Transfer complete. 5 B in ")
+			So(stored.Message, ShouldEndWith, "B/s")
+			So(retrieved.Message, ShouldStartWith, "Transfer complete. 5 B in ")
+		})
+
+		Convey("Won't be added to directory listings", func() {
+			So(listed.Message, ShouldEqual, "Transfer complete.")
+		})
+
+		Convey("Will be given to the hook", func() {
+			mu.Lock()
+			defer mu.Unlock()
+			So(len(completed), ShouldEqual, 2)
+			So(completed[0].Direction, ShouldEqual, "upload")
+			So(completed[0].Bytes, ShouldEqual, 5)
+			So(completed[1].Direction, ShouldEqual, "download")
+			So(completed[1].Path, ShouldEqual, "/upload.txt")
+		})
+	})
+}
+
+func TestMinTransferRate(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/large.bin", bytes.Repeat([]byte("x"), 32<<20))
+	var mu sync.Mutex
+	var failures []*graval.FailedTransfer
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:               factory,
+		Clock:                 clock,
+		MinTransferRate:       1024,
+		MinTransferRatePeriod: 3 * time.Second,
+		TransferFailureHook: func(failure *graval.FailedTransfer) {
+			mu.Lock()
+			defer mu.Unlock()
+			failures = append(failures, failure)
+		},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	// nothing reads the data connection, so the download stalls once the
+	// socket buffers fill
+	conn, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client.Expect(t, 150, "RETR /large.bin")
+	replies := make(chan *Reply, 1)
+	go func() {
+		reply, _ := client.ReadReply()
+		replies <- reply
+	}()
+	var aborted *Reply
+	for i := 0; i < 1000 && aborted == nil; i++ {
+		select {
+		case aborted = <-replies:
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Second)
+		}
+	}
+	afterAbort := client.Expect(t, 200, "NOOP")
+
+	Convey("A transfer below the minimum rate", t, func() {
+		Convey("Will be aborted with a 426 reply", func() {
+			So(aborted, ShouldNotBeNil)
+			So(aborted.Code, ShouldEqual, 426)
+			So(aborted.Message, ShouldContainSubstring, "minimum transfer rate")
+		})
+
+		Convey("Will free the session for other commands", func() {
+			So(afterAbort.Code, ShouldEqual, 200)
+			So(server.FTPServer().Transfers(), ShouldBeEmpty)
+		})
+
+		Convey("Will be reported as a failure", func() {
+			mu.Lock()
+			defer mu.Unlock()
+			So(len(failures), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestResumeVerification(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/good.txt", []byte("hello"))
+	factory.WriteFile("/bad.txt", []byte("HELLO"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	crc := fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte("hello")))
+
+	invalid := client.Expect(t, 501, "SITE XCRC nonsense")
+	client.Expect(t, 200, "SITE XCRC %s", crc)
+	goodErr := client.StoreAt("/good.txt", 5, []byte(" world"))
+	good, _ := factory.ReadFile("/good.txt")
+	client.Expect(t, 200, "SITE XCRC %s", crc)
+	badErr := client.StoreAt("/bad.txt", 5, []byte(" world"))
+	bad, _ := factory.ReadFile("/bad.txt")
+	againErr := client.StoreAt("/bad.txt", 5, []byte(" world"))
+
+	// REST only applies to the next command, so SITE XCRC after it leaves a
+	// STOR that would replace the file unchecked
+	factory.WriteFile("/late.txt", []byte("HELLO"))
+	client.Expect(t, 350, "REST 5")
+	client.Expect(t, 200, "SITE XCRC %s", crc)
+	lateErr := client.Store("/late.txt", []byte("hello world"))
+	late, _ := factory.ReadFile("/late.txt")
+	client.Expect(t, 200, "SITE XCRC %s", crc)
+	noRestErr := client.Store("/late.txt", []byte("hello world"))
+	afterErr := client.Store("/late.txt", []byte("replaced"))
+
+	Convey("A resumed upload after SITE XCRC", t, func() {
+		Convey("Will append when the data already uploaded matches", func() {
+			So(goodErr, ShouldBeNil)
+			So(string(good), ShouldEqual, "hello world")
+		})
+
+		Convey("Will be refused when it doesn't", func() {
+			So(badErr, ShouldNotBeNil)
+			So(badErr.Error(), ShouldContainSubstring, "554")
+			So(string(bad), ShouldEqual, "HELLO")
+		})
+
+		Convey("Will only check the next upload", func() {
+			So(againErr, ShouldBeNil)
+			So(afterErr, ShouldBeNil)
+		})
+
+		Convey("Will need SITE XCRC, REST and STOR in that order", func() {
+			So(lateErr, ShouldNotBeNil)
+			So(lateErr.Error(), ShouldContainSubstring, "503")
+			So(string(late), ShouldEqual, "HELLO")
+			So(noRestErr, ShouldNotBeNil)
+			So(noRestErr.Error(), ShouldContainSubstring, "503")
+		})
+
+		Convey("Will need a CRC in hex", func() {
+			So(invalid.Message, ShouldContainSubstring, "CRC")
+		})
+	})
+}
+
+// rangeDriver records calls to ReadRange.
+type rangeDriver struct {
+	*MemDriver
+	ranges *[]string
+}
+
+func (driver rangeDriver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	*driver.ranges = append(*driver.ranges, fmt.Sprintf("%s %d %d", path, offset, length))
+	file, err := driver.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := ioutil.ReadAll(file)
+	return ioutil.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+type rangeDriverFactory struct {
+	*MemDriverFactory
+	ranges *[]string
+}
+
+func (factory rangeDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return rangeDriver{MemDriver: driver.(*MemDriver), ranges: factory.ranges}, nil
+}
+
+func retrieveRange(t *testing.T, client *Client, path string, start int, end int) string {
+	conn, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client.Expect(t, 350, "RANG %d %d", start, end)
+	client.Expect(t, 150, "RETR %s", path)
+	data, _ := ioutil.ReadAll(conn)
+	client.ExpectReply(t, 226)
+	return string(data)
+}
+
+func TestRange(t *testing.T) {
+	plain := NewServer(nil)
+	defer plain.Close()
+	plain.Factory.(*MemDriverFactory).WriteFile("/digits.txt", []byte("0123456789"))
+	client := plain.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	var ranges []string
+	memFactory := NewMemDriverFactory()
+	memFactory.WriteFile("/digits.txt", []byte("0123456789"))
+	ranged := NewServer(&graval.FTPServerOpts{Factory: rangeDriverFactory{MemDriverFactory: memFactory, ranges: &ranges}})
+	defer ranged.Close()
+	rangedClient := ranged.Client(t)
+	defer rangedClient.Close()
+	rangedClient.Login(t, "test", "1234")
+
+	feat := client.Expect(t, 211, "FEAT")
+	middle := retrieveRange(t, client, "/digits.txt", 2, 5)
+	fromDriver := retrieveRange(t, rangedClient, "/digits.txt", 7, 9)
+	client.Run(t,
+		Step{"RANG 5 2", 501},
+		Step{"RANG 1", 501},
+		Step{"RANG 1 0", 350},
+		Step{"RANG 0 1", 350},
+		Step{"STOR /digits.txt", 504},
+	)
+	whole, _ := client.Retrieve("/digits.txt")
+
+	Convey("Byte range downloads", t, func() {
+		Convey("Will be advertised in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, "RANG STREAM")
+		})
+
+		Convey("Will send the inclusive range of bytes requested", func() {
+			So(middle, ShouldEqual, "2345")
+		})
+
+		Convey("Will use the driver's ReadRange if it has one", func() {
+			So(fromDriver, ShouldEqual, "789")
+			So(ranges, ShouldResemble, []string{"/digits.txt 7 3"})
+		})
+
+		Convey("Will only apply to the next command", func() {
+			So(string(whole), ShouldEqual, "0123456789")
+		})
+	})
+}
+
+func TestCreateUploadDirs(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{CreateUploadDirs: true})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/file.txt", []byte("not a directory"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	nestedErr := client.Store("/camera/2026/10/16/image.jpg", []byte("jpeg"))
+	conflictErr := client.Store("/file.txt/image.jpg", []byte("jpeg"))
+
+	Convey("Uploading with CreateUploadDirs", t, func() {
+		Convey("Will create missing parent directories", func() {
+			So(nestedErr, ShouldBeNil)
+			data, ok := factory.ReadFile("/camera/2026/10/16/image.jpg")
+			So(ok, ShouldBeTrue)
+			So(string(data), ShouldEqual, "jpeg")
+		})
+
+		Convey("Will refuse when a parent is a file", func() {
+			So(conflictErr, ShouldNotBeNil)
+			So(conflictErr.Error(), ShouldContainSubstring, "553")
+		})
+	})
+}
+
+func TestFilenamePolicy(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{
+		FilenamePolicy: &graval.FilenamePolicy{StripControl: true, RejectWindowsReserved: true},
+	})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	strippedErr := client.Store("/bell\x07.txt", []byte("ding"))
+	client.Run(t,
+		Step{"MKD /nul", 553},
+		Step{"CWD /com1", 553},
+	)
+
+	Convey("A server with a filename policy", t, func() {
+		Convey("Will clean up paths before they reach the driver", func() {
+			So(strippedErr, ShouldBeNil)
+			_, ok := factory.ReadFile("/bell.txt")
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{MaxUploadSize: 10})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	exactErr := client.Store("/exact.txt", []byte("0123456789"))
+	largeErr := client.Store("/large.txt", []byte("0123456789a"))
+	client.Store("/resumed.txt", []byte("01234"))
+	resumedErr := client.StoreAt("/resumed.txt", 5, []byte("56789a"))
+
+	userServer := NewServer(&graval.FTPServerOpts{
+		MaxUploadSize: 10,
+		UserMaxUploadSize: func(user string) int64 {
+			if user == "test" {
+				return 20
+			}
+			return 0
+		},
+	})
+	defer userServer.Close()
+	userFactory := userServer.Factory.(*MemDriverFactory)
+	userClient := userServer.Client(t)
+	defer userClient.Close()
+	userClient.Login(t, "test", "1234")
+
+	userErr := userClient.Store("/user.txt", []byte("0123456789abcdef"))
+
+	Convey("A server with a maximum upload size", t, func() {
+		Convey("Will accept uploads up to the limit", func() {
+			So(exactErr, ShouldBeNil)
+			_, ok := factory.ReadFile("/exact.txt")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Will refuse larger uploads and remove what was written", func() {
+			So(largeErr, ShouldNotBeNil)
+			So(largeErr.Error(), ShouldContainSubstring, "552")
+			_, ok := factory.ReadFile("/large.txt")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Will refuse a resumed upload that goes over the limit, keeping what came before", func() {
+			So(resumedErr, ShouldNotBeNil)
+			So(resumedErr.Error(), ShouldContainSubstring, "552")
+			data, _ := factory.ReadFile("/resumed.txt")
+			So(string(data), ShouldEqual, "01234")
+		})
+
+		Convey("Will use a per-user limit in place of the server's", func() {
+			So(userErr, ShouldBeNil)
+			_, ok := userFactory.ReadFile("/user.txt")
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func TestCommandRateLimit(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{CommandRateLimit: 1, CommandBurst: 1})
+	defer server.Close()
+	first := server.Client(t)
+	defer first.Close()
+	second := server.Client(t)
+	defer second.Close()
+	third := server.Client(t)
+	defer third.Close()
+
+	first.Expect(t, 200, "NOOP")
+	// the second client has to wait for the bucket to refill, which leaves
+	// the third a whole burst behind
+	started := time.Now()
+	second.Send("NOOP")
+	time.Sleep(100 * time.Millisecond)
+	thirdReply, _ := third.Cmd("NOOP")
+	_, thirdErr := third.ReadReply()
+	secondReply, _ := second.ReadReply()
+	secondWait := time.Since(started)
+
+	Convey("A server with a command rate limit", t, func() {
+		Convey("Will slow down clients over the rate", func() {
+			So(secondReply.Code, ShouldEqual, 200)
+			So(secondWait, ShouldBeGreaterThanOrEqualTo, 900*time.Millisecond)
+		})
+
+		Convey("Will disconnect clients that are too far over it", func() {
+			So(thirdReply.Code, ShouldEqual, 421)
+			So(thirdErr, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestAuthFailureDelay(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{
+		AuthFailureDelay: 100 * time.Millisecond,
+		AuthTarpitMax:    time.Second,
+	})
+	defer server.Close()
+
+	var waits []time.Duration
+	for i := 0; i < 2; i++ {
+		client := server.Client(t)
+		client.Expect(t, 331, "USER test")
+		started := time.Now()
+		client.Expect(t, 530, "PASS wrong")
+		waits = append(waits, time.Since(started))
+		client.Close()
+	}
+	client := server.Client(t)
+	defer client.Close()
+	started := time.Now()
+	client.Login(t, "test", "1234")
+	loginWait := time.Since(started)
+
+	Convey("A server with an auth failure delay", t, func() {
+		Convey("Will wait before refusing a login", func() {
+			So(waits[0], ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+		})
+
+		Convey("Will wait longer for repeat offenders", func() {
+			So(waits[1], ShouldBeGreaterThanOrEqualTo, 200*time.Millisecond)
+		})
+
+		Convey("Will not delay a successful login", func() {
+			So(loginWait, ShouldBeLessThan, 100*time.Millisecond)
+		})
+	})
+}
+
+func TestBans(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{BanAfterFailedLogins: 2})
+	defer server.Close()
+
+	var replies []int
+	for i := 0; i < 2; i++ {
+		client := server.Client(t)
+		client.Expect(t, 331, "USER test")
+		reply, _ := client.Cmd("PASS wrong")
+		replies = append(replies, reply.Code)
+		client.Close()
+	}
+	_, bannedErr := Dial(server.Addr)
+	bans := server.FTPServer().Bans()
+	server.FTPServer().Unban("127.0.0.1")
+	unbanned, unbannedErr := Dial(server.Addr)
+	unbanned.Login(t, "test", "1234")
+	server.FTPServer().Ban("127.0.0.1", time.Minute)
+	_, disconnectedErr := unbanned.Cmd("NOOP")
+	unbanned.Close()
+
+	Convey("A server that bans clients after failed logins", t, func() {
+		Convey("Will still reply to the failed login", func() {
+			So(replies, ShouldResemble, []int{530, 530})
+		})
+
+		Convey("Will refuse connections from banned IPs", func() {
+			So(bannedErr, ShouldNotBeNil)
+			So(bannedErr.Error(), ShouldContainSubstring, "421")
+			So(bans, ShouldContainKey, "127.0.0.1")
+		})
+
+		Convey("Will accept connections again after an unban", func() {
+			So(unbannedErr, ShouldBeNil)
+		})
+
+		Convey("Will disconnect open sessions when an IP is banned", func() {
+			So(disconnectedErr, ShouldNotBeNil)
+		})
+	})
+}
+
+// eventRecorder keeps the security events sent by a server.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []graval.SecurityEvent
+}
+
+func (recorder *eventRecorder) Notify(event *graval.SecurityEvent) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.events = append(recorder.events, *event)
+}
+
+func (recorder *eventRecorder) find(eventType string) *graval.SecurityEvent {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	for _, event := range recorder.events {
+		if event.Type == eventType {
+			return &event
+		}
+	}
+	return nil
+}
+
+func (recorder *eventRecorder) details(eventType string) []string {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	details := []string{}
+	for _, event := range recorder.events {
+		if event.Type == eventType {
+			details = append(details, event.Detail)
+		}
+	}
+	return details
+}
+
+func (recorder *eventRecorder) count(eventType string) int {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	count := 0
+	for _, event := range recorder.events {
+		if event.Type == eventType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSecurityEvents(t *testing.T) {
+	recorder := &eventRecorder{}
+	serverTLS, clientTLS := NewTLSConfigs()
+	server := NewServer(&graval.FTPServerOpts{
+		SecurityNotifier: recorder,
+		TLSConfig:        serverTLS,
+		DataTLSConfig:    &tls.Config{MinVersion: tls.VersionTLS13},
+	})
+	defer server.Close()
+
+	failed := server.Client(t)
+	failed.Expect(t, 331, "USER mallory")
+	failed.Expect(t, 530, "PASS guess")
+	failed.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	client.Run(t,
+		Step{"CWD ..", 250},
+		Step{"CWD ../../etc", 550},
+		Step{"PORT 127,0,0,2,0,1", 504},
+	)
+	traversals := recorder.count(graval.SecurityPathTraversal)
+
+	// the server closes the connection once it has reported the failure
+	oldTLS := clientTLS.Clone()
+	oldTLS.MinVersion = tls.VersionTLS10
+	oldTLS.MaxVersion = tls.VersionTLS10
+	control := server.Client(t)
+	defer control.Close()
+	controlErr := control.AuthTLS(oldTLS)
+	control.ReadReply()
+
+	// the 522 reply comes after the failure is reported
+	weakTLS := clientTLS.Clone()
+	weakTLS.MaxVersion = tls.VersionTLS12
+	data := server.Client(t)
+	defer data.Close()
+	data.AuthTLS(clientTLS)
+	data.Login(t, "test", "1234")
+	data.Protect(weakTLS)
+	data.Store("/weak.txt", []byte("weak"))
+	data.ReadReply()
+	tlsFailures := recorder.details(graval.SecurityTLSFailure)
+
+	Convey("A server with a security notifier", t, func() {
+		Convey("Will report failed logins", func() {
+			event := recorder.find(graval.SecurityAuthFailure)
+			So(event, ShouldNotBeNil)
+			So(event.User, ShouldEqual, "mallory")
+			So(event.Detail, ShouldEqual, "mallory")
+			So(event.RemoteIP, ShouldEqual, "127.0.0.1")
+		})
+
+		Convey("Will report attempts to climb above the root", func() {
+			event := recorder.find(graval.SecurityPathTraversal)
+			So(event, ShouldNotBeNil)
+			So(event.User, ShouldEqual, "test")
+			So(event.Detail, ShouldEqual, "../../etc")
+			So(traversals, ShouldEqual, 1)
+		})
+
+		Convey("Will report and refuse active connections to other hosts", func() {
+			event := recorder.find(graval.SecurityBounceAttempt)
+			So(event, ShouldNotBeNil)
+			So(event.Detail, ShouldEqual, "127.0.0.2:1")
+		})
+
+		Convey("Will report failed TLS handshakes on control and data connections", func() {
+			So(controlErr, ShouldNotBeNil)
+			So(tlsFailures, ShouldHaveLength, 2)
+			So(tlsFailures[0], ShouldStartWith, "control: ")
+			So(tlsFailures[1], ShouldStartWith, "data: ")
+		})
+	})
+}
+
+// panicDriver panics while listing directories and downloading files.
+type panicDriver struct {
+	*MemDriver
+}
+
+func (driver panicDriver) DirContents(path string) []os.FileInfo {
+	panic("listing failed")
+}
+
+func (driver panicDriver) GetFile(path string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(panicReader{}), nil
+}
+
+type panicReader struct{}
+
+func (panicReader) Read(p []byte) (int, error) {
+	panic("read failed")
+}
+
+type panicDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory panicDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return panicDriver{MemDriver: driver.(*MemDriver)}, nil
+}
+
+func TestPanicRecovery(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/file.txt", []byte("data"))
+	server := NewServer(&graval.FTPServerOpts{Factory: panicDriverFactory{MemDriverFactory: factory}})
+	defer server.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	listing, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listing.Close()
+	client.Expect(t, 150, "NLST")
+	nlstReply, _ := client.ReadReply()
+	_, nlstErr := client.Cmd("NOOP")
+
+	downloader := server.Client(t)
+	defer downloader.Close()
+	downloader.Login(t, "test", "1234")
+	conn, err := downloader.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	downloader.Expect(t, 150, "RETR /file.txt")
+	abortReply, _ := downloader.ReadReply()
+	closeReply, _ := downloader.ReadReply()
+
+	later := server.Client(t)
+	defer later.Close()
+	later.Login(t, "test", "1234")
+	laterReply, _ := later.Cmd("PWD")
+	stats := server.FTPServer().Stats()
+
+	Convey("A session whose driver panics", t, func() {
+		Convey("Will be ended with a 421", func() {
+			So(nlstReply.Code, ShouldEqual, 421)
+			So(nlstErr, ShouldNotBeNil)
+		})
+
+		Convey("Will abort a transfer in progress with a 451", func() {
+			So(abortReply.Code, ShouldEqual, 451)
+			So(closeReply.Code, ShouldEqual, 421)
+			So(stats.ActiveTransfers, ShouldEqual, 0)
+		})
+
+		Convey("Will not affect other sessions", func() {
+			So(laterReply.Code, ShouldEqual, 257)
+		})
+	})
+}
+
+func TestSessionTeardown(t *testing.T) {
+	// goroutines left by earlier tests aren't this test's leaks
+	earlier := goleak.IgnoreCurrent()
+	server := NewServer(&graval.FTPServerOpts{IdleTimeout: 100 * time.Millisecond})
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/file.txt", []byte("data"))
+
+	quitter := server.Client(t)
+	quitter.Login(t, "test", "1234")
+	quitter.Run(t,
+		Step{"RNFR /file.txt", 350},
+		Step{"PASV", 227},
+	)
+	quitReply, _ := quitter.Cmd("QUIT")
+	_, quitErr := quitter.ReadReply()
+	quitter.Close()
+
+	idle := server.Client(t)
+	idle.Login(t, "test", "1234")
+	pasv := idle.Expect(t, 227, "PASV")
+	idleReply, _ := idle.ReadReply()
+	_, idleErr := idle.ReadReply()
+	idle.Close()
+	pasvPort := pasvRegexp.FindStringSubmatch(pasv.Message)
+	_, pasvErr := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pasvPortNumber(pasvPort)))
+
+	dropped := server.Client(t)
+	dropped.Login(t, "test", "1234")
+	dropped.Expect(t, 227, "PASV")
+	dropped.Close()
+
+	uploader := server.Client(t)
+	uploader.Login(t, "test", "1234")
+	data, err := uploader.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader.Expect(t, 150, "STOR /stalled.txt")
+	data.Write([]byte("partial"))
+
+	shutdownErr := server.FTPServer().Shutdown()
+	shutdownReply, _ := uploader.ReadReply()
+	uploader.Close()
+	data.Close()
+	server.Close()
+	leaks := goleak.Find(earlier)
+	stats := server.FTPServer().Stats()
+
+	Convey("Sessions ended", t, func() {
+		Convey("By QUIT will close the control connection", func() {
+			So(quitReply.Code, ShouldEqual, 221)
+			So(quitErr, ShouldNotBeNil)
+		})
+
+		Convey("By a timeout will close their passive listener", func() {
+			So(idleReply.Code, ShouldEqual, 421)
+			So(idleErr, ShouldNotBeNil)
+			So(pasvErr, ShouldNotBeNil)
+		})
+
+		Convey("By a shutdown will be told why", func() {
+			So(shutdownErr, ShouldBeNil)
+			So(shutdownReply.Code, ShouldEqual, 421)
+		})
+
+		Convey("Will release all their resources", func() {
+			So(stats.ActiveConnections, ShouldEqual, 0)
+			So(stats.ActiveTransfers, ShouldEqual, 0)
+			So(leaks, ShouldBeNil)
+		})
+	})
+}
+
+func pasvPortNumber(match []string) int {
+	high, _ := strconv.Atoi(match[5])
+	low, _ := strconv.Atoi(match[6])
+	return high*256 + low
+}
+
+func TestMaxTransfers(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{MaxTransfers: 1})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/file.txt", []byte("data"))
+
+	uploader := server.Client(t)
+	defer uploader.Close()
+	uploader.Login(t, "test", "1234")
+	data, err := uploader.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader.Expect(t, 150, "STOR /upload.txt")
+	data.Write([]byte("upload"))
+
+	downloader := server.Client(t)
+	defer downloader.Close()
+	downloader.Login(t, "test", "1234")
+	busyData, err := downloader.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busyData.Close()
+	busyReply, _ := downloader.Cmd("RETR /file.txt")
+
+	data.Close()
+	uploader.ExpectReply(t, 226)
+	retried, retryErr := downloader.Retrieve("/file.txt")
+
+	Convey("A server with a cap on transfers", t, func() {
+		Convey("Will ask clients to try again when it's reached", func() {
+			So(busyReply.Code, ShouldEqual, 450)
+		})
+
+		Convey("Will free the slot when a transfer finishes", func() {
+			So(retryErr, ShouldBeNil)
+			So(string(retried), ShouldEqual, "data")
+		})
+	})
+}
+
+func TestPipelining(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/file.txt", []byte("pipelined"))
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	client.Send("TYPE I\r\nPASV\r\nRETR /file.txt")
+	typeReply, _ := client.ReadReply()
+	pasvReply, _ := client.ReadReply()
+	var data []byte
+	if match := pasvRegexp.FindStringSubmatch(pasvReply.Message); match != nil {
+		if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", pasvPortNumber(match))); err == nil {
+			data, _ = ioutil.ReadAll(conn)
+			conn.Close()
+		}
+	}
+	startReply, _ := client.ReadReply()
+	completeReply, _ := client.ReadReply()
+
+	raw, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.Write([]byte("NOOP\r\nPWD"))
+	raw.(*net.TCPConn).CloseWrite()
+	unterminated, _ := ioutil.ReadAll(raw)
+
+	Convey("Commands sent together", t, func() {
+		Convey("Will each be answered in order", func() {
+			So(typeReply.Code, ShouldEqual, 200)
+			So(pasvReply.Code, ShouldEqual, 227)
+			So(startReply.Code, ShouldEqual, 150)
+			So(completeReply.Code, ShouldEqual, 226)
+			So(string(data), ShouldEqual, "pipelined")
+		})
+
+		Convey("Will include a final command without a line ending", func() {
+			So(string(unterminated), ShouldContainSubstring, "200 ")
+			So(string(unterminated), ShouldContainSubstring, "530 ")
+		})
+	})
+}
+
+func TestReplySequencing(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/file.txt", []byte("data"))
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	client.Run(t,
+		Step{"LIST", 425},
+		Step{"RETR /file.txt", 425},
+		Step{"STOR /other.txt", 425},
+	)
+	_, retrieveErr := client.Retrieve("/file.txt")
+	reusedReply, _ := client.Cmd("RETR /file.txt")
+	quitReply, _ := client.Cmd("QUIT")
+	stats := server.FTPServer().Stats()
+
+	Convey("Replies to transfer commands", t, func() {
+		Convey("Will refuse a transfer without a data connection", func() {
+			So(retrieveErr, ShouldBeNil)
+			So(reusedReply.Code, ShouldEqual, 425)
+		})
+
+		Convey("Will say goodbye to QUIT", func() {
+			So(quitReply.Code, ShouldEqual, 221)
+		})
+
+		Convey("Will each be answered once", func() {
+			So(stats.ReplyErrors, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestTCPTuning(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{
+		KeepAlivePeriod:    30 * time.Second,
+		DataConnBufferSize: 256 * 1024,
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	data := bytes.Repeat([]byte("tuned"), 100000)
+	storeErr := client.Store("/tuned.bin", data)
+	retrieved, retrieveErr := client.Retrieve("/tuned.bin")
+
+	Convey("A server with TCP tuning options", t, func() {
+		Convey("Will still transfer files", func() {
+			So(storeErr, ShouldBeNil)
+			So(retrieveErr, ShouldBeNil)
+			So(bytes.Equal(retrieved, data), ShouldBeTrue)
+		})
+	})
+}
+
+func TestPriorityClasses(t *testing.T) {
+	priorities := map[string]int{"premium": 1}
+	factory := NewMemDriverFactory()
+	factory.Users["premium"] = "5678"
+	factory.WriteFile("/file.bin", bytes.Repeat([]byte("x"), 64*1024))
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:           factory,
+		MaxTransfers:      2,
+		ReservedTransfers: 1,
+		MaxBandwidth:      128 * 1024,
+		UserPriority:      func(user string) int { return priorities[user] },
+	})
+	defer server.Close()
+
+	normal := server.Client(t)
+	defer normal.Close()
+	normal.Login(t, "test", "1234")
+	data, err := normal.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	normal.Expect(t, 150, "STOR /upload.bin")
+	data.Write([]byte("upload"))
+
+	other := server.Client(t)
+	defer other.Close()
+	other.Login(t, "test", "1234")
+	otherData, err := other.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherData.Close()
+	normalReply, _ := other.Cmd("RETR /file.bin")
+
+	premium := server.Client(t)
+	defer premium.Close()
+	premium.Login(t, "premium", "5678")
+	started := time.Now()
+	retrieved, premiumErr := premium.Retrieve("/file.bin")
+	elapsed := time.Since(started)
+
+	data.Close()
+	normal.ExpectReply(t, 226)
+
+	Convey("A server with priority classes", t, func() {
+		Convey("Will keep reserved transfer slots for priority users", func() {
+			So(normalReply.Code, ShouldEqual, 450)
+			So(premiumErr, ShouldBeNil)
+			So(len(retrieved), ShouldEqual, 64*1024)
+		})
+
+		Convey("Will limit transfers to the maximum bandwidth", func() {
+			So(elapsed, ShouldBeGreaterThanOrEqualTo, 200*time.Millisecond)
+		})
+	})
+}
+
+// countingDriverFactory counts the drivers it creates.
+type countingDriverFactory struct {
+	*MemDriverFactory
+	mu      sync.Mutex
+	created int
+}
+
+func (factory *countingDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	factory.mu.Lock()
+	factory.created++
+	factory.mu.Unlock()
+	return factory.MemDriverFactory.NewDriver()
+}
+
+func (factory *countingDriverFactory) count() int {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	return factory.created
+}
+
+func TestMaintenance(t *testing.T) {
+	factory := &countingDriverFactory{MemDriverFactory: NewMemDriverFactory()}
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+	ftpServer := server.FTPServer()
+
+	ftpServer.ScheduleMaintenance(time.Now().Add(time.Hour), 2*time.Hour, "Down for upgrades")
+	early := server.Client(t)
+	defer early.Close()
+	refused, _ := early.Cmd("USER test")
+	ftpServer.CancelMaintenance()
+
+	idle := server.Client(t)
+	defer idle.Close()
+	idle.Login(t, "test", "1234")
+	uploader := server.Client(t)
+	defer uploader.Close()
+	uploader.Login(t, "test", "1234")
+	data, err := uploader.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader.Expect(t, 150, "STOR /upload.txt")
+	data.Write([]byte("draining"))
+
+	drained := ftpServer.ScheduleMaintenance(time.Now(), 0, "")
+	idleReply, _ := idle.ReadReply()
+	_, idleErr := idle.ReadReply()
+
+	driversBefore := factory.count()
+	raw, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	greeting, _ := ioutil.ReadAll(raw)
+	refusedDrivers := factory.count() - driversBefore
+
+	data.Write([]byte(" upload"))
+	data.Close()
+	completeReply, _ := uploader.ReadReply()
+	closingReply, _ := uploader.ReadReply()
+	uploaded, _ := factory.ReadFile("/upload.txt")
+
+	drainedInTime := false
+	select {
+	case <-drained:
+		drainedInTime = true
+	case <-time.After(5 * time.Second):
+	}
+
+	Convey("A maintenance window", t, func() {
+		Convey("Will refuse logins after the cutoff", func() {
+			So(refused.Code, ShouldEqual, 421)
+			So(refused.Message, ShouldContainSubstring, "Down for upgrades")
+		})
+
+		Convey("Will close idle sessions when it starts", func() {
+			So(idleReply.Code, ShouldEqual, 421)
+			So(idleReply.Message, ShouldContainSubstring, "maintenance")
+			So(idleErr, ShouldNotBeNil)
+		})
+
+		Convey("Will refuse new connections once it's started", func() {
+			So(string(greeting), ShouldStartWith, "421 ")
+			So(refusedDrivers, ShouldEqual, 0)
+		})
+
+		Convey("Will let transfers in progress finish", func() {
+			So(completeReply.Code, ShouldEqual, 226)
+			So(string(uploaded), ShouldEqual, "draining upload")
+			So(closingReply.Code, ShouldEqual, 421)
+		})
+
+		Convey("Will report when every session has ended", func() {
+			So(drainedInTime, ShouldBeTrue)
+		})
+	})
+}
+
+func TestAvailableSpace(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.Capacity = 100
+	factory.WriteFile("/dir/file.txt", bytes.Repeat([]byte("x"), 40))
+	server := NewServer(&graval.FTPServerOpts{Factory: factory, MaxUploadSize: 80})
+	defer server.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	feat, _ := client.Cmd("FEAT")
+	avbl, _ := client.Cmd("AVBL")
+	avblDir, _ := client.Cmd("AVBL /dir")
+	avblFile, _ := client.Cmd("AVBL /dir/file.txt")
+	quota, _ := client.Cmd("SITE QUOTA")
+	help, _ := client.Cmd("SITE HELP")
+	unknown, _ := client.Cmd("SITE NONSENSE")
+	overErr := client.Store("/big.txt", bytes.Repeat([]byte("x"), 70))
+
+	unlimited := NewServer(nil)
+	defer unlimited.Close()
+	other := unlimited.Client(t)
+	defer other.Close()
+	other.Login(t, "test", "1234")
+	unknownSpace, _ := other.Cmd("AVBL")
+
+	Convey("A driver that reports available space", t, func() {
+		Convey("Will be advertised in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, "AVBL")
+		})
+
+		Convey("Will answer AVBL for directories", func() {
+			So(avbl.Code, ShouldEqual, 213)
+			So(avbl.Message, ShouldEqual, "60")
+			So(avblDir.Code, ShouldEqual, 213)
+			So(avblFile.Code, ShouldEqual, 550)
+		})
+
+		Convey("Will answer SITE QUOTA", func() {
+			So(quota.Code, ShouldEqual, 200)
+			So(quota.Message, ShouldContainSubstring, "Available space: 60 bytes")
+			So(quota.Message, ShouldContainSubstring, "Maximum upload size: 80 bytes")
+		})
+
+		Convey("Will refuse uploads that don't fit", func() {
+			So(overErr, ShouldNotBeNil)
+		})
+
+		Convey("Will reply 550 if the space is unknown", func() {
+			So(unknownSpace.Code, ShouldEqual, 550)
+		})
+	})
+
+	Convey("The SITE command", t, func() {
+		Convey("Will list its subcommands", func() {
+			So(help.Code, ShouldEqual, 214)
+			So(help.Message, ShouldContainSubstring, "QUOTA")
+		})
+
+		Convey("Will refuse unknown subcommands", func() {
+			So(unknown.Code, ShouldEqual, 504)
+		})
+	})
+}
+
+func TestSymlinks(t *testing.T) {
+	listings := map[graval.SymlinkMode]string{}
+	var machine string
+	var mlst *Reply
+	for _, mode := range []graval.SymlinkMode{graval.ListSymlinks, graval.ResolveSymlinks, graval.HideSymlinks} {
+		factory := NewMemDriverFactory()
+		factory.WriteFile("/data/file.txt", []byte("data"))
+		factory.Symlink("/link.txt", "data/file.txt")
+		factory.Symlink("/dangling", "/missing")
+		server := NewServer(&graval.FTPServerOpts{Factory: factory, Symlinks: mode})
+		client := server.Client(t)
+		client.Login(t, "test", "1234")
+		listings[mode], _ = client.List("/")
+		if mode == graval.ListSymlinks {
+			data, _ := client.readData("MLSD /")
+			machine = string(data)
+			mlst, _ = client.Cmd("MLST /data/file.txt")
+		}
+		client.Close()
+		server.Close()
+	}
+
+	Convey("Symlinks in listings", t, func() {
+		Convey("Will be listed with their targets by default", func() {
+			So(listings[graval.ListSymlinks], ShouldContainSubstring, " link.txt -> data/file.txt\r\n")
+			So(listings[graval.ListSymlinks], ShouldContainSubstring, "lrwxrwxrwx")
+			So(machine, ShouldContainSubstring, "type=OS.unix=slink:data/file.txt;")
+			So(machine, ShouldContainSubstring, "type=dir;")
+		})
+
+		Convey("Will be shown as their targets when resolved", func() {
+			So(listings[graval.ResolveSymlinks], ShouldContainSubstring, "            4 ")
+			So(listings[graval.ResolveSymlinks], ShouldContainSubstring, " link.txt\r\n")
+			So(listings[graval.ResolveSymlinks], ShouldNotContainSubstring, "dangling")
+			So(listings[graval.ResolveSymlinks], ShouldNotContainSubstring, "->")
+		})
+
+		Convey("Will be left out when hidden", func() {
+			So(listings[graval.HideSymlinks], ShouldNotContainSubstring, "link.txt")
+			So(listings[graval.HideSymlinks], ShouldContainSubstring, "data")
+		})
+	})
+
+	Convey("MLST", t, func() {
+		Convey("Will describe a single file", func() {
+			So(mlst.Code, ShouldEqual, 250)
+			So(mlst.Message, ShouldContainSubstring, "type=file;size=4;")
+		})
+	})
+}
+
+func TestListOwner(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{ListOwner: "ftp", ListGroup: "ftpusers"})
+	defer server.Close()
+	server.Factory.(*MemDriverFactory).WriteFile("/file.txt", []byte("data"))
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	listing, _ := client.List("/")
+
+	Convey("A server with a default listing owner", t, func() {
+		Convey("Will show it for files without an owner", func() {
+			So(listing, ShouldContainSubstring, " 1 ftp ftpusers ")
+		})
+	})
+}
+
+func TestSubsecondTimes(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{SubsecondTimes: true})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/file.txt", []byte("data"))
+	driver, _ := factory.NewDriver()
+	modTime, _ := driver.ModifiedTime("/file.txt")
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	mdtm, _ := client.Cmd("MDTM /file.txt")
+
+	Convey("A server with sub-second times", t, func() {
+		Convey("Will send MDTM in UTC with milliseconds", func() {
+			So(mdtm.Code, ShouldEqual, 213)
+			So(mdtm.Message, ShouldEqual, modTime.UTC().Format("20060102150405.000"))
+		})
+	})
+}
+
+func TestSetFacts(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	server.Factory.(*MemDriverFactory).WriteFile("/file.txt", []byte("data"))
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	feat, _ := client.Cmd("FEAT")
+	mfmt, _ := client.Cmd("MFMT 20190825130000 file.txt")
+	mdtm, _ := client.Cmd("MDTM file.txt")
+	mff, _ := client.Cmd("MFF modify=20200101000000.5; /file.txt")
+	mdtmAfter, _ := client.Cmd("MDTM file.txt")
+	mfct, _ := client.Cmd("MFCT 20190825130000 file.txt")
+	badTime, _ := client.Cmd("MFMT yesterday file.txt")
+	missing, _ := client.Cmd("MFMT 20190825130000 missing.txt")
+	noPath, _ := client.Cmd("MFMT 20190825130000")
+
+	Convey("Changing facts about files", t, func() {
+		Convey("Will be advertised in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, " MFMT")
+			So(feat.Message, ShouldContainSubstring, " MFF Modify;")
+			So(feat.Message, ShouldNotContainSubstring, " MFCT")
+		})
+
+		Convey("Will set the modification time with MFMT", func() {
+			So(mfmt.Code, ShouldEqual, 213)
+			So(mfmt.Message, ShouldEqual, "Modify=20190825130000; file.txt")
+			So(mdtm.Message, ShouldEqual, "20190825130000")
+		})
+
+		Convey("Will set facts with MFF", func() {
+			So(mff.Code, ShouldEqual, 213)
+			So(mff.Message, ShouldEqual, "Modify=20200101000000.5; /file.txt")
+			So(mdtmAfter.Message, ShouldEqual, "20200101000000")
+		})
+
+		Convey("Will refuse facts the driver can't change", func() {
+			So(mfct.Code, ShouldEqual, 504)
+		})
+
+		Convey("Will refuse bad requests", func() {
+			So(badTime.Code, ShouldEqual, 501)
+			So(missing.Code, ShouldEqual, 550)
+			So(noPath.Code, ShouldEqual, 501)
+		})
+	})
+}
+
+// copyDriver records calls to Copy, and copies with the fallback anyway.
+type copyDriver struct {
+	*MemDriver
+	copies *[]string
+}
+
+func (driver copyDriver) Copy(fromPath string, toPath string) bool {
+	*driver.copies = append(*driver.copies, fromPath+" "+toPath)
+	reader, err := driver.GetFile(fromPath)
+	if err != nil {
+		return false
+	}
+	return driver.PutFile(toPath, reader)
+}
+
+type copyDriverFactory struct {
+	*MemDriverFactory
+	copies *[]string
+}
+
+func (factory copyDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return copyDriver{MemDriver: driver.(*MemDriver), copies: factory.copies}, nil
+}
+
+func TestSiteCopy(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/file.txt", []byte("data"))
+	factory.WriteFile("/tree/a.txt", []byte("a"))
+	factory.WriteFile("/tree/sub/b.txt", []byte("b"))
+	factory.Symlink("/tree/link", "a.txt")
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	client.Expect(t, 350, "SITE CPFR file.txt")
+	fileReply, _ := client.Cmd("SITE CPTO copy.txt")
+	client.Expect(t, 350, "SITE CPFR /tree")
+	treeReply, _ := client.Cmd("SITE CPTO /tree2")
+	client.Expect(t, 350, "SITE CPFR file.txt")
+	existsReply, _ := client.Cmd("SITE CPTO copy.txt")
+	client.Expect(t, 350, "SITE CPFR /tree")
+	intoItself, _ := client.Cmd("SITE CPTO /tree/inner")
+	noSource, _ := client.Cmd("SITE CPTO other.txt")
+	missing, _ := client.Cmd("SITE CPFR missing.txt")
+	copied, _ := factory.ReadFile("/copy.txt")
+	treeA, _ := factory.ReadFile("/tree2/a.txt")
+	treeB, _ := factory.ReadFile("/tree2/sub/b.txt")
+	listing, _ := client.List("/tree2")
+
+	var copies []string
+	native := NewServer(&graval.FTPServerOpts{Factory: copyDriverFactory{MemDriverFactory: NewMemDriverFactory(), copies: &copies}})
+	defer native.Close()
+	nativeClient := native.Client(t)
+	defer nativeClient.Close()
+	nativeClient.Login(t, "test", "1234")
+	nativeClient.Store("/file.txt", []byte("data"))
+	nativeClient.Expect(t, 350, "SITE CPFR file.txt")
+	nativeReply, _ := nativeClient.Cmd("SITE CPTO copy.txt")
+
+	Convey("Copying on the server", t, func() {
+		Convey("Will copy a file", func() {
+			So(fileReply.Code, ShouldEqual, 250)
+			So(string(copied), ShouldEqual, "data")
+		})
+
+		Convey("Will copy a directory tree without its symlinks", func() {
+			So(treeReply.Code, ShouldEqual, 250)
+			So(string(treeA), ShouldEqual, "a")
+			So(string(treeB), ShouldEqual, "b")
+			So(listing, ShouldNotContainSubstring, "link")
+		})
+
+		Convey("Will refuse to overwrite or copy a directory into itself", func() {
+			So(existsReply.Code, ShouldEqual, 550)
+			So(intoItself.Code, ShouldEqual, 550)
+		})
+
+		Convey("Will need an existing source first", func() {
+			So(noSource.Code, ShouldEqual, 503)
+			So(missing.Code, ShouldEqual, 550)
+		})
+
+		Convey("Will use the driver's own Copy if it has one", func() {
+			So(nativeReply.Code, ShouldEqual, 250)
+			So(copies, ShouldResemble, []string{"/file.txt /copy.txt"})
+		})
+	})
+}
+
+func TestSiteRmdir(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.Users["admin"] = "5678"
+	factory.WriteFile("/tree/a.txt", []byte("a"))
+	factory.WriteFile("/tree/sub/b.txt", []byte("b"))
+	factory.Symlink("/tree/link", "/keep.txt")
+	factory.WriteFile("/keep.txt", []byte("keep"))
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:             factory,
+		UserRecursiveDelete: func(user string) bool { return user == "admin" },
+	})
+	defer server.Close()
+
+	user := server.Client(t)
+	defer user.Close()
+	user.Login(t, "test", "1234")
+	denied, _ := user.Cmd("SITE RMDIR /tree")
+
+	admin := server.Client(t)
+	defer admin.Close()
+	admin.Login(t, "admin", "5678")
+	removed, _ := admin.Cmd("SITE RMDIR /tree")
+	gone, _ := admin.Cmd("CWD /tree")
+	root, _ := admin.Cmd("SITE RMDIR /")
+	missing, _ := admin.Cmd("SITE RMDIR /missing")
+	kept, _ := factory.ReadFile("/keep.txt")
+
+	Convey("Recursive deletes", t, func() {
+		Convey("Will be refused for other users", func() {
+			So(denied.Code, ShouldEqual, 550)
+		})
+
+		Convey("Will delete a whole tree for allowed users", func() {
+			So(removed.Code, ShouldEqual, 250)
+			So(gone.Code, ShouldEqual, 550)
+		})
+
+		Convey("Will delete symlinks without following them", func() {
+			So(string(kept), ShouldEqual, "keep")
+		})
+
+		Convey("Will refuse the root and missing directories", func() {
+			So(root.Code, ShouldEqual, 550)
+			So(missing.Code, ShouldEqual, 550)
+		})
+	})
+}
+
+func TestTransferCap(t *testing.T) {
+	recorder := &eventRecorder{}
+	server := NewServer(&graval.FTPServerOpts{
+		SecurityNotifier: recorder,
+		UserTransferCap: func(user string) int64 {
+			if user == "test" {
+				return 10
+			}
+			return 0
+		},
+	})
+	defer server.Close()
+	ftpServer := server.FTPServer()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	storeErr := client.Store("/file.txt", []byte("012345"))
+	data, cutErr := client.Retrieve("/file.txt")
+	usage := ftpServer.UserUsage("test")
+	stats := ftpServer.Stats()
+	_, refusedErr := client.Retrieve("/file.txt")
+	reset := ftpServer.ResetUsage()
+	_, resetErr := client.Retrieve("/file.txt")
+
+	Convey("A server with a transfer cap", t, func() {
+		Convey("Will count the bytes each user moves", func() {
+			So(storeErr, ShouldBeNil)
+			So(usage.BytesUploaded, ShouldEqual, 6)
+			So(usage.BytesDownloaded, ShouldEqual, 4)
+			So(stats.Users, ShouldResemble, []graval.UserUsage{usage})
+		})
+
+		Convey("Will cut off a transfer that goes over the cap", func() {
+			So(string(data), ShouldEqual, "0123")
+			So(cutErr, ShouldNotBeNil)
+			So(cutErr.Error(), ShouldContainSubstring, "552")
+			event := recorder.find(graval.SecurityTransferCap)
+			So(event, ShouldNotBeNil)
+			So(event.User, ShouldEqual, "test")
+			So(event.Detail, ShouldEqual, "10")
+		})
+
+		Convey("Will refuse transfers once the cap is used up", func() {
+			So(refusedErr, ShouldNotBeNil)
+			So(refusedErr.Error(), ShouldContainSubstring, "552")
+		})
+
+		Convey("Will allow transfers again after the usage is reset", func() {
+			So(reset, ShouldResemble, []graval.UserUsage{usage})
+			So(resetErr, ShouldBeNil)
+			So(ftpServer.UserUsage("test").BytesDownloaded, ShouldEqual, 6)
+		})
+	})
+}
+
+func TestSetDriverFactory(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	server.Factory.(*MemDriverFactory).WriteFile("/old.txt", []byte("old"))
+	oldClient := server.Client(t)
+	defer oldClient.Close()
+	oldClient.Login(t, "test", "1234")
+
+	newFactory := NewMemDriverFactory()
+	newFactory.WriteFile("/new.txt", []byte("new"))
+	server.FTPServer().SetDriverFactory(newFactory)
+	newClient := server.Client(t)
+	defer newClient.Close()
+	newClient.Login(t, "test", "1234")
+
+	oldData, oldErr := oldClient.Retrieve("/old.txt")
+	newData, newErr := newClient.Retrieve("/new.txt")
+	_, missingErr := newClient.Retrieve("/old.txt")
+
+	Convey("A server given a new driver factory", t, func() {
+		Convey("Will keep established sessions on their old driver", func() {
+			So(oldErr, ShouldBeNil)
+			So(string(oldData), ShouldEqual, "old")
+		})
+
+		Convey("Will use the new factory for new sessions", func() {
+			So(newErr, ShouldBeNil)
+			So(string(newData), ShouldEqual, "new")
+			So(missingErr, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestReload(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{ServerName: "old", MaxUploadSize: 5})
+	defer server.Close()
+	oldClient := server.Client(t)
+	defer oldClient.Close()
+	oldClient.Login(t, "test", "1234")
+
+	invalidErr := server.FTPServer().Reload(&graval.FTPServerOpts{})
+	newFactory := NewMemDriverFactory()
+	reloadErr := server.FTPServer().Reload(&graval.FTPServerOpts{Factory: newFactory, ServerName: "new"})
+	newClient := server.Client(t)
+	defer newClient.Close()
+	newClient.Login(t, "test", "1234")
+
+	oldStat, _ := oldClient.Cmd("STAT")
+	newStat, _ := newClient.Cmd("STAT")
+	oldErr := oldClient.Store("/old.txt", []byte("0123456789"))
+	newErr := newClient.Store("/new.txt", []byte("0123456789"))
+	_, stored := newFactory.ReadFile("/new.txt")
+
+	Convey("A reloaded server", t, func() {
+		Convey("Will refuse invalid options", func() {
+			So(invalidErr, ShouldNotBeNil)
+		})
+
+		Convey("Will keep established sessions on their old settings", func() {
+			So(reloadErr, ShouldBeNil)
+			So(oldStat.Message, ShouldStartWith, "old status:")
+			So(oldErr, ShouldNotBeNil)
+			So(oldErr.Error(), ShouldContainSubstring, "552")
+		})
+
+		Convey("Will use the new settings and driver for new sessions", func() {
+			So(newStat.Message, ShouldStartWith, "new status:")
+			So(newErr, ShouldBeNil)
+			So(stored, ShouldBeTrue)
+		})
+	})
+}
+
+func TestReloadTLS(t *testing.T) {
+	oldTLS, oldClientTLS := NewTLSConfigs()
+	newTLS, newClientTLS := NewTLSConfigs()
+	server := NewServer(&graval.FTPServerOpts{TLSConfig: oldTLS})
+	defer server.Close()
+	oldClient := server.Client(t)
+	defer oldClient.Close()
+
+	disableErr := server.FTPServer().Reload(&graval.FTPServerOpts{Factory: server.Factory})
+	reloadErr := server.FTPServer().Reload(&graval.FTPServerOpts{Factory: server.Factory, TLSConfig: newTLS})
+	oldErr := oldClient.AuthTLS(oldClientTLS)
+	staleClient := server.Client(t)
+	defer staleClient.Close()
+	staleErr := staleClient.AuthTLS(oldClientTLS)
+	newClient := server.Client(t)
+	defer newClient.Close()
+	newErr := newClient.AuthTLS(newClientTLS)
+
+	Convey("A server reloaded with a new TLSConfig", t, func() {
+		Convey("Will refuse to turn TLS off", func() {
+			So(disableErr, ShouldNotBeNil)
+		})
+
+		Convey("Will keep the old certificate for established sessions", func() {
+			So(reloadErr, ShouldBeNil)
+			So(oldErr, ShouldBeNil)
+		})
+
+		Convey("Will serve the new certificate to new sessions", func() {
+			So(staleErr, ShouldNotBeNil)
+			So(newErr, ShouldBeNil)
+		})
+	})
+}
+
+// adminRequest sends a request to an admin handler, decoding the JSON
+// response into result.
+func adminRequest(handler http.Handler, method string, target string, result interface{}) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	json.NewDecoder(recorder.Body).Decode(result)
+	return recorder.Code
+}
+
+func TestAdmin(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.Users["other"] = "5678"
+	factory.WriteFile("/file.txt", []byte("hello"))
+	handler := server.FTPServer().AdminHandler()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	other := server.Client(t)
+	defer other.Close()
+	other.Login(t, "other", "5678")
+
+	var sessions []graval.SessionState
+	sessionsCode := adminRequest(handler, "GET", "/sessions", &sessions)
+	users := []string{}
+	for _, session := range sessions {
+		users = append(users, session.User)
+	}
+
+	var readOnly map[string]bool
+	readOnlyCode := adminRequest(handler, "POST", "/read-only?enabled=true", &readOnly)
+	refusedErr := client.Store("/new.txt", []byte("data"))
+	_, retrieveErr := client.Retrieve("/file.txt")
+	client.Expect(t, 550, "DELE /file.txt")
+	client.Expect(t, 550, "SITE RMDIR /dir")
+	server.FTPServer().SetReadOnly(false)
+	allowedErr := client.Store("/new.txt", []byte("data"))
+
+	var bandwidth map[string]int64
+	bandwidthCode := adminRequest(handler, "POST", "/bandwidth?rate=1000000", &bandwidth)
+	badBandwidthCode := adminRequest(handler, "POST", "/bandwidth?rate=fast", &map[string]string{})
+	wrongMethodCode := adminRequest(handler, "GET", "/kick?user=other", &map[string]string{})
+
+	var kicked map[string]int
+	kickCode := adminRequest(handler, "POST", "/kick?user=other", &kicked)
+	kickReply, _ := other.ReadReply()
+	missingCode := adminRequest(handler, "POST", "/kick?session=nosuchsession", &map[string]string{})
+	_, stillConnectedErr := client.Cmd("NOOP")
+
+	Convey("A server's admin API", t, func() {
+		Convey("Will list the sessions", func() {
+			So(sessionsCode, ShouldEqual, http.StatusOK)
+			So(users, ShouldContain, "test")
+			So(users, ShouldContain, "other")
+		})
+
+		Convey("Will switch the server to read-only mode and back", func() {
+			So(readOnlyCode, ShouldEqual, http.StatusOK)
+			So(readOnly["enabled"], ShouldBeTrue)
+			So(refusedErr, ShouldNotBeNil)
+			So(refusedErr.Error(), ShouldContainSubstring, "550")
+			So(retrieveErr, ShouldBeNil)
+			So(allowedErr, ShouldBeNil)
+		})
+
+		Convey("Will change the bandwidth limit", func() {
+			So(bandwidthCode, ShouldEqual, http.StatusOK)
+			So(bandwidth["rate"], ShouldEqual, 1000000)
+			So(badBandwidthCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Will only make changes on POST", func() {
+			So(wrongMethodCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		Convey("Will kick a user's sessions and leave others alone", func() {
+			So(kickCode, ShouldEqual, http.StatusOK)
+			So(kicked["kicked"], ShouldEqual, 1)
+			So(kickReply, ShouldNotBeNil)
+			So(kickReply.Code, ShouldEqual, 421)
+			So(missingCode, ShouldEqual, http.StatusNotFound)
+			So(stillConnectedErr, ShouldBeNil)
+		})
+	})
+}
+
+// interruptUpload starts an upload of data to path, waits for it to reach
+// file on disk, then shuts the server down mid-transfer.
+func interruptUpload(t *testing.T, server *Server, path string, data []byte, file string) {
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	dataConn, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataConn.Close()
+	client.Expect(t, 150, "STOR "+path)
+	dataConn.Write(data)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if info, err := os.Stat(file); err == nil && info.Size() == int64(len(data)) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.FTPServer().Shutdown()
+	server.Close()
+}
+
+func TestUploadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gravaltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0755)
+	factory := &osdriver.DriverFactory{
+		Root:         root,
+		Authenticate: func(user string, pass string) bool { return user == "test" && pass == "1234" },
+	}
+	opts := &graval.FTPServerOpts{
+		Factory:         factory,
+		AtomicUploads:   true,
+		UploadStateFile: filepath.Join(dir, "uploads.json"),
+	}
+	tempFile := filepath.Join(root, "big.txt.in-progress")
+	staleFile := filepath.Join(root, "stale.txt.in-progress")
+
+	interruptUpload(t, NewServer(opts), "/big.txt", []byte("partial"), tempFile)
+	_, keptErr := os.Stat(tempFile)
+
+	restarted := NewServer(opts)
+	client := restarted.Client(t)
+	client.Login(t, "test", "1234")
+	noRecordErr := client.StoreAt("/nothing.txt", 3, []byte("data"))
+	resumeErr := client.StoreAt("/big.txt", 7, []byte(" and the rest"))
+	resumed, _ := ioutil.ReadFile(filepath.Join(root, "big.txt"))
+	_, tempErr := os.Stat(tempFile)
+	client.Close()
+	interruptUpload(t, restarted, "/stale.txt", []byte("stale"), staleFile)
+
+	limitedFile := filepath.Join(root, "limited.txt.in-progress")
+	limitedOpts := *opts
+	limitedOpts.MaxUploadSize = 10
+	interruptUpload(t, NewServer(&limitedOpts), "/limited.txt", []byte("partial"), limitedFile)
+	limited := NewServer(&limitedOpts)
+	client = limited.Client(t)
+	client.Login(t, "test", "1234")
+	overLimitErr := client.StoreAt("/limited.txt", 7, []byte(" and too much"))
+	overLimit, _ := ioutil.ReadFile(limitedFile)
+	afterLimitErr := client.StoreAt("/limited.txt", 7, []byte("!"))
+	afterLimit, _ := ioutil.ReadFile(filepath.Join(root, "limited.txt"))
+	client.Close()
+	limited.Close()
+
+	// the record is dated by the system clock, and expired by this one
+	expiring := *opts
+	expiring.UploadStateExpiry = time.Hour
+	expiring.Clock = NewFakeClock(time.Now().Add(2 * time.Hour))
+	collector := NewServer(&expiring)
+	defer collector.Close()
+	client = collector.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	_, staleErr := os.Stat(staleFile)
+
+	Convey("A server with an upload state file", t, func() {
+		Convey("Will keep the temporary file of an interrupted upload", func() {
+			So(keptErr, ShouldBeNil)
+		})
+
+		Convey("Will resume an interrupted upload after a restart", func() {
+			So(resumeErr, ShouldBeNil)
+			So(string(resumed), ShouldEqual, "partial and the rest")
+			So(os.IsNotExist(tempErr), ShouldBeTrue)
+		})
+
+		Convey("Will keep an interrupted upload resumable after a resume goes over the size limit", func() {
+			So(overLimitErr, ShouldNotBeNil)
+			So(overLimitErr.Error(), ShouldContainSubstring, "552")
+			So(string(overLimit), ShouldEqual, "partial")
+			So(afterLimitErr, ShouldBeNil)
+			So(string(afterLimit), ShouldEqual, "partial!")
+		})
+
+		Convey("Will only resume uploads it has a record of", func() {
+			So(noRecordErr, ShouldNotBeNil)
+			So(noRecordErr.Error(), ShouldContainSubstring, "550")
+		})
+
+		Convey("Will delete stale uploads when their user logs in", func() {
+			So(os.IsNotExist(staleErr), ShouldBeTrue)
+		})
+	})
+}
+
+func TestPartialUploadJanitor(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{AtomicUploads: true, PartialUploadMaxAge: 50 * time.Millisecond})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.MakeDir("/dir")
+	factory.WriteFile("/dir/abandoned.txt.in-progress", []byte("partial"))
+	factory.WriteFile("/dir/complete.txt", []byte("complete"))
+	factory.WriteFile("/fresh.txt.in-progress", []byte("partial"))
+	freshSwept := server.FTPServer().SweepPartialUploads()
+
+	deadline := time.Now().Add(3 * time.Second)
+	abandoned := true
+	for abandoned && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, abandoned = factory.ReadFile("/dir/abandoned.txt.in-progress")
+	}
+	_, complete := factory.ReadFile("/dir/complete.txt")
+
+	Convey("A server with a partial upload janitor", t, func() {
+		Convey("Will leave recent partial uploads alone", func() {
+			So(freshSwept, ShouldEqual, 0)
+		})
+
+		Convey("Will delete abandoned partial uploads in the background", func() {
+			So(abandoned, ShouldBeFalse)
+		})
+
+		Convey("Will leave other files alone", func() {
+			So(complete, ShouldBeTrue)
+		})
+	})
+}
+
+func TestPartialUploadJanitorClock(t *testing.T) {
+	start := time.Now()
+	clock := NewFakeClock(start)
+	server := NewServer(&graval.FTPServerOpts{AtomicUploads: true, PartialUploadMaxAge: time.Hour, Clock: clock})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/abandoned.txt.in-progress", []byte("partial"))
+
+	waitForTimers(t, clock, 1)
+	clock.Advance(30 * time.Minute)
+	waitForTimers(t, clock, 1)
+	_, early := factory.ReadFile("/abandoned.txt.in-progress")
+	clock.Advance(time.Hour)
+	waitForTimers(t, clock, 1)
+	_, late := factory.ReadFile("/abandoned.txt.in-progress")
+
+	Convey("A partial upload janitor", t, func() {
+		Convey("Will run on the server's clock", func() {
+			So(early, ShouldBeTrue)
+			So(late, ShouldBeFalse)
+		})
+	})
+}
+
+func TestDirPolicies(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{DirPolicies: []graval.DirPolicy{
+		{Dir: "/incoming", WriteOnly: true},
+		{Dir: "/outgoing", ReadOnly: true},
+		{Dir: "/outgoing/scratch"},
+		{Dir: "/tmp", Expire: 50 * time.Millisecond},
+	}})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/incoming/secret.txt", []byte("secret"))
+	factory.WriteFile("/outgoing/release.txt", []byte("release"))
+	factory.MakeDir("/outgoing/scratch")
+	factory.WriteFile("/tmp/old.txt", []byte("old"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	uploadErr := client.Store("/incoming/new.txt", []byte("new"))
+	_, downloadErr := client.Retrieve("/incoming/secret.txt")
+	_, listErr := client.List("/incoming")
+	client.Expect(t, 250, "CWD /incoming")
+	_, cwdListErr := client.List("")
+	client.Run(t,
+		Step{"SIZE secret.txt", 550},
+		Step{"RNFR secret.txt", 550},
+		Step{"SITE CPFR secret.txt", 550},
+		Step{"CWD /", 250},
+		Step{"DELE /outgoing/release.txt", 550},
+		Step{"MKD /outgoing/new", 550},
+		Step{"MFMT 20190825130000 /outgoing/release.txt", 550},
+		Step{"SITE CPFR /outgoing/release.txt", 350},
+		Step{"SITE CPTO /outgoing/copy.txt", 550},
+		Step{"MKD /outgoing/scratch/new", 257},
+	)
+	release, releaseErr := client.Retrieve("/outgoing/release.txt")
+	outgoingErr := client.Store("/outgoing/new.txt", []byte("new"))
+
+	deadline := time.Now().Add(3 * time.Second)
+	old := true
+	for old && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, old = factory.ReadFile("/tmp/old.txt")
+	}
+	_, outgoingKept := factory.ReadFile("/outgoing/release.txt")
+
+	Convey("Directory policies", t, func() {
+		Convey("Will accept uploads to a write-only directory", func() {
+			So(uploadErr, ShouldBeNil)
+			data, _ := factory.ReadFile("/incoming/new.txt")
+			So(string(data), ShouldEqual, "new")
+		})
+
+		Convey("Will refuse downloads and listings in a write-only directory", func() {
+			So(downloadErr, ShouldNotBeNil)
+			So(downloadErr.Error(), ShouldContainSubstring, "550")
+			So(listErr, ShouldNotBeNil)
+			So(cwdListErr, ShouldNotBeNil)
+		})
+
+		Convey("Will allow downloads from a read-only directory", func() {
+			So(releaseErr, ShouldBeNil)
+			So(string(release), ShouldEqual, "release")
+		})
+
+		Convey("Will refuse changes to a read-only directory", func() {
+			So(outgoingErr, ShouldNotBeNil)
+			So(outgoingErr.Error(), ShouldContainSubstring, "550")
+		})
+
+		Convey("Will delete expired files in the background", func() {
+			So(old, ShouldBeFalse)
+			So(outgoingKept, ShouldBeTrue)
+		})
+	})
+}
+
+// blindDriver treats any directory named flagged as a blind drop box.
+type blindDriver struct {
+	*MemDriver
+}
+
+func (driver blindDriver) IsBlindDrop(filePath string) bool {
+	return strings.Contains(filePath+"/", "/flagged/")
+}
+
+type blindDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory blindDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return blindDriver{MemDriver: driver.(*MemDriver)}, nil
+}
+
+func TestBlindDrop(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/drop/earlier.txt", []byte("earlier"))
+	factory.WriteFile("/flagged/earlier.txt", []byte("earlier"))
+	factory.WriteFile("/pub/public.txt", []byte("public"))
+	factory.WriteFile("/pub/drop/earlier.txt", []byte("earlier"))
+	factory.WriteFile("/shared/flagged/earlier.txt", []byte("earlier"))
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:          blindDriverFactory{MemDriverFactory: factory},
+		ArchiveDownloads: true,
+		DirPolicies:      []graval.DirPolicy{{Dir: "/drop", Blind: true}, {Dir: "/pub/drop", Blind: true}},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	uploadErr := client.Store("/drop/new.txt", []byte("new"))
+	listing, listErr := client.List("/drop")
+	names, _ := client.NameList("/drop")
+	_, downloadErr := client.Retrieve("/drop/earlier.txt")
+	flaggedErr := client.Store("/flagged/new.txt", []byte("new"))
+	flaggedListing, flaggedListErr := client.List("/flagged")
+	_, flaggedDownloadErr := client.Retrieve("/flagged/earlier.txt")
+	size, _ := client.Cmd("SIZE /drop/earlier.txt")
+	copyFrom, _ := client.Cmd("SITE CPFR /flagged/earlier.txt")
+	copyTo, _ := client.Cmd("SITE CPTO /copied.txt")
+	client.Expect(t, 350, "SITE CPFR /shared")
+	copyTree, _ := client.Cmd("SITE CPTO /shared-copy")
+	_, copiedOk := factory.ReadFile("/copied.txt")
+	_, treeCopiedOk := factory.ReadFile("/shared-copy/flagged/earlier.txt")
+	tarData, tarErr := client.Retrieve("/pub.tar")
+	_, dropTarErr := client.Retrieve("/pub/drop.tar")
+	tarFiles := []string{}
+	archive := tar.NewReader(bytes.NewReader(tarData))
+	for header, err := archive.Next(); err == nil; header, err = archive.Next() {
+		tarFiles = append(tarFiles, header.Name)
+	}
+
+	Convey("A blind drop box", t, func() {
+		Convey("Will accept uploads", func() {
+			So(uploadErr, ShouldBeNil)
+			data, _ := factory.ReadFile("/drop/new.txt")
+			So(string(data), ShouldEqual, "new")
+		})
+
+		Convey("Will list as empty", func() {
+			So(listErr, ShouldBeNil)
+			So(listing, ShouldNotContainSubstring, "earlier.txt")
+			So(names, ShouldNotContainSubstring, "earlier.txt")
+		})
+
+		Convey("Will refuse downloads and SIZE", func() {
+			So(downloadErr, ShouldNotBeNil)
+			So(downloadErr.Error(), ShouldContainSubstring, "550")
+			So(size.Code, ShouldEqual, 550)
+		})
+
+		Convey("Can be chosen by the driver", func() {
+			So(flaggedErr, ShouldBeNil)
+			So(flaggedListErr, ShouldBeNil)
+			So(flaggedListing, ShouldNotContainSubstring, "earlier.txt")
+			So(flaggedDownloadErr, ShouldNotBeNil)
+		})
+
+		Convey("Can't be read by copying", func() {
+			So(copyFrom.Code, ShouldEqual, 550)
+			So(copyTo.Code, ShouldEqual, 503)
+			So(copiedOk, ShouldBeFalse)
+			So(copyTree.Code, ShouldEqual, 550)
+			So(treeCopiedOk, ShouldBeFalse)
+		})
+
+		Convey("Will be left out of archives", func() {
+			So(tarErr, ShouldBeNil)
+			So(tarFiles, ShouldResemble, []string{"drop/", "public.txt"})
+			So(dropTarErr, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestHomeTemplate(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{HomeTemplate: &graval.HomeTemplate{
+		Dirs:  []string{"incoming", "reports/2019"},
+		Files: map[string][]byte{"README.txt": []byte("welcome"), "docs/guide.txt": []byte("guide")},
+	}})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	client := server.Client(t)
+	client.Login(t, "test", "1234")
+	client.Expect(t, 250, "DELE /README.txt")
+	client.Close()
+
+	second := server.Client(t)
+	defer second.Close()
+	second.Login(t, "test", "1234")
+	listing, _ := second.NameList("/")
+	nested, _ := second.Cmd("CWD /reports/2019")
+
+	used := NewServer(&graval.FTPServerOpts{HomeTemplate: &graval.HomeTemplate{Dirs: []string{"incoming"}}})
+	defer used.Close()
+	used.Factory.(*MemDriverFactory).WriteFile("/existing.txt", []byte("existing"))
+	usedClient := used.Client(t)
+	defer usedClient.Close()
+	usedClient.Login(t, "test", "1234")
+	usedListing, _ := usedClient.NameList("/")
+
+	Convey("A home template", t, func() {
+		Convey("Will create directories and files at first login", func() {
+			So(listing, ShouldContainSubstring, "incoming")
+			So(listing, ShouldContainSubstring, "reports")
+			So(nested.Code, ShouldEqual, 250)
+			guide, _ := factory.ReadFile("/docs/guide.txt")
+			So(string(guide), ShouldEqual, "guide")
+		})
+
+		Convey("Will not recreate anything the user removed later", func() {
+			So(listing, ShouldNotContainSubstring, "README.txt")
+		})
+
+		Convey("Will leave a tree that's already in use alone", func() {
+			So(usedListing, ShouldNotContainSubstring, "incoming")
+		})
+	})
+}
+
+// motdDriver greets users with a message of the day.
+type motdDriver struct {
+	*MemDriver
+}
+
+func (driver motdDriver) LoginMessage(user string) []string {
+	if user != "test" {
+		return nil
+	}
+	return []string{"Welcome back, " + user, "You have 10 MB left\r\n230 Fake"}
+}
+
+type motdDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory motdDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return motdDriver{MemDriver: driver.(*MemDriver)}, nil
+}
+
+func TestLoginMessage(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{Factory: motdDriverFactory{MemDriverFactory: NewMemDriverFactory()}})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Expect(t, 331, "USER test")
+	login, loginErr := client.Cmd("PASS 1234")
+	noop, _ := client.Cmd("NOOP")
+
+	plain := NewServer(nil)
+	defer plain.Close()
+	plainClient := plain.Client(t)
+	defer plainClient.Close()
+	plainClient.Expect(t, 331, "USER test")
+	plainLogin, _ := plainClient.Cmd("PASS 1234")
+
+	Convey("A login message from the driver", t, func() {
+		Convey("Will be added to the 230 reply", func() {
+			So(loginErr, ShouldBeNil)
+			So(login.Code, ShouldEqual, 230)
+			So(login.Message, ShouldEqual, "Welcome back, test\nYou have 10 MB left  230 Fake\nPassword ok, continue")
+		})
+
+		Convey("Will not leave stray replies behind", func() {
+			So(noop.Code, ShouldEqual, 200)
+		})
+
+		Convey("Will not change the reply when there isn't one", func() {
+			So(plainLogin.Message, ShouldEqual, "Password ok, continue")
+		})
+	})
+}
+
+func TestLastLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastlogin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "logins.json")
+	store, err := graval.NewLoginStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(&graval.FTPServerOpts{LoginStore: store})
+	defer server.Close()
+	handler := server.FTPServer().AdminHandler()
+
+	first := server.Client(t)
+	first.Expect(t, 331, "USER test")
+	firstLogin, _ := first.Cmd("PASS 1234")
+	first.Close()
+
+	second := server.Client(t)
+	defer second.Close()
+	second.Expect(t, 331, "USER test")
+	secondLogin, _ := second.Cmd("PASS 1234")
+	var session graval.SessionState
+	for _, state := range server.FTPServer().Sessions() {
+		if state.User == "test" {
+			session = state
+		}
+	}
+
+	var record graval.LoginRecord
+	recordCode := adminRequest(handler, "GET", "/last-login?user=test", &record)
+	missingCode := adminRequest(handler, "GET", "/last-login?user=nobody", &map[string]string{})
+	reloaded, reloadErr := graval.NewLoginStore(file)
+	var persisted *graval.LoginRecord
+	if reloadErr == nil {
+		persisted, _ = reloaded.LastLogin("test")
+	}
+
+	Convey("Last login tracking", t, func() {
+		Convey("Will say nothing at a user's first login", func() {
+			So(firstLogin.Code, ShouldEqual, 230)
+			So(firstLogin.Message, ShouldEqual, "Password ok, continue")
+		})
+
+		Convey("Will report the previous login in the 230 reply", func() {
+			So(secondLogin.Code, ShouldEqual, 230)
+			So(secondLogin.Message, ShouldStartWith, "Last login: ")
+			So(secondLogin.Message, ShouldContainSubstring, " from 127.0.0.1\n")
+		})
+
+		Convey("Will show the previous login in Sessions", func() {
+			So(session.LastLogin, ShouldNotBeNil)
+			So(session.LastLogin.RemoteIP, ShouldEqual, "127.0.0.1")
+		})
+
+		Convey("Will report the latest login through the admin API", func() {
+			So(recordCode, ShouldEqual, http.StatusOK)
+			So(record.User, ShouldEqual, "test")
+			So(record.Time.After(session.LastLogin.Time), ShouldBeTrue)
+			So(missingCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Will keep logins in the store's file", func() {
+			So(reloadErr, ShouldBeNil)
+			So(persisted, ShouldNotBeNil)
+			So(persisted.Time.Equal(record.Time), ShouldBeTrue)
+		})
+	})
+}
+
+// failingReader fails every read, like a broken disk.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("disk error")
+}
+
+// brokenDriver fails to read /broken.txt part way through.
+type brokenDriver struct {
+	*MemDriver
+}
+
+func (driver brokenDriver) GetFile(filePath string) (io.ReadCloser, error) {
+	reader, err := driver.MemDriver.GetFile(filePath)
+	if err != nil || filePath != "/broken.txt" {
+		return reader, err
+	}
+	reader.Close()
+	return ioutil.NopCloser(io.MultiReader(strings.NewReader("hello"), failingReader{})), nil
+}
+
+type brokenDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory brokenDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return brokenDriver{MemDriver: driver.(*MemDriver)}, nil
+}
+
+func TestTransferFailures(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/broken.txt", []byte("hello world"))
+	var mu sync.Mutex
+	var failures []*graval.FailedTransfer
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:       brokenDriverFactory{MemDriverFactory: factory},
+		MaxUploadSize: 4,
+		TransferFailureHook: func(failure *graval.FailedTransfer) {
+			mu.Lock()
+			defer mu.Unlock()
+			failures = append(failures, failure)
+		},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	_, downloadErr := client.Retrieve("/broken.txt")
+	_, resumedErr := client.RetrieveFrom("/broken.txt", 2)
+	uploadErr := client.Store("/large.txt", []byte("too large"))
+	stats := server.FTPServer().Stats()
+
+	mu.Lock()
+	defer mu.Unlock()
+	Convey("A transfer that fails part way through", t, func() {
+		Convey("Will say how far it got and how to resume in the reply", func() {
+			So(downloadErr, ShouldNotBeNil)
+			So(downloadErr.Error(), ShouldContainSubstring, "451")
+			So(downloadErr.Error(), ShouldContainSubstring, "after 5 bytes; resume with REST 5")
+			So(resumedErr, ShouldNotBeNil)
+			So(resumedErr.Error(), ShouldContainSubstring, "after 3 bytes; resume with REST 5")
+		})
+
+		Convey("Will be reported to the hook", func() {
+			So(len(failures), ShouldEqual, 3)
+			So(failures[0].Path, ShouldEqual, "/broken.txt")
+			So(failures[0].Direction, ShouldEqual, "download")
+			So(failures[0].Bytes, ShouldEqual, 5)
+			So(failures[0].Resumable, ShouldBeTrue)
+			So(failures[0].ResumeFrom, ShouldEqual, 5)
+			So(failures[0].Error, ShouldContainSubstring, "disk error")
+			So(failures[1].Offset, ShouldEqual, 2)
+			So(failures[1].ResumeFrom, ShouldEqual, 5)
+		})
+
+		Convey("Will not be resumable if it was refused by policy", func() {
+			So(uploadErr, ShouldNotBeNil)
+			So(failures[2].Direction, ShouldEqual, "upload")
+			So(failures[2].Resumable, ShouldBeFalse)
+		})
+
+		Convey("Will be counted in the stats", func() {
+			So(stats.FailedTransfers, ShouldEqual, 3)
+		})
+	})
+}
+
+func TestArchiveDownloads(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{ArchiveDownloads: true})
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.MakeDir("/dir/sub")
+	factory.WriteFile("/dir/one.txt", []byte("one"))
+	factory.WriteFile("/dir/sub/two.txt", []byte("two"))
+	factory.WriteFile("/real.zip", []byte("not an archive"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	zipData, zipErr := client.Retrieve("/dir.zip")
+	zipFiles := map[string]string{}
+	if archive, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData))); err == nil {
+		for _, file := range archive.File {
+			reader, _ := file.Open()
+			contents, _ := ioutil.ReadAll(reader)
+			reader.Close()
+			zipFiles[file.Name] = string(contents)
+		}
+	}
+
+	tgzData, tgzErr := client.Retrieve("/dir.tar.gz")
+	tarFiles := map[string]string{}
+	if decompressor, err := gzip.NewReader(bytes.NewReader(tgzData)); err == nil {
+		archive := tar.NewReader(decompressor)
+		for header, err := archive.Next(); err == nil; header, err = archive.Next() {
+			contents, _ := ioutil.ReadAll(archive)
+			tarFiles[header.Name] = string(contents)
+		}
+	}
+
+	realData, realErr := client.Retrieve("/real.zip")
+	_, missingErr := client.Retrieve("/missing.zip")
+	_, resumeErr := client.RetrieveFrom("/dir.tar", 10)
+
+	disabled := NewServer(nil)
+	defer disabled.Close()
+	disabled.Factory.(*MemDriverFactory).MakeDir("/dir")
+	disabledClient := disabled.Client(t)
+	defer disabledClient.Close()
+	disabledClient.Login(t, "test", "1234")
+	_, disabledErr := disabledClient.Retrieve("/dir.zip")
+
+	expected := map[string]string{"one.txt": "one", "sub/": "", "sub/two.txt": "two"}
+
+	Convey("A server with archive downloads", t, func() {
+		Convey("Will send a zip of a directory", func() {
+			So(zipErr, ShouldBeNil)
+			So(zipFiles, ShouldResemble, expected)
+		})
+
+		Convey("Will send a compressed tar of a directory", func() {
+			So(tgzErr, ShouldBeNil)
+			So(tarFiles, ShouldResemble, expected)
+		})
+
+		Convey("Will prefer a real file with the same name", func() {
+			So(realErr, ShouldBeNil)
+			So(string(realData), ShouldEqual, "not an archive")
+		})
+
+		Convey("Will refuse archives of directories that don't exist", func() {
+			So(missingErr, ShouldNotBeNil)
+			So(missingErr.Error(), ShouldContainSubstring, "551")
+		})
+
+		Convey("Will refuse to resume an archive", func() {
+			So(resumeErr, ShouldNotBeNil)
+			So(resumeErr.Error(), ShouldContainSubstring, "550")
+		})
+
+		Convey("Will not send archives unless enabled", func() {
+			So(disabledErr, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestVirtualFiles(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{ArchiveDownloads: true})
+	defer server.Close()
+	generated := 0
+	server.Factory.(*MemDriverFactory).Generate("/dir/status.txt", func() []byte {
+		generated++
+		return []byte(fmt.Sprintf("generated %d", generated))
+	})
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	first, firstErr := client.Retrieve("/dir/status.txt")
+	second, _ := client.Retrieve("/dir/status.txt")
+	listing, _ := client.List("/dir")
+	machine, _ := client.readData("MLSD /dir")
+	mlst, _ := client.Cmd("MLST /dir/status.txt")
+	size, _ := client.Cmd("SIZE /dir/status.txt")
+	_, resumeErr := client.RetrieveFrom("/dir/status.txt", 4)
+	tarData, tarErr := client.Retrieve("/dir.tar")
+	tarFiles := map[string]string{}
+	archive := tar.NewReader(bytes.NewReader(tarData))
+	for header, err := archive.Next(); err == nil; header, err = archive.Next() {
+		contents, _ := ioutil.ReadAll(archive)
+		tarFiles[header.Name] = string(contents)
+	}
+
+	Convey("A virtual file", t, func() {
+		Convey("Will be generated on each download", func() {
+			So(firstErr, ShouldBeNil)
+			So(string(first), ShouldEqual, "generated 1")
+			So(string(second), ShouldEqual, "generated 2")
+		})
+
+		Convey("Will be listed with a size of 0", func() {
+			So(listing, ShouldContainSubstring, "            0 ")
+			So(listing, ShouldContainSubstring, " status.txt\r\n")
+		})
+
+		Convey("Will be described without a size", func() {
+			So(string(machine), ShouldContainSubstring, "type=file;")
+			So(string(machine), ShouldNotContainSubstring, "size=")
+			So(mlst.Code, ShouldEqual, 250)
+			So(mlst.Message, ShouldNotContainSubstring, "size=")
+		})
+
+		Convey("Will refuse SIZE", func() {
+			So(size.Code, ShouldEqual, 550)
+		})
+
+		Convey("Will refuse to resume a download", func() {
+			So(resumeErr, ShouldNotBeNil)
+			So(resumeErr.Error(), ShouldContainSubstring, "554")
+		})
+
+		Convey("Will be included in archives", func() {
+			So(tarErr, ShouldBeNil)
+			So(tarFiles, ShouldResemble, map[string]string{"status.txt": "generated 3"})
+		})
+	})
+}
+
+func TestUploadDedup(t *testing.T) {
+	server := NewServer(nil)
+	defer server.Close()
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/backup/one.dat", []byte("backup contents"))
+	sha := sha256.Sum256([]byte("backup contents"))
+	md := md5.Sum([]byte("backup contents"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	defaultAlgorithm, _ := client.Cmd("OPTS HASH")
+	client.Expect(t, 200, "SITE HASH %s", hex.EncodeToString(sha[:]))
+	dataConn, _ := client.Passive()
+	dedupStart, _ := client.Cmd("STOR /backup/two.dat")
+	dedupEnd, _ := client.ReadReply()
+	if dataConn != nil {
+		dataConn.Close()
+	}
+	dedupData, _ := factory.ReadFile("/backup/two.dat")
+
+	md5Algorithm, _ := client.Cmd("OPTS HASH md5")
+	client.Expect(t, 200, "SITE HASH %s", hex.EncodeToString(md[:]))
+	dataConn, _ = client.Passive()
+	md5Start, _ := client.Cmd("STOR /backup/three.dat")
+	client.ReadReply()
+	if dataConn != nil {
+		dataConn.Close()
+	}
+	md5Data, _ := factory.ReadFile("/backup/three.dat")
+
+	client.Expect(t, 200, "SITE HASH %032x", 0)
+	unknownErr := client.Store("/backup/four.dat", []byte("new contents"))
+	unknownData, _ := factory.ReadFile("/backup/four.dat")
+	badHash, _ := client.Cmd("SITE HASH %s", hex.EncodeToString(sha[:]))
+	badAlgorithm, _ := client.Cmd("OPTS HASH CRC-64")
+
+	Convey("Upload deduplication", t, func() {
+		Convey("Will use SHA-256 by default", func() {
+			So(defaultAlgorithm.Code, ShouldEqual, 200)
+			So(defaultAlgorithm.Message, ShouldEqual, "SHA-256")
+		})
+
+		Convey("Will complete an upload of content the driver already has without the data", func() {
+			So(dedupStart.Code, ShouldEqual, 150)
+			So(dedupEnd.Code, ShouldEqual, 226)
+			So(string(dedupData), ShouldEqual, "backup contents")
+		})
+
+		Convey("Will use the algorithm chosen with OPTS HASH", func() {
+			So(md5Algorithm.Message, ShouldEqual, "MD5")
+			So(md5Start.Code, ShouldEqual, 150)
+			So(string(md5Data), ShouldEqual, "backup contents")
+		})
+
+		Convey("Will upload content the driver doesn't have as usual", func() {
+			So(unknownErr, ShouldBeNil)
+			So(string(unknownData), ShouldEqual, "new contents")
+		})
+
+		Convey("Will refuse hashes that don't match the algorithm", func() {
+			So(badHash.Code, ShouldEqual, 501)
+		})
+
+		Convey("Will refuse unknown algorithms", func() {
+			So(badAlgorithm.Code, ShouldEqual, 501)
+		})
+	})
+}
+
+// wrappedError wraps another error, the way drivers often add context.
+type wrappedError struct {
+	err error
+}
+
+func (e wrappedError) Error() string {
+	return "backend: " + e.err.Error()
+}
+
+func (e wrappedError) Unwrap() error {
+	return e.err
+}
+
+// reasonDriver fails requests for a few paths and says why.
+type reasonDriver struct {
+	*MemDriver
+	lastErr error
+}
+
+func (driver *reasonDriver) fail(err error) bool {
+	driver.lastErr = err
+	return false
+}
+
+func (driver *reasonDriver) LastError() error {
+	return driver.lastErr
+}
+
+func (driver *reasonDriver) MakeDir(dirPath string) bool {
+	if dirPath == "/full" {
+		return driver.fail(wrappedError{graval.ErrNoSpace})
+	}
+	return driver.MemDriver.MakeDir(dirPath)
+}
+
+func (driver *reasonDriver) DeleteFile(filePath string) bool {
+	if filePath == "/locked.txt" {
+		return driver.fail(graval.ErrPermission)
+	}
+	return driver.MemDriver.DeleteFile(filePath)
+}
+
+func (driver *reasonDriver) Rename(fromPath string, toPath string) bool {
+	if driver.Bytes(toPath) >= 0 {
+		return driver.fail(graval.ErrExists)
+	}
+	return driver.MemDriver.Rename(fromPath, toPath)
+}
+
+func (driver *reasonDriver) GetFile(filePath string) (io.ReadCloser, error) {
+	if filePath == "/gone.txt" {
+		return nil, &os.PathError{Op: "open", Path: filePath, Err: os.ErrNotExist}
+	}
+	return driver.MemDriver.GetFile(filePath)
+}
+
+func (driver *reasonDriver) ModifiedTime(filePath string) (time.Time, error) {
+	if filePath == "/locked.txt/inside" {
+		return time.Time{}, graval.ErrNotDir
+	}
+	return driver.MemDriver.ModifiedTime(filePath)
+}
+
+func (driver *reasonDriver) PutFile(destPath string, data io.Reader) bool {
+	if destPath == "/huge.txt" {
+		ioutil.ReadAll(data)
+		return driver.fail(graval.ErrNoSpace)
+	}
+	return driver.MemDriver.PutFile(destPath, data)
+}
+
+type reasonDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory reasonDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &reasonDriver{MemDriver: driver.(*MemDriver)}, nil
+}
+
+func TestDriverErrors(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/locked.txt", []byte("locked"))
+	factory.WriteFile("/other.txt", []byte("other"))
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: reasonDriverFactory{MemDriverFactory: factory},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	full, _ := client.Cmd("MKD /full")
+	locked, _ := client.Cmd("DELE /locked.txt")
+	client.Expect(t, 350, "RNFR /other.txt")
+	exists, _ := client.Cmd("RNTO /locked.txt")
+	notDir, _ := client.Cmd("MDTM /locked.txt/inside")
+	unknown, _ := client.Cmd("MDTM /missing.txt")
+	dataConn, _ := client.Passive()
+	gone, _ := client.Cmd("RETR /gone.txt")
+	if dataConn != nil {
+		dataConn.Close()
+	}
+	dataConn, _ = client.Passive()
+	hugeStart, _ := client.Cmd("STOR /huge.txt")
+	if dataConn != nil {
+		dataConn.Write([]byte("too much data"))
+		dataConn.Close()
+	}
+	hugeEnd, _ := client.ReadReply()
+
+	Convey("Errors from the driver", t, func() {
+		Convey("Will be explained when a bool call fails", func() {
+			So(locked.Code, ShouldEqual, 550)
+			So(locked.Message, ShouldEqual, "Permission denied")
+			So(exists.Code, ShouldEqual, 550)
+			So(exists.Message, ShouldEqual, "File exists")
+		})
+
+		Convey("Will be recognised when wrapped", func() {
+			So(full.Code, ShouldEqual, 452)
+			So(full.Message, ShouldEqual, "Insufficient storage space")
+		})
+
+		Convey("Will be recognised from the os package", func() {
+			So(gone.Code, ShouldEqual, 551)
+			So(gone.Message, ShouldEqual, "No such file or directory")
+		})
+
+		Convey("Will be explained when returned", func() {
+			So(notDir.Code, ShouldEqual, 450)
+			So(notDir.Message, ShouldEqual, "Not a directory")
+		})
+
+		Convey("Will get the usual reply when they're not recognised", func() {
+			So(unknown.Code, ShouldEqual, 450)
+			So(unknown.Message, ShouldEqual, "File not available")
+		})
+
+		Convey("Will end a failed upload with the reason", func() {
+			So(hugeStart.Code, ShouldEqual, 150)
+			So(hugeEnd.Code, ShouldEqual, 452)
+		})
+	})
+}
+
+func TestReplyFilter(t *testing.T) {
+	var mu sync.Mutex
+	var commands []string
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: NewMemDriverFactory(),
+		ReplyFilter: func(reply *graval.Reply) {
+			mu.Lock()
+			commands = append(commands, reply.Command)
+			mu.Unlock()
+			switch {
+			case reply.Code == 220:
+				reply.Message = "Ready"
+			case reply.Code == 211 && len(reply.Lines) > 0:
+				reply.Lines = []string{"211-Features:", " UTF8", "211 End"}
+			case reply.User != "":
+				reply.Message += " [" + reply.User + "]"
+			}
+		},
+	})
+	defer server.Close()
+
+	raw, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	greeting, _ := bufio.NewReader(raw).ReadString('\n')
+	raw.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	beforeLogin, _ := client.Cmd("NOOP")
+	client.Login(t, "test", "1234")
+	afterLogin, _ := client.Cmd("NOOP")
+	feat, _ := client.Cmd("FEAT")
+	client.Cmd("QUIT")
+
+	mu.Lock()
+	defer mu.Unlock()
+	Convey("A reply filter", t, func() {
+		Convey("Will change the greeting", func() {
+			So(greeting, ShouldEqual, "220 Ready\r\n")
+		})
+
+		Convey("Will change single line replies", func() {
+			So(beforeLogin.Message, ShouldEqual, "OK")
+			So(afterLogin.Message, ShouldEqual, "OK [test]")
+		})
+
+		Convey("Will change multiline replies", func() {
+			So(feat.Code, ShouldEqual, 211)
+			So(feat.Message, ShouldEqual, "Features:\n UTF8\nEnd")
+		})
+
+		Convey("Will be told the command being answered", func() {
+			So(commands, ShouldContain, "")
+			So(commands, ShouldContain, "NOOP")
+			So(commands, ShouldContain, "FEAT")
+			So(commands, ShouldContain, "QUIT")
+		})
+
+		Convey("Will keep the reply sequence intact", func() {
+			So(server.FTPServer().Stats().ReplyErrors, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestStealth(t *testing.T) {
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: NewMemDriverFactory(),
+		Stealth: true,
+	})
+	defer server.Close()
+
+	raw, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	greeting, _ := bufio.NewReader(raw).ReadString('\n')
+	raw.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	syst, _ := client.Cmd("SYST")
+	feat, _ := client.Cmd("FEAT")
+	help, _ := client.Cmd("SITE HELP")
+	mlst, _ := client.Cmd("MLST /")
+
+	// rejectDataDriver only has the methods of an FTPDriver, so it can't
+	// resume uploads
+	plain := NewServer(&graval.FTPServerOpts{
+		Factory: rejectDataDriverFactory{NewMemDriverFactory()},
+		Stealth: true,
+	})
+	defer plain.Close()
+	client = plain.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	plainFeat, _ := client.Cmd("FEAT")
+
+	Convey("A stealthy server", t, func() {
+		Convey("Will not name itself in the greeting", func() {
+			So(greeting, ShouldEqual, "220 FTP server\r\n")
+		})
+
+		Convey("Will give the usual SYST reply", func() {
+			So(syst.Code, ShouldEqual, 215)
+			So(syst.Message, ShouldEqual, "UNIX Type: L8")
+		})
+
+		Convey("Will list only common features", func() {
+			So(feat.Code, ShouldEqual, 211)
+			So(feat.Message, ShouldContainSubstring, "SIZE")
+			So(feat.Message, ShouldNotContainSubstring, "RANG")
+			So(feat.Message, ShouldNotContainSubstring, "MFF")
+			So(feat.Message, ShouldNotContainSubstring, "UNIX.ownername")
+		})
+
+		Convey("Will only list REST STREAM when the driver can resume uploads", func() {
+			So(feat.Message, ShouldContainSubstring, "REST STREAM")
+			So(plainFeat.Code, ShouldEqual, 211)
+			So(plainFeat.Message, ShouldNotContainSubstring, "REST STREAM")
+		})
+
+		Convey("Will not list the SITE commands", func() {
+			So(help.Code, ShouldEqual, 214)
+			So(help.Message, ShouldEqual, "Help OK.")
+		})
+
+		Convey("Will still support the commands it doesn't list", func() {
+			So(mlst.Code, ShouldEqual, 250)
+		})
+	})
+}
+
+// recordedSession runs the same client session against factory each time.
+func recordedSession(t *testing.T, factory graval.FTPDriverFactory, upload string) (string, []byte, *Reply) {
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	client.Expect(t, 257, "MKD /docs/drafts")
+	if err := client.Store("/docs/new.txt", []byte(upload)); err != nil {
+		t.Fatal(err)
+	}
+	listing, _ := client.NameList("/docs")
+	data, _ := client.Retrieve("/docs/readme.txt")
+	dele, _ := client.Cmd("DELE /docs/missing.txt")
+	return listing, data, dele
+}
+
+func TestRecordingPlayback(t *testing.T) {
+	newBackend := func() *MemDriverFactory {
+		backend := NewMemDriverFactory()
+		backend.WriteFile("/docs/readme.txt", []byte("read me"))
+		return backend
+	}
+	recorder := NewRecordingFactory(newBackend())
+	recordedList, recordedData, recordedDele := recordedSession(t, recorder, "hello")
+	var recording bytes.Buffer
+	saveErr := recorder.Save(&recording)
+
+	playback, loadErr := NewPlaybackFactory(bytes.NewReader(recording.Bytes()))
+	playedList, playedData, playedDele := recordedSession(t, playback, "hello")
+	playedMisses := playback.Misses()
+
+	changed, _ := NewPlaybackFactory(bytes.NewReader(recording.Bytes()))
+	recordedSession(t, changed, "goodbye")
+	changedMisses := changed.Misses()
+
+	dir, err := ioutil.TempDir("", "gravaltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+	first, save, firstErr := RecordOrPlayback(filename, newBackend())
+	_, isRecorder := first.(*RecordingFactory)
+	recordedSession(t, first, "hello")
+	fileSaveErr := save()
+	second, _, secondErr := RecordOrPlayback(filename, nil)
+	_, isPlayback := second.(*PlaybackFactory)
+
+	Convey("Recording and playback", t, func() {
+		Convey("Will save a recording", func() {
+			So(saveErr, ShouldBeNil)
+			So(loadErr, ShouldBeNil)
+			So(recording.String(), ShouldContainSubstring, `"method": "PutFile"`)
+		})
+
+		Convey("Will replay the session without the backend", func() {
+			So(playedList, ShouldEqual, recordedList)
+			So(string(playedData), ShouldEqual, "read me")
+			So(playedData, ShouldResemble, recordedData)
+			So(playedDele.Code, ShouldEqual, recordedDele.Code)
+			So(playedMisses, ShouldBeEmpty)
+		})
+
+		Convey("Will report calls that differ from the recording", func() {
+			So(len(changedMisses), ShouldEqual, 1)
+			So(changedMisses[0], ShouldContainSubstring, "/docs/new.txt")
+		})
+
+		Convey("Will record on the first run and replay after that", func() {
+			So(firstErr, ShouldBeNil)
+			So(isRecorder, ShouldBeTrue)
+			So(fileSaveErr, ShouldBeNil)
+			So(secondErr, ShouldBeNil)
+			So(isPlayback, ShouldBeTrue)
+		})
+	})
+}
+
+func TestMalformedCommands(t *testing.T) {
+	factory := NewMemDriverFactory()
+	factory.MakeDir("/pub")
+	factory.MakeDir("/pub/a\r226 Transfer complete")
+	factory.WriteFile("/pub/hello.txt", []byte("hello world"))
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	// a refused line still uses up a REST
+	var afterRefused []string
+	for _, refused := range []string{"CWD /" + strings.Repeat("a", 100000), "CWD /pub\x00/etc"} {
+		dataConn, err := client.Passive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Expect(t, 350, "REST 6")
+		client.Cmd(refused)
+		client.Expect(t, 150, "RETR /pub/hello.txt")
+		data, _ := ioutil.ReadAll(dataConn)
+		dataConn.Close()
+		client.ExpectReply(t, 226)
+		afterRefused = append(afterRefused, string(data))
+	}
+
+	tooLong, _ := client.Cmd("CWD /%s", strings.Repeat("a", 100000))
+	afterLong, _ := client.Cmd("NOOP")
+	withNul, _ := client.Cmd("CWD /pub\x00/etc")
+	injected, _ := client.Cmd("CWD /pub/a\r226 Transfer complete")
+	afterInjected, _ := client.Cmd("NOOP")
+
+	Convey("Malformed commands", t, func() {
+		Convey("Will be refused if they're too long, without ending the session", func() {
+			So(tooLong.Code, ShouldEqual, 500)
+			So(afterLong.Code, ShouldEqual, 200)
+		})
+
+		Convey("Will be refused if they contain NUL", func() {
+			So(withNul.Code, ShouldEqual, 501)
+		})
+
+		Convey("Will clear a restart offset like any other command", func() {
+			So(afterRefused, ShouldResemble, []string{"hello world", "hello world"})
+		})
+
+		Convey("Can't inject replies through text that's echoed back", func() {
+			So(injected.Code, ShouldEqual, 250)
+			So(injected.Message, ShouldEqual, "Directory changed to /pub/a 226 Transfer complete")
+			So(afterInjected.Code, ShouldEqual, 200)
+			So(afterInjected.Message, ShouldEqual, "OK")
+		})
+	})
+}
+
+// tapBuffer collects a wire tap and notes when it's closed.
+type tapBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed chan struct{}
+}
+
+func (tap *tapBuffer) Write(p []byte) (int, error) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	return tap.buf.Write(p)
+}
+
+func (tap *tapBuffer) Close() error {
+	close(tap.closed)
+	return nil
+}
+
+func (tap *tapBuffer) String() string {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	return tap.buf.String()
+}
+
+func TestWireTap(t *testing.T) {
+	tap := &tapBuffer{closed: make(chan struct{})}
+	var mu sync.Mutex
+	var sessions []string
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: NewMemDriverFactory(),
+		WireTap: func(sessionId string, remoteIP string) io.Writer {
+			mu.Lock()
+			defer mu.Unlock()
+			sessions = append(sessions, sessionId)
+			if len(sessions) > 1 {
+				return nil
+			}
+			return tap
+		},
+	})
+	defer server.Close()
+
+	client := server.Client(t)
+	client.Login(t, "test", "1234")
+	client.Expect(t, 211, "FEAT")
+	client.Send("QUIT")
+	client.ReadReply()
+	closed := false
+	select {
+	case <-tap.closed:
+		closed = true
+	case <-time.After(5 * time.Second):
+	}
+	client.Close()
+
+	untapped := server.Client(t)
+	untapped.Login(t, "test", "1234")
+	untapped.Close()
+	dialogue := tap.String()
+
+	Convey("A wire tap", t, func() {
+		Convey("Will mirror what the client sent, exactly", func() {
+			So(dialogue, ShouldContainSubstring, `> "USER test\r\n"`)
+			So(dialogue, ShouldContainSubstring, `> "QUIT\r\n"`)
+		})
+
+		Convey("Will mirror every line of the server's replies", func() {
+			So(dialogue, ShouldContainSubstring, `< "220 Go FTP Server\r\n"`)
+			So(dialogue, ShouldContainSubstring, `< "211-Features supported:\r\n"`)
+			So(dialogue, ShouldContainSubstring, `< " UTF8\r\n"`)
+		})
+
+		Convey("Will redact passwords", func() {
+			So(dialogue, ShouldContainSubstring, `> "PASS ****\r\n"`)
+			So(dialogue, ShouldNotContainSubstring, "1234")
+		})
+
+		Convey("Will be closed when the session ends", func() {
+			So(closed, ShouldBeTrue)
+		})
+
+		Convey("Will only tap the sessions it's asked to", func() {
+			So(strings.Count(dialogue, `"USER test\r\n"`), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestFTPS(t *testing.T) {
+	serverTLS, clientTLS := NewTLSConfigs()
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/file.txt", []byte("secret data"))
+	server := NewServer(&graval.FTPServerOpts{Factory: factory, TLSConfig: serverTLS})
+	defer server.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	feat, _ := client.Cmd("FEAT")
+	early, _ := client.Cmd("PBSZ 0")
+	authErr := client.AuthTLS(clientTLS)
+	again, _ := client.Cmd("AUTH TLS")
+	mic, _ := client.Cmd("MIC %s", base64.StdEncoding.EncodeToString([]byte("PWD")))
+	client.Login(t, "test", "1234")
+	protectErr := client.Protect(nil)
+	storeErr := client.Store("/upload.txt", []byte("uploaded"))
+	uploaded, _ := factory.ReadFile("/upload.txt")
+	retrieved, retrieveErr := client.Retrieve("/file.txt")
+
+	// PROT P, but a data connection in the clear
+	plain := server.Client(t)
+	defer plain.Close()
+	plainAuthErr := plain.AuthTLS(clientTLS)
+	plain.Login(t, "test", "1234")
+	plain.Run(t, Step{"PBSZ 0", 200}, Step{"PROT P", 200})
+	plainErr := plain.Store("/plain.txt", []byte("in the clear"))
+	_, plainStored := factory.ReadFile("/plain.txt")
+
+	unconfigured := NewServer(&graval.FTPServerOpts{})
+	defer unconfigured.Close()
+	other := unconfigured.Client(t)
+	defer other.Close()
+	unsupported, _ := other.Cmd("AUTH TLS")
+
+	Convey("A server with a TLS config", t, func() {
+		So(authErr, ShouldBeNil)
+		So(plainAuthErr, ShouldBeNil)
+
+		Convey("Will list AUTH TLS in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, "\n AUTH TLS\n PBSZ\n PROT\n")
+		})
+
+		Convey("Will refuse PBSZ before AUTH TLS", func() {
+			So(early.Code, ShouldEqual, 503)
+		})
+
+		Convey("Will refuse a second AUTH once TLS is negotiated", func() {
+			So(again.Code, ShouldEqual, 503)
+		})
+
+		Convey("Will refuse RFC 2228 protected commands over TLS", func() {
+			So(mic.Code, ShouldEqual, 500)
+		})
+
+		Convey("Will protect data connections after PROT P", func() {
+			So(protectErr, ShouldBeNil)
+			So(storeErr, ShouldBeNil)
+			So(string(uploaded), ShouldEqual, "uploaded")
+			So(retrieveErr, ShouldBeNil)
+			So(string(retrieved), ShouldEqual, "secret data")
+		})
+
+		Convey("Will refuse a data connection in the clear after PROT P", func() {
+			So(plainErr, ShouldNotBeNil)
+			So(plainErr.Error(), ShouldContainSubstring, "522")
+			So(plainStored, ShouldBeFalse)
+		})
+	})
+
+	Convey("A server without a TLS config will refuse AUTH TLS", t, func() {
+		So(unsupported.Code, ShouldEqual, 504)
+	})
+}
+
+func TestDataTLSPolicy(t *testing.T) {
+	serverTLS, clientTLS := NewTLSConfigs()
+	factory := NewMemDriverFactory()
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:       factory,
+		TLSConfig:     serverTLS,
+		DataTLSConfig: &tls.Config{MinVersion: tls.VersionTLS13, NextProtos: []string{"ftp-data"}},
+	})
+	defer server.Close()
+
+	controlTLS := clientTLS.Clone()
+	controlTLS.MaxVersion = tls.VersionTLS12
+	strongTLS := clientTLS.Clone()
+	strongTLS.NextProtos = []string{"ftp-data"}
+	client := server.Client(t)
+	defer client.Close()
+	authErr := client.AuthTLS(controlTLS)
+	client.Login(t, "test", "1234")
+	protectErr := client.Protect(strongTLS)
+	strongErr := client.Store("/strong.txt", []byte("strong"))
+	_, strongStored := factory.ReadFile("/strong.txt")
+
+	weak := server.Client(t)
+	defer weak.Close()
+	weakAuthErr := weak.AuthTLS(controlTLS)
+	weak.Login(t, "test", "1234")
+	weak.Protect(nil)
+	weakErr := weak.Store("/weak.txt", []byte("weak"))
+	weakReply, _ := weak.ReadReply()
+	_, weakStored := factory.ReadFile("/weak.txt")
+
+	otherProtocol := clientTLS.Clone()
+	otherProtocol.NextProtos = []string{"other"}
+	mismatched := server.Client(t)
+	defer mismatched.Close()
+	mismatched.AuthTLS(clientTLS)
+	mismatched.Login(t, "test", "1234")
+	mismatched.Protect(otherProtocol)
+	mismatchErr := mismatched.Store("/mismatch.txt", []byte("other"))
+	mismatchReply, _ := mismatched.ReadReply()
+
+	Convey("A data connection TLS policy", t, func() {
+		Convey("Is held separately from the control connection", func() {
+			So(authErr, ShouldBeNil)
+			So(weakAuthErr, ShouldBeNil)
+			So(protectErr, ShouldBeNil)
+			So(strongErr, ShouldBeNil)
+			So(strongStored, ShouldBeTrue)
+		})
+
+		Convey("Will refuse transfers that fall below the minimum version", func() {
+			So(weakErr, ShouldNotBeNil)
+			So(weakReply.Code, ShouldEqual, 522)
+			So(weakStored, ShouldBeFalse)
+		})
+
+		Convey("Will refuse transfers that offer none of its protocols", func() {
+			So(mismatchErr, ShouldNotBeNil)
+			So(mismatchReply.Code, ShouldEqual, 522)
+		})
+	})
+}
+
+func TestSecureFXP(t *testing.T) {
+	serverTLS, clientTLS := NewTLSConfigs()
+	source := NewMemDriverFactory()
+	source.WriteFile("/file.txt", []byte("server to server"))
+	target := NewMemDriverFactory()
+	sourceServer := NewServer(&graval.FTPServerOpts{Factory: source, TLSConfig: serverTLS, AllowFXP: true})
+	defer sourceServer.Close()
+	targetServer := NewServer(&graval.FTPServerOpts{Factory: target, TLSConfig: serverTLS})
+	defer targetServer.Close()
+
+	plain := sourceServer.Client(t)
+	defer plain.Close()
+	plain.Login(t, "test", "1234")
+	early, _ := plain.Cmd("SSCN ON")
+
+	from := sourceServer.Client(t)
+	defer from.Close()
+	to := targetServer.Client(t)
+	defer to.Close()
+	for _, client := range []*Client{from, to} {
+		if err := client.AuthTLS(clientTLS); err != nil {
+			t.Fatal(err)
+		}
+		client.Login(t, "test", "1234")
+		if err := client.Protect(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	feat, _ := from.Cmd("FEAT")
+	query, _ := from.Cmd("SSCN")
+	bad, _ := from.Cmd("SSCN MAYBE")
+	refused, _ := to.Cmd("SSCN ON")
+	on, _ := from.Cmd("SSCN ON")
+	pasv := to.Expect(t, 227, "PASV")
+	match := pasvRegexp.FindStringSubmatch(pasv.Message)
+	from.Expect(t, 200, "PORT %s", strings.Join(match[1:], ","))
+	to.Expect(t, 150, "STOR /copy.txt")
+	from.Expect(t, 150, "RETR /file.txt")
+	sent, _ := from.ReadReply()
+	received, _ := to.ReadReply()
+	copied, _ := target.ReadFile("/copy.txt")
+	off, _ := from.Cmd("SSCN OFF")
+
+	Convey("SSCN", t, func() {
+		Convey("Is listed in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, "\n SSCN\n")
+		})
+
+		Convey("Needs AUTH TLS first", func() {
+			So(early.Code, ShouldEqual, 503)
+		})
+
+		Convey("Will report and change which end is the TLS client", func() {
+			So(query.Message, ShouldEqual, "SSCN:SERVER METHOD")
+			So(bad.Code, ShouldEqual, 501)
+			So(on.Message, ShouldEqual, "SSCN:CLIENT METHOD")
+			So(off.Message, ShouldEqual, "SSCN:SERVER METHOD")
+		})
+
+		Convey("Will refuse SSCN ON without AllowFXP", func() {
+			So(refused.Code, ShouldEqual, 504)
+		})
+
+		Convey("Will let two servers transfer a file over TLS", func() {
+			So(sent.Code, ShouldEqual, 226)
+			So(received.Code, ShouldEqual, 226)
+			So(string(copied), ShouldEqual, "server to server")
+		})
+	})
+}
+
+func TestClearCommandChannel(t *testing.T) {
+	serverTLS, clientTLS := NewTLSConfigs()
+	factory := NewMemDriverFactory()
+	server := NewServer(&graval.FTPServerOpts{Factory: factory, TLSConfig: serverTLS, AllowCCC: true})
+	defer server.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	feat, _ := client.Cmd("FEAT")
+	client.AuthTLS(clientTLS)
+	client.Login(t, "test", "1234")
+	protectErr := client.Protect(nil)
+	clearErr := client.ClearCommandChannel()
+	pwd, _ := client.Cmd("PWD")
+	storeErr := client.Store("/after.txt", []byte("still protected"))
+	stored, _ := factory.ReadFile("/after.txt")
+	again, _ := client.Cmd("CCC")
+
+	// logged in before AUTH TLS, so the password crossed in the clear
+	early := server.Client(t)
+	defer early.Close()
+	early.Login(t, "test", "1234")
+	early.AuthTLS(clientTLS)
+	earlyCCC, _ := early.Cmd("CCC")
+
+	refusing := NewServer(&graval.FTPServerOpts{Factory: factory, TLSConfig: serverTLS})
+	defer refusing.Close()
+	other := refusing.Client(t)
+	defer other.Close()
+	refusingFeat, _ := other.Cmd("FEAT")
+	other.AuthTLS(clientTLS)
+	other.Login(t, "test", "1234")
+	refused, _ := other.Cmd("CCC")
+	stillTLS, _ := other.Cmd("PWD")
+
+	Convey("A server that allows CCC", t, func() {
+		Convey("Will list it in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, "\n CCC\n")
+			So(refusingFeat.Message, ShouldNotContainSubstring, "CCC")
+		})
+
+		Convey("Will return the control connection to the clear", func() {
+			So(clearErr, ShouldBeNil)
+			So(pwd.Code, ShouldEqual, 257)
+		})
+
+		Convey("Will keep protecting data connections", func() {
+			So(protectErr, ShouldBeNil)
+			So(storeErr, ShouldBeNil)
+			So(string(stored), ShouldEqual, "still protected")
+		})
+
+		Convey("Will refuse CCC once the control connection is clear", func() {
+			So(again.Code, ShouldEqual, 533)
+		})
+
+		Convey("Will refuse CCC to clients that logged in before AUTH TLS", func() {
+			So(earlyCCC.Code, ShouldEqual, 534)
+		})
+	})
+
+	Convey("A server that doesn't allow CCC will refuse it", t, func() {
+		So(refused.Code, ShouldEqual, 534)
+		So(stillTLS.Code, ShouldEqual, 257)
+	})
+}
+
+func TestRequireTLS(t *testing.T) {
+	serverTLS, clientTLS := NewTLSConfigs()
+	factory := NewMemDriverFactory()
+	factory.WriteFile("/file.txt", []byte("payload"))
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:         factory,
+		TLSConfig:       serverTLS,
+		RequireTLSLogin: true,
+		RequireTLSData:  true,
+	})
+	defer server.Close()
+
+	plain := server.Client(t)
+	defer plain.Close()
+	user, _ := plain.Cmd("USER test")
+	pass, _ := plain.Cmd("PASS 1234")
+
+	client := server.Client(t)
+	defer client.Close()
+	authErr := client.AuthTLS(clientTLS)
+	client.Login(t, "test", "1234")
+	client.Expect(t, 227, "PASV")
+	clearList, _ := client.Cmd("LIST")
+	unused, _ := client.Cmd("RETR /file.txt")
+	client.Run(t, Step{"PBSZ 0", 200}, Step{"PROT C", 200}, Step{"PASV", 227})
+	clearRetr, _ := client.Cmd("RETR /file.txt")
+	protectErr := client.Protect(nil)
+	data, retrieveErr := client.Retrieve("/file.txt")
+
+	Convey("A server that requires TLS", t, func() {
+		Convey("Will refuse logins before AUTH TLS", func() {
+			So(user.Code, ShouldEqual, 550)
+			So(pass.Code, ShouldEqual, 550)
+		})
+
+		Convey("Will accept logins after AUTH TLS", func() {
+			So(authErr, ShouldBeNil)
+		})
+
+		Convey("Will refuse transfers in the clear", func() {
+			So(clearList.Code, ShouldEqual, 521)
+			So(clearRetr.Code, ShouldEqual, 521)
+		})
+
+		Convey("Will close the data connection of a refused transfer", func() {
+			So(unused.Code, ShouldEqual, 425)
+		})
+
+		Convey("Will allow transfers after PROT P", func() {
+			So(protectErr, ShouldBeNil)
+			So(retrieveErr, ShouldBeNil)
+			So(string(data), ShouldEqual, "payload")
+		})
+	})
+}
+
+// iterDriver lists /huge, and /endless, which never runs out of entries, one
+// entry at a time.
+type iterDriver struct {
+	*MemDriver
+	factory *iterDriverFactory
+}
+
+func (driver *iterDriver) DirContents(path string) []os.FileInfo {
+	driver.factory.mu.Lock()
+	driver.factory.sliced++
+	driver.factory.mu.Unlock()
+	return driver.MemDriver.DirContents(path)
+}
+
+func (driver *iterDriver) DirContentsIter(path string, fn func(os.FileInfo) bool) error {
+	for i := 0; path == "/endless" || i < 5000; i++ {
+		if !fn(graval.NewFileItem(fmt.Sprintf("file%07d.txt", i), int64(i), time.Now())) {
+			break
+		}
+	}
+	return nil
+}
+
+type iterDriverFactory struct {
+	*MemDriverFactory
+	mu     sync.Mutex
+	sliced int
+}
+
+func (factory *iterDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &iterDriver{MemDriver: driver.(*MemDriver), factory: factory}, nil
+}
+
+func TestDirContentsIter(t *testing.T) {
+	factory := &iterDriverFactory{MemDriverFactory: NewMemDriverFactory()}
+	factory.MakeDir("/huge")
+	factory.MakeDir("/endless")
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	names, _ := client.NameList("/huge")
+	detailed, _ := client.List("/huge")
+	machineData, _ := client.readData("MLSD /huge")
+	machine := string(machineData)
+
+	conn, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Expect(t, 150, "NLST /endless")
+	firstLine, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	abortReply, _ := client.ReadReply()
+	pwdReply, _ := client.Cmd("PWD")
+
+	factory.mu.Lock()
+	sliced := factory.sliced
+	factory.mu.Unlock()
+
+	Convey("A driver that can iterate over a directory", t, func() {
+		Convey("Will have NLST, LIST and MLSD stream every entry", func() {
+			So(strings.Count(names, ".txt\r\n"), ShouldEqual, 5000)
+			So(names, ShouldStartWith, "file0000000.txt\r\n")
+			So(strings.Count(detailed, ".txt\r\n"), ShouldEqual, 5000)
+			So(detailed, ShouldContainSubstring, " file0004999.txt\r\n")
+			So(strings.Count(machine, ".txt\r\n"), ShouldEqual, 5000)
+			So(machine, ShouldContainSubstring, "; file0004999.txt\r\n")
+		})
+
+		Convey("Won't be asked for the whole directory at once", func() {
+			So(sliced, ShouldEqual, 0)
+		})
+
+		Convey("Will stop listing when the client closes the data connection", func() {
+			So(firstLine, ShouldEqual, "file0000000.txt\r\n")
+			So(abortReply.Code, ShouldEqual, 426)
+			So(pwdReply.Code, ShouldEqual, 257)
+		})
+	})
+}
+
+// listingLimitServer starts a server with limits on listing size, and seven
+// files in /dir.
+func listingLimitServer(opts *graval.FTPServerOpts) *Server {
+	factory := NewMemDriverFactory()
+	for i := 1; i <= 7; i++ {
+		factory.WriteFile(fmt.Sprintf("/dir/file%d.txt", i), []byte("data"))
+	}
+	opts.Factory = factory
+	return NewServer(opts)
+}
+
+// listWithReply sends a listing command, and returns the listing and the
+// message of its 226 reply.
+func listWithReply(t *testing.T, client *Client, line string) (string, string) {
+	conn, err := client.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Expect(t, 150, line)
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	return string(data), client.ExpectReply(t, 226).Message
+}
+
+func TestListingLimits(t *testing.T) {
+	server := listingLimitServer(&graval.FTPServerOpts{MaxListEntries: 3})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	detailed, detailedReply := listWithReply(t, client, "LIST /dir")
+	var pages, pageReplies []string
+	for i := 0; i < 3; i++ {
+		page, reply := listWithReply(t, client, "MLSD /dir")
+		pages = append(pages, page)
+		pageReplies = append(pageReplies, reply)
+	}
+	first, _ := listWithReply(t, client, "MLSD /dir")
+	client.Expect(t, 200, "NOOP")
+	restarted, _ := listWithReply(t, client, "MLSD /dir")
+
+	bytesServer := listingLimitServer(&graval.FTPServerOpts{MaxListBytes: 44})
+	defer bytesServer.Close()
+	bytesClient := bytesServer.Client(t)
+	defer bytesClient.Close()
+	bytesClient.Login(t, "test", "1234")
+	names, namesReply := listWithReply(t, bytesClient, "NLST /dir")
+
+	Convey("A server with a limit on listing size", t, func() {
+		Convey("Will truncate LIST and say so in the 226 reply", func() {
+			So(strings.Count(detailed, ".txt\r\n"), ShouldEqual, 3)
+			So(detailedReply, ShouldEqual, "Listing truncated after 3 entries.")
+		})
+
+		Convey("Will page through a directory with repeated MLSD commands", func() {
+			So(pages[0], ShouldContainSubstring, " file1.txt\r\n")
+			So(pages[0], ShouldContainSubstring, " file3.txt\r\n")
+			So(pages[1], ShouldContainSubstring, " file4.txt\r\n")
+			So(pages[1], ShouldContainSubstring, " file6.txt\r\n")
+			So(strings.Count(pages[2], "\r\n"), ShouldEqual, 1)
+			So(pages[2], ShouldContainSubstring, " file7.txt\r\n")
+			So(pageReplies[0], ShouldEqual, "Listing truncated after 3 entries. Send MLSD again for the rest.")
+			So(pageReplies[1], ShouldEqual, "Listing truncated after 6 entries. Send MLSD again for the rest.")
+			So(pageReplies[2], ShouldEqual, "Transfer complete.")
+		})
+
+		Convey("Will start MLSD from the beginning after a complete listing or another command", func() {
+			So(first, ShouldEqual, pages[0])
+			So(restarted, ShouldEqual, pages[0])
+		})
+
+		Convey("Will stop before a listing grows past the byte limit", func() {
+			So(names, ShouldEqual, "file1.txt\r\nfile2.txt\r\nfile3.txt\r\nfile4.txt\r\n\r\n")
+			So(namesReply, ShouldEqual, "Listing truncated after 4 entries.")
+		})
+	})
+}
+
+// segmentDriver serves segmented downloads from one copy of a file per
+// download group. Downloads from the start of the file wait for release.
+type segmentDriver struct {
+	*MemDriver
+	factory *segmentDriverFactory
+}
+
+// segmentHandle is the copy of a file shared by a download group.
+type segmentHandle struct {
+	data    []byte
+	factory *segmentDriverFactory
+}
+
+func (handle *segmentHandle) Close() error {
+	handle.factory.mu.Lock()
+	defer handle.factory.mu.Unlock()
+	handle.factory.closed++
+	return nil
+}
+
+func (driver *segmentDriver) GetFileSegment(path string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	shared, err := group.Shared(func() (interface{}, error) {
+		data, ok := driver.factory.ReadFile(path)
+		if !ok {
+			return nil, graval.ErrNotFound
+		}
+		driver.factory.mu.Lock()
+		driver.factory.opened++
+		driver.factory.mu.Unlock()
+		return &segmentHandle{data: data, factory: driver.factory}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	driver.factory.mu.Lock()
+	driver.factory.groups = append(driver.factory.groups, group.Segments())
+	driver.factory.mu.Unlock()
+	data := shared.(*segmentHandle).data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	var reader io.Reader = bytes.NewReader(data)
+	if offset == 0 {
+		reader = io.MultiReader(waitReader{driver.factory.release}, reader)
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+// waitReader reads nothing once its channel is closed.
+type waitReader struct {
+	wait chan struct{}
+}
+
+func (reader waitReader) Read(p []byte) (int, error) {
+	<-reader.wait
+	return 0, io.EOF
+}
+
+type segmentDriverFactory struct {
+	*MemDriverFactory
+	release chan struct{}
+	mu      sync.Mutex
+	opened  int
+	closed  int
+	groups  [][]graval.DownloadSegment
+}
+
+func (factory *segmentDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &segmentDriver{MemDriver: driver.(*MemDriver), factory: factory}, nil
+}
+
+func (factory *segmentDriverFactory) counts() (int, int) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	return factory.opened, factory.closed
+}
+
+func TestSegmentedDownloads(t *testing.T) {
+	factory := &segmentDriverFactory{MemDriverFactory: NewMemDriverFactory(), release: make(chan struct{})}
+	factory.WriteFile("/file.txt", []byte("0123456789"))
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+
+	first := server.Client(t)
+	defer first.Close()
+	first.Login(t, "test", "1234")
+	conn, err := first.Passive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Expect(t, 150, "RETR /file.txt")
+
+	second := server.Client(t)
+	defer second.Close()
+	second.Login(t, "test", "1234")
+	secondData, secondErr := second.RetrieveFrom("/file.txt", 6)
+	ranged := retrieveRange(t, second, "/file.txt", 2, 5)
+	openedDuring, closedDuring := factory.counts()
+
+	close(factory.release)
+	firstData, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	first.ExpectReply(t, 226)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, closed := factory.counts(); closed == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	openedAfter, closedAfter := factory.counts()
+	laterData, _ := second.Retrieve("/file.txt")
+	factory.mu.Lock()
+	groups := factory.groups
+	factory.mu.Unlock()
+
+	Convey("A driver that serves segmented downloads", t, func() {
+		Convey("Will be given each segment a user downloads at once", func() {
+			So(secondErr, ShouldBeNil)
+			So(string(secondData), ShouldEqual, "6789")
+			So(ranged, ShouldEqual, "2345")
+			So(string(firstData), ShouldEqual, "0123456789")
+			So(groups[0], ShouldResemble, []graval.DownloadSegment{{Offset: 0, Length: -1}})
+			So(groups[1], ShouldResemble, []graval.DownloadSegment{{Offset: 0, Length: -1}, {Offset: 6, Length: -1}})
+			So(groups[2], ShouldResemble, []graval.DownloadSegment{{Offset: 0, Length: -1}, {Offset: 2, Length: 4}})
+		})
+
+		Convey("Will share one handle between them, closed after the last", func() {
+			So(openedDuring, ShouldEqual, 1)
+			So(closedDuring, ShouldEqual, 0)
+			So(openedAfter, ShouldEqual, 1)
+			So(closedAfter, ShouldEqual, 1)
+		})
+
+		Convey("Will start a new group once the last one has finished", func() {
+			So(string(laterData), ShouldEqual, "0123456789")
+			So(groups[len(groups)-1], ShouldResemble, []graval.DownloadSegment{{Offset: 0, Length: -1}})
+		})
+	})
+}
+
+// pooledDriver takes a backend connection from its factory's pool for each
+// session.
+type pooledDriver struct {
+	*MemDriver
+	factory *pooledDriverFactory
+	backend *int
+}
+
+func (driver *pooledDriver) SessionStart(ctx context.Context) error {
+	select {
+	case driver.backend = <-driver.factory.pool:
+	default:
+		return errors.New("no backend connections free")
+	}
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	driver.factory.started = append(driver.factory.started, graval.SessionFromContext(ctx).Id())
+	return nil
+}
+
+func (driver *pooledDriver) SessionEnd(ctx context.Context) {
+	driver.factory.mu.Lock()
+	driver.factory.ended = append(driver.factory.ended, graval.SessionFromContext(ctx).Id())
+	driver.factory.mu.Unlock()
+	driver.factory.pool <- driver.backend
+}
+
+func (driver *pooledDriver) MakeDir(path string) bool {
+	*driver.backend++
+	return driver.MemDriver.MakeDir(path)
+}
+
+type pooledDriverFactory struct {
+	*MemDriverFactory
+	pool    chan *int
+	mu      sync.Mutex
+	started []string
+	ended   []string
+}
+
+func (factory *pooledDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &pooledDriver{MemDriver: driver.(*MemDriver), factory: factory}, nil
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	backend := 0
+	factory := &pooledDriverFactory{MemDriverFactory: NewMemDriverFactory(), pool: make(chan *int, 1)}
+	factory.pool <- &backend
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+
+	client := server.Client(t)
+	client.Login(t, "test", "1234")
+	client.Expect(t, 257, "MKD /one")
+	_, refusedErr := Dial(server.Addr)
+	client.Expect(t, 221, "QUIT")
+	client.Close()
+	var returned *int
+	select {
+	case returned = <-factory.pool:
+		factory.pool <- returned
+	case <-time.After(5 * time.Second):
+	}
+
+	later := server.Client(t)
+	defer later.Close()
+	later.Login(t, "test", "1234")
+	later.Expect(t, 257, "MKD /two")
+	factory.mu.Lock()
+	started, ended := factory.started, factory.ended
+	factory.mu.Unlock()
+
+	Convey("A driver with a session lifecycle", t, func() {
+		Convey("Will acquire its backend when the session starts and release it when it ends", func() {
+			So(returned, ShouldEqual, &backend)
+			So(backend, ShouldEqual, 2)
+			So(len(started), ShouldEqual, 2)
+			So(ended, ShouldResemble, started[:1])
+		})
+
+		Convey("Will turn clients away with a 421 if the session can't start", func() {
+			So(refusedErr, ShouldNotBeNil)
+			So(refusedErr.Error(), ShouldContainSubstring, "421")
+		})
+	})
+}
+
+// pingFactory has a backend whose health can be set.
+type pingFactory struct {
+	*MemDriverFactory
+	mu   sync.Mutex
+	down error
+}
+
+func (factory *pingFactory) Ping(ctx context.Context) error {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	return factory.down
+}
+
+func (factory *pingFactory) setDown(err error) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	factory.down = err
+}
+
+func TestHealth(t *testing.T) {
+	factory := &pingFactory{MemDriverFactory: NewMemDriverFactory()}
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	ftpServer := server.FTPServer()
+	// once a client has connected, the server is surely listening
+	server.Client(t).Close()
+	healthy := ftpServer.Health(context.Background())
+
+	factory.setDown(errors.New("database unreachable"))
+	recorder := httptest.NewRecorder()
+	ftpServer.HealthHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	var backendDown graval.Health
+	json.NewDecoder(recorder.Body).Decode(&backendDown)
+	factory.setDown(nil)
+
+	ftpServer.ScheduleMaintenance(time.Now().Add(time.Hour), 2*time.Hour, "")
+	maintenance := ftpServer.Health(context.Background())
+	ftpServer.CancelMaintenance()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ftpServer.ServeHealth(listener)
+	checkTCP := func() string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+		status, _ := ioutil.ReadAll(conn)
+		return string(status)
+	}
+	readyTCP := checkTCP()
+	server.Close()
+	closed := ftpServer.Health(context.Background())
+	closedTCP := checkTCP()
+	listener.Close()
+
+	Convey("A server's health", t, func() {
+		Convey("Will be ready while it's listening and the backend is up", func() {
+			So(healthy, ShouldResemble, graval.Health{Listening: true, Ready: true})
+			So(readyTCP, ShouldEqual, "ready\n")
+		})
+
+		Convey("Will report a backend that's down with a 503", func() {
+			So(recorder.Code, ShouldEqual, 503)
+			So(backendDown.Ready, ShouldBeFalse)
+			So(backendDown.BackendError, ShouldEqual, "database unreachable")
+		})
+
+		Convey("Won't be ready during maintenance", func() {
+			So(maintenance.Maintenance, ShouldBeTrue)
+			So(maintenance.Ready, ShouldBeFalse)
+		})
+
+		Convey("Won't be ready once the server is closed", func() {
+			So(closed.Closed, ShouldBeTrue)
+			So(closed.Listening, ShouldBeFalse)
+			So(closed.Ready, ShouldBeFalse)
+			So(closedTCP, ShouldEqual, "not ready\n")
+		})
+	})
+}
+
+// fixedPortAllocator hands out a single port.
+type fixedPortAllocator struct {
+	mu        sync.Mutex
+	port      int
+	allocated bool
+	released  []int
+}
+
+func (allocator *fixedPortAllocator) AllocatePort() (int, error) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	if allocator.allocated {
+		return 0, errors.New("no ports free")
+	}
+	allocator.allocated = true
+	return allocator.port, nil
+}
+
+func (allocator *fixedPortAllocator) ReleasePort(port int) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	allocator.allocated = false
+	allocator.released = append(allocator.released, port)
+}
+
+func (allocator *fixedPortAllocator) releasedPorts() []int {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	return append([]int(nil), allocator.released...)
+}
+
+func TestPortAllocator(t *testing.T) {
+	// find a port that's free to hand out
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	allocator := &fixedPortAllocator{port: port}
+	server := NewServer(&graval.FTPServerOpts{PortAllocator: allocator})
+	defer server.Close()
+	server.Factory.(*MemDriverFactory).WriteFile("/file.txt", []byte("data"))
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	pasv, _ := client.Cmd("PASV")
+	refused, _ := client.Cmd("EPSV")
+	data, retrieveErr := client.Retrieve("/file.txt")
+	// each passive command replaces the last listener, and the transfer
+	// closes the final one
+	for deadline := time.Now().Add(5 * time.Second); len(allocator.releasedPorts()) < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	Convey("A port allocator", t, func() {
+		Convey("Will choose the port for passive data connections", func() {
+			So(pasv.Code, ShouldEqual, 227)
+			So(pasv.Message, ShouldEndWith, fmt.Sprintf(",%d,%d)", port/256, port%256))
+		})
+
+		Convey("Will get the port back when the data connection is finished with", func() {
+			So(refused.Code, ShouldEqual, 229)
+			So(string(data), ShouldEqual, "data")
+			So(retrieveErr, ShouldBeNil)
+			So(allocator.releasedPorts(), ShouldResemble, []int{port, port, port})
+		})
+	})
+}
+
+func TestSessionAffinity(t *testing.T) {
+	var mu sync.Mutex
+	var events []graval.SessionAffinity
+	ended := make(chan struct{})
+	server := NewServer(&graval.FTPServerOpts{
+		InstanceName: "ftp-2",
+		AffinityHook: func(affinity *graval.SessionAffinity) {
+			mu.Lock()
+			events = append(events, *affinity)
+			mu.Unlock()
+			if affinity.Event == graval.AffinityEnd {
+				close(ended)
+			}
+		},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	client.Login(t, "test", "1234")
+	epsv, _ := client.Cmd("EPSV")
+	client.Expect(t, 221, "QUIT")
+	client.Close()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	Convey("An affinity hook", t, func() {
+		Convey("Will hear of each stage of a session", func() {
+			kinds := []graval.AffinityEvent{}
+			for _, event := range events {
+				kinds = append(kinds, event.Event)
+			}
+			So(kinds, ShouldResemble, []graval.AffinityEvent{graval.AffinityConnect, graval.AffinityLogin, graval.AffinityPassive, graval.AffinityEnd})
+		})
+
+		Convey("Will be given a token naming the instance and session", func() {
+			So(events[0].Instance, ShouldEqual, "ftp-2")
+			So(events[0].Token, ShouldEqual, "ftp-2:"+events[0].SessionId)
+			So(events[0].RemoteIP, ShouldEqual, "127.0.0.1")
+			So(events[0].User, ShouldEqual, "")
+		})
+
+		Convey("Will be told who logged in", func() {
+			So(events[1].User, ShouldEqual, "test")
+			So(events[1].Token, ShouldEqual, events[0].Token)
+		})
+
+		Convey("Will be told the passive port before the client", func() {
+			So(epsv.Code, ShouldEqual, 229)
+			So(epsv.Message, ShouldContainSubstring, fmt.Sprintf("|||%d|", events[2].PassivePort))
+			So(events[3].PassivePort, ShouldEqual, 0)
+		})
+	})
+}
+
+// toyMechanism is a security mechanism whose exchange takes two ADAT tokens
+// and whose protection is a prefix, so tests can check the state machine.
+type toyMechanism struct{}
+
+func (mechanism toyMechanism) NewExchange(session *graval.Session) (graval.SecurityExchange, error) {
+	return &toyExchange{}, nil
+}
+
+type toyExchange struct {
+	greeted bool
+}
+
+func (exchange *toyExchange) Accept(token []byte) ([]byte, bool, error) {
+	switch {
+	case !exchange.greeted && string(token) == "hello":
+		exchange.greeted = true
+		return []byte("challenge"), false, nil
+	case exchange.greeted && string(token) == "response":
+		return nil, true, nil
+	}
+	return nil, false, errors.New("unexpected token")
+}
+
+func (exchange *toyExchange) Unwrap(level graval.ProtectionLevel, token []byte) ([]byte, error) {
+	if !bytes.HasPrefix(token, []byte("u:")) {
+		return nil, errors.New("bad token")
+	}
+	return token[2:], nil
+}
+
+func (exchange *toyExchange) Wrap(level graval.ProtectionLevel, line []byte) ([]byte, error) {
+	return append([]byte{byte(level), ':'}, line...), nil
+}
+
+// unwrapToy decodes each line of a reply protected by toyMechanism.
+func unwrapToy(reply *Reply) []string {
+	lines := []string{}
+	for _, line := range strings.Split(reply.Message, "\n") {
+		token, _ := base64.StdEncoding.DecodeString(line)
+		lines = append(lines, string(token))
+	}
+	return lines
+}
+
+func TestSecurityMechanisms(t *testing.T) {
+	encode := base64.StdEncoding.EncodeToString
+	server := NewServer(&graval.FTPServerOpts{
+		SecurityMechanisms: map[string]graval.SecurityMechanism{"TOY": toyMechanism{}},
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+
+	feat, _ := client.Cmd("FEAT")
+	unknown, _ := client.Cmd("AUTH KERBEROS_V4")
+	early, _ := client.Cmd("MIC %s", encode([]byte("u:PWD")))
+	earlyPbsz, _ := client.Cmd("PBSZ 0")
+	auth, _ := client.Cmd("AUTH toy")
+	challenge, _ := client.Cmd("ADAT %s", encode([]byte("hello")))
+	complete, _ := client.Cmd("ADAT %s", encode([]byte("response")))
+	again, _ := client.Cmd("ADAT %s", encode([]byte("hello")))
+	user, _ := client.Cmd("ENC %s", encode([]byte("u:USER test")))
+	pass, _ := client.Cmd("ENC %s", encode([]byte("u:PASS 1234")))
+	pwd, _ := client.Cmd("MIC %s", encode([]byte("u:PWD")))
+	protectedFeat, _ := client.Cmd("CONF %s", encode([]byte("u:FEAT")))
+	forged, _ := client.Cmd("MIC %s", encode([]byte("PWD")))
+	nested, _ := client.Cmd("MIC %s", encode([]byte("u:MIC "+encode([]byte("u:PWD")))))
+	clear, _ := client.Cmd("PWD")
+	prot, _ := client.Cmd("PROT C")
+	pbsz, _ := client.Cmd("PBSZ 0")
+	private, _ := client.Cmd("PROT P")
+	protC, _ := client.Cmd("PROT C")
+
+	other := server.Client(t)
+	defer other.Close()
+	other.Cmd("AUTH TOY")
+	refused, _ := other.Cmd("ADAT %s", encode([]byte("response")))
+
+	Convey("A server with security mechanisms", t, func() {
+		Convey("Will list them in FEAT", func() {
+			So(feat.Message, ShouldContainSubstring, "\n AUTH TOY\n PBSZ\n PROT\n")
+		})
+
+		Convey("Will refuse mechanisms it doesn't have", func() {
+			So(unknown.Code, ShouldEqual, 504)
+		})
+
+		Convey("Will refuse protected commands and PBSZ before an exchange", func() {
+			So(early.Code, ShouldEqual, 503)
+			So(earlyPbsz.Code, ShouldEqual, 503)
+		})
+
+		Convey("Will run the security data exchange", func() {
+			So(auth.Code, ShouldEqual, 334)
+			So(challenge.Code, ShouldEqual, 335)
+			So(challenge.Message, ShouldEqual, "ADAT="+encode([]byte("challenge")))
+			So(complete.Code, ShouldEqual, 235)
+			So(again.Code, ShouldEqual, 503)
+		})
+
+		Convey("Will refuse tokens the mechanism rejects", func() {
+			So(refused.Code, ShouldEqual, 535)
+		})
+
+		Convey("Will run protected commands and protect their replies at the same level", func() {
+			So(user.Code, ShouldEqual, 633)
+			So(unwrapToy(user)[0], ShouldStartWith, "P:331 ")
+			So(pass.Code, ShouldEqual, 633)
+			So(unwrapToy(pass)[0], ShouldStartWith, "P:230 ")
+			So(pwd.Code, ShouldEqual, 631)
+			So(unwrapToy(pwd), ShouldResemble, []string{`S:257 "/" is the current directory`})
+		})
+
+		Convey("Will protect each line of a multiline reply", func() {
+			So(protectedFeat.Code, ShouldEqual, 632)
+			lines := unwrapToy(protectedFeat)
+			So(lines[0], ShouldEqual, "E:211-Features supported:")
+			So(lines[len(lines)-1], ShouldEqual, "E:211 End FEAT.")
+		})
+
+		Convey("Will refuse commands that fail the security check", func() {
+			So(forged.Code, ShouldEqual, 535)
+			So(nested.Code, ShouldEqual, 533)
+		})
+
+		Convey("Will still answer commands sent in the clear", func() {
+			So(clear.Code, ShouldEqual, 257)
+		})
+
+		Convey("Will only accept clear data connections, after PBSZ", func() {
+			So(prot.Code, ShouldEqual, 503)
+			So(pbsz.Code, ShouldEqual, 200)
+			So(private.Code, ShouldEqual, 536)
+			So(protC.Code, ShouldEqual, 200)
+		})
+	})
+}
+
+// passwordDriver lets users change the passwords in its factory's Users.
+type passwordDriver struct {
+	*MemDriver
+	factory *MemDriverFactory
+}
+
+func (driver *passwordDriver) ChangePassword(user string, oldPassword string, newPassword string) error {
+	if user == "locked" {
+		return graval.ErrPermission
+	}
+	driver.factory.Users[user] = newPassword
+	return nil
+}
+
+type passwordDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory *passwordDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &passwordDriver{MemDriver: driver.(*MemDriver), factory: factory.MemDriverFactory}, nil
+}
+
+func TestChangePassword(t *testing.T) {
+	factory := &passwordDriverFactory{MemDriverFactory: NewMemDriverFactory()}
+	factory.Users["locked"] = "secret"
+	tap := &tapBuffer{closed: make(chan struct{})}
+	server := NewServer(&graval.FTPServerOpts{
+		Factory:        factory,
+		PasswordPolicy: &graval.PasswordPolicy{MinLength: 10, MinCharClasses: 3, RejectUserName: true},
+		WireTap: func(sessionId string, remoteIP string) io.Writer {
+			return tap
+		},
+	})
+	defer server.Close()
+
+	client := server.Client(t)
+	client.Login(t, "test", "1234")
+	wrong, _ := client.Cmd("SITE PSWD 4321 Correct-Horse-9")
+	syntax, _ := client.Cmd("SITE PSWD 1234")
+	short, _ := client.Cmd("SITE PSWD 1234 Short-1")
+	plain, _ := client.Cmd("SITE PSWD 1234 correcthorsebattery")
+	named, _ := client.Cmd("SITE PSWD 1234 Test-Horse-9")
+	changed, _ := client.Cmd(`SITE CPWD "1234" "Correct Horse 9"`)
+	client.Expect(t, 221, "QUIT")
+	client.Close()
+	<-tap.closed
+
+	later := server.Client(t)
+	defer later.Close()
+	oldLogin, _ := later.Cmd("USER test")
+	oldPass, _ := later.Cmd("PASS 1234")
+	again := server.Client(t)
+	defer again.Close()
+	again.Login(t, "test", "Correct Horse 9")
+	again.Login(t, "locked", "secret")
+	refused, _ := again.Cmd("SITE PSWD secret Correct-Horse-9")
+
+	unsupported := NewServer(nil)
+	defer unsupported.Close()
+	plainClient := unsupported.Client(t)
+	defer plainClient.Close()
+	plainClient.Login(t, "test", "1234")
+	notImplemented, _ := plainClient.Cmd("SITE PSWD 1234 Correct-Horse-9")
+
+	Convey("SITE PSWD", t, func() {
+		Convey("Will refuse a wrong old password", func() {
+			So(wrong.Code, ShouldEqual, 530)
+			So(syntax.Code, ShouldEqual, 501)
+		})
+
+		Convey("Will refuse new passwords that break the policy", func() {
+			So(short.Code, ShouldEqual, 550)
+			So(short.Message, ShouldContainSubstring, "at least 10 characters")
+			So(plain.Code, ShouldEqual, 550)
+			So(named.Code, ShouldEqual, 550)
+			So(named.Message, ShouldContainSubstring, "user name")
+		})
+
+		Convey("Will change the password through the driver", func() {
+			So(changed.Code, ShouldEqual, 200)
+			So(oldLogin.Code, ShouldEqual, 331)
+			So(oldPass.Code, ShouldEqual, 530)
+		})
+
+		Convey("Will pass on why the driver refused", func() {
+			So(refused.Code, ShouldEqual, 550)
+			So(refused.Message, ShouldEqual, "Permission denied")
+		})
+
+		Convey("Will keep passwords out of the wire tap", func() {
+			So(tap.String(), ShouldContainSubstring, "SITE PSWD ****")
+			So(tap.String(), ShouldContainSubstring, "SITE CPWD ****")
+			So(tap.String(), ShouldNotContainSubstring, "Horse")
+		})
+
+		Convey("Will be refused when the driver can't change passwords", func() {
+			So(notImplemented.Code, ShouldEqual, 502)
+		})
+	})
+}
+
+// accountDriver restricts logins with the accounts in its factory, and
+// records the permissions it's asked to create files with.
+type accountDriver struct {
+	*MemDriver
+	factory *accountDriverFactory
+}
+
+func (driver *accountDriver) Account(user string) (*graval.Account, error) {
+	if user == "broken" {
+		return nil, errors.New("directory unavailable")
+	}
+	return driver.factory.accounts[user], nil
+}
+
+func (driver *accountDriver) SetCreateModes(fileMode os.FileMode, dirMode os.FileMode) {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	driver.factory.modes = append(driver.factory.modes, fileMode, dirMode)
+}
+
+type accountDriverFactory struct {
+	*MemDriverFactory
+	accounts map[string]*graval.Account
+	mu       sync.Mutex
+	modes    []os.FileMode
+}
+
+func (factory *accountDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &accountDriver{MemDriver: driver.(*MemDriver), factory: factory}, nil
+}
+
+func TestAccountRestrictions(t *testing.T) {
+	now := time.Date(2020, 3, 4, 23, 30, 0, 0, time.UTC)
+	factory := &accountDriverFactory{MemDriverFactory: NewMemDriverFactory(), accounts: map[string]*graval.Account{
+		"expired":   {Expires: now.Add(-time.Hour)},
+		"current":   {Expires: now.Add(time.Hour)},
+		"daytime":   {AllowedHours: []graval.HourRange{{From: 9, To: 17}}},
+		"overnight": {AllowedHours: []graval.HourRange{{From: 22, To: 6}}},
+		"eastern":   {AllowedHours: []graval.HourRange{{From: 9, To: 17}}, Location: time.FixedZone("UTC+10", 10*60*60)},
+		"office":    {AllowedNetworks: []string{"bad", "10.0.0.0/8"}},
+		"local":     {AllowedNetworks: []string{"192.0.2.1", "127.0.0.0/8"}},
+	}}
+	for user := range factory.accounts {
+		factory.Users[user] = "1234"
+	}
+	factory.Users["broken"] = "1234"
+	var mu sync.Mutex
+	var events []*graval.SecurityEvent
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: factory,
+		Clock:   NewFakeClock(now),
+		SecurityNotifier: graval.SecurityNotifierFunc(func(event *graval.SecurityEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+		}),
+	})
+	defer server.Close()
+
+	login := func(user string, pass string) *Reply {
+		client := server.Client(t)
+		defer client.Close()
+		client.Expect(t, 331, "USER "+user)
+		reply, _ := client.Cmd("PASS " + pass)
+		return reply
+	}
+	replies := map[string]*Reply{}
+	for _, user := range []string{"test", "expired", "current", "daytime", "overnight", "eastern", "office", "local", "broken"} {
+		replies[user] = login(user, "1234")
+	}
+	wrongPassword := login("expired", "4321")
+	mu.Lock()
+	defer mu.Unlock()
+
+	Convey("A driver with account restrictions", t, func() {
+		Convey("Will let users without restrictions log in", func() {
+			So(replies["test"].Code, ShouldEqual, 230)
+			So(replies["current"].Code, ShouldEqual, 230)
+		})
+
+		Convey("Will refuse expired accounts", func() {
+			So(replies["expired"].Code, ShouldEqual, 530)
+			So(replies["expired"].Message, ShouldEqual, "Account expired, not logged in")
+		})
+
+		Convey("Will only say why once the password is right", func() {
+			So(wrongPassword.Code, ShouldEqual, 530)
+			So(wrongPassword.Message, ShouldEqual, "Incorrect password, not logged in")
+		})
+
+		Convey("Will only allow logins in the allowed hours", func() {
+			So(replies["daytime"].Code, ShouldEqual, 530)
+			So(replies["daytime"].Message, ShouldEqual, "Login not allowed at this time")
+			So(replies["overnight"].Code, ShouldEqual, 230)
+			So(replies["eastern"].Code, ShouldEqual, 230)
+		})
+
+		Convey("Will only allow logins from the allowed networks", func() {
+			So(replies["office"].Code, ShouldEqual, 530)
+			So(replies["office"].Message, ShouldEqual, "Login not allowed from your address")
+			So(replies["local"].Code, ShouldEqual, 230)
+		})
+
+		Convey("Will refuse logins when the account can't be looked up", func() {
+			So(replies["broken"].Code, ShouldEqual, 530)
+		})
+
+		Convey("Will report refused logins as security events", func() {
+			restricted := []string{}
+			for _, event := range events {
+				if event.Type == graval.SecurityAccountRestricted {
+					restricted = append(restricted, event.User+": "+event.Detail)
+				}
+			}
+			So(restricted, ShouldResemble, []string{"expired: expired", "daytime: outside allowed hours", "office: outside allowed networks", "broken: unavailable"})
+		})
+	})
+}
+
+// aliasDriver maps the names in its factory's aliases to shared accounts.
+type aliasDriver struct {
+	*MemDriver
+	aliases map[string]string
+}
+
+func (driver *aliasDriver) AccountName(user string) string {
+	return driver.aliases[user]
+}
+
+type aliasDriverFactory struct {
+	*MemDriverFactory
+	aliases map[string]string
+}
+
+func (factory *aliasDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &aliasDriver{MemDriver: driver.(*MemDriver), aliases: factory.aliases}, nil
+}
+
+func TestUserAliases(t *testing.T) {
+	factory := &aliasDriverFactory{MemDriverFactory: NewMemDriverFactory(), aliases: map[string]string{"alice": "guests", "bob": "guests"}}
+	factory.Users["alice"] = "1234"
+	factory.Users["bob"] = "1234"
+	factory.WriteFile("/file.txt", []byte("data"))
+	var mu sync.Mutex
+	var hookUsers []string
+	server := NewServer(&graval.FTPServerOpts{
+		Factory: factory,
+		UserTransferCap: func(user string) int64 {
+			if user == "guests" {
+				return 8
+			}
+			return 0
+		},
+		CommandHook: func(command *graval.CommandRecord) {
+			if command.Command == "RETR" {
+				mu.Lock()
+				hookUsers = append(hookUsers, command.User)
+				mu.Unlock()
+			}
+		},
+	})
+	defer server.Close()
+
+	alice := server.Client(t)
+	defer alice.Close()
+	alice.Login(t, "alice", "1234")
+	aliceData, _ := alice.Retrieve("/file.txt")
+	bob := server.Client(t)
+	defer bob.Close()
+	bob.Login(t, "bob", "1234")
+	bobData, _ := bob.Retrieve("/file.txt")
+	_, capErr := bob.Retrieve("/file.txt")
+	test := server.Client(t)
+	defer test.Close()
+	test.Login(t, "test", "1234")
+	testData, _ := test.Retrieve("/file.txt")
+
+	accounts := map[string]string{}
+	for _, session := range server.FTPServer().Sessions() {
+		accounts[session.User] = session.Account
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	Convey("A driver with user aliases", t, func() {
+		Convey("Will count aliases' usage and limits under their account", func() {
+			So(string(aliceData), ShouldEqual, "data")
+			So(string(bobData), ShouldEqual, "data")
+			So(capErr, ShouldNotBeNil)
+			So(capErr.Error(), ShouldContainSubstring, "552")
+			So(server.FTPServer().UserUsage("guests").BytesDownloaded, ShouldEqual, 8)
+			So(server.FTPServer().UserUsage("alice").BytesDownloaded, ShouldEqual, 0)
+		})
+
+		Convey("Will leave other users to their own accounts", func() {
+			So(string(testData), ShouldEqual, "data")
+			So(server.FTPServer().UserUsage("test").BytesDownloaded, ShouldEqual, 4)
+		})
+
+		Convey("Will report the name each user logged in with", func() {
+			So(hookUsers, ShouldResemble, []string{"alice", "bob", "bob", "test"})
+			So(accounts, ShouldResemble, map[string]string{"alice": "guests", "bob": "guests", "test": ""})
+		})
+	})
+}
+
+func TestAccountCreateModes(t *testing.T) {
+	factory := &accountDriverFactory{MemDriverFactory: NewMemDriverFactory(), accounts: map[string]*graval.Account{
+		"shared":  {Umask: 002},
+		"private": {FileMode: 0600, DirMode: 0700, Umask: 077},
+	}}
+	factory.Users["shared"] = "1234"
+	factory.Users["private"] = "1234"
+	server := NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+	for _, user := range []string{"test", "shared", "private"} {
+		client := server.Client(t)
+		client.Login(t, user, "1234")
+		client.Close()
+	}
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+
+	Convey("An account with a umask", t, func() {
+		Convey("Will have its permissions for new files passed to the driver", func() {
+			So(factory.modes, ShouldResemble, []os.FileMode{0664, 0775, 0600, 0700})
+		})
+	})
+}
+
+// noCommitDriverFactory creates drivers that can't rename anything into
+// /docs/report.txt except from the archive, so an atomic upload to it can't
+// be committed.
+type noCommitDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory noCommitDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return noCommitDriver{driver}, nil
+}
+
+type noCommitDriver struct {
+	graval.FTPDriver
+}
+
+func (driver noCommitDriver) Rename(fromPath string, toPath string) bool {
+	if toPath == "/docs/report.txt" && !strings.HasPrefix(fromPath, "/.versions/") {
+		return false
+	}
+	return driver.FTPDriver.Rename(fromPath, toPath)
+}
+
+// rejectDataDriverFactory creates drivers that store what's uploaded to
+// /docs/report.txt but then report that they couldn't.
+type rejectDataDriverFactory struct {
+	*MemDriverFactory
+}
+
+func (factory rejectDataDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return rejectDataDriver{driver}, nil
+}
+
+type rejectDataDriver struct {
+	graval.FTPDriver
+}
+
+func (driver rejectDataDriver) PutFile(destPath string, data io.Reader) bool {
+	return driver.FTPDriver.PutFile(destPath, data) && destPath != "/docs/report.txt"
+}
+
+// collisionServer starts a server with the given collision policy and a
+// report.txt already in it.
+func collisionServer(policy graval.CollisionPolicy, atomic bool) (*Server, *MemDriverFactory) {
+	server := NewServer(&graval.FTPServerOpts{
+		UploadCollisions: policy,
+		UploadArchiveDir: "/.versions",
+		AtomicUploads:    atomic,
+		Clock:            NewFakeClock(time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)),
+	})
+	factory := server.Factory.(*MemDriverFactory)
+	factory.WriteFile("/docs/report.txt", []byte("old"))
+	return server, factory
+}
+
+func TestUploadCollisions(t *testing.T) {
+	contents := func(factory *MemDriverFactory, filePath string) string {
+		data, ok := factory.ReadFile(filePath)
+		if !ok {
+			return "missing"
+		}
+		return string(data)
+	}
+
+	overwrite, overwriteFactory := collisionServer(graval.OverwriteExisting, false)
+	defer overwrite.Close()
+	client := overwrite.Client(t)
+	client.Login(t, "test", "1234")
+	overwriteErr := client.Store("/docs/report.txt", []byte("new"))
+	client.Close()
+
+	reject, rejectFactory := collisionServer(graval.RejectExisting, false)
+	defer reject.Close()
+	client = reject.Client(t)
+	client.Login(t, "test", "1234")
+	rejectErr := client.Store("/docs/report.txt", []byte("new"))
+	newFileErr := client.Store("/docs/other.txt", []byte("new"))
+	client.Close()
+
+	rename, renameFactory := collisionServer(graval.RenameUpload, false)
+	defer rename.Close()
+	renameFactory.WriteFile("/docs/.profile", []byte("old"))
+	client = rename.Client(t)
+	client.Login(t, "test", "1234")
+	dataConn, _ := client.Passive()
+	renameReply, _ := client.Cmd("STOR /docs/report.txt")
+	dataConn.Write([]byte("first"))
+	dataConn.Close()
+	client.ExpectReply(t, 226)
+	secondErr := client.Store("/docs/report.txt", []byte("second"))
+	dotErr := client.Store("/docs/.profile", []byte("new"))
+	client.Close()
+
+	versions := map[bool]*MemDriverFactory{}
+	var versionErrs []error
+	for _, atomic := range []bool{false, true} {
+		server, factory := collisionServer(graval.VersionExisting, atomic)
+		defer server.Close()
+		client = server.Client(t)
+		client.Login(t, "test", "1234")
+		versionErrs = append(versionErrs, client.Store("/docs/report.txt", []byte("new")), client.Store("/docs/report.txt", []byte("newer")))
+		client.Close()
+		versions[atomic] = factory
+	}
+
+	// a failed SITE HASH store, then an upload refused by a hook
+	hooked := NewServer(&graval.FTPServerOpts{
+		UploadCollisions: graval.VersionExisting,
+		UploadArchiveDir: "/.versions",
+		UploadHooks: []graval.UploadHook{func(upload *graval.CompletedUpload) error {
+			return errors.New("refused")
+		}},
+	})
+	defer hooked.Close()
+	hookedFactory := hooked.Factory.(*MemDriverFactory)
+	hookedFactory.WriteFile("/docs/report.txt", []byte("old"))
+	client = hooked.Client(t)
+	client.Login(t, "test", "1234")
+	client.Expect(t, 200, "SITE HASH %x", sha256.Sum256([]byte("unknown")))
+	hookedErr := client.Store("/docs/report.txt", []byte("new"))
+	client.Close()
+	hookedListing := hookedFactory.children("/.versions/docs")
+
+	uncommitted := NewServer(&graval.FTPServerOpts{
+		Factory:          noCommitDriverFactory{NewMemDriverFactory()},
+		UploadCollisions: graval.VersionExisting,
+		UploadArchiveDir: "/.versions",
+		AtomicUploads:    true,
+	})
+	defer uncommitted.Close()
+	uncommittedFactory := uncommitted.Factory.(noCommitDriverFactory).MemDriverFactory
+	uncommittedFactory.WriteFile("/docs/report.txt", []byte("old"))
+	client = uncommitted.Client(t)
+	client.Login(t, "test", "1234")
+	uncommittedErr := client.Store("/docs/report.txt", []byte("new"))
+	client.Close()
+	uncommittedListing := uncommittedFactory.children("/.versions/docs")
+
+	rejected := NewServer(&graval.FTPServerOpts{
+		Factory:          rejectDataDriverFactory{NewMemDriverFactory()},
+		UploadCollisions: graval.VersionExisting,
+		UploadArchiveDir: "/.versions",
+	})
+	defer rejected.Close()
+	rejectedFactory := rejected.Factory.(rejectDataDriverFactory).MemDriverFactory
+	rejectedFactory.WriteFile("/docs/report.txt", []byte("old"))
+	client = rejected.Client(t)
+	client.Login(t, "test", "1234")
+	rejectedErr := client.Store("/docs/report.txt", []byte("new"))
+	client.Close()
+	rejectedListing := rejectedFactory.children("/.versions/docs")
+
+	Convey("An upload onto an existing file", t, func() {
+		Convey("Will replace it by default", func() {
+			So(overwriteErr, ShouldBeNil)
+			So(contents(overwriteFactory, "/docs/report.txt"), ShouldEqual, "new")
+		})
+
+		Convey("Will be refused with a 553 when rejecting", func() {
+			So(rejectErr, ShouldNotBeNil)
+			So(rejectErr.Error(), ShouldContainSubstring, "553")
+			So(contents(rejectFactory, "/docs/report.txt"), ShouldEqual, "old")
+			So(newFileErr, ShouldBeNil)
+		})
+
+		Convey("Will be stored under a numbered name when renaming", func() {
+			So(renameReply.Code, ShouldEqual, 150)
+			So(renameReply.Message, ShouldEqual, "FILE: /docs/report.1.txt")
+			So(secondErr, ShouldBeNil)
+			So(dotErr, ShouldBeNil)
+			So(contents(renameFactory, "/docs/report.txt"), ShouldEqual, "old")
+			So(contents(renameFactory, "/docs/report.1.txt"), ShouldEqual, "first")
+			So(contents(renameFactory, "/docs/report.2.txt"), ShouldEqual, "second")
+			So(contents(renameFactory, "/docs/.profile.1"), ShouldEqual, "new")
+		})
+
+		Convey("Will move the existing file into the archive when versioning", func() {
+			So(versionErrs, ShouldResemble, []error{nil, nil, nil, nil})
+			for _, factory := range versions {
+				So(contents(factory, "/docs/report.txt"), ShouldEqual, "newer")
+				So(contents(factory, "/.versions/docs/report.txt.20200304050607"), ShouldEqual, "old")
+				So(contents(factory, "/.versions/docs/report.txt.20200304050607.1"), ShouldEqual, "new")
+			}
+		})
+
+		Convey("Will put the existing file back when versioning, if the upload isn't stored", func() {
+			So(hookedErr, ShouldNotBeNil)
+			So(contents(hookedFactory, "/docs/report.txt"), ShouldEqual, "old")
+			So(hookedListing, ShouldBeEmpty)
+			So(uncommittedErr, ShouldNotBeNil)
+			So(uncommittedErr.Error(), ShouldContainSubstring, "451")
+			So(contents(uncommittedFactory, "/docs/report.txt"), ShouldEqual, "old")
+			So(uncommittedListing, ShouldBeEmpty)
+			So(rejectedErr, ShouldNotBeNil)
+			So(rejectedErr.Error(), ShouldContainSubstring, "451")
+			So(rejectedErr.Error(), ShouldNotContainSubstring, "REST")
+			So(contents(rejectedFactory, "/docs/report.txt"), ShouldEqual, "old")
+			So(rejectedListing, ShouldBeEmpty)
+		})
+	})
+}
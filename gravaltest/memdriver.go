@@ -0,0 +1,411 @@
+package gravaltest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"github.com/royallthefourth/graval"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memEntry struct {
+	dir      bool
+	link     string
+	data     []byte
+	generate func() []byte
+	modtime  time.Time
+}
+
+// isFile reports whether the entry holds file data, rather than being a
+// directory or a symlink.
+func (entry *memEntry) isFile() bool {
+	return entry != nil && !entry.dir && entry.link == ""
+}
+
+// MemDriverFactory creates drivers that store everything in memory. All
+// drivers created by the same factory share a single file tree, so files
+// uploaded by one client are visible to the others.
+//
+// Unlike the graval-mem example, the tree is writable, which makes it a
+// useful stand in for a real persistence layer when testing.
+type MemDriverFactory struct {
+	// Users maps usernames to passwords. Any other credentials are rejected.
+	Users map[string]string
+
+	// The most file data the tree can hold, in bytes. Uploads that would go
+	// over it fail. If zero, there's no limit, and AvailableSpace returns an
+	// error.
+	Capacity int64
+
+	mu      sync.Mutex
+	entries map[string]*memEntry
+}
+
+// NewMemDriverFactory returns a factory with an empty file tree and a single
+// user, "test", with the password "1234".
+func NewMemDriverFactory() *MemDriverFactory {
+	factory := new(MemDriverFactory)
+	factory.Users = map[string]string{"test": "1234"}
+	factory.entries = map[string]*memEntry{
+		"/": {dir: true, modtime: time.Now()},
+	}
+	return factory
+}
+
+func (factory *MemDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	return &MemDriver{factory: factory}, nil
+}
+
+// WriteFile adds a file to the tree, creating any missing parent directories.
+// It's intended for seeding the tree before a test.
+func (factory *MemDriverFactory) WriteFile(filePath string, data []byte) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	filePath = path.Clean("/" + filePath)
+	factory.mkdirAll(path.Dir(filePath))
+	factory.entries[filePath] = &memEntry{data: data, modtime: time.Now()}
+}
+
+// Generate adds a virtual file to the tree, creating any missing parent
+// directories. Its size is graval.SizeUnknown, and generate is called for
+// its contents each time it's downloaded.
+func (factory *MemDriverFactory) Generate(filePath string, generate func() []byte) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	filePath = path.Clean("/" + filePath)
+	factory.mkdirAll(path.Dir(filePath))
+	factory.entries[filePath] = &memEntry{generate: generate, modtime: time.Now()}
+}
+
+// ReadFile returns the contents of a file in the tree, or false if it doesn't
+// exist. It's intended for checking the results of a test.
+func (factory *MemDriverFactory) ReadFile(filePath string) ([]byte, bool) {
+	factory.mu.Lock()
+	entry := factory.entries[path.Clean("/"+filePath)]
+	factory.mu.Unlock()
+	if !entry.isFile() {
+		return nil, false
+	}
+	if entry.generate != nil {
+		return entry.generate(), true
+	}
+	return entry.data, true
+}
+
+// Symlink adds a symlink to target to the tree, creating any missing parent
+// directories. Links are only shown in listings; the driver doesn't follow
+// them.
+func (factory *MemDriverFactory) Symlink(linkPath string, target string) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	linkPath = path.Clean("/" + linkPath)
+	factory.mkdirAll(path.Dir(linkPath))
+	factory.entries[linkPath] = &memEntry{link: target, modtime: time.Now()}
+}
+
+// MakeDir adds a directory to the tree, creating any missing parents.
+func (factory *MemDriverFactory) MakeDir(dirPath string) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	factory.mkdirAll(path.Clean("/" + dirPath))
+}
+
+func (factory *MemDriverFactory) mkdirAll(dirPath string) {
+	for dirPath != "/" {
+		if _, ok := factory.entries[dirPath]; !ok {
+			factory.entries[dirPath] = &memEntry{dir: true, modtime: time.Now()}
+		}
+		dirPath = path.Dir(dirPath)
+	}
+}
+
+func (factory *MemDriverFactory) isDir(dirPath string) bool {
+	entry := factory.entries[dirPath]
+	return entry != nil && entry.dir
+}
+
+// fits reports whether replacing the file at filePath with size bytes keeps
+// the tree within its capacity.
+func (factory *MemDriverFactory) fits(filePath string, size int64) bool {
+	if factory.Capacity <= 0 {
+		return true
+	}
+	used := factory.used()
+	if entry := factory.entries[filePath]; entry != nil {
+		used -= int64(len(entry.data))
+	}
+	return used+size <= factory.Capacity
+}
+
+// used returns the total size of the files in the tree.
+func (factory *MemDriverFactory) used() int64 {
+	var total int64
+	for _, entry := range factory.entries {
+		total += int64(len(entry.data))
+	}
+	return total
+}
+
+// children returns the paths of all entries directly inside dirPath, sorted
+// by name.
+func (factory *MemDriverFactory) children(dirPath string) []string {
+	var result []string
+	for p := range factory.entries {
+		if p != "/" && path.Dir(p) == dirPath {
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// MemDriver is the graval.FTPDriver created by a MemDriverFactory.
+type MemDriver struct {
+	factory *MemDriverFactory
+}
+
+func (driver *MemDriver) Authenticate(user string, pass string) bool {
+	expected, ok := driver.factory.Users[user]
+	return ok && expected == pass
+}
+
+func (driver *MemDriver) Bytes(path string) int64 {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entry := driver.factory.entries[path]
+	if !entry.isFile() {
+		return -1
+	}
+	if entry.generate != nil {
+		return graval.SizeUnknown
+	}
+	return int64(len(entry.data))
+}
+
+func (driver *MemDriver) ModifiedTime(path string) (time.Time, error) {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entry := driver.factory.entries[path]
+	if entry == nil {
+		return time.Time{}, errors.New("file not found")
+	}
+	return entry.modtime, nil
+}
+
+func (driver *MemDriver) ChangeDir(path string) bool {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	return driver.factory.isDir(path)
+}
+
+func (driver *MemDriver) DirContents(dirPath string) []os.FileInfo {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	files := []os.FileInfo{}
+	for _, p := range driver.factory.children(dirPath) {
+		entry := driver.factory.entries[p]
+		if entry.dir {
+			files = append(files, graval.NewDirItem(path.Base(p), entry.modtime))
+		} else if entry.link != "" {
+			files = append(files, graval.NewSymlinkItem(path.Base(p), entry.link, entry.modtime))
+		} else if entry.generate != nil {
+			files = append(files, graval.NewVirtualItem(path.Base(p), entry.modtime))
+		} else {
+			files = append(files, graval.NewFileItem(path.Base(p), int64(len(entry.data)), entry.modtime))
+		}
+	}
+	return files
+}
+
+func (driver *MemDriver) DeleteDir(path string) bool {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	if path == "/" || !driver.factory.isDir(path) || len(driver.factory.children(path)) > 0 {
+		return false
+	}
+	delete(driver.factory.entries, path)
+	return true
+}
+
+func (driver *MemDriver) DeleteFile(path string) bool {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entry := driver.factory.entries[path]
+	if entry == nil || entry.dir {
+		return false
+	}
+	delete(driver.factory.entries, path)
+	return true
+}
+
+func (driver *MemDriver) Rename(fromPath string, toPath string) bool {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entries := driver.factory.entries
+	if fromPath == "/" || entries[fromPath] == nil || entries[toPath] != nil || !driver.factory.isDir(path.Dir(toPath)) {
+		return false
+	}
+	if strings.HasPrefix(toPath, fromPath+"/") {
+		return false
+	}
+	moved := map[string]*memEntry{}
+	for p, entry := range entries {
+		if p == fromPath || strings.HasPrefix(p, fromPath+"/") {
+			moved[toPath+strings.TrimPrefix(p, fromPath)] = entry
+			delete(entries, p)
+		}
+	}
+	for p, entry := range moved {
+		entries[p] = entry
+	}
+	return true
+}
+
+func (driver *MemDriver) MakeDir(dirPath string) bool {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	if driver.factory.entries[dirPath] != nil || !driver.factory.isDir(path.Dir(dirPath)) {
+		return false
+	}
+	driver.factory.entries[dirPath] = &memEntry{dir: true, modtime: time.Now()}
+	return true
+}
+
+func (driver *MemDriver) GetFile(path string) (io.ReadCloser, error) {
+	driver.factory.mu.Lock()
+	entry := driver.factory.entries[path]
+	driver.factory.mu.Unlock()
+	if !entry.isFile() {
+		return nil, errors.New("file not found")
+	}
+	if entry.generate != nil {
+		return ioutil.NopCloser(bytes.NewReader(entry.generate())), nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(entry.data)), nil
+}
+
+func (driver *MemDriver) PutFile(destPath string, data io.Reader) bool {
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return false
+	}
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entry := driver.factory.entries[destPath]
+	if (entry != nil && entry.dir) || !driver.factory.isDir(path.Dir(destPath)) {
+		return false
+	}
+	if !driver.factory.fits(destPath, int64(len(contents))) {
+		return false
+	}
+	driver.factory.entries[destPath] = &memEntry{data: contents, modtime: time.Now()}
+	return true
+}
+
+// StoreExisting implements graval.FTPDedupDriver, copying any file in the
+// tree with the same hash to destPath.
+func (driver *MemDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	newHash := hashAlgorithms[algorithm]
+	if newHash == nil {
+		return false
+	}
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entry := driver.factory.entries[destPath]
+	if (entry != nil && entry.dir) || !driver.factory.isDir(path.Dir(destPath)) {
+		return false
+	}
+	for _, existing := range driver.factory.entries {
+		if !existing.isFile() || existing.generate != nil {
+			continue
+		}
+		hasher := newHash()
+		hasher.Write(existing.data)
+		if hex.EncodeToString(hasher.Sum(nil)) != hash {
+			continue
+		}
+		if !driver.factory.fits(destPath, int64(len(existing.data))) {
+			return false
+		}
+		driver.factory.entries[destPath] = &memEntry{data: existing.data, modtime: time.Now()}
+		return true
+	}
+	return false
+}
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"MD5":     md5.New,
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// PutFileAt implements graval.FTPResumableDriver.
+func (driver *MemDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return false
+	}
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entry := driver.factory.entries[destPath]
+	if !entry.isFile() || int64(len(entry.data)) < offset {
+		return false
+	}
+	resumed := append(append([]byte{}, entry.data[:offset]...), contents...)
+	if !driver.factory.fits(destPath, int64(len(resumed))) {
+		return false
+	}
+	driver.factory.entries[destPath] = &memEntry{data: resumed, modtime: time.Now()}
+	return true
+}
+
+// AvailableSpace implements graval.FTPSpaceDriver. The whole tree shares the
+// factory's Capacity, so the answer is the same for every directory.
+func (driver *MemDriver) AvailableSpace(dirPath string) (int64, error) {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	if driver.factory.Capacity <= 0 {
+		return 0, errors.New("no capacity set")
+	}
+	return driver.factory.Capacity - driver.factory.used(), nil
+}
+
+// SettableFacts implements graval.FTPFactsDriver. Only the modification time
+// can be changed.
+func (driver *MemDriver) SettableFacts() []string {
+	return []string{"modify"}
+}
+
+// SetFacts implements graval.FTPFactsDriver.
+func (driver *MemDriver) SetFacts(path string, facts map[string]string) error {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	entry := driver.factory.entries[path]
+	if entry == nil {
+		return errors.New("file not found")
+	}
+	for name, value := range facts {
+		if name != "modify" {
+			return errors.New("fact not supported: " + name)
+		}
+		modtime, err := graval.ParseFactTime(value)
+		if err != nil {
+			return err
+		}
+		entry.modtime = modtime
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package gravaltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/royallthefourth/graval"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedCall is a single call to a driver and its result.
+type recordedCall struct {
+	Method string         `json:"method"`
+	Args   []string       `json:"args,omitempty"`
+	Bool   bool           `json:"bool,omitempty"`
+	Int    int64          `json:"int,omitempty"`
+	Time   *time.Time     `json:"time,omitempty"`
+	Data   []byte         `json:"data,omitempty"`
+	Files  []recordedFile `json:"files,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// recordedFile is an entry in a directory listing.
+type recordedFile struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modified"`
+}
+
+func (call *recordedCall) key() string {
+	return call.Method + "\x00" + strings.Join(call.Args, "\x00")
+}
+
+// the errors drivers return that graval treats specially, so playback
+// returns the same values rather than just the same text
+var recordedErrors = []error{
+	graval.ErrNotFound, graval.ErrPermission, graval.ErrExists,
+	graval.ErrNoSpace, graval.ErrNotDir, graval.ErrUnavailable,
+	graval.ErrBackendDown,
+}
+
+func recordError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func playbackError(message string) error {
+	if message == "" {
+		return nil
+	}
+	for _, err := range recordedErrors {
+		if err.Error() == message {
+			return err
+		}
+	}
+	return errors.New(message)
+}
+
+// RecordingFactory wraps another factory and records every call to its
+// drivers, with the results, so a PlaybackFactory can answer the same calls
+// in later runs without the real backend. Only the methods of
+// graval.FTPDriver are recorded; the drivers don't implement any of the
+// optional interfaces. Downloads and uploads are read in full as they start,
+// so keep the files small.
+type RecordingFactory struct {
+	Factory graval.FTPDriverFactory
+
+	mu    sync.Mutex
+	calls []*recordedCall
+}
+
+// NewRecordingFactory returns a factory that records calls to the drivers
+// created by factory.
+func NewRecordingFactory(factory graval.FTPDriverFactory) *RecordingFactory {
+	return &RecordingFactory{Factory: factory}
+}
+
+func (factory *RecordingFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, err := factory.Factory.NewDriver()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingDriver{next: driver, factory: factory}, nil
+}
+
+func (factory *RecordingFactory) record(call *recordedCall) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	factory.calls = append(factory.calls, call)
+}
+
+// Save writes the calls recorded so far to w as JSON.
+func (factory *RecordingFactory) Save(w io.Writer) error {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(factory.calls)
+}
+
+// SaveFile writes the calls recorded so far to a file.
+func (factory *RecordingFactory) SaveFile(filename string) error {
+	var buf bytes.Buffer
+	if err := factory.Save(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+type recordingDriver struct {
+	next    graval.FTPDriver
+	factory *RecordingFactory
+}
+
+func (driver *recordingDriver) record(method string, args ...string) *recordedCall {
+	call := &recordedCall{Method: method, Args: args}
+	driver.factory.record(call)
+	return call
+}
+
+func (driver *recordingDriver) Authenticate(user string, pass string) bool {
+	ok := driver.next.Authenticate(user, pass)
+	driver.record("Authenticate", user, pass).Bool = ok
+	return ok
+}
+
+func (driver *recordingDriver) Bytes(path string) int64 {
+	size := driver.next.Bytes(path)
+	driver.record("Bytes", path).Int = size
+	return size
+}
+
+func (driver *recordingDriver) ModifiedTime(path string) (time.Time, error) {
+	modTime, err := driver.next.ModifiedTime(path)
+	call := driver.record("ModifiedTime", path)
+	call.Error = recordError(err)
+	if err == nil {
+		call.Time = &modTime
+	}
+	return modTime, err
+}
+
+func (driver *recordingDriver) ChangeDir(path string) bool {
+	ok := driver.next.ChangeDir(path)
+	driver.record("ChangeDir", path).Bool = ok
+	return ok
+}
+
+func (driver *recordingDriver) DirContents(path string) []os.FileInfo {
+	files := driver.next.DirContents(path)
+	call := driver.record("DirContents", path)
+	for _, file := range files {
+		call.Files = append(call.Files, recordedFile{
+			Name:    file.Name(),
+			Size:    file.Size(),
+			Mode:    file.Mode(),
+			ModTime: file.ModTime(),
+		})
+	}
+	return files
+}
+
+func (driver *recordingDriver) DeleteDir(path string) bool {
+	ok := driver.next.DeleteDir(path)
+	driver.record("DeleteDir", path).Bool = ok
+	return ok
+}
+
+func (driver *recordingDriver) DeleteFile(path string) bool {
+	ok := driver.next.DeleteFile(path)
+	driver.record("DeleteFile", path).Bool = ok
+	return ok
+}
+
+func (driver *recordingDriver) Rename(fromPath string, toPath string) bool {
+	ok := driver.next.Rename(fromPath, toPath)
+	driver.record("Rename", fromPath, toPath).Bool = ok
+	return ok
+}
+
+func (driver *recordingDriver) MakeDir(path string) bool {
+	ok := driver.next.MakeDir(path)
+	driver.record("MakeDir", path).Bool = ok
+	return ok
+}
+
+func (driver *recordingDriver) GetFile(path string) (io.ReadCloser, error) {
+	reader, err := driver.next.GetFile(path)
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadAll(reader)
+		reader.Close()
+	}
+	call := driver.record("GetFile", path)
+	call.Error = recordError(err)
+	if err != nil {
+		return nil, err
+	}
+	call.Data = data
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (driver *recordingDriver) PutFile(destPath string, data io.Reader) bool {
+	contents, err := ioutil.ReadAll(data)
+	ok := err == nil && driver.next.PutFile(destPath, bytes.NewReader(contents))
+	call := driver.record("PutFile", destPath)
+	call.Data = contents
+	call.Bool = ok
+	return ok
+}
+
+// PlaybackFactory creates drivers that answer calls from a recording made by
+// a RecordingFactory. Each call gets the results recorded for the same
+// method and arguments, in the order they were recorded, and once they run
+// out the last one is repeated. Calls that weren't recorded fail, and are
+// reported by Misses.
+type PlaybackFactory struct {
+	mu      sync.Mutex
+	results map[string][]*recordedCall
+	misses  []string
+}
+
+// NewPlaybackFactory reads a recording written by RecordingFactory.Save.
+func NewPlaybackFactory(r io.Reader) (*PlaybackFactory, error) {
+	var calls []*recordedCall
+	if err := json.NewDecoder(r).Decode(&calls); err != nil {
+		return nil, fmt.Errorf("gravaltest: reading recording: %s", err)
+	}
+	factory := &PlaybackFactory{results: map[string][]*recordedCall{}}
+	for _, call := range calls {
+		factory.results[call.key()] = append(factory.results[call.key()], call)
+	}
+	return factory, nil
+}
+
+func (factory *PlaybackFactory) NewDriver() (graval.FTPDriver, error) {
+	return &playbackDriver{factory: factory}, nil
+}
+
+// Misses returns the calls that weren't in the recording, or that uploaded
+// different data, which means the client or graval behaved differently from
+// when it was recorded.
+func (factory *PlaybackFactory) Misses() []string {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	return append([]string(nil), factory.misses...)
+}
+
+// result returns the next recorded result for a call, or nil if there isn't
+// one.
+func (factory *PlaybackFactory) result(method string, args ...string) *recordedCall {
+	wanted := &recordedCall{Method: method, Args: args}
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	results := factory.results[wanted.key()]
+	if len(results) == 0 {
+		factory.misses = append(factory.misses, fmt.Sprintf("%s(%q)", method, args))
+		return nil
+	}
+	if len(results) > 1 {
+		factory.results[wanted.key()] = results[1:]
+	}
+	return results[0]
+}
+
+func (factory *PlaybackFactory) miss(format string, args ...interface{}) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	factory.misses = append(factory.misses, fmt.Sprintf(format, args...))
+}
+
+type playbackDriver struct {
+	factory *PlaybackFactory
+}
+
+func (driver *playbackDriver) Authenticate(user string, pass string) bool {
+	call := driver.factory.result("Authenticate", user, pass)
+	return call != nil && call.Bool
+}
+
+func (driver *playbackDriver) Bytes(path string) int64 {
+	if call := driver.factory.result("Bytes", path); call != nil {
+		return call.Int
+	}
+	return -1
+}
+
+func (driver *playbackDriver) ModifiedTime(path string) (time.Time, error) {
+	call := driver.factory.result("ModifiedTime", path)
+	if call == nil {
+		return time.Time{}, graval.ErrNotFound
+	}
+	if call.Time == nil {
+		return time.Time{}, playbackError(call.Error)
+	}
+	return *call.Time, nil
+}
+
+func (driver *playbackDriver) ChangeDir(path string) bool {
+	call := driver.factory.result("ChangeDir", path)
+	return call != nil && call.Bool
+}
+
+func (driver *playbackDriver) DirContents(path string) []os.FileInfo {
+	call := driver.factory.result("DirContents", path)
+	if call == nil {
+		return nil
+	}
+	files := make([]os.FileInfo, 0, len(call.Files))
+	for _, file := range call.Files {
+		if file.Mode.IsDir() {
+			files = append(files, graval.NewDirItem(file.Name, file.ModTime))
+		} else {
+			files = append(files, graval.NewFileItem(file.Name, file.Size, file.ModTime))
+		}
+	}
+	return files
+}
+
+func (driver *playbackDriver) DeleteDir(path string) bool {
+	call := driver.factory.result("DeleteDir", path)
+	return call != nil && call.Bool
+}
+
+func (driver *playbackDriver) DeleteFile(path string) bool {
+	call := driver.factory.result("DeleteFile", path)
+	return call != nil && call.Bool
+}
+
+func (driver *playbackDriver) Rename(fromPath string, toPath string) bool {
+	call := driver.factory.result("Rename", fromPath, toPath)
+	return call != nil && call.Bool
+}
+
+func (driver *playbackDriver) MakeDir(path string) bool {
+	call := driver.factory.result("MakeDir", path)
+	return call != nil && call.Bool
+}
+
+func (driver *playbackDriver) GetFile(path string) (io.ReadCloser, error) {
+	call := driver.factory.result("GetFile", path)
+	if call == nil {
+		return nil, graval.ErrNotFound
+	}
+	if call.Error != "" {
+		return nil, playbackError(call.Error)
+	}
+	return ioutil.NopCloser(bytes.NewReader(call.Data)), nil
+}
+
+func (driver *playbackDriver) PutFile(destPath string, data io.Reader) bool {
+	contents, err := ioutil.ReadAll(data)
+	call := driver.factory.result("PutFile", destPath)
+	if call == nil || err != nil {
+		return false
+	}
+	if !bytes.Equal(contents, call.Data) {
+		driver.factory.miss("PutFile(%q) with %d bytes that weren't recorded", destPath, len(contents))
+	}
+	return call.Bool
+}
+
+// RecordOrPlayback returns a factory for a test that replays the recording
+// in filename if it exists. Otherwise it records calls to the drivers that
+// factory creates, and the returned save function writes them to filename,
+// ready for the next run. Delete the file to record again.
+func RecordOrPlayback(filename string, factory graval.FTPDriverFactory) (graval.FTPDriverFactory, func() error, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		recorder := NewRecordingFactory(factory)
+		return recorder, func() error { return recorder.SaveFile(filename) }, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	playback, err := NewPlaybackFactory(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return playback, func() error { return nil }, nil
+}
@@ -0,0 +1,134 @@
+package gravaltest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TranscriptStep is a single line sent by the client in a recorded
+// transcript, along with the codes of the replies the server sent before the
+// client's next line.
+type TranscriptStep struct {
+	Send    string
+	Replies []int
+}
+
+// Transcript is a recorded control channel session, as written by an
+// FTPServer with the TranscriptDir option set.
+type Transcript struct {
+	Steps []TranscriptStep
+}
+
+// ParseTranscript reads a transcript recorded by graval. Any replies before
+// the first client line (the welcome message) are skipped, since Dial
+// consumes the welcome.
+func ParseTranscript(r io.Reader) (*Transcript, error) {
+	transcript := new(Transcript)
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "> "):
+			transcript.Steps = append(transcript.Steps, TranscriptStep{Send: line[2:]})
+		case strings.HasPrefix(line, "< "):
+			code, final := parseReplyLine(line[2:])
+			if !final || len(transcript.Steps) == 0 {
+				continue
+			}
+			step := &transcript.Steps[len(transcript.Steps)-1]
+			step.Replies = append(step.Replies, code)
+		default:
+			return nil, fmt.Errorf("transcript line %d: unrecognised line %q", lineNo, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return transcript, nil
+}
+
+// parseReplyLine reports the code of a reply line, and whether it's the last
+// line of the reply. Continuation lines of a multiline reply are never final.
+func parseReplyLine(line string) (int, bool) {
+	if len(line) < 4 || line[3] != ' ' {
+		return 0, false
+	}
+	code, err := strconv.Atoi(line[0:3])
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// Replay sends each client line of the transcript to the server and fails the
+// test if the reply codes differ from those recorded. Redacted passwords are
+// replaced with password.
+//
+// Only the control channel is recorded, so data connections are simulated:
+// PASV, EPSV, PORT and EPRT are all replayed as PASV, downloads are read and
+// discarded, and uploads are sent empty.
+func (transcript *Transcript) Replay(t testing.TB, client *Client, password string) {
+	t.Helper()
+	var dataConn net.Conn
+	defer func() {
+		if dataConn != nil {
+			dataConn.Close()
+		}
+	}()
+
+	for _, step := range transcript.Steps {
+		verb := strings.ToUpper(strings.SplitN(step.Send, " ", 2)[0])
+		line := step.Send
+		replies := step.Replies
+
+		switch verb {
+		case "PASS":
+			line = "PASS " + password
+		case "PASV", "EPSV", "PORT", "EPRT":
+			if dataConn != nil {
+				dataConn.Close()
+			}
+			conn, err := client.Passive()
+			if err != nil {
+				t.Fatalf("gravaltest: replaying %s: %s", step.Send, err)
+			}
+			dataConn = conn
+			continue
+		case "QUIT":
+			client.Send("%s", line)
+			return
+		}
+
+		if err := client.Send("%s", line); err != nil {
+			t.Fatalf("gravaltest: replaying %s: %s", step.Send, err)
+		}
+		for _, expected := range replies {
+			reply, err := client.ReadReply()
+			if err != nil {
+				t.Fatalf("gravaltest: replaying %s: %s", step.Send, err)
+			}
+			if reply.Code != expected {
+				t.Fatalf("gravaltest: replaying %s: expected %d, got %s", step.Send, expected, reply)
+			}
+			if reply.Code >= 100 && reply.Code < 200 && dataConn != nil {
+				if verb == "STOR" || verb == "APPE" || verb == "STOU" {
+					dataConn.Close()
+				} else {
+					ioutil.ReadAll(dataConn)
+					dataConn.Close()
+				}
+				dataConn = nil
+			}
+		}
+	}
+}
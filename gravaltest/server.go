@@ -0,0 +1,85 @@
+// Package gravaltest provides utilities for testing graval drivers and
+// servers. It's modelled on net/http/httptest: start a Server on a random
+// local port, connect to it with a Client and assert on the replies.
+//
+//	server := gravaltest.NewServer(nil)
+//	defer server.Close()
+//
+//	client := server.Client(t)
+//	defer client.Close()
+//	client.Login(t, "test", "1234")
+//	client.Expect(t, 257, "PWD")
+package gravaltest
+
+import (
+	"fmt"
+	"github.com/royallthefourth/graval"
+	"net"
+	"testing"
+)
+
+// Server is an FTP server listening on a random port on the loopback
+// interface, for use in tests.
+type Server struct {
+	// The address the server is listening on, in host:port form
+	Addr string
+
+	// The factory passed to NewServer, or the in-memory factory created by
+	// NewServer if none was given
+	Factory graval.FTPDriverFactory
+
+	ftpServer *graval.FTPServer
+	done      chan error
+}
+
+// NewServer starts a new FTPServer and returns once it's accepting
+// connections. The Hostname and Port options are ignored. If opts is nil or
+// has no Factory, a MemDriverFactory is used.
+//
+// The caller should call Close when finished, to shut it down.
+func NewServer(opts *graval.FTPServerOpts) *Server {
+	var copied graval.FTPServerOpts
+	if opts != nil {
+		copied = *opts
+	}
+	if copied.Factory == nil {
+		copied.Factory = NewMemDriverFactory()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("gravaltest: failed to listen on a port: %v", err))
+	}
+
+	s := new(Server)
+	s.Addr = listener.Addr().String()
+	s.Factory = copied.Factory
+	s.ftpServer = graval.NewFTPServer(&copied)
+	s.done = make(chan error, 1)
+	go func() {
+		s.done <- s.ftpServer.Serve(listener)
+	}()
+	return s
+}
+
+// FTPServer returns the underlying graval server, for inspecting Stats() and
+// the like.
+func (s *Server) FTPServer() *graval.FTPServer {
+	return s.ftpServer
+}
+
+// Client connects a new Client to the server and reads the welcome message,
+// failing the test if either step fails.
+func (s *Server) Client(t testing.TB) *Client {
+	t.Helper()
+	client, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatalf("gravaltest: connecting to %s: %s", s.Addr, err)
+	}
+	return client
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.ftpServer.Close()
+	<-s.done
+}
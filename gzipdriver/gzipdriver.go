@@ -0,0 +1,210 @@
+// Package gzipdriver provides driver middleware that compresses files as
+// they're uploaded and decompresses them as they're downloaded, so the
+// persistence layer only ever holds gzip data while clients see the original
+// files. It suits servers that ingest large text files, like logs, from
+// clients that can't be changed to compress them first.
+//
+//	factory := &gzipdriver.DriverFactory{Factory: &osdriver.DriverFactory{Root: "/srv/logs"}}
+//
+// Only files the middleware compressed itself are decompressed. They're marked
+// with an extra field in their gzip header, so files stored without it,
+// including gzip files like .tar.gz archives that were already in the tree,
+// are passed through unchanged and the middleware can be added to an existing
+// tree.
+//
+// SIZE reports the uncompressed size, which is read from the end of the gzip
+// data, so it's only correct for files smaller than 4GiB. When the wrapped
+// driver implements graval.FTPRangeDriver only the header and the end are
+// read; otherwise the whole file is. Directory listings show the compressed
+// size.
+package gzipdriver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"github.com/royallthefourth/graval"
+	"io"
+)
+
+// the extra field marking gzip data written by the middleware: a subfield
+// with the ID "GV" and no data
+var gzipMarker = []byte{'G', 'V', 0, 0}
+
+// the start of the gzip header of files written by the middleware: the magic
+// number, the deflate method and the FEXTRA flag, then after the time, extra
+// flags and OS bytes, the length of the extra field and the marker
+var (
+	markedPrefix = []byte{0x1f, 0x8b, 8}
+	markedLength = 10 + 2 + len(gzipMarker)
+)
+
+// DriverFactory wraps the drivers created by another factory with
+// compression.
+type DriverFactory struct {
+	// The factory for the drivers that store the compressed files. Mandatory.
+	Factory graval.FTPDriverFactory
+
+	// The gzip compression level. Optional, defaults to
+	// gzip.DefaultCompression.
+	Level int
+}
+
+func (factory *DriverFactory) NewDriver() (graval.FTPDriver, error) {
+	inner, err := factory.Factory.NewDriver()
+	if err != nil {
+		return nil, err
+	}
+	level := factory.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return &Driver{FTPDriver: inner, level: level}, nil
+}
+
+// Driver is the graval.FTPDriver created by a DriverFactory. Everything other
+// than file contents and sizes is handled by the wrapped driver.
+type Driver struct {
+	graval.FTPDriver
+	level int
+}
+
+// Bytes returns the uncompressed size of the file at path.
+func (driver *Driver) Bytes(path string) int64 {
+	size := driver.FTPDriver.Bytes(path)
+	if size < int64(markedLength) {
+		return size
+	}
+	var rangeDriver graval.FTPRangeDriver
+	if graval.DriverAs(driver.FTPDriver, &rangeDriver) {
+		header, ok := readRange(rangeDriver, path, 0, int64(markedLength))
+		if !ok {
+			return -1
+		}
+		if !isMarked(header) {
+			return size
+		}
+		tail, ok := readRange(rangeDriver, path, size-4, 4)
+		if !ok {
+			return -1
+		}
+		return uncompressedSize(tail)
+	}
+
+	file, err := driver.FTPDriver.GetFile(path)
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	if !peekMarked(reader) {
+		return size
+	}
+	var tail [4]byte
+	buf := make([]byte, 32*1024)
+	total := 0
+	for {
+		n, err := reader.Read(buf)
+		if n >= 4 {
+			copy(tail[:], buf[n-4:n])
+		} else if n > 0 {
+			copy(tail[:], append(tail[n:], buf[:n]...))
+		}
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return -1
+		}
+	}
+	if total < 4 {
+		return -1
+	}
+	return uncompressedSize(tail[:])
+}
+
+// GetFile returns the decompressed contents of the file at path.
+func (driver *Driver) GetFile(path string) (io.ReadCloser, error) {
+	file, err := driver.FTPDriver.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	if !peekMarked(reader) {
+		return &readCloser{Reader: reader, closer: file}, nil
+	}
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: gz, closer: file}, nil
+}
+
+// PutFile compresses data as it's passed to the wrapped driver.
+func (driver *Driver) PutFile(destPath string, data io.Reader) bool {
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		gz, err := gzip.NewWriterLevel(pipeWriter, driver.level)
+		if err == nil {
+			gz.Extra = gzipMarker
+			_, err = io.Copy(gz, data)
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pipeWriter.CloseWithError(err)
+		done <- err
+	}()
+	ok := driver.FTPDriver.PutFile(destPath, pipeReader)
+	// unblock the compressor if the driver gave up before reading everything
+	pipeReader.Close()
+	err := <-done
+	return ok && err == nil
+}
+
+// isMarked reports whether header, the start of a file, is the gzip header
+// the middleware writes.
+func isMarked(header []byte) bool {
+	return len(header) >= markedLength &&
+		bytes.HasPrefix(header, markedPrefix) &&
+		header[3]&0x04 != 0 &&
+		int(header[10])|int(header[11])<<8 == len(gzipMarker) &&
+		bytes.Equal(header[12:markedLength], gzipMarker)
+}
+
+// peekMarked reports whether the data in reader was written by the
+// middleware, without consuming it.
+func peekMarked(reader *bufio.Reader) bool {
+	header, _ := reader.Peek(markedLength)
+	return isMarked(header)
+}
+
+// readRange reads length bytes of the file at path, starting at offset.
+func readRange(driver graval.FTPRangeDriver, path string, offset int64, length int64) ([]byte, bool) {
+	file, err := driver.ReadRange(path, offset, length)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	_, err = io.ReadFull(file, data)
+	return data, err == nil
+}
+
+// uncompressedSize decodes the last four bytes of gzip data, which are the
+// uncompressed size modulo 2^32.
+func uncompressedSize(tail []byte) int64 {
+	return int64(tail[0]) | int64(tail[1])<<8 | int64(tail[2])<<16 | int64(tail[3])<<24
+}
+
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *readCloser) Close() error {
+	return r.closer.Close()
+}
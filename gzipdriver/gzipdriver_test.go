@@ -0,0 +1,128 @@
+package gzipdriver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/gravaltest"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDriverConformance(t *testing.T) {
+	gravaltest.TestDriver(t, &DriverFactory{Factory: gravaltest.NewMemDriverFactory()}, "test", "1234")
+}
+
+func TestCompression(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.WriteFile("/plain.txt", []byte("stored before compression"))
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	gz.Write([]byte("an archive a client uploaded"))
+	gz.Close()
+	inner.WriteFile("/backup.tar.gz", archive.Bytes())
+	factory := &DriverFactory{Factory: inner}
+	driver, _ := factory.NewDriver()
+	contents := bytes.Repeat([]byte("log line\n"), 1000)
+
+	Convey("Storing a file", t, func() {
+		So(driver.PutFile("/app.log", bytes.NewReader(contents)), ShouldBeTrue)
+		stored, _ := inner.ReadFile("/app.log")
+
+		Convey("Will compress it in the wrapped driver", func() {
+			So(len(stored), ShouldBeLessThan, len(contents))
+			gz, err := gzip.NewReader(bytes.NewReader(stored))
+			So(err, ShouldBeNil)
+			data, _ := ioutil.ReadAll(gz)
+			So(data, ShouldResemble, contents)
+		})
+
+		Convey("Will report the uncompressed size", func() {
+			So(driver.Bytes("/app.log"), ShouldEqual, len(contents))
+		})
+
+		Convey("Will decompress it when read", func() {
+			file, err := driver.GetFile("/app.log")
+			So(err, ShouldBeNil)
+			defer file.Close()
+			data, _ := ioutil.ReadAll(file)
+			So(data, ShouldResemble, contents)
+		})
+	})
+
+	Convey("Files stored without compression", t, func() {
+		Convey("Will be read unchanged", func() {
+			file, err := driver.GetFile("/plain.txt")
+			So(err, ShouldBeNil)
+			defer file.Close()
+			data, _ := ioutil.ReadAll(file)
+			So(string(data), ShouldEqual, "stored before compression")
+			So(driver.Bytes("/plain.txt"), ShouldEqual, 25)
+		})
+	})
+
+	Convey("Gzip files the driver didn't compress", t, func() {
+		Convey("Will be read unchanged", func() {
+			file, err := driver.GetFile("/backup.tar.gz")
+			So(err, ShouldBeNil)
+			defer file.Close()
+			data, _ := ioutil.ReadAll(file)
+			So(data, ShouldResemble, archive.Bytes())
+			So(driver.Bytes("/backup.tar.gz"), ShouldEqual, archive.Len())
+		})
+	})
+
+	Convey("Missing files", t, func() {
+		Convey("Will have no size", func() {
+			So(driver.Bytes("/missing.txt"), ShouldEqual, -1)
+		})
+	})
+}
+
+// rangeDriver adds ReadRange to a MemDriver, and counts calls to GetFile.
+type rangeDriver struct {
+	*gravaltest.MemDriver
+	gets *int
+}
+
+func (driver rangeDriver) GetFile(path string) (io.ReadCloser, error) {
+	*driver.gets++
+	return driver.MemDriver.GetFile(path)
+}
+
+func (driver rangeDriver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	file, err := driver.MemDriver.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	io.CopyN(ioutil.Discard, file, offset)
+	return ioutil.NopCloser(io.LimitReader(file, length)), nil
+}
+
+type rangeDriverFactory struct {
+	*gravaltest.MemDriverFactory
+	gets *int
+}
+
+func (factory rangeDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return rangeDriver{MemDriver: driver.(*gravaltest.MemDriver), gets: factory.gets}, nil
+}
+
+func TestRangedSize(t *testing.T) {
+	var gets int
+	inner := gravaltest.NewMemDriverFactory()
+	driver, _ := (&DriverFactory{Factory: rangeDriverFactory{MemDriverFactory: inner, gets: &gets}}).NewDriver()
+	contents := bytes.Repeat([]byte("log line\n"), 1000)
+	driver.PutFile("/app.log", bytes.NewReader(contents))
+	size := driver.Bytes("/app.log")
+
+	Convey("The size of a file in a driver that can read ranges", t, func() {
+		Convey("Will be read without reading the whole file", func() {
+			So(size, ShouldEqual, len(contents))
+			So(gets, ShouldEqual, 0)
+		})
+	})
+}
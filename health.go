@@ -0,0 +1,120 @@
+package graval
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// how long ServeHealth waits for the backend to answer a ping
+const healthPingTimeout = 5 * time.Second
+
+// Health describes whether the server can take new clients, for load
+// balancers and orchestrators deciding where to send them.
+type Health struct {
+	// Whether the server is accepting connections on at least one listener
+	Listening bool `json:"listening"`
+
+	// Whether Close or Shutdown has been called
+	Closed bool `json:"closed"`
+
+	// Whether logins are being refused for maintenance
+	Maintenance bool `json:"maintenance"`
+
+	// Why the backend didn't answer a ping, if the driver implements
+	// FTPPingDriver
+	BackendError string `json:"backend_error,omitempty"`
+
+	// Whether new clients will be served: the server is listening, isn't
+	// closed or in maintenance, and the backend is up
+	Ready bool `json:"ready"`
+}
+
+// Health reports whether the server is ready for new clients. If the driver
+// factory, or failing that a driver it creates, implements FTPPingDriver, the
+// backend is pinged with ctx.
+func (ftpServer *FTPServer) Health(ctx context.Context) Health {
+	ftpServer.mu.Lock()
+	health := Health{
+		Listening: len(ftpServer.listeners) > 0,
+		Closed:    ftpServer.closed,
+	}
+	factory := ftpServer.settings.driverFactory
+	ftpServer.mu.Unlock()
+	_, health.Maintenance = ftpServer.maintenanceMessage()
+	if err := pingBackend(ctx, factory); err != nil {
+		health.BackendError = err.Error()
+	}
+	health.Ready = health.Listening && !health.Closed && !health.Maintenance && health.BackendError == ""
+	return health
+}
+
+// pingBackend pings the backend through the factory, or a driver it creates,
+// if either implements FTPPingDriver. A driver created for the check is
+// started and ended like a session's, if it implements FTPLifecycleDriver, so
+// it doesn't hold on to backend resources afterwards.
+func pingBackend(ctx context.Context, factory FTPDriverFactory) error {
+	if pinger, ok := factory.(FTPPingDriver); ok {
+		if support, ok := factory.(FTPSupportDriver); !ok || support.Supports(new(FTPPingDriver)) {
+			return pinger.Ping(ctx)
+		}
+	}
+	driver, err := factory.NewDriver()
+	if err != nil {
+		return err
+	}
+	var pinger FTPPingDriver
+	if !DriverAs(driver, &pinger) {
+		return nil
+	}
+	var lifecycleDriver FTPLifecycleDriver
+	if DriverAs(driver, &lifecycleDriver) {
+		if err := lifecycleDriver.SessionStart(ctx); err != nil {
+			return err
+		}
+		defer lifecycleDriver.SessionEnd(ctx)
+	}
+	return pinger.Ping(ctx)
+}
+
+// HealthHandler returns an http.Handler for load balancer health checks. It
+// responds with the server's Health encoded as JSON, with status 200 if it's
+// ready and 503 if it isn't.
+func (ftpServer *FTPServer) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := ftpServer.Health(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+}
+
+// ServeHealth answers health checks from load balancers that only speak TCP.
+// Each connection accepted from listener is sent "ready" or "not ready",
+// followed by a newline, and closed, so a check can match the reply. It
+// returns when the listener is closed, and always closes it before
+// returning.
+func (ftpServer *FTPServer) ServeHealth(listener net.Listener) error {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil
+		}
+		go func() {
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), healthPingTimeout)
+			defer cancel()
+			status := "ready\n"
+			if !ftpServer.Health(ctx).Ready {
+				status = "not ready\n"
+			}
+			conn.SetWriteDeadline(time.Now().Add(healthPingTimeout))
+			conn.Write([]byte(status))
+		}()
+	}
+}
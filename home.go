@@ -0,0 +1,50 @@
+package graval
+
+import (
+	"bytes"
+	"path"
+	"sort"
+)
+
+// HomeTemplate is the starting content of a new user's tree, created when
+// they first log in so that accounts don't need to be set up separately. A
+// user's tree is only provisioned while its root directory is empty, so
+// anything they delete or change later stays that way.
+type HomeTemplate struct {
+	// Directories to create, like "incoming" or "reports/2019", relative to
+	// the root. Missing parents are created too.
+	Dirs []string
+
+	// Files to create, by path relative to the root, like a README. Missing
+	// parent directories are created too.
+	Files map[string][]byte
+}
+
+// provisionHome fills an empty tree from the server's HomeTemplate, if it
+// has one. It's called just after login, and failures are logged rather
+// than refusing the login.
+func (ftpConn *ftpConn) provisionHome() {
+	template := ftpConn.server.homeTemplate
+	if template == nil || len(ftpConn.driver.DirContents("/")) > 0 {
+		return
+	}
+	ftpConn.logger.Printf("Provisioning home directory for %s", ftpConn.account)
+	for _, dir := range template.Dirs {
+		dir = path.Clean("/" + dir)
+		if !ftpConn.makeParentDirs(dir) || !(ftpConn.driver.ChangeDir(dir) || ftpConn.driver.MakeDir(dir)) {
+			ftpConn.logger.Printf("Unable to create %s", dir)
+		}
+	}
+	// in a fixed order, so that any failures are reported consistently
+	names := make([]string, 0, len(template.Files))
+	for name := range template.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filePath := path.Clean("/" + name)
+		if !ftpConn.makeParentDirs(filePath) || !ftpConn.driver.PutFile(filePath, bytes.NewReader(template.Files[name])) {
+			ftpConn.logger.Printf("Unable to create %s", filePath)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package honeypot provides a graval driver for running an FTP honeypot. Any
+// user name and password logs in, to a fake filesystem that's held in memory
+// and thrown away when the session ends, so nothing a client does reaches
+// real files. Every login attempt and upload is passed to the factory's
+// hooks.
+//
+//	factory := &honeypot.DriverFactory{
+//		Files:    map[string][]byte{"/backup/db.sql": fakeDump},
+//		OnLogin:  recordCredential,
+//		OnUpload: recordPayload,
+//	}
+//	server := graval.NewFTPServer(&graval.FTPServerOpts{
+//		Factory:     factory,
+//		CommandHook: recordCommand,
+//		Stealth:     true,
+//	})
+//
+// Set the server's CommandHook too, to capture every command clients send.
+package honeypot
+
+import (
+	"bytes"
+	"github.com/royallthefourth/graval"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how much of each upload is kept by default
+const defaultMaxPayload = 10 << 20
+
+// Credential is a login attempt.
+type Credential struct {
+	Time      time.Time
+	SessionId string
+	RemoteIP  string
+	User      string
+	Password  string
+}
+
+// Payload is a file a client uploaded.
+type Payload struct {
+	Time      time.Time
+	SessionId string
+	RemoteIP  string
+	User      string
+	Path      string
+
+	// The contents of the file, up to the factory's MaxPayload
+	Data []byte
+
+	// The size of the whole upload, which is more than len(Data) if it was
+	// cut short
+	Bytes int64
+}
+
+// DriverFactory creates a Driver for each client connection, each with its
+// own copy of the fake filesystem.
+type DriverFactory struct {
+	// The files every session starts with, by absolute path. The
+	// directories they're in are created for them. Optional.
+	Files map[string][]byte
+
+	// The most bytes of each upload to keep. The rest is accepted from the
+	// client and discarded. Optional, defaults to 10MiB.
+	MaxPayload int64
+
+	// Called with every login attempt. Optional.
+	OnLogin func(*Credential)
+
+	// Called with every upload once the client stops sending it. Optional.
+	OnUpload func(*Payload)
+}
+
+func (factory *DriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver := &Driver{
+		factory: factory,
+		entries: map[string]*entry{"/": {dir: true, modTime: time.Now()}},
+	}
+	for filePath, data := range factory.Files {
+		filePath = path.Clean("/" + filePath)
+		driver.makeParents(filePath)
+		driver.entries[filePath] = &entry{data: data, modTime: time.Now()}
+	}
+	return driver, nil
+}
+
+// entry is a file or directory in the fake filesystem.
+type entry struct {
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+// Driver is the graval.FTPDriver created by a DriverFactory.
+type Driver struct {
+	factory   *DriverFactory
+	sessionId string
+	remoteIP  string
+	user      string
+	mu        sync.Mutex
+	entries   map[string]*entry
+}
+
+// SetSession implements graval.FTPSessionDriver, so captures can say which
+// session and client they came from.
+func (driver *Driver) SetSession(sessionId string, remoteIP string) {
+	driver.sessionId = sessionId
+	driver.remoteIP = remoteIP
+}
+
+// Authenticate records the attempt and lets it in.
+func (driver *Driver) Authenticate(user string, pass string) bool {
+	driver.user = user
+	if driver.factory.OnLogin != nil {
+		driver.factory.OnLogin(&Credential{
+			Time:      time.Now().UTC(),
+			SessionId: driver.sessionId,
+			RemoteIP:  driver.remoteIP,
+			User:      user,
+			Password:  pass,
+		})
+	}
+	return true
+}
+
+// makeParents creates the directories above filePath. The caller must hold
+// mu, or have the only reference to the driver.
+func (driver *Driver) makeParents(filePath string) {
+	for dir := path.Dir(filePath); driver.entries[dir] == nil; dir = path.Dir(dir) {
+		driver.entries[dir] = &entry{dir: true, modTime: time.Now()}
+	}
+}
+
+func (driver *Driver) lookup(filePath string) *entry {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	return driver.entries[filePath]
+}
+
+func (driver *Driver) Bytes(filePath string) int64 {
+	if e := driver.lookup(filePath); e != nil && !e.dir {
+		return int64(len(e.data))
+	}
+	return -1
+}
+
+func (driver *Driver) ModifiedTime(filePath string) (time.Time, error) {
+	if e := driver.lookup(filePath); e != nil {
+		return e.modTime, nil
+	}
+	return time.Time{}, graval.ErrNotFound
+}
+
+func (driver *Driver) ChangeDir(filePath string) bool {
+	e := driver.lookup(filePath)
+	return e != nil && e.dir
+}
+
+func (driver *Driver) DirContents(dirPath string) []os.FileInfo {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	names := []string{}
+	for filePath := range driver.entries {
+		if filePath != "/" && path.Dir(filePath) == dirPath {
+			names = append(names, filePath)
+		}
+	}
+	sort.Strings(names)
+	files := make([]os.FileInfo, 0, len(names))
+	for _, filePath := range names {
+		e := driver.entries[filePath]
+		if e.dir {
+			files = append(files, graval.NewDirItem(path.Base(filePath), e.modTime))
+		} else {
+			files = append(files, graval.NewFileItem(path.Base(filePath), int64(len(e.data)), e.modTime))
+		}
+	}
+	return files
+}
+
+func (driver *Driver) DeleteDir(dirPath string) bool {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if e := driver.entries[dirPath]; dirPath == "/" || e == nil || !e.dir {
+		return false
+	}
+	for filePath := range driver.entries {
+		if strings.HasPrefix(filePath, dirPath+"/") {
+			return false
+		}
+	}
+	delete(driver.entries, dirPath)
+	return true
+}
+
+func (driver *Driver) DeleteFile(filePath string) bool {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if e := driver.entries[filePath]; e == nil || e.dir {
+		return false
+	}
+	delete(driver.entries, filePath)
+	return true
+}
+
+func (driver *Driver) Rename(fromPath string, toPath string) bool {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	e := driver.entries[fromPath]
+	parent := driver.entries[path.Dir(toPath)]
+	if e == nil || e.dir || driver.entries[toPath] != nil || parent == nil || !parent.dir {
+		return false
+	}
+	delete(driver.entries, fromPath)
+	driver.entries[toPath] = e
+	return true
+}
+
+func (driver *Driver) MakeDir(dirPath string) bool {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	parent := driver.entries[path.Dir(dirPath)]
+	if driver.entries[dirPath] != nil || parent == nil || !parent.dir {
+		return false
+	}
+	driver.entries[dirPath] = &entry{dir: true, modTime: time.Now()}
+	return true
+}
+
+func (driver *Driver) GetFile(filePath string) (io.ReadCloser, error) {
+	e := driver.lookup(filePath)
+	if e == nil || e.dir {
+		return nil, graval.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(e.data)), nil
+}
+
+// PutFile keeps up to MaxPayload bytes of the upload in the fake filesystem
+// and passes them to OnUpload, even if the client didn't finish sending it.
+func (driver *Driver) PutFile(destPath string, data io.Reader) bool {
+	max := driver.factory.MaxPayload
+	if max <= 0 {
+		max = defaultMaxPayload
+	}
+	kept, err := ioutil.ReadAll(io.LimitReader(data, max))
+	size := int64(len(kept))
+	if err == nil {
+		var discarded int64
+		discarded, err = io.Copy(ioutil.Discard, data)
+		size += discarded
+	}
+	if driver.factory.OnUpload != nil {
+		driver.factory.OnUpload(&Payload{
+			Time:      time.Now().UTC(),
+			SessionId: driver.sessionId,
+			RemoteIP:  driver.remoteIP,
+			User:      driver.user,
+			Path:      destPath,
+			Data:      kept,
+			Bytes:     size,
+		})
+	}
+	if err != nil {
+		return false
+	}
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	parent := driver.entries[path.Dir(destPath)]
+	if existing := driver.entries[destPath]; parent == nil || !parent.dir || existing != nil && existing.dir {
+		return false
+	}
+	driver.entries[destPath] = &entry{data: kept, modTime: time.Now()}
+	return true
+}
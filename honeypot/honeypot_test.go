@@ -0,0 +1,98 @@
+package honeypot
+
+import (
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/gravaltest"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+)
+
+func TestHoneypot(t *testing.T) {
+	var mu sync.Mutex
+	var credentials []*Credential
+	var payloads []*Payload
+	var commands []*graval.CommandRecord
+	factory := &DriverFactory{
+		Files:      map[string][]byte{"/backup/db.sql": []byte("-- dump")},
+		MaxPayload: 4,
+		OnLogin: func(credential *Credential) {
+			mu.Lock()
+			defer mu.Unlock()
+			credentials = append(credentials, credential)
+		},
+		OnUpload: func(payload *Payload) {
+			mu.Lock()
+			defer mu.Unlock()
+			payloads = append(payloads, payload)
+		},
+	}
+	server := gravaltest.NewServer(&graval.FTPServerOpts{
+		Factory: factory,
+		CommandHook: func(command *graval.CommandRecord) {
+			mu.Lock()
+			defer mu.Unlock()
+			commands = append(commands, command)
+		},
+	})
+	defer server.Close()
+
+	attacker := server.Client(t)
+	defer attacker.Close()
+	attacker.Login(t, "root", "toor")
+	bait, baitErr := attacker.Retrieve("/backup/db.sql")
+	storeErr := attacker.Store("/backup/x.sh", []byte("wget evil"))
+	kept, _ := attacker.Retrieve("/backup/x.sh")
+
+	other := server.Client(t)
+	defer other.Close()
+	other.Login(t, "admin", "admin")
+	otherList, _ := other.NameList("/backup")
+
+	mu.Lock()
+	defer mu.Unlock()
+	Convey("A honeypot", t, func() {
+		Convey("Will let anyone in and record their credentials", func() {
+			So(len(credentials), ShouldEqual, 2)
+			So(credentials[0].User, ShouldEqual, "root")
+			So(credentials[0].Password, ShouldEqual, "toor")
+			So(credentials[0].RemoteIP, ShouldEqual, "127.0.0.1")
+			So(credentials[0].SessionId, ShouldNotBeEmpty)
+			So(credentials[1].SessionId, ShouldNotEqual, credentials[0].SessionId)
+		})
+
+		Convey("Will serve the bait files", func() {
+			So(baitErr, ShouldBeNil)
+			So(string(bait), ShouldEqual, "-- dump")
+		})
+
+		Convey("Will capture uploads", func() {
+			So(storeErr, ShouldBeNil)
+			So(len(payloads), ShouldEqual, 1)
+			So(payloads[0].Path, ShouldEqual, "/backup/x.sh")
+			So(payloads[0].User, ShouldEqual, "root")
+			So(payloads[0].SessionId, ShouldEqual, credentials[0].SessionId)
+			So(string(payloads[0].Data), ShouldEqual, "wget")
+			So(payloads[0].Bytes, ShouldEqual, 9)
+			So(string(kept), ShouldEqual, "wget")
+		})
+
+		Convey("Will give each session its own filesystem", func() {
+			So(otherList, ShouldContainSubstring, "db.sql")
+			So(otherList, ShouldNotContainSubstring, "x.sh")
+		})
+
+		Convey("Will let the server capture every command", func() {
+			var pass *graval.CommandRecord
+			for _, command := range commands {
+				if command.Command == "PASS" && pass == nil {
+					pass = command
+				}
+			}
+			So(pass, ShouldNotBeNil)
+			So(pass.Param, ShouldEqual, "toor")
+			So(pass.User, ShouldEqual, "")
+			So(commands[len(commands)-1].User, ShouldEqual, "admin")
+		})
+	})
+}
@@ -0,0 +1,90 @@
+package graval
+
+// CommandCall is a command passing through the server's CommandInterceptors.
+type CommandCall struct {
+	SessionId string
+	RemoteIP  string
+
+	// The user who's logged in, or an empty string before login
+	User string
+
+	// The values stored for the session
+	Values *SessionValues
+
+	// The session the command was sent on
+	Session *Session
+
+	// The command as the client sent it, like "RETR"
+	Command string
+
+	// The parameter, which an interceptor can change before calling next.
+	// The changed parameter is still checked against the FilenamePolicy and
+	// DirPolicies.
+	Param string
+
+	// The code of the reply that completed the command, once it's run
+	Code int
+
+	conn    *ftpConn
+	replied bool
+}
+
+// Reply answers the command in place of running it, for an interceptor that
+// doesn't call next.
+func (call *CommandCall) Reply(code int, message string) {
+	call.replied = true
+	call.conn.writeMessage(code, message)
+	call.Code = call.conn.cmdCode
+}
+
+// CommandInterceptor runs around every command a client sends, for example to
+// add authorisation rules, rewrite parameters or time commands. It calls next
+// to run the command, and the rest of the chain, with call.Param; code after
+// next sees the reply in call.Code. To refuse the command it calls
+// call.Reply instead of next. An interceptor that does neither leaves the
+// client with a 550 reply.
+//
+// Interceptors see every command, including those sent before login and
+// those graval doesn't know, before the usual checks that the user is logged
+// in and the command is allowed.
+type CommandInterceptor func(call *CommandCall, next func())
+
+// intercept runs a command through the server's CommandInterceptors, then
+// dispatch.
+func (ftpConn *ftpConn) intercept(command string, param string) {
+	interceptors := ftpConn.server.cmdInterceptors
+	if len(interceptors) == 0 {
+		ftpConn.dispatch(command, param)
+		return
+	}
+	call := &CommandCall{
+		SessionId: ftpConn.sessionId,
+		RemoteIP:  ftpConn.remoteIP(),
+		User:      ftpConn.user,
+		Values:    ftpConn.values,
+		Session:   &Session{conn: ftpConn},
+		Command:   command,
+		Param:     param,
+		conn:      ftpConn,
+	}
+	var run func(i int)
+	run = func(i int) {
+		if i == len(interceptors) {
+			call.replied = true
+			ftpConn.dispatch(call.Command, call.Param)
+			call.Code = ftpConn.cmdCode
+			return
+		}
+		called := false
+		interceptors[i](call, func() {
+			if !called {
+				called = true
+				run(i + 1)
+			}
+		})
+	}
+	run(0)
+	if !call.replied {
+		ftpConn.writeMessage(550, "Permission denied")
+	}
+}
@@ -0,0 +1,125 @@
+package graval
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// PartialUpload is a temporary file written by an upload that's in progress
+// or was abandoned.
+type PartialUpload struct {
+	Path    string
+	ModTime time.Time
+}
+
+// FTPPartialUploadDriver is an optional interface for drivers that can list
+// the temporary files of uploads, for the janitor enabled by
+// PartialUploadMaxAge. Drivers that implement FTPTempUploadDriver should
+// implement it too. Without it, the janitor walks the whole tree looking for
+// names ending in UploadTempSuffix.
+type FTPPartialUploadDriver interface {
+	// returns - every temporary upload file, wherever it is
+	PartialUploads() []PartialUpload
+}
+
+// startJanitor starts deleting abandoned uploads and expired files in the
+// background, if PartialUploadMaxAge or a DirPolicy Expire is set and it
+// isn't already running. It's timed by the server's clock. The caller must
+// hold mu.
+func (ftpServer *FTPServer) startJanitor() {
+	period := ftpServer.janitorPeriod()
+	if period <= 0 || ftpServer.janitorStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	ftpServer.janitorStop = stop
+	go func() {
+		for {
+			fired, timer := clockAfter(ftpServer.clock, period)
+			select {
+			case <-fired:
+				ftpServer.SweepPartialUploads()
+				ftpServer.SweepExpiredFiles()
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// janitorPeriod returns how often the janitor runs: twice in the shortest
+// of PartialUploadMaxAge and the DirPolicy Expire times, or 0 if it isn't
+// needed.
+func (ftpServer *FTPServer) janitorPeriod() time.Duration {
+	shortest := ftpServer.partialMaxAge
+	for _, policy := range ftpServer.dirPolicies {
+		if policy.Expire > 0 && (shortest <= 0 || policy.Expire < shortest) {
+			shortest = policy.Expire
+		}
+	}
+	return shortest / 2
+}
+
+// stopJanitor stops the janitor started by startJanitor. The caller must
+// hold mu.
+func (ftpServer *FTPServer) stopJanitor() {
+	if ftpServer.janitorStop != nil {
+		close(ftpServer.janitorStop)
+		ftpServer.janitorStop = nil
+	}
+}
+
+// SweepPartialUploads deletes the temporary files of uploads that haven't
+// been written to for PartialUploadMaxAge, and returns how many were
+// deleted. It's run in the background while the server is serving, but can
+// also be called directly. It does nothing if PartialUploadMaxAge isn't set.
+func (ftpServer *FTPServer) SweepPartialUploads() int {
+	if ftpServer.partialMaxAge <= 0 {
+		return 0
+	}
+	driver, err := ftpServer.currentSettings().driverFactory.NewDriver()
+	if err != nil {
+		ftpServer.logger.Printf("Unable to sweep partial uploads: %s", err)
+		return 0
+	}
+	cutoff := ftpServer.clock.Now().Add(-ftpServer.partialMaxAge)
+	deleted := 0
+	for _, upload := range ftpServer.partialUploads(driver) {
+		if upload.ModTime.Before(cutoff) && driver.DeleteFile(upload.Path) {
+			ftpServer.logger.Printf("Deleted abandoned upload %s", upload.Path)
+			ftpServer.uploadState.removeTemp(upload.Path)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// partialUploads lists the temporary upload files visible to driver.
+func (ftpServer *FTPServer) partialUploads(driver FTPDriver) []PartialUpload {
+	var lister FTPPartialUploadDriver
+	if DriverAs(driver, &lister) {
+		return lister.PartialUploads()
+	}
+	if !ftpServer.atomicUploads {
+		return nil
+	}
+	var uploads []PartialUpload
+	var walk func(dir string)
+	walk = func(dir string) {
+		for _, file := range driver.DirContents(dir) {
+			filePath := path.Join(dir, file.Name())
+			switch {
+			case file.Mode()&os.ModeSymlink != 0:
+			case file.IsDir():
+				walk(filePath)
+			case strings.HasSuffix(file.Name(), ftpServer.uploadTempSuffix):
+				uploads = append(uploads, PartialUpload{Path: filePath, ModTime: file.ModTime()})
+			}
+		}
+	}
+	walk("/")
+	return uploads
+}
@@ -0,0 +1,122 @@
+package graval
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// LoginRecord is a successful login.
+type LoginRecord struct {
+	User     string    `json:"user"`
+	Time     time.Time `json:"time"`
+	RemoteIP string    `json:"remote_ip"`
+}
+
+// LoginStore keeps track of each user's last login, for the LoginStore
+// option. Implement it to keep logins in a database shared by several
+// servers, or use NewLoginStore.
+type LoginStore interface {
+	// LastLogin returns the user's most recent login, or nil if they've
+	// never logged in.
+	LastLogin(user string) (*LoginRecord, error)
+
+	// RecordLogin saves a login, replacing the user's previous one.
+	RecordLogin(record LoginRecord) error
+}
+
+// NewLoginStore returns a LoginStore that keeps logins in memory and, if
+// file isn't empty, in a JSON file so they survive a restart. Logins already
+// in the file are read first.
+func NewLoginStore(file string) (LoginStore, error) {
+	store := &loginStore{file: file, logins: map[string]LoginRecord{}}
+	if file == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []LoginRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		store.logins[record.User] = record
+	}
+	return store, nil
+}
+
+type loginStore struct {
+	file string
+
+	mu     sync.Mutex
+	logins map[string]LoginRecord
+}
+
+func (store *loginStore) LastLogin(user string) (*LoginRecord, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if record, ok := store.logins[user]; ok {
+		return &record, nil
+	}
+	return nil, nil
+}
+
+func (store *loginStore) RecordLogin(record LoginRecord) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.logins[record.User] = record
+	if store.file == "" {
+		return nil
+	}
+	records := make([]LoginRecord, 0, len(store.logins))
+	for _, record := range store.logins {
+		records = append(records, record)
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	// replaced in one step so a crash can't leave it half written
+	temp := store.file + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, store.file)
+}
+
+// recordLogin saves the login that has just succeeded in the server's
+// LoginStore, if it has one, and remembers the user's previous login for
+// the 230 reply and Sessions. Failures are logged rather than refusing the
+// login.
+func (ftpConn *ftpConn) recordLogin() {
+	store := ftpConn.server.loginStore
+	if store == nil {
+		return
+	}
+	previous, err := store.LastLogin(ftpConn.user)
+	if err != nil {
+		ftpConn.logger.Printf("Unable to read last login: %s", err)
+	}
+	record := LoginRecord{User: ftpConn.user, Time: ftpConn.server.clock.Now().UTC(), RemoteIP: ftpConn.remoteIP()}
+	if err := store.RecordLogin(record); err != nil {
+		ftpConn.logger.Printf("Unable to record login: %s", err)
+	}
+	ftpConn.mu.Lock()
+	ftpConn.lastLogin = previous
+	ftpConn.mu.Unlock()
+}
+
+// LastLogin returns the user's most recent login from the LoginStore, or nil
+// if they've never logged in or there's no LoginStore.
+func (ftpServer *FTPServer) LastLogin(user string) (*LoginRecord, error) {
+	if ftpServer.loginStore == nil {
+		return nil, nil
+	}
+	return ftpServer.loginStore.LastLogin(user)
+}
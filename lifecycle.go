@@ -0,0 +1,26 @@
+package graval
+
+// startSession lets a driver that implements FTPLifecycleDriver acquire what
+// it needs for the session. If it can't, the client is told and false is
+// returned.
+func (ftpConn *ftpConn) startSession() bool {
+	var driver FTPLifecycleDriver
+	if !DriverAs(ftpConn.driver, &driver) {
+		return true
+	}
+	if err := driver.SessionStart(ftpConn.sessionCtx); err != nil {
+		ftpConn.logger.Printf("Unable to start session: %s", err)
+		ftpConn.writeMessage(421, "Service not available, closing control connection")
+		return false
+	}
+	ftpConn.lifecycle = driver
+	return true
+}
+
+// endSession lets a driver that implements FTPLifecycleDriver release what it
+// acquired in startSession.
+func (ftpConn *ftpConn) endSession() {
+	if ftpConn.lifecycle != nil {
+		ftpConn.lifecycle.SessionEnd(ftpConn.sessionCtx)
+	}
+}
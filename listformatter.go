@@ -5,43 +5,157 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type listFormatter struct {
 	files []os.FileInfo
+
+	// shown for files that don't supply their own owner and group
+	owner string
+	group string
+
+	// the time zone for Detailed, and whether Machine includes milliseconds
+	location  *time.Location
+	subsecond bool
 }
 
 func newListFormatter(files []os.FileInfo) *listFormatter {
 	f := new(listFormatter)
 	f.files = files
+	f.owner = "owner"
+	f.group = "group"
+	f.location = time.UTC
 	return f
 }
 
+// listFormatter returns a formatter for files that uses the server's default
+// owner and group and its time settings.
+func (ftpConn *ftpConn) listFormatter(files []os.FileInfo) *listFormatter {
+	formatter := newListFormatter(files)
+	formatter.owner = ftpConn.server.listOwner
+	formatter.group = ftpConn.server.listGroup
+	formatter.location = ftpConn.server.listLocation
+	formatter.subsecond = ftpConn.server.subsecondTimes
+	return formatter
+}
+
 // Short returns a string that lists the collection of files by name only,
 // one per line
 func (formatter *listFormatter) Short() string {
-	output := ""
-	for _, file := range formatter.files {
-		output += file.Name() + "\r\n"
-	}
-	output += "\r\n"
-	return output
+	return formatter.join(formatter.ShortLine) + "\r\n"
+}
+
+// ShortLine returns the line of Short for a single file.
+func (formatter *listFormatter) ShortLine(file os.FileInfo) string {
+	return file.Name() + "\r\n"
 }
 
 // Detailed returns a string that lists the collection of files with extra
 // detail, one per line
 func (formatter *listFormatter) Detailed() string {
-	output := ""
+	return formatter.join(formatter.DetailedLine) + "\r\n"
+}
+
+// DetailedLine returns the line of Detailed for a single file.
+func (formatter *listFormatter) DetailedLine(file os.FileInfo) string {
+	output := listMode(file.Mode())
+	owner, group := fileOwner(file)
+	output += " 1 " + listField(owner, formatter.owner) + " " + listField(group, formatter.group) + " "
+	output += lpad(strconv.FormatInt(listSize(file), 10), 12)
+	output += " " + strftime.Format("%b %d %H:%M", file.ModTime().In(formatter.location))
+	output += " " + file.Name()
+	if target, ok := symlinkTarget(file); ok {
+		output += " -> " + target
+	}
+	return output + "\r\n"
+}
+
+// join formats every file with line.
+func (formatter *listFormatter) join(line func(os.FileInfo) string) string {
+	var output strings.Builder
 	for _, file := range formatter.files {
-		output += file.Mode().String()
-		output += " 1 owner group "
-		output += lpad(strconv.Itoa(int(file.Size())), 12)
-		output += " " + strftime.Format("%b %d %H:%M", file.ModTime().UTC())
-		output += " " + file.Name()
-		output += "\r\n"
-	}
-	output += "\r\n"
-	return output
+		output.WriteString(line(file))
+	}
+	return output.String()
+}
+
+// listSize returns the size to show for a file in LIST, which is 0 for a
+// virtual file.
+func listSize(file os.FileInfo) int64 {
+	if file.Size() == SizeUnknown {
+		return 0
+	}
+	return file.Size()
+}
+
+// Machine returns a string that lists the collection of files in the format
+// of MLSD from RFC 3659, one per line
+func (formatter *listFormatter) Machine() string {
+	return formatter.join(formatter.MachineLine)
+}
+
+// MachineLine returns the line of Machine for a single file.
+func (formatter *listFormatter) MachineLine(file os.FileInfo) string {
+	return machineFacts(file, formatter.subsecond) + " " + file.Name() + "\r\n"
+}
+
+// machineFacts returns the RFC 3659 facts describing a file, as used by MLSD
+// and MLST. Symlinks are given the type suggested by section 7.5.1 of the
+// RFC.
+func machineFacts(file os.FileInfo, subsecond bool) string {
+	facts := ""
+	if file.IsDir() {
+		facts += "type=dir;"
+	} else if file.Mode()&os.ModeSymlink != 0 {
+		if target, ok := symlinkTarget(file); ok {
+			facts += "type=OS.unix=slink:" + target + ";"
+		} else {
+			facts += "type=OS.unix=symlink;"
+		}
+	} else if file.Size() == SizeUnknown {
+		facts += "type=file;"
+	} else {
+		facts += "type=file;size=" + strconv.FormatInt(file.Size(), 10) + ";"
+	}
+	facts += "modify=" + machineTime(file.ModTime(), subsecond) + ";"
+	owner, group := fileOwner(file)
+	if owner != "" {
+		facts += "UNIX.ownername=" + owner + ";"
+	}
+	if group != "" {
+		facts += "UNIX.groupname=" + group + ";"
+	}
+	return facts
+}
+
+// machineTime formats t the way RFC 3659 requires for MDTM and MLSD: always
+// in UTC, and optionally with milliseconds.
+func machineTime(t time.Time, subsecond bool) string {
+	layout := machineTimeLayout
+	if subsecond {
+		layout += ".000"
+	}
+	return t.UTC().Format(layout)
+}
+
+// listMode returns the file type and permissions the way ls -l shows them.
+// It differs from os.FileMode's String method for symlinks, which Go marks
+// with an L rather than an l.
+func listMode(mode os.FileMode) string {
+	if mode&os.ModeSymlink != 0 {
+		return "l" + mode.Perm().String()[1:]
+	}
+	return mode.String()
+}
+
+// listField returns value, or fallback if it's empty, with any spaces
+// replaced so the listing can still be split into columns.
+func listField(value string, fallback string) string {
+	if value == "" {
+		value = fallback
+	}
+	return strings.Replace(value, " ", "_", -1)
 }
 
 func lpad(input string, length int) (result string) {
@@ -50,7 +50,76 @@ func TestDetailedFormat(t *testing.T) {
 	formatter := newListFormatter(files)
 	Convey("The Detailed listing format", t, func() {
 		Convey("Will display correctly", func() {
-			So(formatter.Detailed(), ShouldEqual, "L--------- 1 owner group           99 Jan 01 00:00 file1.txt\r\nL--------- 1 owner group           99 Jan 01 00:00 file1.txt\r\n\r\n")
+			So(formatter.Detailed(), ShouldEqual, "l--------- 1 owner group           99 Jan 01 00:00 file1.txt\r\nl--------- 1 owner group           99 Jan 01 00:00 file1.txt\r\n\r\n")
+		})
+	})
+}
+
+func TestSymlinkFormat(t *testing.T) {
+	modTime := time.Unix(1566738000, 0) // 2019-08-25 13:00:00 UTC
+	formatter := newListFormatter([]os.FileInfo{NewSymlinkItem("link", "target.txt", modTime)})
+	Convey("A symlink", t, func() {
+		Convey("Will be listed with its target", func() {
+			So(formatter.Detailed(), ShouldEqual, "lrwxrwxrwx 1 owner group           10 Aug 25 13:00 link -> target.txt\r\n\r\n")
+		})
+
+		Convey("Will be given the RFC 3659 symlink type", func() {
+			So(formatter.Machine(), ShouldEqual, "type=OS.unix=slink:target.txt;modify=20190825130000; link\r\n")
+		})
+	})
+}
+
+func TestMachineFormat(t *testing.T) {
+	modTime := time.Unix(1566738000, 0) // 2019-08-25 13:00:00 UTC
+	formatter := newListFormatter([]os.FileInfo{NewDirItem("dir", modTime), NewFileItem("file.txt", 99, modTime)})
+	Convey("The Machine listing format", t, func() {
+		Convey("Will display correctly", func() {
+			So(formatter.Machine(), ShouldEqual, "type=dir;modify=20190825130000; dir\r\ntype=file;size=99;modify=20190825130000; file.txt\r\n")
+		})
+	})
+}
+
+func TestOwnerFormat(t *testing.T) {
+	modTime := time.Unix(1566738000, 0) // 2019-08-25 13:00:00 UTC
+	formatter := newListFormatter([]os.FileInfo{
+		WithOwner(NewFileItem("owned.txt", 1, modTime), "alice", "staff"),
+		NewFileItem("plain.txt", 1, modTime),
+	})
+	formatter.owner = "ftp"
+	formatter.group = "ftp users"
+	Convey("Files with an owner", t, func() {
+		Convey("Will be listed with their owner and group", func() {
+			So(formatter.Detailed(), ShouldStartWith, "-rw-rw-rw- 1 alice staff            1 Aug 25 13:00 owned.txt\r\n")
+		})
+
+		Convey("Will fall back to the defaults otherwise", func() {
+			So(formatter.Detailed(), ShouldContainSubstring, "-rw-rw-rw- 1 ftp ftp_users            1 Aug 25 13:00 plain.txt\r\n")
+		})
+
+		Convey("Will be given owner facts in MLSD", func() {
+			So(formatter.Machine(), ShouldStartWith, "type=file;size=1;modify=20190825130000;UNIX.ownername=alice;UNIX.groupname=staff; owned.txt\r\n")
+		})
+	})
+}
+
+func TestFormatTimes(t *testing.T) {
+	modTime := time.Unix(1566738000, 123456789).In(time.FixedZone("AEST", 10*3600))
+	formatter := newListFormatter([]os.FileInfo{NewFileItem("file.txt", 1, modTime)})
+	zoned := newListFormatter([]os.FileInfo{NewFileItem("file.txt", 1, modTime)})
+	zoned.location = time.FixedZone("EST", -5*3600)
+	zoned.subsecond = true
+	Convey("Modification times", t, func() {
+		Convey("Will be listed in UTC by default", func() {
+			So(formatter.Detailed(), ShouldContainSubstring, " Aug 25 13:00 ")
+			So(formatter.Machine(), ShouldContainSubstring, "modify=20190825130000;")
+		})
+
+		Convey("Will be listed in the configured zone", func() {
+			So(zoned.Detailed(), ShouldContainSubstring, " Aug 25 08:00 ")
+		})
+
+		Convey("Will stay in UTC for MLSD, with milliseconds if asked for", func() {
+			So(zoned.Machine(), ShouldContainSubstring, "modify=20190825130000.123;")
 		})
 	})
 }
@@ -0,0 +1,123 @@
+package graval
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// listingPanic carries a panic from the goroutine producing a listing to the
+// one sending it, so it's recovered like any other panic in a command.
+type listingPanic struct {
+	value interface{}
+}
+
+func (listingPanic) Error() string {
+	return "panic while listing"
+}
+
+// listingReader reads a listing from the pipe it's written to, and panics if
+// writing it did.
+type listingReader struct {
+	*io.PipeReader
+}
+
+func (reader listingReader) Read(p []byte) (int, error) {
+	n, err := reader.PipeReader.Read(p)
+	if recovered, ok := err.(listingPanic); ok {
+		panic(recovered.value)
+	}
+	return n, err
+}
+
+// listCursor is where a truncated MLSD listing stopped, so the next MLSD of
+// the same directory can carry on from there.
+type listCursor struct {
+	dir  string
+	next int
+}
+
+// the commands that can come between a truncated MLSD and the one continuing
+// it, which only set up its data connection
+var continuesListing = map[string]bool{
+	"MLSD": true,
+	"PASV": true,
+	"EPSV": true,
+	"PORT": true,
+	"EPRT": true,
+}
+
+// sendListing sends a listing of dir over the data connection, formatting
+// each entry with line and ending with trailer. Entries are written as
+// they're listed rather than built up in memory first, so huge directories
+// can be listed by drivers that implement FTPDirIterDriver. The listing stops
+// at the server's MaxListEntries and MaxListBytes, and if continuable, the
+// next listing of dir starts where this one stopped.
+func (ftpConn *ftpConn) sendListing(dir string, line func(os.FileInfo) string, trailer string, continuable bool) {
+	skip := 0
+	if continuable && ftpConn.listCursor.dir == dir {
+		skip = ftpConn.listCursor.next
+	}
+	ftpConn.listCursor = listCursor{}
+	maxEntries := ftpConn.server.maxListEntries
+	maxBytes := ftpConn.server.maxListBytes
+
+	// written by the goroutine below before it closes the pipe, so they're
+	// safe to read once the listing has been sent
+	var sent int
+	var truncated bool
+
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				writer.CloseWithError(listingPanic{value: r})
+			}
+		}()
+		buffered := bufio.NewWriter(writer)
+		var err error
+		var index int
+		var size int64
+		ftpConn.eachDirEntry(dir, func(file os.FileInfo) bool {
+			index++
+			if index <= skip {
+				return true
+			}
+			text := line(file)
+			// a single entry longer than MaxListBytes is still sent, so
+			// a continued listing always makes progress
+			if (maxEntries > 0 && sent >= maxEntries) || (maxBytes > 0 && sent > 0 && size+int64(len(text)) > maxBytes) {
+				truncated = true
+				return false
+			}
+			_, err = buffered.WriteString(text)
+			sent++
+			size += int64(len(text))
+			return err == nil
+		})
+		if err == nil {
+			_, err = buffered.WriteString(trailer)
+		}
+		if err == nil {
+			err = buffered.Flush()
+		}
+		writer.CloseWithError(err)
+	}()
+	ftpConn.sendOutofband(listingReader{reader}, func(xfer *transfer) string {
+		if !truncated {
+			return ftpConn.completeMessage(xfer)
+		}
+		if !continuable {
+			return fmt.Sprintf("Listing truncated after %d entries.", sent)
+		}
+		ftpConn.listCursor = listCursor{dir: dir, next: skip + sent}
+		return fmt.Sprintf("Listing truncated after %d entries. Send MLSD again for the rest.", skip+sent)
+	})
+	// if the client went away, stop listing before the driver is used for
+	// anything else
+	reader.Close()
+	<-done
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package graval
+
+import "os"
+
+// lockFile reports that FilePortAllocator can't be used here.
+func lockFile(file *os.File) error {
+	return errLockUnsupported
+}
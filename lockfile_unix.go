@@ -0,0 +1,15 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package graval
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on file without waiting, which is
+// released when it's closed.
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,139 @@
+package graval
+
+import (
+	"sync"
+	"time"
+)
+
+// the reply sent to clients when no message is given to ScheduleMaintenance
+const defaultMaintenanceMessage = "Service closing for maintenance"
+
+// maintenance is a window scheduled with ScheduleMaintenance.
+type maintenance struct {
+	at      time.Time
+	cutoff  time.Time
+	message string
+	timer   ClockTimer
+	started bool
+
+	drained   chan struct{}
+	drainOnce sync.Once
+}
+
+// drain reports that every session has ended after the window started.
+func (m *maintenance) drain() {
+	m.drainOnce.Do(func() { close(m.drained) })
+}
+
+// ScheduleMaintenance plans a maintenance window starting at the given time,
+// for planned restarts of long-running servers. From loginCutoff before the
+// window starts, new logins are refused with a 421 reply carrying message.
+// When it starts, new connections are refused the same way, and each
+// established session is sent a 421 reply and closed as soon as it's idle, so
+// transfers in progress are allowed to finish.
+//
+// The returned channel is closed once the window has started and every
+// session has ended, when it's safe to stop the server. Scheduling another
+// window replaces this one, and its channel is never closed.
+func (ftpServer *FTPServer) ScheduleMaintenance(at time.Time, loginCutoff time.Duration, message string) <-chan struct{} {
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	m := &maintenance{
+		at:      at,
+		cutoff:  at.Add(-loginCutoff),
+		message: message,
+		drained: make(chan struct{}),
+	}
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	ftpServer.cancelMaintenance()
+	ftpServer.maintenance = m
+	m.timer = ftpServer.clock.AfterFunc(at.Sub(ftpServer.clock.Now()), func() {
+		ftpServer.startMaintenance(m)
+	})
+	return m.drained
+}
+
+// CancelMaintenance cancels the window scheduled with ScheduleMaintenance, and
+// allows logins again. Sessions already closed, or waiting to close, aren't
+// affected.
+func (ftpServer *FTPServer) CancelMaintenance() {
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	ftpServer.cancelMaintenance()
+}
+
+// cancelMaintenance forgets any scheduled window. The caller must hold mu.
+func (ftpServer *FTPServer) cancelMaintenance() {
+	if ftpServer.maintenance != nil {
+		ftpServer.maintenance.timer.Stop()
+		ftpServer.maintenance = nil
+	}
+}
+
+// startMaintenance asks every session to close once it's idle, unless the
+// window has been cancelled.
+func (ftpServer *FTPServer) startMaintenance(m *maintenance) {
+	ftpServer.mu.Lock()
+	if ftpServer.maintenance != m {
+		ftpServer.mu.Unlock()
+		return
+	}
+	m.started = true
+	sessions := make([]*ftpConn, 0, len(ftpServer.sessions))
+	for conn := range ftpServer.sessions {
+		sessions = append(sessions, conn)
+	}
+	if len(sessions) == 0 {
+		m.drain()
+	}
+	ftpServer.mu.Unlock()
+	ftpServer.logger.Printf("Maintenance started, closing %d sessions", len(sessions))
+	for _, conn := range sessions {
+		conn.closeWhenIdle(m.message)
+	}
+}
+
+// maintenanceMessage returns the reply to send, and true, if logins are
+// being refused for maintenance.
+func (ftpServer *FTPServer) maintenanceMessage() (string, bool) {
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	m := ftpServer.maintenance
+	if m == nil || ftpServer.clock.Now().Before(m.cutoff) {
+		return "", false
+	}
+	return m.message, true
+}
+
+// refuseLogin ends the session with a 421 reply, and returns true, if logins
+// are being refused for maintenance.
+func (ftpConn *ftpConn) refuseLogin() bool {
+	message, refused := ftpConn.server.maintenanceMessage()
+	if refused {
+		ftpConn.writeMessage(421, message)
+		ftpConn.Close()
+	}
+	return refused
+}
+
+// closeWhenIdle ends the session with a 421 reply carrying message as soon as
+// the command loop is idle. A command that's already running, including a
+// file transfer, is allowed to finish first.
+func (ftpConn *ftpConn) closeWhenIdle(message string) {
+	ftpConn.mu.Lock()
+	ftpConn.closing = message
+	busy := ftpConn.busy
+	ftpConn.mu.Unlock()
+	if !busy {
+		ftpConn.closeWithMessage(message)
+	}
+}
+
+// closingMessage returns the message passed to closeWhenIdle, if any.
+func (ftpConn *ftpConn) closingMessage() string {
+	ftpConn.mu.Lock()
+	defer ftpConn.mu.Unlock()
+	return ftpConn.closing
+}
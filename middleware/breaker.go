@@ -0,0 +1,310 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// BreakerConfig describes when a CircuitBreaker trips and resets.
+type BreakerConfig struct {
+	// How many calls in a row must fail with graval.ErrBackendDown or
+	// graval.ErrUnavailable before the breaker opens. Defaults to 5.
+	Failures int
+
+	// How long the breaker stays open, failing every call at once, before it
+	// lets a single call through to see if the backend has recovered.
+	// Defaults to 30 seconds.
+	Cooldown time.Duration
+
+	// Where the time comes from. Optional, defaults to the system clock.
+	Clock graval.Clock
+}
+
+// CircuitBreaker stops calling a backend that keeps failing, so every session
+// gets a quick 451 reply while it's down rather than waiting on it in turn.
+// Once Cooldown has passed one call is let through, and if it succeeds the
+// backend is used again. Only failures that mean the backend is down count:
+// graval.ErrBackendDown and graval.ErrUnavailable, including those from
+// Timeout. Put Timeout inside it, so calls to a backend that hangs fail:
+//
+//	middleware.Chain(factory,
+//		middleware.CircuitBreaker(&middleware.BreakerConfig{}),
+//		middleware.Timeout(5*time.Second),
+//	)
+//
+// The breaker is shared by every driver it wraps.
+func CircuitBreaker(config *BreakerConfig) Middleware {
+	b := &breaker{failures: config.Failures, cooldown: config.Cooldown, now: time.Now}
+	if b.failures <= 0 {
+		b.failures = 5
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = 30 * time.Second
+	}
+	if config.Clock != nil {
+		b.now = config.Clock.Now
+	}
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &breakerDriver{Driver: Driver{Next: next}, breaker: b}
+	}
+}
+
+type breaker struct {
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	failed   int
+	open     bool
+	openedAt time.Time
+	trial    bool
+}
+
+// allow reports whether a call may go to the backend. While the breaker is
+// open it's false, except for the first call once the cooldown has passed.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.trial || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record notes the outcome of a call that was allowed.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !backendDown(err) {
+		b.failed = 0
+		b.open = false
+		return
+	}
+	b.failed++
+	if b.open || b.failed >= b.failures {
+		b.open = true
+		b.openedAt = b.now()
+	}
+}
+
+// backendDown reports whether err, or an error it wraps, means the backend is
+// down.
+func backendDown(err error) bool {
+	for err != nil {
+		if err == graval.ErrBackendDown || err == graval.ErrUnavailable {
+			return true
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = wrapper.Unwrap()
+	}
+	return false
+}
+
+type breakerDriver struct {
+	Driver
+	breaker *breaker
+	lastErr error
+}
+
+// call runs f if the breaker allows it, recording the error it returns. If
+// it's not allowed, it returns false and LastError reports
+// graval.ErrBackendDown.
+func (driver *breakerDriver) call(f func() error) bool {
+	driver.lastErr = nil
+	if !driver.breaker.allow() {
+		driver.lastErr = graval.ErrBackendDown
+		return false
+	}
+	driver.breaker.record(f())
+	return true
+}
+
+// failed returns why a call that returned false failed.
+func (driver *breakerDriver) failed(ok bool) error {
+	if ok {
+		return nil
+	}
+	return driver.Driver.LastError()
+}
+
+// Supports serves graval.FTPErrorDriver whatever the next driver is, so
+// graval can report calls refused while the breaker is open.
+func (driver *breakerDriver) Supports(target interface{}) bool {
+	if _, ok := target.(*graval.FTPErrorDriver); ok {
+		return true
+	}
+	return driver.Driver.Supports(target)
+}
+
+func (driver *breakerDriver) LastError() error {
+	if driver.lastErr != nil {
+		return driver.lastErr
+	}
+	return driver.Driver.LastError()
+}
+
+func (driver *breakerDriver) Authenticate(user string, pass string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Next.Authenticate(user, pass)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) Bytes(path string) int64 {
+	size := int64(-1)
+	driver.call(func() error {
+		size = driver.Next.Bytes(path)
+		return driver.failed(size >= 0)
+	})
+	return size
+}
+
+func (driver *breakerDriver) ModifiedTime(path string) (time.Time, error) {
+	var modTime time.Time
+	var err error
+	if !driver.call(func() error {
+		modTime, err = driver.Next.ModifiedTime(path)
+		return err
+	}) {
+		return time.Time{}, graval.ErrBackendDown
+	}
+	return modTime, err
+}
+
+func (driver *breakerDriver) ChangeDir(path string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Next.ChangeDir(path)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) DirContents(path string) []os.FileInfo {
+	files := []os.FileInfo{}
+	driver.call(func() error {
+		files = driver.Next.DirContents(path)
+		return nil
+	})
+	return files
+}
+
+func (driver *breakerDriver) DeleteDir(path string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Next.DeleteDir(path)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) DeleteFile(path string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Next.DeleteFile(path)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) Rename(fromPath string, toPath string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Next.Rename(fromPath, toPath)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) MakeDir(path string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Next.MakeDir(path)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) GetFile(path string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var err error
+	if !driver.call(func() error {
+		reader, err = driver.Next.GetFile(path)
+		return err
+	}) {
+		return nil, graval.ErrBackendDown
+	}
+	return reader, err
+}
+
+func (driver *breakerDriver) PutFile(destPath string, data io.Reader) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Next.PutFile(destPath, data)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Driver.PutFileAt(destPath, offset, data)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var err error
+	if !driver.call(func() error {
+		reader, err = driver.Driver.ReadRange(path, offset, length)
+		return err
+	}) {
+		return nil, graval.ErrBackendDown
+	}
+	return reader, err
+}
+
+func (driver *breakerDriver) GetFileSegment(path string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var err error
+	if !driver.call(func() error {
+		reader, err = driver.Driver.GetFileSegment(path, offset, length, group)
+		return err
+	}) {
+		return nil, graval.ErrBackendDown
+	}
+	return reader, err
+}
+
+func (driver *breakerDriver) Copy(fromPath string, toPath string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Driver.Copy(fromPath, toPath)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) DeleteTree(path string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Driver.DeleteTree(path)
+		return driver.failed(ok)
+	}) && ok
+}
+
+func (driver *breakerDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	var ok bool
+	return driver.call(func() error {
+		ok = driver.Driver.StoreExisting(destPath, algorithm, hash)
+		return driver.failed(ok)
+	}) && ok
+}
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"errors"
+	"github.com/royallthefourth/graval"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// how far into an upload a reset can happen, since its size isn't known
+// until it's over
+const chaosUploadWindow = 64 << 10
+
+var errChaosReset = errors.New("middleware: transfer reset by Chaos")
+
+// ChaosConfig describes the faults Chaos injects. The zero value injects
+// none.
+type ChaosConfig struct {
+	// Added to every call to the driver, along with a random part of Jitter.
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// The chance, from 0 to 1, that a call fails with
+	// graval.ErrUnavailable, which clients see as a 450 reply.
+	FailureRate float64
+
+	// The chance, from 0 to 1, that a download or upload is cut off at a
+	// random point. Uploads are cut off within their first 64KiB.
+	ResetRate float64
+
+	// The most bytes a second of file data that's read or written, to
+	// simulate a slow link. 0 means no limit.
+	DripRate int64
+
+	// The source of randomness. Optional, set it to make tests repeatable.
+	Rand *rand.Rand
+}
+
+// Chaos injects delays, failures, broken transfers and slow data into a
+// driver, so client developers can check how their retry and resume logic
+// copes against a server whose behaviour they control. Don't use it in
+// production.
+func Chaos(config *ChaosConfig) Middleware {
+	random := config.Rand
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	chaos := &chaos{config: config, rand: random}
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &chaosDriver{Driver: Driver{Next: next}, chaos: chaos}
+	}
+}
+
+// chaos makes the random choices for every driver from one Chaos, since a
+// rand.Rand can't be shared between goroutines without a lock.
+type chaos struct {
+	config *ChaosConfig
+	mu     sync.Mutex
+	rand   *rand.Rand
+}
+
+func (chaos *chaos) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	return chaos.rand.Float64() < rate
+}
+
+// upTo returns a random number from 0 up to, but not including, n.
+func (chaos *chaos) upTo(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	return chaos.rand.Int63n(n)
+}
+
+func (chaos *chaos) delay() {
+	delay := chaos.config.Delay + time.Duration(chaos.upTo(int64(chaos.config.Jitter)))
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// wrap applies resets and the drip rate to file data. size is how much data
+// there is, or -1 if it's not known.
+func (chaos *chaos) wrap(reader io.Reader, size int64) io.Reader {
+	if chaos.chance(chaos.config.ResetRate) {
+		if size < 0 {
+			size = chaosUploadWindow
+		}
+		reader = &resetReader{reader: reader, remaining: chaos.upTo(size)}
+	}
+	if chaos.config.DripRate > 0 {
+		reader = &dripReader{reader: reader, rate: chaos.config.DripRate}
+	}
+	return reader
+}
+
+type chaosDriver struct {
+	Driver
+	chaos   *chaos
+	lastErr error
+}
+
+// inject delays a call and decides whether it fails, in which case LastError
+// reports graval.ErrUnavailable.
+func (driver *chaosDriver) inject() bool {
+	driver.chaos.delay()
+	driver.lastErr = nil
+	if driver.chaos.chance(driver.chaos.config.FailureRate) {
+		driver.lastErr = graval.ErrUnavailable
+		return true
+	}
+	return false
+}
+
+// Supports serves graval.FTPErrorDriver whatever the next driver is, so
+// graval can report the failures it injects.
+func (driver *chaosDriver) Supports(target interface{}) bool {
+	if _, ok := target.(*graval.FTPErrorDriver); ok {
+		return true
+	}
+	return driver.Driver.Supports(target)
+}
+
+func (driver *chaosDriver) LastError() error {
+	if driver.lastErr != nil {
+		return driver.lastErr
+	}
+	return driver.Driver.LastError()
+}
+
+func (driver *chaosDriver) Authenticate(user string, pass string) bool {
+	driver.chaos.delay()
+	return driver.Next.Authenticate(user, pass)
+}
+
+func (driver *chaosDriver) Bytes(path string) int64 {
+	if driver.inject() {
+		return -1
+	}
+	return driver.Next.Bytes(path)
+}
+
+func (driver *chaosDriver) ModifiedTime(path string) (time.Time, error) {
+	if driver.inject() {
+		return time.Time{}, graval.ErrUnavailable
+	}
+	return driver.Next.ModifiedTime(path)
+}
+
+func (driver *chaosDriver) ChangeDir(path string) bool {
+	return !driver.inject() && driver.Next.ChangeDir(path)
+}
+
+func (driver *chaosDriver) DirContents(path string) []os.FileInfo {
+	driver.chaos.delay()
+	return driver.Next.DirContents(path)
+}
+
+func (driver *chaosDriver) DeleteDir(path string) bool {
+	return !driver.inject() && driver.Next.DeleteDir(path)
+}
+
+func (driver *chaosDriver) DeleteFile(path string) bool {
+	return !driver.inject() && driver.Next.DeleteFile(path)
+}
+
+func (driver *chaosDriver) Rename(fromPath string, toPath string) bool {
+	return !driver.inject() && driver.Next.Rename(fromPath, toPath)
+}
+
+func (driver *chaosDriver) MakeDir(path string) bool {
+	return !driver.inject() && driver.Next.MakeDir(path)
+}
+
+func (driver *chaosDriver) GetFile(path string) (io.ReadCloser, error) {
+	if driver.inject() {
+		return nil, graval.ErrUnavailable
+	}
+	reader, err := driver.Next.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosReadCloser{Reader: driver.chaos.wrap(reader, driver.Next.Bytes(path)), Closer: reader}, nil
+}
+
+func (driver *chaosDriver) PutFile(destPath string, data io.Reader) bool {
+	return !driver.inject() && driver.Next.PutFile(destPath, driver.chaos.wrap(data, -1))
+}
+
+func (driver *chaosDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	return !driver.inject() && driver.Driver.PutFileAt(destPath, offset, driver.chaos.wrap(data, -1))
+}
+
+func (driver *chaosDriver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	if driver.inject() {
+		return nil, graval.ErrUnavailable
+	}
+	reader, err := driver.Driver.ReadRange(path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosReadCloser{Reader: driver.chaos.wrap(reader, length), Closer: reader}, nil
+}
+
+func (driver *chaosDriver) GetFileSegment(path string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	if driver.inject() {
+		return nil, graval.ErrUnavailable
+	}
+	reader, err := driver.Driver.GetFileSegment(path, offset, length, group)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosReadCloser{Reader: driver.chaos.wrap(reader, length), Closer: reader}, nil
+}
+
+func (driver *chaosDriver) Copy(fromPath string, toPath string) bool {
+	return !driver.inject() && driver.Driver.Copy(fromPath, toPath)
+}
+
+func (driver *chaosDriver) DeleteTree(path string) bool {
+	return !driver.inject() && driver.Driver.DeleteTree(path)
+}
+
+type chaosReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// resetReader fails once it has read remaining bytes, like a connection
+// that's been reset.
+type resetReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (reader *resetReader) Read(p []byte) (int, error) {
+	if reader.remaining <= 0 {
+		return 0, errChaosReset
+	}
+	if int64(len(p)) > reader.remaining {
+		p = p[:reader.remaining]
+	}
+	n, err := reader.reader.Read(p)
+	reader.remaining -= int64(n)
+	return n, err
+}
+
+// dripReader reads no faster than rate bytes a second, in pieces of a tenth
+// of a second's worth.
+type dripReader struct {
+	reader io.Reader
+	rate   int64
+}
+
+func (reader *dripReader) Read(p []byte) (int, error) {
+	chunk := reader.rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	if int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := reader.reader.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(reader.rate))
+	return n, err
+}
@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/royallthefourth/graval"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileCache keeps the contents of recently downloaded files, so popular files
+// on a mirror-style server are only fetched from the backend once. A single
+// cache is shared by every session it wraps.
+//
+// Before serving a cached copy, the size and modification time of the file
+// are checked with the backend, so changes made outside the server are
+// noticed. A file is only cached after a download reads it to the end.
+type FileCache struct {
+	// The most data to hold at once. The least recently used files are
+	// evicted to make room. Mandatory.
+	MaxBytes int64
+
+	// Files larger than this aren't cached. Optional, defaults to MaxBytes.
+	MaxFileSize int64
+
+	// A directory to keep cached files in. Optional, files are kept in memory
+	// if it's empty. The directory should be dedicated to the cache, but it
+	// isn't cleared on startup.
+	Dir string
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type fileCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	data    []byte
+	file    string
+}
+
+// Middleware returns a Middleware that serves downloads from this cache.
+func (cache *FileCache) Middleware() Middleware {
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &fileCacheDriver{Driver: Driver{Next: next}, cache: cache}
+	}
+}
+
+func (cache *FileCache) maxFileSize() int64 {
+	if cache.MaxFileSize > 0 && cache.MaxFileSize < cache.MaxBytes {
+		return cache.MaxFileSize
+	}
+	return cache.MaxBytes
+}
+
+// lookup returns the cached copy of path, if there's one that matches size
+// and modTime. A stale copy is removed.
+func (cache *FileCache) lookup(path string, size int64, modTime time.Time) *fileCacheEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem := cache.entries[path]
+	if elem == nil {
+		return nil
+	}
+	entry := elem.Value.(*fileCacheEntry)
+	if entry.size != size || !entry.modTime.Equal(modTime) {
+		cache.remove(elem)
+		return nil
+	}
+	cache.lru.MoveToFront(elem)
+	return entry
+}
+
+// add stores a new entry, evicting others to make room.
+func (cache *FileCache) add(entry *fileCacheEntry) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.entries == nil {
+		cache.entries = map[string]*list.Element{}
+		cache.lru = list.New()
+	}
+	if elem := cache.entries[entry.path]; elem != nil {
+		cache.remove(elem)
+	}
+	for cache.size+entry.size > cache.MaxBytes && cache.lru.Len() > 0 {
+		cache.remove(cache.lru.Back())
+	}
+	cache.entries[entry.path] = cache.lru.PushFront(entry)
+	cache.size += entry.size
+}
+
+// forget removes any cached copy of path.
+func (cache *FileCache) forget(path string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem := cache.entries[path]; elem != nil {
+		cache.remove(elem)
+	}
+}
+
+// remove drops an entry from the cache. The caller must hold mu.
+func (cache *FileCache) remove(elem *list.Element) {
+	entry := cache.lru.Remove(elem).(*fileCacheEntry)
+	delete(cache.entries, entry.path)
+	cache.size -= entry.size
+	if entry.file != "" {
+		os.Remove(entry.file)
+	}
+}
+
+type fileCacheDriver struct {
+	Driver
+	cache *FileCache
+}
+
+func (driver *fileCacheDriver) GetFile(path string) (io.ReadCloser, error) {
+	size := driver.Next.Bytes(path)
+	modTime, err := driver.Next.ModifiedTime(path)
+	if size < 0 || err != nil {
+		return driver.Next.GetFile(path)
+	}
+	if entry := driver.cache.lookup(path, size, modTime); entry != nil {
+		if entry.file == "" {
+			return ioutil.NopCloser(bytes.NewReader(entry.data)), nil
+		}
+		// the entry may be evicted while it's being read, but the open file
+		// remains readable after it's removed
+		if file, err := os.Open(entry.file); err == nil {
+			return file, nil
+		}
+		driver.cache.forget(path)
+	}
+
+	file, err := driver.Next.GetFile(path)
+	if err != nil || size > driver.cache.maxFileSize() {
+		return file, err
+	}
+	fill := &cacheFill{ReadCloser: file, cache: driver.cache, entry: &fileCacheEntry{path: path, size: size, modTime: modTime}}
+	if driver.cache.Dir == "" {
+		fill.buffer = new(bytes.Buffer)
+		fill.sink = fill.buffer
+	} else if fill.file, err = ioutil.TempFile(driver.cache.Dir, "graval-cache-"); err == nil {
+		fill.sink = fill.file
+	} else {
+		return file, nil
+	}
+	return fill, nil
+}
+
+func (driver *fileCacheDriver) DeleteFile(path string) bool {
+	defer driver.cache.forget(path)
+	return driver.Next.DeleteFile(path)
+}
+
+func (driver *fileCacheDriver) Rename(fromPath string, toPath string) bool {
+	defer driver.cache.forget(toPath)
+	defer driver.cache.forget(fromPath)
+	return driver.Next.Rename(fromPath, toPath)
+}
+
+func (driver *fileCacheDriver) PutFile(destPath string, data io.Reader) bool {
+	defer driver.cache.forget(destPath)
+	return driver.Next.PutFile(destPath, data)
+}
+
+func (driver *fileCacheDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	defer driver.cache.forget(destPath)
+	return driver.Driver.PutFileAt(destPath, offset, data)
+}
+
+func (driver *fileCacheDriver) Copy(fromPath string, toPath string) bool {
+	defer driver.cache.forget(toPath)
+	return driver.Driver.Copy(fromPath, toPath)
+}
+
+func (driver *fileCacheDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	defer driver.cache.forget(destPath)
+	return driver.Driver.StoreExisting(destPath, algorithm, hash)
+}
+
+// cacheFill copies a download into the cache as it's read, and adds it to the
+// cache when it's closed if the whole file was read.
+type cacheFill struct {
+	io.ReadCloser
+	cache    *FileCache
+	entry    *fileCacheEntry
+	sink     io.Writer
+	buffer   *bytes.Buffer
+	file     *os.File
+	read     int64
+	complete bool
+	failed   bool
+}
+
+func (fill *cacheFill) Read(p []byte) (int, error) {
+	n, err := fill.ReadCloser.Read(p)
+	if n > 0 && !fill.failed {
+		fill.read += int64(n)
+		if _, writeErr := fill.sink.Write(p[:n]); writeErr != nil || fill.read > fill.entry.size {
+			fill.failed = true
+		}
+	}
+	if err == io.EOF {
+		fill.complete = true
+	}
+	return n, err
+}
+
+func (fill *cacheFill) Close() error {
+	err := fill.ReadCloser.Close()
+	ok := fill.complete && !fill.failed && fill.read == fill.entry.size
+	if fill.file != nil {
+		fill.file.Close()
+		if !ok {
+			os.Remove(fill.file.Name())
+			return err
+		}
+		fill.entry.file = fill.file.Name()
+	} else if ok {
+		fill.entry.data = fill.buffer.Bytes()
+	}
+	if ok {
+		fill.cache.add(fill.entry)
+	}
+	return err
+}
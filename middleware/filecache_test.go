@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/gravaltest"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileCacheConformance(t *testing.T) {
+	cache := &FileCache{MaxBytes: 4 << 20}
+	gravaltest.TestDriver(t, Chain(gravaltest.NewMemDriverFactory(), cache.Middleware()), "test", "1234")
+}
+
+func readAll(driver graval.FTPDriver, path string) string {
+	file, err := driver.GetFile(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	data, _ := ioutil.ReadAll(file)
+	return string(data)
+}
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, cacheDir := range []string{"", dir} {
+		inner := gravaltest.NewMemDriverFactory()
+		inner.WriteFile("/one.txt", []byte("hello"))
+		inner.WriteFile("/two.txt", []byte("world"))
+		inner.WriteFile("/three.txt", []byte("three"))
+		inner.WriteFile("/big.txt", []byte("too big to cache"))
+		metrics := NewMetrics()
+		cache := &FileCache{MaxBytes: 10, Dir: cacheDir}
+		driver, _ := Chain(inner, cache.Middleware(), metrics.Middleware()).NewDriver()
+		backendReads := func() int64 {
+			return metrics.Snapshot()["GetFile"].Calls
+		}
+
+		Convey("A file cache in "+map[bool]string{true: "memory", false: "a directory"}[cacheDir == ""], t, func() {
+			Convey("Will serve repeat downloads without the backend", func() {
+				So(readAll(driver, "/one.txt"), ShouldEqual, "hello")
+				So(readAll(driver, "/one.txt"), ShouldEqual, "hello")
+				So(backendReads(), ShouldEqual, 1)
+			})
+
+			Convey("Will notice files changed in the backend", func() {
+				inner.WriteFile("/one.txt", []byte("hello!"))
+				So(readAll(driver, "/one.txt"), ShouldEqual, "hello!")
+				So(backendReads(), ShouldEqual, 2)
+			})
+
+			Convey("Will evict the least recently used file when full", func() {
+				So(readAll(driver, "/two.txt"), ShouldEqual, "world")
+				So(readAll(driver, "/one.txt"), ShouldEqual, "hello!")
+				So(readAll(driver, "/two.txt"), ShouldEqual, "world")
+				So(backendReads(), ShouldEqual, 5)
+			})
+
+			Convey("Will not cache files larger than the cache", func() {
+				So(readAll(driver, "/big.txt"), ShouldEqual, "too big to cache")
+				So(readAll(driver, "/big.txt"), ShouldEqual, "too big to cache")
+				So(backendReads(), ShouldEqual, 7)
+			})
+
+			Convey("Will not cache a partly read file", func() {
+				file, _ := driver.GetFile("/three.txt")
+				file.Read(make([]byte, 2))
+				file.Close()
+				So(readAll(driver, "/three.txt"), ShouldEqual, "three")
+				So(readAll(driver, "/three.txt"), ShouldEqual, "three")
+				So(backendReads(), ShouldEqual, 9)
+			})
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListingCache remembers directory listings for backends where DirContents
+// is expensive, like object stores and databases. Listings are refreshed
+// after TTL, and changes made through any driver sharing the cache clear the
+// listings they affect straight away. Changes made outside the server may
+// take up to TTL to appear.
+type ListingCache struct {
+	// How long a listing is reused for. Mandatory.
+	TTL time.Duration
+
+	// When true, each session gets a cache of its own rather than sharing
+	// this one, so sessions never see each other's changes late.
+	PerSession bool
+
+	mu       sync.Mutex
+	listings map[string]*listingEntry
+}
+
+type listingEntry struct {
+	files   []os.FileInfo
+	expires time.Time
+}
+
+// Middleware returns a Middleware that serves listings from this cache.
+func (cache *ListingCache) Middleware() Middleware {
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		if cache.PerSession {
+			return &listingCacheDriver{Driver: Driver{Next: next}, cache: &ListingCache{TTL: cache.TTL}}
+		}
+		return &listingCacheDriver{Driver: Driver{Next: next}, cache: cache}
+	}
+}
+
+func (cache *ListingCache) get(dir string) ([]os.FileInfo, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry := cache.listings[dir]
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return append([]os.FileInfo{}, entry.files...), true
+}
+
+func (cache *ListingCache) put(dir string, files []os.FileInfo) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.listings == nil {
+		cache.listings = map[string]*listingEntry{}
+	}
+	cache.listings[dir] = &listingEntry{
+		files:   append([]os.FileInfo{}, files...),
+		expires: time.Now().Add(cache.TTL),
+	}
+}
+
+// changed clears the listing of the directory containing p. If p is a
+// directory, its own listing and those of any directories beneath it are
+// cleared too.
+func (cache *ListingCache) changed(p string) {
+	p = path.Clean("/" + p)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.listings, path.Dir(p))
+	for dir := range cache.listings {
+		if dir == p || strings.HasPrefix(dir, strings.TrimSuffix(p, "/")+"/") {
+			delete(cache.listings, dir)
+		}
+	}
+}
+
+type listingCacheDriver struct {
+	Driver
+	cache *ListingCache
+}
+
+func (driver *listingCacheDriver) DirContents(p string) []os.FileInfo {
+	dir := path.Clean("/" + p)
+	if files, ok := driver.cache.get(dir); ok {
+		return files
+	}
+	files := driver.Next.DirContents(p)
+	driver.cache.put(dir, files)
+	return files
+}
+
+func (driver *listingCacheDriver) DeleteDir(p string) bool {
+	defer driver.cache.changed(p)
+	return driver.Next.DeleteDir(p)
+}
+
+func (driver *listingCacheDriver) DeleteFile(p string) bool {
+	defer driver.cache.changed(p)
+	return driver.Next.DeleteFile(p)
+}
+
+func (driver *listingCacheDriver) Rename(fromPath string, toPath string) bool {
+	defer driver.cache.changed(toPath)
+	defer driver.cache.changed(fromPath)
+	return driver.Next.Rename(fromPath, toPath)
+}
+
+func (driver *listingCacheDriver) MakeDir(p string) bool {
+	defer driver.cache.changed(p)
+	return driver.Next.MakeDir(p)
+}
+
+func (driver *listingCacheDriver) PutFile(destPath string, data io.Reader) bool {
+	defer driver.cache.changed(destPath)
+	return driver.Next.PutFile(destPath, data)
+}
+
+func (driver *listingCacheDriver) SetFacts(p string, facts map[string]string) error {
+	defer driver.cache.changed(p)
+	return driver.Driver.SetFacts(p, facts)
+}
+
+func (driver *listingCacheDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	defer driver.cache.changed(destPath)
+	return driver.Driver.PutFileAt(destPath, offset, data)
+}
+
+func (driver *listingCacheDriver) Copy(fromPath string, toPath string) bool {
+	defer driver.cache.changed(toPath)
+	return driver.Driver.Copy(fromPath, toPath)
+}
+
+func (driver *listingCacheDriver) DeleteTree(p string) bool {
+	defer driver.cache.changed(p)
+	return driver.Driver.DeleteTree(p)
+}
+
+func (driver *listingCacheDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	defer driver.cache.changed(destPath)
+	return driver.Driver.StoreExisting(destPath, algorithm, hash)
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval/gravaltest"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListingCacheConformance(t *testing.T) {
+	cache := &ListingCache{TTL: time.Minute}
+	gravaltest.TestDriver(t, Chain(gravaltest.NewMemDriverFactory(), cache.Middleware()), "test", "1234")
+}
+
+func TestListingCache(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.WriteFile("/dir/one.txt", []byte("hello"))
+	shared := &ListingCache{TTL: time.Minute}
+	factory := Chain(inner, shared.Middleware())
+	first, _ := factory.NewDriver()
+	second, _ := factory.NewDriver()
+	first.DirContents("/dir")
+
+	Convey("A shared listing cache", t, func() {
+		Convey("Will reuse listings despite changes made elsewhere", func() {
+			inner.WriteFile("/dir/two.txt", []byte("world"))
+			So(len(second.DirContents("/dir")), ShouldEqual, 1)
+		})
+
+		Convey("Will clear listings changed through any session", func() {
+			So(first.PutFile("/dir/three.txt", strings.NewReader("!")), ShouldBeTrue)
+			So(len(second.DirContents("/dir")), ShouldEqual, 3)
+		})
+
+		Convey("Will clear listings beneath a renamed directory", func() {
+			second.DirContents("/dir")
+			So(first.Rename("/dir", "/moved"), ShouldBeTrue)
+			So(len(second.DirContents("/dir")), ShouldEqual, 0)
+			So(len(second.DirContents("/")), ShouldEqual, 1)
+		})
+	})
+
+	Convey("A per-session listing cache", t, func() {
+		inner := gravaltest.NewMemDriverFactory()
+		inner.WriteFile("/one.txt", []byte("hello"))
+		factory := Chain(inner, (&ListingCache{TTL: time.Minute, PerSession: true}).Middleware())
+		first, _ := factory.NewDriver()
+		second, _ := factory.NewDriver()
+		first.DirContents("/")
+		second.DirContents("/")
+
+		Convey("Will not see changes made by other sessions until it expires", func() {
+			So(first.PutFile("/two.txt", strings.NewReader("!")), ShouldBeTrue)
+			So(len(first.DirContents("/")), ShouldEqual, 2)
+			So(len(second.DirContents("/")), ShouldEqual, 1)
+		})
+	})
+
+	Convey("An expired listing", t, func() {
+		inner := gravaltest.NewMemDriverFactory()
+		driver, _ := Chain(inner, (&ListingCache{TTL: time.Millisecond}).Middleware()).NewDriver()
+		driver.DirContents("/")
+		inner.WriteFile("/one.txt", []byte("hello"))
+		time.Sleep(5 * time.Millisecond)
+
+		Convey("Will be fetched again", func() {
+			So(len(driver.DirContents("/")), ShouldEqual, 1)
+		})
+	})
+}
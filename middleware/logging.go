@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Logging logs every call to the driver along with its result and how long
+// it took. Passwords are not logged.
+func Logging(logger *log.Logger) Middleware {
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &loggingDriver{Driver: Driver{Next: next}, logger: logger}
+	}
+}
+
+type loggingDriver struct {
+	Driver
+	logger *log.Logger
+}
+
+func (driver *loggingDriver) log(started time.Time, format string, args ...interface{}) {
+	args = append(args, time.Since(started))
+	driver.logger.Printf(format+" (%s)", args...)
+}
+
+func (driver *loggingDriver) Authenticate(user string, pass string) bool {
+	started := time.Now()
+	ok := driver.Next.Authenticate(user, pass)
+	driver.log(started, "Authenticate(%q) = %t", user, ok)
+	return ok
+}
+
+func (driver *loggingDriver) Bytes(path string) int64 {
+	started := time.Now()
+	size := driver.Next.Bytes(path)
+	driver.log(started, "Bytes(%q) = %d", path, size)
+	return size
+}
+
+func (driver *loggingDriver) ModifiedTime(path string) (time.Time, error) {
+	started := time.Now()
+	modTime, err := driver.Next.ModifiedTime(path)
+	driver.log(started, "ModifiedTime(%q) = %s, %v", path, modTime, err)
+	return modTime, err
+}
+
+func (driver *loggingDriver) ChangeDir(path string) bool {
+	started := time.Now()
+	ok := driver.Next.ChangeDir(path)
+	driver.log(started, "ChangeDir(%q) = %t", path, ok)
+	return ok
+}
+
+func (driver *loggingDriver) DirContents(path string) []os.FileInfo {
+	started := time.Now()
+	files := driver.Next.DirContents(path)
+	driver.log(started, "DirContents(%q) = %d entries", path, len(files))
+	return files
+}
+
+func (driver *loggingDriver) DeleteDir(path string) bool {
+	started := time.Now()
+	ok := driver.Next.DeleteDir(path)
+	driver.log(started, "DeleteDir(%q) = %t", path, ok)
+	return ok
+}
+
+func (driver *loggingDriver) DeleteFile(path string) bool {
+	started := time.Now()
+	ok := driver.Next.DeleteFile(path)
+	driver.log(started, "DeleteFile(%q) = %t", path, ok)
+	return ok
+}
+
+func (driver *loggingDriver) Rename(fromPath string, toPath string) bool {
+	started := time.Now()
+	ok := driver.Next.Rename(fromPath, toPath)
+	driver.log(started, "Rename(%q, %q) = %t", fromPath, toPath, ok)
+	return ok
+}
+
+func (driver *loggingDriver) MakeDir(path string) bool {
+	started := time.Now()
+	ok := driver.Next.MakeDir(path)
+	driver.log(started, "MakeDir(%q) = %t", path, ok)
+	return ok
+}
+
+func (driver *loggingDriver) GetFile(path string) (io.ReadCloser, error) {
+	started := time.Now()
+	file, err := driver.Next.GetFile(path)
+	driver.log(started, "GetFile(%q) = %v", path, err)
+	return file, err
+}
+
+func (driver *loggingDriver) PutFile(destPath string, data io.Reader) bool {
+	started := time.Now()
+	ok := driver.Next.PutFile(destPath, data)
+	driver.log(started, "PutFile(%q) = %t", destPath, ok)
+	return ok
+}
+
+func (driver *loggingDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	started := time.Now()
+	ok := driver.Driver.PutFileAt(destPath, offset, data)
+	driver.log(started, "PutFileAt(%q, %d) = %t", destPath, offset, ok)
+	return ok
+}
+
+func (driver *loggingDriver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	started := time.Now()
+	file, err := driver.Driver.ReadRange(path, offset, length)
+	driver.log(started, "ReadRange(%q, %d, %d) = %v", path, offset, length, err)
+	return file, err
+}
+
+func (driver *loggingDriver) GetFileSegment(path string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	started := time.Now()
+	file, err := driver.Driver.GetFileSegment(path, offset, length, group)
+	driver.log(started, "GetFileSegment(%q, %d, %d) = %v", path, offset, length, err)
+	return file, err
+}
+
+func (driver *loggingDriver) Copy(fromPath string, toPath string) bool {
+	started := time.Now()
+	ok := driver.Driver.Copy(fromPath, toPath)
+	driver.log(started, "Copy(%q, %q) = %t", fromPath, toPath, ok)
+	return ok
+}
+
+func (driver *loggingDriver) DeleteTree(path string) bool {
+	started := time.Now()
+	ok := driver.Driver.DeleteTree(path)
+	driver.log(started, "DeleteTree(%q) = %t", path, ok)
+	return ok
+}
+
+func (driver *loggingDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	started := time.Now()
+	ok := driver.Driver.StoreExisting(destPath, algorithm, hash)
+	driver.log(started, "StoreExisting(%q, %s, %s) = %t", destPath, algorithm, hash, ok)
+	return ok
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// MethodStats counts the calls made to a single driver method.
+type MethodStats struct {
+	Calls    int64         `json:"calls"`
+	Failures int64         `json:"failures"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Metrics counts calls to driver methods, across every driver it wraps. A
+// call fails if it returns false, an error, or a negative size.
+type Metrics struct {
+	mu      sync.Mutex
+	methods map[string]*MethodStats
+}
+
+// NewMetrics returns an empty set of counters.
+func NewMetrics() *Metrics {
+	metrics := new(Metrics)
+	metrics.methods = map[string]*MethodStats{}
+	return metrics
+}
+
+// Middleware returns a Middleware that records calls in these counters.
+func (metrics *Metrics) Middleware() Middleware {
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &metricsDriver{Driver: Driver{Next: next}, metrics: metrics}
+	}
+}
+
+// Snapshot returns a copy of the counters, keyed by method name.
+func (metrics *Metrics) Snapshot() map[string]MethodStats {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	snapshot := make(map[string]MethodStats, len(metrics.methods))
+	for name, stats := range metrics.methods {
+		snapshot[name] = *stats
+	}
+	return snapshot
+}
+
+func (metrics *Metrics) record(method string, started time.Time, ok bool) {
+	elapsed := time.Since(started)
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	stats := metrics.methods[method]
+	if stats == nil {
+		stats = new(MethodStats)
+		metrics.methods[method] = stats
+	}
+	stats.Calls++
+	if !ok {
+		stats.Failures++
+	}
+	stats.Duration += elapsed
+}
+
+type metricsDriver struct {
+	Driver
+	metrics *Metrics
+}
+
+func (driver *metricsDriver) Authenticate(user string, pass string) bool {
+	started := time.Now()
+	ok := driver.Next.Authenticate(user, pass)
+	driver.metrics.record("Authenticate", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) Bytes(path string) int64 {
+	started := time.Now()
+	size := driver.Next.Bytes(path)
+	driver.metrics.record("Bytes", started, size >= 0)
+	return size
+}
+
+func (driver *metricsDriver) ModifiedTime(path string) (time.Time, error) {
+	started := time.Now()
+	modTime, err := driver.Next.ModifiedTime(path)
+	driver.metrics.record("ModifiedTime", started, err == nil)
+	return modTime, err
+}
+
+func (driver *metricsDriver) ChangeDir(path string) bool {
+	started := time.Now()
+	ok := driver.Next.ChangeDir(path)
+	driver.metrics.record("ChangeDir", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) DirContents(path string) []os.FileInfo {
+	started := time.Now()
+	files := driver.Next.DirContents(path)
+	driver.metrics.record("DirContents", started, true)
+	return files
+}
+
+func (driver *metricsDriver) DeleteDir(path string) bool {
+	started := time.Now()
+	ok := driver.Next.DeleteDir(path)
+	driver.metrics.record("DeleteDir", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) DeleteFile(path string) bool {
+	started := time.Now()
+	ok := driver.Next.DeleteFile(path)
+	driver.metrics.record("DeleteFile", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) Rename(fromPath string, toPath string) bool {
+	started := time.Now()
+	ok := driver.Next.Rename(fromPath, toPath)
+	driver.metrics.record("Rename", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) MakeDir(path string) bool {
+	started := time.Now()
+	ok := driver.Next.MakeDir(path)
+	driver.metrics.record("MakeDir", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) GetFile(path string) (io.ReadCloser, error) {
+	started := time.Now()
+	file, err := driver.Next.GetFile(path)
+	driver.metrics.record("GetFile", started, err == nil)
+	return file, err
+}
+
+func (driver *metricsDriver) PutFile(destPath string, data io.Reader) bool {
+	started := time.Now()
+	ok := driver.Next.PutFile(destPath, data)
+	driver.metrics.record("PutFile", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	started := time.Now()
+	ok := driver.Driver.PutFileAt(destPath, offset, data)
+	driver.metrics.record("PutFileAt", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	started := time.Now()
+	file, err := driver.Driver.ReadRange(path, offset, length)
+	driver.metrics.record("ReadRange", started, err == nil)
+	return file, err
+}
+
+func (driver *metricsDriver) GetFileSegment(path string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	started := time.Now()
+	file, err := driver.Driver.GetFileSegment(path, offset, length, group)
+	driver.metrics.record("GetFileSegment", started, err == nil)
+	return file, err
+}
+
+func (driver *metricsDriver) Copy(fromPath string, toPath string) bool {
+	started := time.Now()
+	ok := driver.Driver.Copy(fromPath, toPath)
+	driver.metrics.record("Copy", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) DeleteTree(path string) bool {
+	started := time.Now()
+	ok := driver.Driver.DeleteTree(path)
+	driver.metrics.record("DeleteTree", started, ok)
+	return ok
+}
+
+func (driver *metricsDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	started := time.Now()
+	ok := driver.Driver.StoreExisting(destPath, algorithm, hash)
+	// not having the content isn't a failure
+	driver.metrics.record("StoreExisting", started, true)
+	return ok
+}
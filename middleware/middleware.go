@@ -0,0 +1,314 @@
+// Package middleware composes graval drivers, so behaviour that cuts across
+// every backend - logging, metrics, caching, path mapping, fault injection -
+// can be written once and layered over any driver.
+//
+// A Middleware wraps one driver in another. Chain applies a list of them to
+// every driver created by a factory:
+//
+//	metrics := middleware.NewMetrics()
+//	factory := middleware.Chain(&osdriver.DriverFactory{Root: "/srv/ftp"},
+//		middleware.Logging(log.New(os.Stderr, "driver ", log.LstdFlags)),
+//		metrics.Middleware(),
+//		middleware.StatCache(time.Second),
+//	)
+//
+// New middleware can embed Driver to pass through every call it doesn't need
+// to change.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"github.com/royallthefourth/graval"
+	"io"
+	"os"
+	"time"
+)
+
+// Middleware wraps a driver with extra behaviour.
+type Middleware func(next graval.FTPDriver) graval.FTPDriver
+
+// Chain returns a factory that creates drivers with factory and wraps each
+// one in the given middleware. The first middleware is outermost, so it sees
+// each call first. It passes graval.FTPPingDriver through to factory when
+// factory implements it.
+func Chain(factory graval.FTPDriverFactory, middleware ...Middleware) graval.FTPDriverFactory {
+	return &chainFactory{factory: factory, middleware: middleware}
+}
+
+type chainFactory struct {
+	factory    graval.FTPDriverFactory
+	middleware []Middleware
+}
+
+func (chain *chainFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, err := chain.factory.NewDriver()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(chain.middleware) - 1; i >= 0; i-- {
+		driver = chain.middleware[i](driver)
+	}
+	return driver, nil
+}
+
+func (chain *chainFactory) Ping(ctx context.Context) error {
+	if pinger, ok := chain.factory.(graval.FTPPingDriver); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Supports tells graval whether the wrapped factory can be pinged, so a
+// driver is pinged instead if it can't.
+func (chain *chainFactory) Supports(target interface{}) bool {
+	if _, ok := target.(*graval.FTPPingDriver); !ok {
+		return false
+	}
+	pinger, ok := chain.factory.(graval.FTPPingDriver)
+	if support, isSupport := chain.factory.(graval.FTPSupportDriver); ok && isSupport {
+		return support.Supports(&pinger)
+	}
+	return ok
+}
+
+// Driver passes every call through to Next unchanged, including the methods
+// of these optional interfaces when Next implements them:
+// graval.FTPTracedDriver, graval.FTPResumableDriver, graval.FTPRangeDriver,
+// graval.FTPSegmentDriver, graval.FTPSpaceDriver, graval.FTPFactsDriver,
+// graval.FTPCopyDriver, graval.FTPTreeDeleteDriver, graval.FTPDedupDriver,
+// graval.FTPTempUploadDriver, graval.FTPPartialUploadDriver,
+// graval.FTPBlindDropDriver, graval.FTPLoginMessageDriver,
+// graval.FTPErrorDriver, graval.FTPSessionDriver, graval.FTPValuesDriver,
+// graval.FTPLifecycleDriver, graval.FTPPasswordDriver,
+// graval.FTPAccountDriver, graval.FTPAliasDriver, graval.FTPCreateModeDriver
+// and graval.FTPPingDriver. Embed it in a middleware driver and override
+// only the methods that need new behaviour. A middleware that changes paths
+// or file data must override PutFileAt, ReadRange, GetFileSegment, Copy,
+// DeleteTree, StoreExisting, TempUploadPath and PartialUploads as well as
+// PutFile and GetFile, or refuse them with Supports, since they'd otherwise
+// skip it.
+//
+// Since it has the methods of those optional interfaces whatever Next is, it
+// implements graval.FTPSupportDriver to tell graval which of them Next really
+// serves, so features like AVBL and SITE PSWD are only offered when they
+// work. A middleware that serves an optional interface itself, whatever Next
+// is, should override Supports too.
+//
+// It doesn't pass through DirContentsIter, since listings would then skip any
+// middleware that changes DirContents, so drivers wrapped in middleware are
+// always listed with DirContents.
+type Driver struct {
+	Next graval.FTPDriver
+}
+
+func (driver *Driver) Authenticate(user string, pass string) bool {
+	return driver.Next.Authenticate(user, pass)
+}
+
+func (driver *Driver) Bytes(path string) int64 {
+	return driver.Next.Bytes(path)
+}
+
+func (driver *Driver) ModifiedTime(path string) (time.Time, error) {
+	return driver.Next.ModifiedTime(path)
+}
+
+func (driver *Driver) ChangeDir(path string) bool {
+	return driver.Next.ChangeDir(path)
+}
+
+func (driver *Driver) DirContents(path string) []os.FileInfo {
+	return driver.Next.DirContents(path)
+}
+
+func (driver *Driver) DeleteDir(path string) bool {
+	return driver.Next.DeleteDir(path)
+}
+
+func (driver *Driver) DeleteFile(path string) bool {
+	return driver.Next.DeleteFile(path)
+}
+
+func (driver *Driver) Rename(fromPath string, toPath string) bool {
+	return driver.Next.Rename(fromPath, toPath)
+}
+
+func (driver *Driver) MakeDir(path string) bool {
+	return driver.Next.MakeDir(path)
+}
+
+func (driver *Driver) GetFile(path string) (io.ReadCloser, error) {
+	return driver.Next.GetFile(path)
+}
+
+func (driver *Driver) PutFile(destPath string, data io.Reader) bool {
+	return driver.Next.PutFile(destPath, data)
+}
+
+func (driver *Driver) Supports(target interface{}) bool {
+	return graval.DriverAs(driver.Next, target)
+}
+
+func (driver *Driver) SetTraceContext(ctx context.Context) {
+	if traced, ok := driver.Next.(graval.FTPTracedDriver); ok {
+		traced.SetTraceContext(ctx)
+	}
+}
+
+func (driver *Driver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	if resumableDriver, ok := driver.Next.(graval.FTPResumableDriver); ok {
+		return resumableDriver.PutFileAt(destPath, offset, data)
+	}
+	return false
+}
+
+func (driver *Driver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	if rangeDriver, ok := driver.Next.(graval.FTPRangeDriver); ok {
+		return rangeDriver.ReadRange(path, offset, length)
+	}
+	return nil, errors.New("middleware: ranges can't be read")
+}
+
+func (driver *Driver) GetFileSegment(path string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	if segmentDriver, ok := driver.Next.(graval.FTPSegmentDriver); ok {
+		return segmentDriver.GetFileSegment(path, offset, length, group)
+	}
+	return nil, errors.New("middleware: segments can't be read")
+}
+
+func (driver *Driver) Copy(fromPath string, toPath string) bool {
+	if copyDriver, ok := driver.Next.(graval.FTPCopyDriver); ok {
+		return copyDriver.Copy(fromPath, toPath)
+	}
+	return false
+}
+
+func (driver *Driver) DeleteTree(path string) bool {
+	if deleteDriver, ok := driver.Next.(graval.FTPTreeDeleteDriver); ok {
+		return deleteDriver.DeleteTree(path)
+	}
+	return false
+}
+
+func (driver *Driver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	if dedupDriver, ok := driver.Next.(graval.FTPDedupDriver); ok {
+		return dedupDriver.StoreExisting(destPath, algorithm, hash)
+	}
+	return false
+}
+
+func (driver *Driver) TempUploadPath(path string) string {
+	if tempDriver, ok := driver.Next.(graval.FTPTempUploadDriver); ok {
+		return tempDriver.TempUploadPath(path)
+	}
+	return ""
+}
+
+func (driver *Driver) PartialUploads() []graval.PartialUpload {
+	if partialDriver, ok := driver.Next.(graval.FTPPartialUploadDriver); ok {
+		return partialDriver.PartialUploads()
+	}
+	return nil
+}
+
+func (driver *Driver) IsBlindDrop(path string) bool {
+	if blindDriver, ok := driver.Next.(graval.FTPBlindDropDriver); ok {
+		return blindDriver.IsBlindDrop(path)
+	}
+	return false
+}
+
+func (driver *Driver) AvailableSpace(path string) (int64, error) {
+	if spaceDriver, ok := driver.Next.(graval.FTPSpaceDriver); ok {
+		return spaceDriver.AvailableSpace(path)
+	}
+	return 0, errors.New("middleware: available space unknown")
+}
+
+func (driver *Driver) SettableFacts() []string {
+	if factsDriver, ok := driver.Next.(graval.FTPFactsDriver); ok {
+		return factsDriver.SettableFacts()
+	}
+	return nil
+}
+
+func (driver *Driver) SetFacts(path string, facts map[string]string) error {
+	if factsDriver, ok := driver.Next.(graval.FTPFactsDriver); ok {
+		return factsDriver.SetFacts(path, facts)
+	}
+	return errors.New("middleware: facts can't be changed")
+}
+
+func (driver *Driver) LoginMessage(user string) []string {
+	if messageDriver, ok := driver.Next.(graval.FTPLoginMessageDriver); ok {
+		return messageDriver.LoginMessage(user)
+	}
+	return nil
+}
+
+func (driver *Driver) SetSession(sessionId string, remoteIP string) {
+	if sessionDriver, ok := driver.Next.(graval.FTPSessionDriver); ok {
+		sessionDriver.SetSession(sessionId, remoteIP)
+	}
+}
+
+func (driver *Driver) SetSessionValues(values *graval.SessionValues) {
+	if valuesDriver, ok := driver.Next.(graval.FTPValuesDriver); ok {
+		valuesDriver.SetSessionValues(values)
+	}
+}
+
+func (driver *Driver) SessionStart(ctx context.Context) error {
+	if lifecycleDriver, ok := driver.Next.(graval.FTPLifecycleDriver); ok {
+		return lifecycleDriver.SessionStart(ctx)
+	}
+	return nil
+}
+
+func (driver *Driver) SessionEnd(ctx context.Context) {
+	if lifecycleDriver, ok := driver.Next.(graval.FTPLifecycleDriver); ok {
+		lifecycleDriver.SessionEnd(ctx)
+	}
+}
+
+func (driver *Driver) ChangePassword(user string, oldPassword string, newPassword string) error {
+	if passwordDriver, ok := driver.Next.(graval.FTPPasswordDriver); ok {
+		return passwordDriver.ChangePassword(user, oldPassword, newPassword)
+	}
+	return errors.New("middleware: passwords can't be changed")
+}
+
+func (driver *Driver) Account(user string) (*graval.Account, error) {
+	if accountDriver, ok := driver.Next.(graval.FTPAccountDriver); ok {
+		return accountDriver.Account(user)
+	}
+	return nil, nil
+}
+
+func (driver *Driver) AccountName(user string) string {
+	if aliasDriver, ok := driver.Next.(graval.FTPAliasDriver); ok {
+		return aliasDriver.AccountName(user)
+	}
+	return ""
+}
+
+func (driver *Driver) SetCreateModes(fileMode os.FileMode, dirMode os.FileMode) {
+	if modeDriver, ok := driver.Next.(graval.FTPCreateModeDriver); ok {
+		modeDriver.SetCreateModes(fileMode, dirMode)
+	}
+}
+
+func (driver *Driver) Ping(ctx context.Context) error {
+	if pingDriver, ok := driver.Next.(graval.FTPPingDriver); ok {
+		return pingDriver.Ping(ctx)
+	}
+	return nil
+}
+
+func (driver *Driver) LastError() error {
+	if errorDriver, ok := driver.Next.(graval.FTPErrorDriver); ok {
+		return errorDriver.LastError()
+	}
+	return nil
+}
@@ -0,0 +1,712 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/royallthefourth/graval"
+	"github.com/royallthefourth/graval/gravaltest"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChainConformance(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.MakeDir("/jail")
+	var logged bytes.Buffer
+	factory := Chain(inner,
+		Logging(log.New(&logged, "", 0)),
+		NewMetrics().Middleware(),
+		StatCache(time.Minute),
+		PathPrefix("/jail"),
+	)
+	gravaltest.TestDriver(t, factory, "test", "1234")
+}
+
+// orderMiddleware records the order in which middleware sees calls.
+func orderMiddleware(name string, calls *[]string) Middleware {
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &orderDriver{Driver: Driver{Next: next}, name: name, calls: calls}
+	}
+}
+
+type orderDriver struct {
+	Driver
+	name  string
+	calls *[]string
+}
+
+func (driver *orderDriver) ChangeDir(path string) bool {
+	*driver.calls = append(*driver.calls, driver.name)
+	return driver.Next.ChangeDir(path)
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	factory := Chain(gravaltest.NewMemDriverFactory(), orderMiddleware("outer", &calls), orderMiddleware("inner", &calls))
+	driver, _ := factory.NewDriver()
+
+	Convey("A chain of middleware", t, func() {
+		Convey("Will call the first middleware first", func() {
+			So(driver.ChangeDir("/"), ShouldBeTrue)
+			So(calls, ShouldResemble, []string{"outer", "inner"})
+		})
+	})
+}
+
+// plainDriverFactory creates drivers with only the methods of
+// graval.FTPDriver, and none of the optional interfaces.
+type plainDriverFactory struct {
+	*gravaltest.MemDriverFactory
+}
+
+func (factory plainDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return struct{ graval.FTPDriver }{driver}, nil
+}
+
+func TestDriverSupports(t *testing.T) {
+	memDriver, _ := Chain(gravaltest.NewMemDriverFactory(), StatCache(time.Minute)).NewDriver()
+	plainMem := gravaltest.NewMemDriverFactory()
+	plainMem.WriteFile("/hello.txt", []byte("hello world"))
+	plainFactory := Chain(plainDriverFactory{plainMem}, StatCache(time.Minute))
+	plainDriver, _ := plainFactory.NewDriver()
+	var spaceDriver graval.FTPSpaceDriver
+	memSpace := graval.DriverAs(memDriver, &spaceDriver)
+
+	server := gravaltest.NewServer(&graval.FTPServerOpts{Factory: plainFactory})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	feat, _ := client.Cmd("FEAT")
+	avbl, _ := client.Cmd("AVBL /")
+	pswd, _ := client.Cmd("SITE PSWD 1234 5678")
+	resumed, resumedErr := client.RetrieveFrom("/hello.txt", 6)
+	appendErr := client.StoreAt("/hello.txt", 5, []byte("!"))
+	kept, _ := plainMem.ReadFile("/hello.txt")
+
+	Convey("A driver wrapped in middleware", t, func() {
+		Convey("Will serve the optional interfaces the wrapped driver implements", func() {
+			So(memSpace, ShouldBeTrue)
+			So(spaceDriver, ShouldEqual, memDriver)
+		})
+
+		Convey("Will not serve the optional interfaces the wrapped driver lacks", func() {
+			So(graval.DriverAs(plainDriver, new(graval.FTPSpaceDriver)), ShouldBeFalse)
+			So(graval.DriverAs(plainDriver, new(graval.FTPPasswordDriver)), ShouldBeFalse)
+			So(graval.DriverAs(plainDriver, new(graval.FTPFactsDriver)), ShouldBeFalse)
+			So(graval.DriverAs(plainDriver, new(graval.FTPLoginMessageDriver)), ShouldBeFalse)
+			So(graval.DriverAs(plainDriver, new(graval.FTPTempUploadDriver)), ShouldBeFalse)
+			So(graval.DriverAs(plainDriver, new(graval.FTPPartialUploadDriver)), ShouldBeFalse)
+		})
+
+		Convey("Will not offer commands the wrapped driver can't serve", func() {
+			So(feat.Message, ShouldNotContainSubstring, "AVBL")
+			So(avbl.Code, ShouldEqual, 502)
+			So(pswd.Code, ShouldEqual, 502)
+		})
+
+		Convey("Will resume downloads, but refuse to resume uploads the wrapped driver can't", func() {
+			So(feat.Message, ShouldNotContainSubstring, "REST STREAM")
+			So(resumedErr, ShouldBeNil)
+			So(string(resumed), ShouldEqual, "world")
+			So(appendErr, ShouldNotBeNil)
+			So(appendErr.Error(), ShouldContainSubstring, "554")
+			So(string(kept), ShouldEqual, "hello world")
+		})
+	})
+}
+
+// stagingDriverFactory creates drivers that write uploads to /staging until
+// they're committed.
+type stagingDriverFactory struct {
+	*gravaltest.MemDriverFactory
+}
+
+func (factory stagingDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return stagingDriver{driver}, nil
+}
+
+type stagingDriver struct {
+	graval.FTPDriver
+}
+
+func (driver stagingDriver) TempUploadPath(p string) string {
+	return "/staging/" + path.Base(p)
+}
+
+func (driver stagingDriver) PartialUploads() []graval.PartialUpload {
+	var uploads []graval.PartialUpload
+	for _, file := range driver.DirContents("/staging") {
+		uploads = append(uploads, graval.PartialUpload{Path: "/staging/" + file.Name(), ModTime: file.ModTime()})
+	}
+	return uploads
+}
+
+func TestUploadDrivers(t *testing.T) {
+	staging := stagingDriverFactory{gravaltest.NewMemDriverFactory()}
+	staging.MakeDir("/staging")
+	staging.WriteFile("/staging/abandoned.txt", []byte("partial"))
+	stagingDriver, _ := Chain(staging, StatCache(time.Minute)).NewDriver()
+	prefixed, _ := Chain(staging, PathPrefix("/jail")).NewDriver()
+	var tempDriver graval.FTPTempUploadDriver
+	var partialDriver graval.FTPPartialUploadDriver
+	stagingTemp := graval.DriverAs(stagingDriver, &tempDriver)
+	stagingPartial := graval.DriverAs(stagingDriver, &partialDriver)
+
+	plain := plainDriverFactory{gravaltest.NewMemDriverFactory()}
+	server := gravaltest.NewServer(&graval.FTPServerOpts{
+		Factory:       Chain(plain, StatCache(time.Minute)),
+		AtomicUploads: true,
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	storeErr := client.Store("/file.txt", []byte("data"))
+	stored, _ := plain.ReadFile("/file.txt")
+
+	Convey("A driver wrapped in middleware", t, func() {
+		Convey("Will pass temporary upload paths and partial uploads through", func() {
+			So(stagingTemp, ShouldBeTrue)
+			So(tempDriver.TempUploadPath("/dir/file.txt"), ShouldEqual, "/staging/file.txt")
+			So(stagingPartial, ShouldBeTrue)
+			So(partialDriver.PartialUploads(), ShouldHaveLength, 1)
+		})
+
+		Convey("Will not pass them through a path prefix", func() {
+			So(graval.DriverAs(prefixed, new(graval.FTPTempUploadDriver)), ShouldBeFalse)
+			So(graval.DriverAs(prefixed, new(graval.FTPPartialUploadDriver)), ShouldBeFalse)
+		})
+
+		Convey("Will stage uploads beside their final names when the wrapped driver can't choose", func() {
+			So(storeErr, ShouldBeNil)
+			So(string(stored), ShouldEqual, "data")
+		})
+	})
+}
+
+func TestOptionalDrivers(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.WriteFile("/jail/partial.txt", []byte("hello"))
+	metrics := NewMetrics()
+	server := gravaltest.NewServer(&graval.FTPServerOpts{
+		Factory: Chain(inner, metrics.Middleware(), StatCache(time.Minute), PathPrefix("/jail")),
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	feat, _ := client.Cmd("FEAT")
+	resumeErr := client.StoreAt("/partial.txt", 5, []byte(" world"))
+	resumed, _ := inner.ReadFile("/jail/partial.txt")
+	_, escaped := inner.ReadFile("/partial.txt")
+	snapshot := metrics.Snapshot()
+
+	Convey("A driver wrapped in middleware", t, func() {
+		Convey("Will offer resumed uploads when the wrapped driver can resume", func() {
+			So(feat.Message, ShouldContainSubstring, "REST STREAM")
+			So(resumeErr, ShouldBeNil)
+			So(string(resumed), ShouldEqual, "hello world")
+		})
+
+		Convey("Will pass resumed uploads through each middleware", func() {
+			So(escaped, ShouldBeFalse)
+			So(snapshot["PutFileAt"].Calls, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestPathPrefix(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.WriteFile("/secret.txt", []byte("secret"))
+	inner.WriteFile("/jail/public.txt", []byte("public"))
+	driver, _ := Chain(inner, PathPrefix("jail")).NewDriver()
+
+	Convey("A driver with a path prefix", t, func() {
+		Convey("Will serve files inside the prefix", func() {
+			So(driver.Bytes("/public.txt"), ShouldEqual, 6)
+		})
+
+		Convey("Will not reach outside the prefix", func() {
+			So(driver.Bytes("/secret.txt"), ShouldEqual, -1)
+			So(driver.Bytes("/../secret.txt"), ShouldEqual, -1)
+		})
+
+		Convey("Will refuse to delete the root", func() {
+			So(driver.DeleteDir("/"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.WriteFile("/one.txt", []byte("hello"))
+	metrics := NewMetrics()
+	driver, _ := Chain(inner, metrics.Middleware()).NewDriver()
+	driver.Bytes("/one.txt")
+	driver.Bytes("/missing.txt")
+	driver.Authenticate("test", "wrong")
+	snapshot := metrics.Snapshot()
+
+	Convey("Driver metrics", t, func() {
+		Convey("Will count calls and failures", func() {
+			So(snapshot["Bytes"].Calls, ShouldEqual, 2)
+			So(snapshot["Bytes"].Failures, ShouldEqual, 1)
+			So(snapshot["Authenticate"].Failures, ShouldEqual, 1)
+		})
+
+		Convey("Will not include methods that weren't called", func() {
+			_, ok := snapshot["PutFile"]
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestStatCache(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.WriteFile("/one.txt", []byte("hello"))
+	driver, _ := Chain(inner, StatCache(time.Minute)).NewDriver()
+
+	Convey("A stat cache", t, func() {
+		So(driver.Bytes("/one.txt"), ShouldEqual, 5)
+
+		Convey("Will return cached sizes for changes made elsewhere", func() {
+			inner.WriteFile("/one.txt", []byte("hello world"))
+			So(driver.Bytes("/one.txt"), ShouldEqual, 5)
+		})
+
+		Convey("Will forget paths changed through the same driver", func() {
+			So(driver.PutFile("/one.txt", strings.NewReader("hello world")), ShouldBeTrue)
+			So(driver.Bytes("/one.txt"), ShouldEqual, 11)
+			So(driver.DeleteFile("/one.txt"), ShouldBeTrue)
+			So(driver.Bytes("/one.txt"), ShouldEqual, -1)
+		})
+	})
+}
+
+func TestLogging(t *testing.T) {
+	var logged bytes.Buffer
+	driver, _ := Chain(gravaltest.NewMemDriverFactory(), Logging(log.New(&logged, "", 0))).NewDriver()
+	driver.Authenticate("test", "1234")
+	driver.MakeDir("/new")
+
+	Convey("A logging driver", t, func() {
+		Convey("Will log each call and its result", func() {
+			So(logged.String(), ShouldContainSubstring, `MakeDir("/new") = true`)
+		})
+
+		Convey("Will not log passwords", func() {
+			So(logged.String(), ShouldContainSubstring, `Authenticate("test") = true`)
+			So(logged.String(), ShouldNotContainSubstring, "1234")
+		})
+	})
+}
+
+func TestChaos(t *testing.T) {
+	inner := gravaltest.NewMemDriverFactory()
+	inner.WriteFile("/data.bin", bytes.Repeat([]byte("x"), 1000))
+	seed := func() *rand.Rand { return rand.New(rand.NewSource(1)) }
+
+	failing, _ := Chain(inner, Chaos(&ChaosConfig{FailureRate: 1, Rand: seed()})).NewDriver()
+	made := failing.MakeDir("/new")
+	madeErr := failing.(graval.FTPErrorDriver).LastError()
+	_, getErr := failing.GetFile("/data.bin")
+
+	resetting, _ := Chain(inner, Chaos(&ChaosConfig{ResetRate: 1, Rand: seed()})).NewDriver()
+	reader, _ := resetting.GetFile("/data.bin")
+	partial, resetErr := ioutil.ReadAll(reader)
+	reader.Close()
+
+	slow, _ := Chain(inner, Chaos(&ChaosConfig{Delay: 20 * time.Millisecond, DripRate: 2000, Rand: seed()})).NewDriver()
+	started := time.Now()
+	slow.Bytes("/data.bin")
+	delayed := time.Since(started)
+	reader, _ = slow.GetFile("/data.bin")
+	started = time.Now()
+	dripped, _ := ioutil.ReadAll(reader)
+	dripTime := time.Since(started)
+	reader.Close()
+
+	server := gravaltest.NewServer(&graval.FTPServerOpts{
+		Factory: Chain(inner, Chaos(&ChaosConfig{FailureRate: 1, Rand: seed()})),
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	mkd, _ := client.Cmd("MKD /new")
+	plain, _ := inner.NewDriver()
+
+	Convey("A chaotic driver", t, func() {
+		Convey("Will fail calls as temporarily unavailable", func() {
+			So(made, ShouldBeFalse)
+			So(madeErr, ShouldEqual, graval.ErrUnavailable)
+			So(getErr, ShouldEqual, graval.ErrUnavailable)
+			So(plain.ChangeDir("/new"), ShouldBeFalse)
+		})
+
+		Convey("Will cut transfers off part way through", func() {
+			So(resetErr, ShouldNotBeNil)
+			So(len(partial), ShouldBeLessThan, 1000)
+		})
+
+		Convey("Will slow calls and data down", func() {
+			So(delayed, ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+			So(len(dripped), ShouldEqual, 1000)
+			So(dripTime, ShouldBeGreaterThanOrEqualTo, 400*time.Millisecond)
+		})
+
+		Convey("Will give clients a 450 reply for failures", func() {
+			So(mkd.Code, ShouldEqual, 450)
+		})
+	})
+}
+
+type tenantKey struct{}
+
+// tenantDriver stashes a tenant for the user once they've logged in.
+type tenantDriver struct {
+	Driver
+	values *graval.SessionValues
+}
+
+func (driver *tenantDriver) SetSessionValues(values *graval.SessionValues) {
+	driver.values = values
+	driver.Driver.SetSessionValues(values)
+}
+
+func (driver *tenantDriver) Authenticate(user string, pass string) bool {
+	if !driver.Next.Authenticate(user, pass) {
+		return false
+	}
+	driver.values.Set(tenantKey{}, "tenant-"+user)
+	return true
+}
+
+// tenantMemDriver records the tenant it finds when a directory is made.
+type tenantMemDriver struct {
+	*gravaltest.MemDriver
+	values  *graval.SessionValues
+	tenants chan<- interface{}
+}
+
+func (driver *tenantMemDriver) SetSessionValues(values *graval.SessionValues) {
+	driver.values = values
+}
+
+func (driver *tenantMemDriver) MakeDir(path string) bool {
+	driver.tenants <- driver.values.Get(tenantKey{})
+	return driver.MemDriver.MakeDir(path)
+}
+
+type tenantMemDriverFactory struct {
+	*gravaltest.MemDriverFactory
+	tenants chan<- interface{}
+}
+
+func (factory tenantMemDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &tenantMemDriver{MemDriver: driver.(*gravaltest.MemDriver), tenants: factory.tenants}, nil
+}
+
+func TestSessionValues(t *testing.T) {
+	tenants := make(chan interface{}, 10)
+	inner := tenantMemDriverFactory{MemDriverFactory: gravaltest.NewMemDriverFactory(), tenants: tenants}
+	tenantMiddleware := func(next graval.FTPDriver) graval.FTPDriver {
+		return &tenantDriver{Driver: Driver{Next: next}}
+	}
+	server := gravaltest.NewServer(&graval.FTPServerOpts{
+		Factory: Chain(inner, tenantMiddleware),
+		CommandInterceptors: []graval.CommandInterceptor{
+			func(call *graval.CommandCall, next func()) {
+				if call.Command == "MKD" {
+					tenants <- call.Values.Get(tenantKey{})
+				}
+				next()
+			},
+		},
+	})
+	defer server.Close()
+
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	client.Expect(t, 257, "MKD /one")
+	seenByInterceptor, seenByDriver := <-tenants, <-tenants
+
+	other := server.Client(t)
+	defer other.Close()
+	other.Expect(t, 530, "MKD /two")
+
+	Convey("Session values", t, func() {
+		Convey("Will be shared by middleware, drivers and interceptors", func() {
+			So(seenByInterceptor, ShouldEqual, "tenant-test")
+			So(seenByDriver, ShouldEqual, "tenant-test")
+		})
+
+		Convey("Will belong to a single session", func() {
+			So(len(tenants), ShouldEqual, 1)
+			So(<-tenants, ShouldBeNil)
+		})
+	})
+}
+
+// flakyDriver is a backend that can hang, or be down.
+type flakyDriver struct {
+	*gravaltest.MemDriver
+	factory *flakyDriverFactory
+}
+
+func (driver *flakyDriver) MakeDir(path string) bool {
+	factory := driver.factory
+	factory.mu.Lock()
+	factory.calls++
+	down, hang := factory.down, factory.hang
+	factory.mu.Unlock()
+	if hang != nil {
+		<-hang
+	}
+	return !down && driver.MemDriver.MakeDir(path)
+}
+
+func (driver *flakyDriver) LastError() error {
+	driver.factory.mu.Lock()
+	defer driver.factory.mu.Unlock()
+	if driver.factory.down {
+		return graval.ErrUnavailable
+	}
+	return nil
+}
+
+type flakyDriverFactory struct {
+	*gravaltest.MemDriverFactory
+	mu    sync.Mutex
+	calls int
+	down  bool
+	hang  chan struct{}
+}
+
+func (factory *flakyDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &flakyDriver{MemDriver: driver.(*gravaltest.MemDriver), factory: factory}, nil
+}
+
+func (factory *flakyDriverFactory) set(down bool, hang chan struct{}) int {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	factory.down, factory.hang = down, hang
+	return factory.calls
+}
+
+func TestTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	inner := &flakyDriverFactory{MemDriverFactory: gravaltest.NewMemDriverFactory(), hang: hang}
+	server := gravaltest.NewServer(&graval.FTPServerOpts{
+		Factory: Chain(inner, Timeout(50*time.Millisecond)),
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	started := time.Now()
+	hung, _ := client.Cmd("MKD /hung")
+	elapsed := time.Since(started)
+	inner.set(false, nil)
+	close(hang)
+	fast, _ := client.Cmd("MKD /fast")
+
+	Convey("A driver call that takes too long", t, func() {
+		Convey("Will be abandoned with a 451 reply", func() {
+			So(hung.Code, ShouldEqual, 451)
+			So(elapsed, ShouldBeLessThan, time.Second)
+		})
+
+		Convey("Won't affect later calls that are quick", func() {
+			So(fast.Code, ShouldEqual, 257)
+		})
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := gravaltest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inner := &flakyDriverFactory{MemDriverFactory: gravaltest.NewMemDriverFactory()}
+	server := gravaltest.NewServer(&graval.FTPServerOpts{
+		Factory: Chain(inner, CircuitBreaker(&BreakerConfig{Failures: 2, Cooldown: time.Minute, Clock: clock})),
+	})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+
+	inner.set(true, nil)
+	var failing []int
+	for i := 0; i < 3; i++ {
+		reply, _ := client.Cmd("MKD /down%d", i)
+		failing = append(failing, reply.Code)
+	}
+	callsWhileOpen := inner.set(false, nil)
+	cooling, _ := client.Cmd("MKD /cooling")
+	clock.Advance(time.Minute)
+	trial, _ := client.Cmd("MKD /trial")
+	closed, _ := client.Cmd("MKD /closed")
+	callsAfterReset := inner.set(true, nil)
+
+	client.Cmd("MKD /again1")
+	client.Cmd("MKD /again2")
+	clock.Advance(time.Minute)
+	failedTrial, _ := client.Cmd("MKD /again3")
+	reopened, _ := client.Cmd("MKD /again4")
+	callsAfterFailedTrial := inner.set(false, nil)
+
+	Convey("A circuit breaker", t, func() {
+		Convey("Will open after enough failures in a row, and fail calls at once", func() {
+			So(failing, ShouldResemble, []int{450, 450, 451})
+			So(callsWhileOpen, ShouldEqual, 2)
+		})
+
+		Convey("Will stay open until the cooldown has passed", func() {
+			So(cooling.Code, ShouldEqual, 451)
+		})
+
+		Convey("Will close again when a trial call succeeds", func() {
+			So(trial.Code, ShouldEqual, 257)
+			So(closed.Code, ShouldEqual, 257)
+			So(callsAfterReset, ShouldEqual, 4)
+		})
+
+		Convey("Will open again at once when a trial call fails", func() {
+			So(failedTrial.Code, ShouldEqual, 450)
+			So(reopened.Code, ShouldEqual, 451)
+			So(callsAfterFailedTrial, ShouldEqual, 7)
+		})
+	})
+}
+
+// pingFactory is a factory whose backend is down.
+type pingFactory struct {
+	*gravaltest.MemDriverFactory
+}
+
+func (factory pingFactory) Ping(ctx context.Context) error {
+	return errors.New("factory down")
+}
+
+// callLog records the optional calls graval makes to a driver.
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (log *callLog) add(call string) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.calls = append(log.calls, call)
+}
+
+func (log *callLog) list() []string {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return append([]string{}, log.calls...)
+}
+
+// pingDriverFactory creates drivers that can ping a backend that's down,
+// and log the optional calls made to them.
+type pingDriverFactory struct {
+	*gravaltest.MemDriverFactory
+	log *callLog
+}
+
+func (factory pingDriverFactory) NewDriver() (graval.FTPDriver, error) {
+	driver, _ := factory.MemDriverFactory.NewDriver()
+	return &pingDriver{FTPDriver: driver, log: factory.log}, nil
+}
+
+type pingDriver struct {
+	graval.FTPDriver
+	log *callLog
+}
+
+func (driver *pingDriver) Ping(ctx context.Context) error {
+	return errors.New("driver down")
+}
+
+func (driver *pingDriver) SetSession(sessionId string, remoteIP string) {
+	driver.log.add("SetSession")
+}
+
+func (driver *pingDriver) SessionStart(ctx context.Context) error {
+	driver.log.add("SessionStart")
+	return nil
+}
+
+func (driver *pingDriver) SessionEnd(ctx context.Context) {
+	driver.log.add("SessionEnd")
+}
+
+func TestChainPing(t *testing.T) {
+	health := func(factory graval.FTPDriverFactory) graval.Health {
+		server := gravaltest.NewServer(&graval.FTPServerOpts{Factory: factory})
+		defer server.Close()
+		return server.FTPServer().Health(context.Background())
+	}
+	factoryHealth := health(Chain(pingFactory{gravaltest.NewMemDriverFactory()}, StatCache(time.Minute)))
+	calls := &callLog{}
+	driverHealth := health(Chain(pingDriverFactory{gravaltest.NewMemDriverFactory(), calls}, StatCache(time.Minute)))
+	plainHealth := health(Chain(plainDriverFactory{gravaltest.NewMemDriverFactory()}, StatCache(time.Minute)))
+
+	Convey("A health check through a chain of middleware", t, func() {
+		Convey("Will ping the wrapped factory", func() {
+			So(factoryHealth.BackendError, ShouldEqual, "factory down")
+		})
+
+		Convey("Will ping a wrapped driver, and end its session afterwards", func() {
+			So(driverHealth.BackendError, ShouldEqual, "driver down")
+			So(calls.list(), ShouldResemble, []string{"SessionStart", "SessionEnd"})
+		})
+
+		Convey("Will find nothing to ping when neither can", func() {
+			So(plainHealth.BackendError, ShouldEqual, "")
+		})
+	})
+}
+
+// refusingDriver is a middleware driver that refuses every optional
+// interface through Supports.
+type refusingDriver struct {
+	Driver
+}
+
+func (driver *refusingDriver) Supports(target interface{}) bool {
+	return false
+}
+
+func TestDriverRefuses(t *testing.T) {
+	calls := &callLog{}
+	factory := Chain(pingDriverFactory{gravaltest.NewMemDriverFactory(), calls}, func(next graval.FTPDriver) graval.FTPDriver {
+		return &refusingDriver{Driver{Next: next}}
+	})
+	server := gravaltest.NewServer(&graval.FTPServerOpts{Factory: factory})
+	defer server.Close()
+	client := server.Client(t)
+	defer client.Close()
+	client.Login(t, "test", "1234")
+	health := server.FTPServer().Health(context.Background())
+
+	Convey("A middleware that refuses an optional interface", t, func() {
+		Convey("Will keep graval from using it", func() {
+			So(calls.list(), ShouldBeEmpty)
+			So(health.BackendError, ShouldEqual, "")
+		})
+	})
+}
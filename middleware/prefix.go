@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// PathPrefix serves a subtree of the next driver, by adding prefix to the
+// start of every path. Clients see the subtree as the root and can't reach
+// anything outside it.
+func PathPrefix(prefix string) Middleware {
+	prefix = path.Clean("/" + prefix)
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &prefixDriver{Driver: Driver{Next: next}, prefix: prefix}
+	}
+}
+
+type prefixDriver struct {
+	Driver
+	prefix string
+}
+
+// Supports refuses temporary upload paths chosen by the next driver, which
+// may be outside the subtree, so uploads are staged beside their final
+// names inside it instead.
+func (driver *prefixDriver) Supports(target interface{}) bool {
+	switch target.(type) {
+	case *graval.FTPTempUploadDriver, *graval.FTPPartialUploadDriver:
+		return false
+	}
+	return driver.Driver.Supports(target)
+}
+
+func (driver *prefixDriver) path(p string) string {
+	return path.Join(driver.prefix, path.Clean("/"+p))
+}
+
+func (driver *prefixDriver) Bytes(p string) int64 {
+	return driver.Next.Bytes(driver.path(p))
+}
+
+func (driver *prefixDriver) ModifiedTime(p string) (time.Time, error) {
+	return driver.Next.ModifiedTime(driver.path(p))
+}
+
+func (driver *prefixDriver) ChangeDir(p string) bool {
+	return driver.Next.ChangeDir(driver.path(p))
+}
+
+func (driver *prefixDriver) AvailableSpace(p string) (int64, error) {
+	return driver.Driver.AvailableSpace(driver.path(p))
+}
+
+func (driver *prefixDriver) SetFacts(p string, facts map[string]string) error {
+	return driver.Driver.SetFacts(driver.path(p), facts)
+}
+
+func (driver *prefixDriver) DirContents(p string) []os.FileInfo {
+	return driver.Next.DirContents(driver.path(p))
+}
+
+func (driver *prefixDriver) DeleteDir(p string) bool {
+	if path.Clean("/"+p) == "/" {
+		return false
+	}
+	return driver.Next.DeleteDir(driver.path(p))
+}
+
+func (driver *prefixDriver) DeleteFile(p string) bool {
+	return driver.Next.DeleteFile(driver.path(p))
+}
+
+func (driver *prefixDriver) Rename(fromPath string, toPath string) bool {
+	if path.Clean("/"+fromPath) == "/" {
+		return false
+	}
+	return driver.Next.Rename(driver.path(fromPath), driver.path(toPath))
+}
+
+func (driver *prefixDriver) MakeDir(p string) bool {
+	return driver.Next.MakeDir(driver.path(p))
+}
+
+func (driver *prefixDriver) GetFile(p string) (io.ReadCloser, error) {
+	return driver.Next.GetFile(driver.path(p))
+}
+
+func (driver *prefixDriver) PutFile(destPath string, data io.Reader) bool {
+	return driver.Next.PutFile(driver.path(destPath), data)
+}
+
+func (driver *prefixDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	return driver.Driver.PutFileAt(driver.path(destPath), offset, data)
+}
+
+func (driver *prefixDriver) ReadRange(p string, offset int64, length int64) (io.ReadCloser, error) {
+	return driver.Driver.ReadRange(driver.path(p), offset, length)
+}
+
+func (driver *prefixDriver) GetFileSegment(p string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	return driver.Driver.GetFileSegment(driver.path(p), offset, length, group)
+}
+
+func (driver *prefixDriver) Copy(fromPath string, toPath string) bool {
+	return driver.Driver.Copy(driver.path(fromPath), driver.path(toPath))
+}
+
+func (driver *prefixDriver) DeleteTree(p string) bool {
+	if path.Clean("/"+p) == "/" {
+		return false
+	}
+	return driver.Driver.DeleteTree(driver.path(p))
+}
+
+func (driver *prefixDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	return driver.Driver.StoreExisting(driver.path(destPath), algorithm, hash)
+}
+
+func (driver *prefixDriver) IsBlindDrop(p string) bool {
+	return driver.Driver.IsBlindDrop(driver.path(p))
+}
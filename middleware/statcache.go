@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatCache remembers the results of Bytes and ModifiedTime for ttl, which
+// saves round trips to slow backends when clients check a file's size and
+// modification time repeatedly, as many sync tools do. Each session has its
+// own cache, and changes made through the session clear the affected entries
+// immediately, but changes made by other sessions may take up to ttl to be
+// seen.
+func StatCache(ttl time.Duration) Middleware {
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		driver := &statCacheDriver{Driver: Driver{Next: next}, ttl: ttl}
+		driver.entries = map[string]*statEntry{}
+		return driver
+	}
+}
+
+type statEntry struct {
+	expires time.Time
+
+	sizeSet bool
+	size    int64
+
+	modTimeSet bool
+	modTime    time.Time
+	modTimeErr error
+}
+
+type statCacheDriver struct {
+	Driver
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*statEntry
+}
+
+// entry returns the cache entry for path, replacing it if it has expired.
+// The caller must hold mu.
+func (driver *statCacheDriver) entry(path string) *statEntry {
+	entry := driver.entries[path]
+	if entry == nil || time.Now().After(entry.expires) {
+		entry = &statEntry{expires: time.Now().Add(driver.ttl)}
+		driver.entries[path] = entry
+	}
+	return entry
+}
+
+// forget removes path and everything beneath it from the cache.
+func (driver *statCacheDriver) forget(path string) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	for p := range driver.entries {
+		if p == path || strings.HasPrefix(p, strings.TrimSuffix(path, "/")+"/") {
+			delete(driver.entries, p)
+		}
+	}
+}
+
+func (driver *statCacheDriver) Bytes(path string) int64 {
+	driver.mu.Lock()
+	entry := driver.entry(path)
+	if entry.sizeSet {
+		driver.mu.Unlock()
+		return entry.size
+	}
+	driver.mu.Unlock()
+
+	size := driver.Next.Bytes(path)
+	driver.mu.Lock()
+	entry.size, entry.sizeSet = size, true
+	driver.mu.Unlock()
+	return size
+}
+
+func (driver *statCacheDriver) ModifiedTime(path string) (time.Time, error) {
+	driver.mu.Lock()
+	entry := driver.entry(path)
+	if entry.modTimeSet {
+		driver.mu.Unlock()
+		return entry.modTime, entry.modTimeErr
+	}
+	driver.mu.Unlock()
+
+	modTime, err := driver.Next.ModifiedTime(path)
+	driver.mu.Lock()
+	entry.modTime, entry.modTimeErr, entry.modTimeSet = modTime, err, true
+	driver.mu.Unlock()
+	return modTime, err
+}
+
+func (driver *statCacheDriver) DeleteDir(path string) bool {
+	defer driver.forget(path)
+	return driver.Next.DeleteDir(path)
+}
+
+func (driver *statCacheDriver) DeleteFile(path string) bool {
+	defer driver.forget(path)
+	return driver.Next.DeleteFile(path)
+}
+
+func (driver *statCacheDriver) Rename(fromPath string, toPath string) bool {
+	defer driver.forget(toPath)
+	defer driver.forget(fromPath)
+	return driver.Next.Rename(fromPath, toPath)
+}
+
+func (driver *statCacheDriver) MakeDir(path string) bool {
+	defer driver.forget(path)
+	return driver.Next.MakeDir(path)
+}
+
+func (driver *statCacheDriver) PutFile(destPath string, data io.Reader) bool {
+	defer driver.forget(destPath)
+	return driver.Next.PutFile(destPath, data)
+}
+
+func (driver *statCacheDriver) SetFacts(path string, facts map[string]string) error {
+	defer driver.forget(path)
+	return driver.Driver.SetFacts(path, facts)
+}
+
+func (driver *statCacheDriver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	defer driver.forget(destPath)
+	return driver.Driver.PutFileAt(destPath, offset, data)
+}
+
+func (driver *statCacheDriver) Copy(fromPath string, toPath string) bool {
+	defer driver.forget(toPath)
+	return driver.Driver.Copy(fromPath, toPath)
+}
+
+func (driver *statCacheDriver) DeleteTree(path string) bool {
+	defer driver.forget(path)
+	return driver.Driver.DeleteTree(path)
+}
+
+func (driver *statCacheDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	defer driver.forget(destPath)
+	return driver.Driver.StoreExisting(destPath, algorithm, hash)
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"github.com/royallthefourth/graval"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Timeout abandons driver calls that take longer than d, so a backend that
+// hangs gives clients a quick 451 reply rather than hanging their sessions.
+// An abandoned call fails with graval.ErrBackendDown, but carries on in the
+// background, so the driver it wraps must cope with being called again
+// before an earlier call has returned. PutFile and PutFileAt aren't timed,
+// since they last as long as the upload; use MinTransferRate for stalled
+// uploads. Copy and DeleteTree aren't timed either, since they last as long
+// as the tree they copy or delete takes.
+func Timeout(d time.Duration) Middleware {
+	return func(next graval.FTPDriver) graval.FTPDriver {
+		return &timeoutDriver{Driver: Driver{Next: next}, timeout: d}
+	}
+}
+
+type timeoutDriver struct {
+	Driver
+	timeout time.Duration
+	lastErr error
+}
+
+// call runs f, and returns false if it didn't finish in time, in which case
+// LastError reports graval.ErrBackendDown.
+func (driver *timeoutDriver) call(f func()) bool {
+	driver.lastErr = nil
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	timer := time.NewTimer(driver.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		driver.lastErr = graval.ErrBackendDown
+		return false
+	}
+}
+
+// Supports serves graval.FTPErrorDriver whatever the next driver is, so
+// graval can report calls that time out.
+func (driver *timeoutDriver) Supports(target interface{}) bool {
+	if _, ok := target.(*graval.FTPErrorDriver); ok {
+		return true
+	}
+	return driver.Driver.Supports(target)
+}
+
+func (driver *timeoutDriver) LastError() error {
+	if driver.lastErr != nil {
+		return driver.lastErr
+	}
+	return driver.Driver.LastError()
+}
+
+func (driver *timeoutDriver) Authenticate(user string, pass string) bool {
+	var ok bool
+	return driver.call(func() { ok = driver.Next.Authenticate(user, pass) }) && ok
+}
+
+func (driver *timeoutDriver) Bytes(path string) int64 {
+	var size int64
+	if !driver.call(func() { size = driver.Next.Bytes(path) }) {
+		return -1
+	}
+	return size
+}
+
+func (driver *timeoutDriver) ModifiedTime(path string) (time.Time, error) {
+	var modTime time.Time
+	var err error
+	if !driver.call(func() { modTime, err = driver.Next.ModifiedTime(path) }) {
+		return time.Time{}, graval.ErrBackendDown
+	}
+	return modTime, err
+}
+
+func (driver *timeoutDriver) ChangeDir(path string) bool {
+	var ok bool
+	return driver.call(func() { ok = driver.Next.ChangeDir(path) }) && ok
+}
+
+func (driver *timeoutDriver) DirContents(path string) []os.FileInfo {
+	var files []os.FileInfo
+	if !driver.call(func() { files = driver.Next.DirContents(path) }) {
+		return []os.FileInfo{}
+	}
+	return files
+}
+
+func (driver *timeoutDriver) DeleteDir(path string) bool {
+	var ok bool
+	return driver.call(func() { ok = driver.Next.DeleteDir(path) }) && ok
+}
+
+func (driver *timeoutDriver) DeleteFile(path string) bool {
+	var ok bool
+	return driver.call(func() { ok = driver.Next.DeleteFile(path) }) && ok
+}
+
+func (driver *timeoutDriver) Rename(fromPath string, toPath string) bool {
+	var ok bool
+	return driver.call(func() { ok = driver.Next.Rename(fromPath, toPath) }) && ok
+}
+
+func (driver *timeoutDriver) MakeDir(path string) bool {
+	var ok bool
+	return driver.call(func() { ok = driver.Next.MakeDir(path) }) && ok
+}
+
+func (driver *timeoutDriver) GetFile(path string) (io.ReadCloser, error) {
+	return driver.open(func() (io.ReadCloser, error) { return driver.Next.GetFile(path) })
+}
+
+func (driver *timeoutDriver) ReadRange(path string, offset int64, length int64) (io.ReadCloser, error) {
+	return driver.open(func() (io.ReadCloser, error) { return driver.Driver.ReadRange(path, offset, length) })
+}
+
+func (driver *timeoutDriver) GetFileSegment(path string, offset int64, length int64, group *graval.DownloadGroup) (io.ReadCloser, error) {
+	return driver.open(func() (io.ReadCloser, error) { return driver.Driver.GetFileSegment(path, offset, length, group) })
+}
+
+func (driver *timeoutDriver) StoreExisting(destPath string, algorithm string, hash string) bool {
+	var ok bool
+	return driver.call(func() { ok = driver.Driver.StoreExisting(destPath, algorithm, hash) }) && ok
+}
+
+// open opens a file with f, within the timeout.
+func (driver *timeoutDriver) open(f func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	// a file opened after the call was abandoned is closed, since nothing
+	// else will
+	var mu sync.Mutex
+	var abandoned bool
+	var reader io.ReadCloser
+	var err error
+	if driver.call(func() {
+		opened, openErr := f()
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned && opened != nil {
+			opened.Close()
+		}
+		reader, err = opened, openErr
+	}) {
+		return reader, err
+	}
+	mu.Lock()
+	abandoned = true
+	opened := reader
+	mu.Unlock()
+	if opened != nil {
+		opened.Close()
+	}
+	return nil, graval.ErrBackendDown
+}
@@ -0,0 +1,86 @@
+package graval
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWatch aborts a transfer that stays slower than the server's
+// MinTransferRate for MinTransferRatePeriod, checking once a second.
+type rateWatch struct {
+	t       *transfer
+	mu      sync.Mutex
+	timer   ClockTimer
+	stopped bool
+	last    int64
+	slow    time.Duration
+	tripped int32
+}
+
+// watchRate starts checking the speed of t, if the server has a
+// MinTransferRate.
+func (t *transfer) watchRate() {
+	if t.conn.server.minRate <= 0 {
+		return
+	}
+	t.rate = &rateWatch{t: t}
+	t.rate.schedule()
+}
+
+func (watch *rateWatch) schedule() {
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	if !watch.stopped {
+		watch.timer = watch.t.conn.server.clock.AfterFunc(time.Second, watch.check)
+	}
+}
+
+// check looks at how much the transfer moved in the last second. Once it's
+// been too slow for long enough, the data connection is closed, which stops
+// the transfer wherever it's blocked.
+func (watch *rateWatch) check() {
+	conn := watch.t.conn
+	moved := atomic.LoadInt64(&watch.t.bytes)
+	if moved-watch.last < conn.server.minRate {
+		watch.slow += time.Second
+	} else {
+		watch.slow = 0
+	}
+	watch.last = moved
+	if watch.slow < conn.server.minRatePeriod {
+		watch.schedule()
+		return
+	}
+	watch.mu.Lock()
+	stopped := watch.stopped
+	watch.mu.Unlock()
+	if stopped {
+		return
+	}
+	conn.logger.Printf("Aborting %s of %s, below the minimum transfer rate", watch.t.direction, watch.t.path)
+	atomic.StoreInt32(&watch.tripped, 1)
+	conn.mu.Lock()
+	if conn.dataConn != nil {
+		conn.dataConn.Close()
+	}
+	conn.mu.Unlock()
+}
+
+// stop stops checking once the transfer has finished.
+func (watch *rateWatch) stop() {
+	if watch == nil {
+		return
+	}
+	watch.mu.Lock()
+	defer watch.mu.Unlock()
+	watch.stopped = true
+	if watch.timer != nil {
+		watch.timer.Stop()
+	}
+}
+
+// tooSlow reports whether the transfer was aborted for being too slow.
+func (t *transfer) tooSlow() bool {
+	return t.rate != nil && atomic.LoadInt32(&t.rate.tripped) == 1
+}
@@ -0,0 +1,393 @@
+// Package osdriver provides a graval driver that serves a directory on the
+// local filesystem.
+//
+// Paths from clients are always resolved inside the root directory, but
+// symlinks inside the root are followed unless RefuseSymlinks is set, so
+// don't point it at a tree where untrusted users can create symlinks.
+package osdriver
+
+import (
+	"errors"
+	"github.com/royallthefourth/graval"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many entries DirContentsIter reads from a directory at a time
+const dirBatchSize = 256
+
+// DriverFactory creates a Driver for each client connection. All drivers
+// share the same root directory.
+type DriverFactory struct {
+	// The directory to serve. Mandatory.
+	Root string
+
+	// When true, any request that would modify the filesystem is refused.
+	ReadOnly bool
+
+	// When true, paths that pass through a symlink are refused, so links
+	// inside the root can't be used to reach files outside it. Links are
+	// still shown in listings.
+	RefuseSymlinks bool
+
+	// Checks the credentials supplied by the client. If nil, all logins are
+	// refused.
+	Authenticate func(user string, pass string) bool
+}
+
+func (factory *DriverFactory) NewDriver() (graval.FTPDriver, error) {
+	if factory.Root == "" {
+		return nil, errors.New("osdriver: Root is required")
+	}
+	return &Driver{factory: factory}, nil
+}
+
+// Driver is the graval.FTPDriver created by a DriverFactory.
+type Driver struct {
+	factory *DriverFactory
+	lastErr error
+
+	// the permissions for new files and directories, when set by
+	// SetCreateModes
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	modesSet bool
+}
+
+// fail records why a call failed, for LastError, and returns false.
+func (driver *Driver) fail(err error) bool {
+	driver.lastErr = err
+	return false
+}
+
+// LastError implements graval.FTPErrorDriver.
+func (driver *Driver) LastError() error {
+	return driver.lastErr
+}
+
+// localPath converts a path from graval (always absolute and cleaned) to a
+// path on the local filesystem inside the root. If the path passes through a
+// symlink and the factory refuses them, it returns an empty path instead,
+// which every call into the os package fails on.
+func (driver *Driver) localPath(path string) string {
+	relative := filepath.FromSlash(filepath.Clean("/" + path))
+	if driver.factory.RefuseSymlinks {
+		local := driver.factory.Root
+		for _, name := range strings.Split(relative, string(filepath.Separator)) {
+			if name == "" {
+				continue
+			}
+			local = filepath.Join(local, name)
+			if info, err := os.Lstat(local); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return ""
+			}
+		}
+	}
+	return filepath.Join(driver.factory.Root, relative)
+}
+
+// linkTarget returns the target of a symlink as a client should see it:
+// relative targets as they are, and absolute ones as a path from the root.
+// Absolute targets outside the root are hidden, rather than revealing the
+// layout of the server.
+func (driver *Driver) linkTarget(local string) string {
+	target, err := os.Readlink(local)
+	if err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(target) {
+		return filepath.ToSlash(target)
+	}
+	relative, err := filepath.Rel(driver.factory.Root, target)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return "/" + filepath.ToSlash(relative)
+}
+
+func (driver *Driver) Authenticate(user string, pass string) bool {
+	if driver.factory.Authenticate == nil {
+		return false
+	}
+	return driver.factory.Authenticate(user, pass)
+}
+
+func (driver *Driver) Bytes(path string) int64 {
+	info, err := os.Stat(driver.localPath(path))
+	if err != nil || info.IsDir() {
+		return -1
+	}
+	return info.Size()
+}
+
+func (driver *Driver) ModifiedTime(path string) (time.Time, error) {
+	info, err := os.Stat(driver.localPath(path))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (driver *Driver) ChangeDir(path string) bool {
+	info, err := os.Stat(driver.localPath(path))
+	if err != nil {
+		return driver.fail(err)
+	}
+	if !info.IsDir() {
+		return driver.fail(graval.ErrNotDir)
+	}
+	return true
+}
+
+func (driver *Driver) DirContents(path string) []os.FileInfo {
+	local := driver.localPath(path)
+	files, err := ioutil.ReadDir(local)
+	if err != nil {
+		return []os.FileInfo{}
+	}
+	for i, file := range files {
+		files[i] = driver.dirEntry(local, file)
+	}
+	return files
+}
+
+// DirContentsIter lists a directory a batch at a time, so huge directories
+// can be listed without reading them into memory. Unlike DirContents, the
+// entries come in the order the filesystem returns them, not sorted by name.
+func (driver *Driver) DirContentsIter(path string, fn func(os.FileInfo) bool) error {
+	local := driver.localPath(path)
+	dir, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		files, err := dir.Readdir(dirBatchSize)
+		for _, file := range files {
+			if !fn(driver.dirEntry(local, file)) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// dirEntry adds a symlink's target and the file's owner to an entry in the
+// directory local.
+func (driver *Driver) dirEntry(local string, file os.FileInfo) os.FileInfo {
+	owner, group := fileOwner(file)
+	if file.Mode()&os.ModeSymlink != 0 {
+		target := driver.linkTarget(filepath.Join(local, file.Name()))
+		file = graval.NewSymlinkItem(file.Name(), target, file.ModTime())
+	}
+	if owner != "" {
+		file = graval.WithOwner(file, owner, group)
+	}
+	return file
+}
+
+func (driver *Driver) DeleteDir(path string) bool {
+	if driver.factory.ReadOnly || path == "/" {
+		return driver.fail(graval.ErrPermission)
+	}
+	local := driver.localPath(path)
+	info, err := os.Stat(local)
+	if err != nil {
+		return driver.fail(err)
+	}
+	if !info.IsDir() {
+		return driver.fail(graval.ErrNotDir)
+	}
+	if err := os.Remove(local); err != nil {
+		return driver.fail(err)
+	}
+	return true
+}
+
+func (driver *Driver) DeleteFile(path string) bool {
+	if driver.factory.ReadOnly {
+		return driver.fail(graval.ErrPermission)
+	}
+	local := driver.localPath(path)
+	info, err := os.Stat(local)
+	if err != nil {
+		return driver.fail(err)
+	}
+	if info.IsDir() {
+		return driver.fail(errors.New("is a directory"))
+	}
+	if err := os.Remove(local); err != nil {
+		return driver.fail(err)
+	}
+	return true
+}
+
+func (driver *Driver) Rename(fromPath string, toPath string) bool {
+	if driver.factory.ReadOnly || fromPath == "/" {
+		return driver.fail(graval.ErrPermission)
+	}
+	local := driver.localPath(toPath)
+	if _, err := os.Lstat(local); err == nil {
+		return driver.fail(graval.ErrExists)
+	}
+	if err := os.Rename(driver.localPath(fromPath), local); err != nil {
+		return driver.fail(err)
+	}
+	return true
+}
+
+// SetCreateModes implements graval.FTPCreateModeDriver. New files and
+// directories are given exactly these permissions, regardless of the
+// process's umask.
+func (driver *Driver) SetCreateModes(fileMode os.FileMode, dirMode os.FileMode) {
+	driver.fileMode, driver.dirMode, driver.modesSet = fileMode, dirMode, true
+}
+
+func (driver *Driver) MakeDir(path string) bool {
+	if driver.factory.ReadOnly {
+		return driver.fail(graval.ErrPermission)
+	}
+	local := driver.localPath(path)
+	mode := os.FileMode(0755)
+	if driver.modesSet {
+		mode = driver.dirMode
+	}
+	if err := os.Mkdir(local, mode); err != nil {
+		return driver.fail(err)
+	}
+	if driver.modesSet {
+		if err := os.Chmod(local, mode); err != nil {
+			return driver.fail(err)
+		}
+	}
+	return true
+}
+
+func (driver *Driver) GetFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(driver.localPath(path))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, errors.New("not a file")
+	}
+	return file, nil
+}
+
+func (driver *Driver) PutFile(destPath string, data io.Reader) bool {
+	if driver.factory.ReadOnly {
+		return driver.fail(graval.ErrPermission)
+	}
+	local := driver.localPath(destPath)
+	mode := os.FileMode(0644)
+	if driver.modesSet {
+		mode = driver.fileMode
+	}
+	_, statErr := os.Lstat(local)
+	file, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return driver.fail(err)
+	}
+	if driver.modesSet && os.IsNotExist(statErr) {
+		err = file.Chmod(mode)
+	}
+	if err == nil {
+		_, err = io.Copy(file, data)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return driver.fail(err)
+	}
+	return true
+}
+
+// PutFileAt resumes an upload, keeping the first offset bytes of the existing
+// file and replacing the rest with data.
+func (driver *Driver) PutFileAt(destPath string, offset int64, data io.Reader) bool {
+	if driver.factory.ReadOnly {
+		return driver.fail(graval.ErrPermission)
+	}
+	file, err := os.OpenFile(driver.localPath(destPath), os.O_WRONLY, 0644)
+	if err != nil {
+		return driver.fail(err)
+	}
+	info, err := file.Stat()
+	if err == nil && (info.IsDir() || info.Size() < offset) {
+		err = errors.New("offset is beyond the end of the file")
+	}
+	if err == nil {
+		err = file.Truncate(offset)
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(file, data)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return driver.fail(err)
+	}
+	return true
+}
+
+// SettableFacts implements graval.FTPFactsDriver. The modification time and
+// permissions of files can be changed, unless the driver is read only.
+func (driver *Driver) SettableFacts() []string {
+	if driver.factory.ReadOnly {
+		return nil
+	}
+	return []string{"modify", "unix.mode"}
+}
+
+// SetFacts implements graval.FTPFactsDriver. Only the permission bits of
+// UNIX.mode are used, so clients can't set the setuid bit.
+func (driver *Driver) SetFacts(path string, facts map[string]string) error {
+	if driver.factory.ReadOnly {
+		return graval.ErrPermission
+	}
+	local := driver.localPath(path)
+	if _, err := os.Stat(local); err != nil {
+		return err
+	}
+	for name, value := range facts {
+		var err error
+		switch name {
+		case "modify":
+			var modTime time.Time
+			if modTime, err = graval.ParseFactTime(value); err == nil {
+				err = os.Chtimes(local, time.Now(), modTime)
+			}
+		case "unix.mode":
+			var mode uint64
+			if mode, err = strconv.ParseUint(value, 8, 32); err == nil {
+				err = os.Chmod(local, os.FileMode(mode)&os.ModePerm)
+			}
+		default:
+			err = errors.New("fact not supported: " + name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package osdriver
+
+import (
+	"github.com/royallthefourth/graval/gravaltest"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDriverConformance(t *testing.T) {
+	root, err := ioutil.TempDir("", "osdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	factory := &DriverFactory{
+		Root: root,
+		Authenticate: func(user string, pass string) bool {
+			return user == "test" && pass == "1234"
+		},
+	}
+	gravaltest.TestDriver(t, factory, "test", "1234")
+}
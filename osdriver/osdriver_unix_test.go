@@ -0,0 +1,177 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package osdriver
+
+import (
+	"github.com/royallthefourth/graval"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAvailableSpace(t *testing.T) {
+	root, err := ioutil.TempDir("", "osdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	driver, _ := (&DriverFactory{Root: root}).NewDriver()
+	readOnly, _ := (&DriverFactory{Root: root, ReadOnly: true}).NewDriver()
+	available, availableErr := driver.(*Driver).AvailableSpace("/")
+	none, _ := readOnly.(*Driver).AvailableSpace("/")
+	_, missingErr := driver.(*Driver).AvailableSpace("/missing")
+
+	Convey("A driver on the local filesystem", t, func() {
+		Convey("Will report the space left", func() {
+			So(availableErr, ShouldBeNil)
+			So(available, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("Will report no space when read only", func() {
+			So(none, ShouldEqual, 0)
+		})
+
+		Convey("Will fail for a missing directory", func() {
+			So(missingErr, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFileOwner(t *testing.T) {
+	root, err := ioutil.TempDir("", "osdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "file.txt"), []byte("data"), 0644)
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("current user unknown")
+	}
+	driver, _ := (&DriverFactory{Root: root}).NewDriver()
+	files := driver.DirContents("/")
+
+	Convey("Files on the local filesystem", t, func() {
+		Convey("Will be listed with their owner", func() {
+			So(files, ShouldHaveLength, 1)
+			owned, ok := files[0].(graval.FTPOwnerInfo)
+			So(ok, ShouldBeTrue)
+			So(owned.Owner(), ShouldEqual, current.Username)
+			So(owned.Group(), ShouldNotBeEmpty)
+		})
+	})
+}
+
+func TestSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "osdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "osdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	ioutil.WriteFile(filepath.Join(root, "file.txt"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	os.Symlink("file.txt", filepath.Join(root, "relative"))
+	os.Symlink(filepath.Join(root, "file.txt"), filepath.Join(root, "absolute"))
+	os.Symlink(outside, filepath.Join(root, "escape"))
+
+	following, _ := (&DriverFactory{Root: root}).NewDriver()
+	refusing, _ := (&DriverFactory{Root: root, RefuseSymlinks: true}).NewDriver()
+	targets := map[string]string{}
+	for _, file := range following.DirContents("/") {
+		if link, ok := file.(graval.FTPSymlinkInfo); ok {
+			targets[file.Name()] = link.SymlinkTarget()
+		}
+	}
+
+	Convey("Symlinks on the local filesystem", t, func() {
+		Convey("Will be listed with their targets", func() {
+			So(targets["relative"], ShouldEqual, "file.txt")
+			So(targets["absolute"], ShouldEqual, "/file.txt")
+		})
+
+		Convey("Will hide targets outside the root", func() {
+			So(targets, ShouldContainKey, "escape")
+			So(targets["escape"], ShouldEqual, "")
+		})
+
+		Convey("Will be followed by default", func() {
+			So(following.Bytes("/escape/secret.txt"), ShouldEqual, 6)
+		})
+
+		Convey("Will be refused when the factory refuses them", func() {
+			So(refusing.Bytes("/escape/secret.txt"), ShouldEqual, -1)
+			So(refusing.Bytes("/relative"), ShouldEqual, -1)
+			So(refusing.Bytes("/file.txt"), ShouldEqual, 4)
+			So(refusing.ChangeDir("/escape"), ShouldBeFalse)
+		})
+	})
+}
+
+func TestSetFacts(t *testing.T) {
+	root, err := ioutil.TempDir("", "osdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	local := filepath.Join(root, "file.txt")
+	ioutil.WriteFile(local, []byte("data"), 0644)
+	driver, _ := (&DriverFactory{Root: root}).NewDriver()
+	readOnly, _ := (&DriverFactory{Root: root, ReadOnly: true}).NewDriver()
+	setErr := driver.(graval.FTPFactsDriver).SetFacts("/file.txt", map[string]string{"modify": "20190825130000", "unix.mode": "4600"})
+	info, _ := os.Stat(local)
+	readOnlyErr := readOnly.(graval.FTPFactsDriver).SetFacts("/file.txt", map[string]string{"unix.mode": "0777"})
+
+	Convey("Changing facts on the local filesystem", t, func() {
+		Convey("Will set the modification time and permissions", func() {
+			So(setErr, ShouldBeNil)
+			So(info.ModTime().Unix(), ShouldEqual, 1566738000)
+			So(info.Mode(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("Will be refused when read only", func() {
+			So(readOnlyErr, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCreateModes(t *testing.T) {
+	root, err := ioutil.TempDir("", "osdriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "existing.txt"), []byte("data"), 0600)
+	driver, _ := (&DriverFactory{Root: root}).NewDriver()
+	driver.(*Driver).SetCreateModes(0664, 0775)
+	driver.PutFile("/new.txt", strings.NewReader("data"))
+	driver.PutFile("/existing.txt", strings.NewReader("data"))
+	driver.MakeDir("/dir")
+	mode := func(name string) os.FileMode {
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			return 0
+		}
+		return info.Mode() & os.ModePerm
+	}
+
+	Convey("A driver with modes for new files", t, func() {
+		Convey("Will create files and directories with them, whatever the umask", func() {
+			So(mode("new.txt"), ShouldEqual, 0664)
+			So(mode("dir"), ShouldEqual, 0775)
+		})
+
+		Convey("Will leave existing files alone", func() {
+			So(mode("existing.txt"), ShouldEqual, 0600)
+		})
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package osdriver
+
+import "os"
+
+// fileOwner returns no owner, since it can't be found on this platform.
+func fileOwner(info os.FileInfo) (string, string) {
+	return "", ""
+}
@@ -0,0 +1,47 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package osdriver
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// the names of users and groups already looked up, keyed by "u" or "g" and
+// the numeric ID, since a listing often has many files with the same owner
+var ownerNames = struct {
+	sync.Mutex
+	names map[string]string
+}{names: map[string]string{}}
+
+// fileOwner returns the names of the user and group that own a file, or
+// their numeric IDs if they have no names.
+func fileOwner(info os.FileInfo) (string, string) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+	return ownerName("u", strconv.FormatUint(uint64(stat.Uid), 10)), ownerName("g", strconv.FormatUint(uint64(stat.Gid), 10))
+}
+
+func ownerName(kind string, id string) string {
+	ownerNames.Lock()
+	defer ownerNames.Unlock()
+	if name, ok := ownerNames.names[kind+id]; ok {
+		return name
+	}
+	name := id
+	if kind == "u" {
+		if found, err := user.LookupId(id); err == nil {
+			name = found.Username
+		}
+	} else if found, err := user.LookupGroupId(id); err == nil {
+		name = found.Name
+	}
+	ownerNames.names[kind+id] = name
+	return name
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package osdriver
+
+import "errors"
+
+// AvailableSpace implements graval.FTPSpaceDriver. The space left on the
+// filesystem can't be found on this platform, so it always fails.
+func (driver *Driver) AvailableSpace(path string) (int64, error) {
+	if driver.factory.ReadOnly {
+		return 0, nil
+	}
+	return 0, errors.New("osdriver: available space unknown on this platform")
+}
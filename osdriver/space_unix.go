@@ -0,0 +1,20 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package osdriver
+
+import "syscall"
+
+// AvailableSpace implements graval.FTPSpaceDriver, reporting the space left
+// for unprivileged users on the filesystem holding path. A read only driver
+// always reports none.
+func (driver *Driver) AvailableSpace(path string) (int64, error) {
+	if driver.factory.ReadOnly {
+		return 0, nil
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(driver.localPath(path), &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,87 @@
+package graval
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// passivePool keeps listening sockets for passive data connections open
+// between transfers, so busy servers don't bind and close a socket for every
+// PASV. Listeners are grouped by the local IP they're bound to, since passive
+// sockets are always opened on the same IP as the control connection.
+type passivePool struct {
+	mu      sync.Mutex
+	minPort int
+	maxPort int
+	size    int
+	rand    *lockedRand
+	ports   PortAllocator
+	idle    map[string][]*net.TCPListener
+	total   map[string]int
+	closed  bool
+}
+
+func newPassivePool(minPort int, maxPort int, size int, random *lockedRand, allocator PortAllocator) *passivePool {
+	pool := new(passivePool)
+	pool.minPort = minPort
+	pool.maxPort = maxPort
+	pool.size = size
+	pool.rand = random
+	pool.ports = allocator
+	pool.idle = map[string][]*net.TCPListener{}
+	pool.total = map[string]int{}
+	return pool
+}
+
+// get checks out an idle listener on ip. The first time an ip is requested
+// the whole pool for it is allocated up front. An error is returned if every
+// listener for ip is in use, in which case the caller should fall back to a
+// one-off listener.
+func (pool *passivePool) get(ip string) (*net.TCPListener, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		return nil, errors.New("passive listener pool is closed")
+	}
+	for pool.total[ip] < pool.size {
+		listener, err := listenInRange(ip, pool.minPort, pool.maxPort, pool.rand, pool.ports)
+		if err != nil {
+			break
+		}
+		pool.idle[ip] = append(pool.idle[ip], listener)
+		pool.total[ip]++
+	}
+	idle := pool.idle[ip]
+	if len(idle) == 0 {
+		return nil, errors.New("no pooled passive listeners available")
+	}
+	listener := idle[len(idle)-1]
+	pool.idle[ip] = idle[:len(idle)-1]
+	return listener, nil
+}
+
+// put returns a listener to the pool once a transfer no longer needs it.
+func (pool *passivePool) put(ip string, listener *net.TCPListener) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		closeListener(listener, pool.ports)
+		return
+	}
+	pool.idle[ip] = append(pool.idle[ip], listener)
+}
+
+// close releases every idle listener. Listeners that are checked out are
+// closed when they're returned.
+func (pool *passivePool) close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.closed = true
+	for ip, idle := range pool.idle {
+		for _, listener := range idle {
+			closeListener(listener, pool.ports)
+		}
+		delete(pool.idle, ip)
+	}
+}
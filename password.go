@@ -0,0 +1,158 @@
+package graval
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// the shortest password accepted when a PasswordPolicy doesn't say
+const defaultPasswordLength = 8
+
+// PasswordPolicy is what a new password must be like for SITE PSWD to accept
+// it. The zero value only requires the default length.
+type PasswordPolicy struct {
+	// The fewest characters a password may have. Defaults to 8.
+	MinLength int
+
+	// How many kinds of character a password must include, out of lower
+	// case letters, upper case letters, digits and anything else.
+	MinCharClasses int
+
+	// Refuse passwords that contain the user's name, in any case.
+	RejectUserName bool
+
+	// Further checks, like against a list of leaked passwords. The error
+	// is shown to the user, so it should say what's wrong. Optional.
+	Check func(user string, password string) error
+}
+
+// Validate returns why password can't be user's new password, or nil if it
+// can.
+func (policy *PasswordPolicy) Validate(user string, password string) error {
+	if policy == nil {
+		policy = &PasswordPolicy{}
+	}
+	min := policy.MinLength
+	if min <= 0 {
+		min = defaultPasswordLength
+	}
+	if len([]rune(password)) < min {
+		return fmt.Errorf("password must have at least %d characters", min)
+	}
+	if classes := charClasses(password); classes < policy.MinCharClasses {
+		return fmt.Errorf("password must mix at least %d of lower case, upper case, digits and symbols", policy.MinCharClasses)
+	}
+	if policy.RejectUserName && user != "" && strings.Contains(strings.ToLower(password), strings.ToLower(user)) {
+		return errors.New("password must not contain the user name")
+	}
+	if policy.Check != nil {
+		return policy.Check(user, password)
+	}
+	return nil
+}
+
+// charClasses counts the kinds of character in password.
+func charClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// the SITE commands that change passwords, whose parameters must be kept out
+// of logs
+var passwordSiteCommands = map[string]bool{
+	"CPWD": true,
+	"PSWD": true,
+}
+
+// redactParam hides the passwords in the parameter of a PASS, SITE PSWD or
+// SITE CPWD command, for logs and transcripts.
+func redactParam(command string, param string) string {
+	switch strings.ToUpper(command) {
+	case "PASS":
+		return "****"
+	case "SITE":
+		name := strings.SplitN(param, " ", 2)[0]
+		if passwordSiteCommands[strings.ToUpper(name)] {
+			return name + " ****"
+		}
+	}
+	return param
+}
+
+// parsePasswords splits the parameter of SITE PSWD into the old and new
+// passwords. They're separated by a space, or quoted so they can contain
+// spaces, like "old password" "new password".
+func parsePasswords(param string) (string, string, bool) {
+	if strings.HasPrefix(param, `"`) && strings.HasSuffix(param, `"`) {
+		passwords := strings.Split(param[1:len(param)-1], `" "`)
+		if len(passwords) != 2 {
+			return "", "", false
+		}
+		return passwords[0], passwords[1], true
+	}
+	passwords := strings.Fields(param)
+	if len(passwords) != 2 {
+		return "", "", false
+	}
+	return passwords[0], passwords[1], true
+}
+
+// commandSitePswd responds to SITE PSWD, and its alias SITE CPWD, which
+// change the user's password when the driver implements FTPPasswordDriver.
+type commandSitePswd struct{}
+
+func (cmd commandSitePswd) RequireParam() bool {
+	return true
+}
+
+func (cmd commandSitePswd) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSitePswd) Execute(conn *ftpConn, param string) {
+	var driver FTPPasswordDriver
+	if !DriverAs(conn.driver, &driver) {
+		conn.writeMessage(502, "Password changes not supported")
+		return
+	}
+	oldPassword, newPassword, ok := parsePasswords(param)
+	if !ok {
+		conn.writeMessage(501, "Syntax error, use SITE PSWD <old password> <new password>")
+		return
+	}
+	if !conn.driver.Authenticate(conn.user, oldPassword) {
+		conn.securityEvent(SecurityAuthFailure, conn.user)
+		conn.authFailed()
+		conn.writeMessage(530, "Incorrect password, not changed")
+		return
+	}
+	if newPassword == oldPassword {
+		conn.writeMessage(550, "Password not changed: new password must be different")
+		return
+	}
+	if err := conn.server.passwordPolicy.Validate(conn.user, newPassword); err != nil {
+		conn.writeMessage(550, "Password not changed: "+err.Error())
+		return
+	}
+	if err := driver.ChangePassword(conn.user, oldPassword, newPassword); err != nil {
+		conn.logger.Printf("Unable to change password for %s: %s", conn.user, err)
+		conn.writeDriverError(err, 550, "Password not changed")
+		return
+	}
+	conn.logger.Printf("Password changed for %s", conn.user)
+	conn.writeMessage(200, "Password changed")
+}
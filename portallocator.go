@@ -0,0 +1,128 @@
+package graval
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// PortAllocator chooses the ports for passive data connections, in place of
+// picking a random free port between PasvMinPort and PasvMaxPort. Use one
+// when several servers share a public IP, such as containers behind one NAT
+// address, so they never give clients the same port. An implementation
+// could lock a file for each port, like FilePortAllocator, or record the
+// ports in use in Redis. It's called from more than one goroutine.
+type PortAllocator interface {
+	// returns - a port no other server is using, or an error if none are
+	//           free
+	AllocatePort() (int, error)
+
+	// params  - a port returned by AllocatePort that's no longer in use
+	ReleasePort(int)
+}
+
+// listenAllocated opens a listener on host, on a port from allocator. Ports
+// that turn out to be in use by another program are released and another is
+// tried.
+func listenAllocated(host string, allocator PortAllocator) (*net.TCPListener, error) {
+	for retries := 1; retries < 100; retries++ {
+		port, err := allocator.AllocatePort()
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return l.(*net.TCPListener), nil
+		}
+		allocator.ReleasePort(port)
+	}
+	return nil, errors.New("Unable to find available port to listen on")
+}
+
+// closeListener closes a passive listener, and gives its port back to
+// allocator if there is one.
+func closeListener(listener *net.TCPListener, allocator PortAllocator) {
+	listener.Close()
+	if allocator != nil {
+		allocator.ReleasePort(listener.Addr().(*net.TCPAddr).Port)
+	}
+}
+
+var errLockUnsupported = errors.New("graval: file locks aren't supported on this platform")
+
+// FilePortAllocator is a PortAllocator for servers on the same host, which
+// share ports by locking a file for each one in a common directory. Locks are
+// released by the operating system if a server dies, so no ports are lost. It
+// needs flock, so it's only available on Linux, macOS and FreeBSD.
+type FilePortAllocator struct {
+	dir     string
+	minPort int
+	maxPort int
+	rand    *lockedRand
+
+	mu   sync.Mutex
+	held map[int]*os.File
+}
+
+// NewFilePortAllocator returns an allocator for ports from minPort to maxPort,
+// inclusive, that keeps its lock files in dir, creating it if need be. Every
+// server sharing the ports must use the same directory.
+func NewFilePortAllocator(dir string, minPort int, maxPort int) (*FilePortAllocator, error) {
+	if minPort < 1 || maxPort > 65535 || minPort > maxPort {
+		return nil, fmt.Errorf("graval: port range %d-%d is invalid", minPort, maxPort)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FilePortAllocator{
+		dir:     dir,
+		minPort: minPort,
+		maxPort: maxPort,
+		rand:    &lockedRand{},
+		held:    map[int]*os.File{},
+	}, nil
+}
+
+// AllocatePort locks the first free port found, starting from a random one
+// in the range.
+func (allocator *FilePortAllocator) AllocatePort() (int, error) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	count := allocator.maxPort - allocator.minPort + 1
+	start := allocator.rand.intn(count)
+	for i := 0; i < count; i++ {
+		port := allocator.minPort + (start+i)%count
+		if allocator.held[port] != nil {
+			continue
+		}
+		file, err := os.OpenFile(filepath.Join(allocator.dir, fmt.Sprintf("port-%d.lock", port)), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return 0, err
+		}
+		if err := lockFile(file); err != nil {
+			file.Close()
+			if err == errLockUnsupported {
+				return 0, err
+			}
+			continue
+		}
+		allocator.held[port] = file
+		return port, nil
+	}
+	return 0, errors.New("graval: no passive ports free")
+}
+
+// ReleasePort unlocks a port. Its lock file is left behind, since removing it
+// could race with another server locking it.
+func (allocator *FilePortAllocator) ReleasePort(port int) {
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	if file := allocator.held[port]; file != nil {
+		file.Close()
+		delete(allocator.held, port)
+	}
+}
@@ -0,0 +1,50 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFilePortAllocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graval-ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, _ := NewFilePortAllocator(dir, 40000, 40001)
+	second, _ := NewFilePortAllocator(dir, 40000, 40001)
+
+	a, errA := first.AllocatePort()
+	b, errB := first.AllocatePort()
+	_, errFull := second.AllocatePort()
+	first.ReleasePort(a)
+	c, errC := second.AllocatePort()
+	_, errRange := NewFilePortAllocator(dir, 40001, 40000)
+
+	Convey("A file port allocator", t, func() {
+		Convey("Will hand out each port in its range once", func() {
+			So(errA, ShouldBeNil)
+			So(errB, ShouldBeNil)
+			So([]int{a, b}, ShouldContain, 40000)
+			So([]int{a, b}, ShouldContain, 40001)
+		})
+
+		Convey("Won't hand out ports locked by another allocator", func() {
+			So(errFull, ShouldNotBeNil)
+		})
+
+		Convey("Will hand out a port again once it's released", func() {
+			So(errC, ShouldBeNil)
+			So(c, ShouldEqual, a)
+		})
+
+		Convey("Will reject an invalid range", func() {
+			So(errRange, ShouldNotBeNil)
+		})
+	})
+}
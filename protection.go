@@ -0,0 +1,430 @@
+package graval
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProtectionLevel is how a command or reply on the control connection is
+// protected, as described in RFC 2228.
+type ProtectionLevel byte
+
+const (
+	ProtectionClear ProtectionLevel = 'C'
+
+	// Integrity protected, sent with MIC and answered with 631 replies
+	ProtectionSafe ProtectionLevel = 'S'
+
+	// Confidentiality protected, sent with CONF and answered with 632 replies
+	ProtectionConfidential ProtectionLevel = 'E'
+
+	// Integrity and confidentiality protected, sent with ENC and answered
+	// with 633 replies
+	ProtectionPrivate ProtectionLevel = 'P'
+)
+
+// SecurityMechanism is a security mechanism clients can choose with the AUTH
+// command, like GSSAPI, for servers that protect the control connection as
+// described in RFC 2228. graval runs the AUTH, ADAT, MIC, CONF and ENC
+// commands, and the mechanism does the cryptography.
+type SecurityMechanism interface {
+	// NewExchange starts a security data exchange for a session that has
+	// chosen the mechanism with AUTH.
+	//
+	// params  - the session
+	// returns - the exchange, or an error if the mechanism can't be used now
+	NewExchange(session *Session) (SecurityExchange, error)
+}
+
+// SecurityExchange is a session's security data exchange with a
+// SecurityMechanism, and once it's complete, the security context that
+// protects the session's commands and replies.
+type SecurityExchange interface {
+	// Accept takes a token the client sent with ADAT.
+	//
+	// params  - the token
+	// returns - a token to send back, or nil, true when the exchange is
+	//           complete, and an error if the token was refused
+	Accept(token []byte) ([]byte, bool, error)
+
+	// Unwrap recovers a command the client protected with MIC, CONF or ENC.
+	//
+	// params  - the protection level, and the token the client sent
+	// returns - the command line, and an error if it can't be recovered
+	Unwrap(level ProtectionLevel, token []byte) ([]byte, error)
+
+	// Wrap protects a line of a reply to a protected command.
+	//
+	// params  - the protection level, and the reply line
+	// returns - the token to send, and an error if it can't be protected
+	Wrap(level ProtectionLevel, line []byte) ([]byte, error)
+}
+
+// the commands that carry protected commands, and the level of each
+var protectedCommands = map[string]ProtectionLevel{
+	"MIC":  ProtectionSafe,
+	"CONF": ProtectionConfidential,
+	"ENC":  ProtectionPrivate,
+}
+
+// the reply code for replies protected at each level
+var protectedReplyCodes = map[ProtectionLevel]int{
+	ProtectionSafe:         631,
+	ProtectionConfidential: 632,
+	ProtectionPrivate:      633,
+}
+
+// securityState is a session's progress through RFC 2228 security. For TLS,
+// as described in RFC 4217, there's no exchange: security is established as
+// soon as the handshake completes.
+type securityState struct {
+	mechanism   string
+	exchange    SecurityExchange
+	established bool
+	bufferSize  bool
+	dataPrivate bool
+
+	// set by SSCN ON, when the server is the TLS client on data
+	// connections
+	clientMethod bool
+}
+
+// securityFeatures lists the AUTH mechanisms and related commands in a FEAT
+// reply.
+func securityFeatures(server *FTPServer) []string {
+	mechanisms := server.mechanisms
+	if len(mechanisms) == 0 && server.tlsConfig == nil {
+		return nil
+	}
+	names := make([]string, 0, len(mechanisms)+1)
+	for name := range mechanisms {
+		names = append(names, name)
+	}
+	if server.tlsConfig != nil {
+		names = append(names, "TLS")
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, " AUTH "+name)
+	}
+	if server.tlsConfig != nil && server.allowCCC {
+		lines = append(lines, " CCC")
+	}
+	lines = append(lines, " PBSZ", " PROT")
+	if server.tlsConfig != nil {
+		lines = append(lines, " SSCN")
+	}
+	return lines
+}
+
+// unprotect unwraps a MIC, CONF or ENC command line, returning the command
+// line inside it and the level it was protected at. Other lines are returned
+// unchanged, at ProtectionClear. If a protected command can't be unwrapped
+// the client is told, and false is returned.
+func (ftpConn *ftpConn) unprotect(line string) (string, ProtectionLevel, bool) {
+	command, param := parseCommandLine(line)
+	level, ok := protectedCommands[command]
+	if !ok || len(ftpConn.server.mechanisms) == 0 {
+		return line, ProtectionClear, true
+	}
+	ftpConn.logger.PrintCommand(command, "")
+	ftpConn.transcript.Command(command, "")
+	ftpConn.beginReplies(command)
+	security := ftpConn.security
+	if security == nil || !security.established {
+		ftpConn.writeMessage(503, "Bad sequence of commands: security data exchange not complete")
+		return "", ProtectionClear, false
+	}
+	if security.exchange == nil {
+		ftpConn.writeMessage(537, "Command protection level not supported by security mechanism")
+		return "", ProtectionClear, false
+	}
+	token, err := base64.StdEncoding.DecodeString(param)
+	if err != nil {
+		ftpConn.writeMessage(501, "Syntax error in parameters or arguments")
+		return "", ProtectionClear, false
+	}
+	unwrapped, err := security.exchange.Unwrap(level, token)
+	if err != nil {
+		ftpConn.logger.Printf("Unable to unwrap %s command: %s", command, err)
+		ftpConn.writeMessage(535, "Failed security check")
+		return "", ProtectionClear, false
+	}
+	inner := strings.TrimRight(string(unwrapped), "\r\n")
+	if _, nested := protectedCommands[strings.ToUpper(strings.SplitN(inner, " ", 2)[0])]; nested {
+		ftpConn.writeMessage(533, "Command protection level denied for policy reasons")
+		return "", ProtectionClear, false
+	}
+	return inner, level, true
+}
+
+// setProtection sets the level replies are protected at, for the protected
+// command that's about to run.
+func (ftpConn *ftpConn) setProtection(level ProtectionLevel) {
+	ftpConn.replyMu.Lock()
+	ftpConn.protection = level
+	ftpConn.replyMu.Unlock()
+}
+
+// protectReply protects each line of a reply at the level the command it
+// answers was protected at. If it can't be protected, a 535 reply is sent
+// in the clear instead. The caller must hold replyMu.
+func (ftpConn *ftpConn) protectReply(reply string) string {
+	level := ftpConn.protection
+	code := protectedReplyCodes[level]
+	if code == 0 || ftpConn.security == nil {
+		return reply
+	}
+	lines := strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+	var protected strings.Builder
+	for i, line := range lines {
+		token, err := ftpConn.security.exchange.Wrap(level, []byte(line))
+		if err != nil {
+			ftpConn.logger.Printf("Unable to protect reply: %s", err)
+			return formatReply(535, "Failed security check")
+		}
+		separator := " "
+		if i < len(lines)-1 {
+			separator = "-"
+		}
+		protected.WriteString(strconv.Itoa(code) + separator + base64.StdEncoding.EncodeToString(token) + "\r\n")
+	}
+	return protected.String()
+}
+
+// commandAuth responds to the AUTH FTP command, which chooses a security
+// mechanism and starts a security data exchange, or with TLS or SSL, starts
+// a TLS handshake on the control connection.
+type commandAuth struct{}
+
+func (cmd commandAuth) RequireParam() bool {
+	return true
+}
+
+func (cmd commandAuth) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandAuth) Execute(conn *ftpConn, param string) {
+	name := strings.ToUpper(param)
+	if conn.tlsConn != nil {
+		conn.writeMessage(503, "Bad sequence of commands: TLS already negotiated")
+		return
+	}
+	if tlsMechanism(name) && conn.server.tlsConfig != nil {
+		if conn.protection != ProtectionClear {
+			// the command was read from under another mechanism, and what
+			// follows it may already have been read too
+			conn.writeMessage(533, "Command protection level denied for policy reasons")
+			return
+		}
+		conn.setProtection(ProtectionClear)
+		conn.security = nil
+		conn.writeMessage(234, "AUTH "+name+" successful")
+		if conn.startTLS() {
+			conn.security = &securityState{mechanism: name, established: true}
+		}
+		return
+	}
+	mechanism, ok := conn.server.mechanisms[name]
+	if !ok {
+		conn.writeMessage(504, "Security mechanism not understood")
+		return
+	}
+	// a new AUTH abandons any earlier exchange
+	conn.setProtection(ProtectionClear)
+	conn.security = nil
+	exchange, err := mechanism.NewExchange(&Session{conn: conn})
+	if err != nil {
+		conn.logger.Printf("Unable to start %s security data exchange: %s", name, err)
+		conn.writeMessage(431, "Need some unavailable resource to process security")
+		return
+	}
+	conn.security = &securityState{mechanism: name, exchange: exchange}
+	conn.writeMessage(334, fmt.Sprintf("Using authentication type %s; ADAT must follow", name))
+}
+
+// commandAdat responds to the ADAT FTP command, which carries the tokens of
+// a security data exchange.
+type commandAdat struct{}
+
+func (cmd commandAdat) RequireParam() bool {
+	return true
+}
+
+func (cmd commandAdat) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandAdat) Execute(conn *ftpConn, param string) {
+	security := conn.security
+	if security == nil {
+		conn.writeMessage(503, "Bad sequence of commands: send AUTH first")
+		return
+	}
+	if security.established {
+		conn.writeMessage(503, "Bad sequence of commands: security data exchange complete")
+		return
+	}
+	token, err := base64.StdEncoding.DecodeString(param)
+	if err != nil {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	reply, done, err := security.exchange.Accept(token)
+	if err != nil {
+		conn.logger.Printf("%s security data exchange failed: %s", security.mechanism, err)
+		conn.securityEvent(SecurityAuthFailure, "")
+		conn.writeMessage(535, "Failed security check")
+		return
+	}
+	message := ""
+	if reply != nil {
+		message = "ADAT=" + base64.StdEncoding.EncodeToString(reply)
+	}
+	if !done {
+		conn.writeMessage(335, message)
+		return
+	}
+	security.established = true
+	if message == "" {
+		message = "Security data exchange complete"
+	}
+	conn.writeMessage(235, message)
+}
+
+// commandPbsz responds to the PBSZ FTP command, which sets the buffer size
+// for data connection protection. TLS doesn't use a buffer, so the reply is
+// always PBSZ=0.
+type commandPbsz struct{}
+
+func (cmd commandPbsz) RequireParam() bool {
+	return true
+}
+
+func (cmd commandPbsz) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandPbsz) Execute(conn *ftpConn, param string) {
+	if conn.security == nil || !conn.security.established {
+		conn.writeMessage(503, "Bad sequence of commands: security data exchange not complete")
+		return
+	}
+	if _, err := strconv.ParseUint(param, 10, 32); err != nil {
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	conn.security.bufferSize = true
+	conn.writeMessage(200, "PBSZ=0")
+}
+
+// commandProt responds to the PROT FTP command, which sets the protection
+// level of data connections. C, for clear, is always supported, and P, for
+// private, once TLS protects the control connection.
+type commandProt struct{}
+
+func (cmd commandProt) RequireParam() bool {
+	return true
+}
+
+func (cmd commandProt) RequireAuth() bool {
+	return false
+}
+
+func (cmd commandProt) Execute(conn *ftpConn, param string) {
+	if conn.security == nil || !conn.security.bufferSize {
+		conn.writeMessage(503, "Bad sequence of commands: send PBSZ first")
+		return
+	}
+	if len(param) != 1 {
+		conn.writeMessage(504, "Command not implemented for that parameter")
+		return
+	}
+	switch level := ProtectionLevel(strings.ToUpper(param)[0]); {
+	case level == ProtectionClear:
+		conn.security.dataPrivate = false
+		conn.writeMessage(200, "Protection level set to C")
+	case level == ProtectionPrivate && conn.security.exchange == nil:
+		conn.security.dataPrivate = true
+		conn.writeMessage(200, "Protection level set to P")
+	case level == ProtectionSafe, level == ProtectionConfidential, level == ProtectionPrivate:
+		conn.writeMessage(536, "Requested PROT level not supported by mechanism")
+	default:
+		conn.writeMessage(504, "Command not implemented for that parameter")
+	}
+}
+
+// commandSscn responds to the SSCN FTP command, which chooses which end of
+// a protected data connection is the TLS client. Clients use it in server
+// to server transfers, where both ends of the data connection are servers:
+// SSCN ON makes this server the TLS client, and SSCN OFF, the default, the
+// TLS server. Without a parameter it reports the current choice. SSCN ON is
+// only accepted when the server allows FXP.
+type commandSscn struct{}
+
+func (cmd commandSscn) RequireParam() bool {
+	return false
+}
+
+func (cmd commandSscn) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandSscn) Execute(conn *ftpConn, param string) {
+	security := conn.security
+	if security == nil || !security.established || security.exchange != nil {
+		conn.writeMessage(503, "Bad sequence of commands: use AUTH TLS first")
+		return
+	}
+	switch strings.ToUpper(param) {
+	case "":
+	case "ON":
+		if !conn.server.allowFXP {
+			conn.writeMessage(504, "Command not implemented for that parameter")
+			return
+		}
+		security.clientMethod = true
+	case "OFF":
+		security.clientMethod = false
+	default:
+		conn.writeMessage(501, "Syntax error in parameters or arguments")
+		return
+	}
+	if security.clientMethod {
+		conn.writeMessage(200, "SSCN:CLIENT METHOD")
+	} else {
+		conn.writeMessage(200, "SSCN:SERVER METHOD")
+	}
+}
+
+// commandCcc responds to the CCC FTP command, which returns the control
+// connection to the clear, for clients behind NAT devices that need to read
+// PORT and PASV. It's only allowed if the server has AllowCCC set and the
+// client logged in over TLS, so credentials are never sent in the clear.
+type commandCcc struct{}
+
+func (cmd commandCcc) RequireParam() bool {
+	return false
+}
+
+func (cmd commandCcc) RequireAuth() bool {
+	return true
+}
+
+func (cmd commandCcc) Execute(conn *ftpConn, param string) {
+	if conn.tlsConn == nil {
+		conn.writeMessage(533, "Command protection level denied for policy reasons")
+		return
+	}
+	if !conn.server.allowCCC || !conn.tlsLogin {
+		conn.writeMessage(534, "Request denied for policy reasons")
+		return
+	}
+	conn.writeMessage(200, "Control channel cleared")
+	conn.stopTLS()
+}
@@ -0,0 +1,134 @@
+package graval
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// the most data a paced transfer moves before checking its share of the
+// bandwidth again
+const pacedChunkSize = 32 * 1024
+
+// transferSlots limits the number of transfers running at once. Some slots
+// can be held back for users with a priority above zero, so they can still
+// transfer files when everyone else has filled the server.
+type transferSlots struct {
+	mu       sync.Mutex
+	max      int
+	reserved int
+	active   int
+}
+
+// acquire takes a slot for a user with the given priority, returning false if
+// there are none left for them.
+func (slots *transferSlots) acquire(priority int) bool {
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+	limit := slots.max
+	if priority <= 0 {
+		limit -= slots.reserved
+	}
+	if slots.active >= limit {
+		return false
+	}
+	slots.active++
+	return true
+}
+
+func (slots *transferSlots) release() {
+	slots.mu.Lock()
+	slots.active--
+	slots.mu.Unlock()
+}
+
+// bandwidthShare divides MaxBandwidth between the transfers in progress, in
+// proportion to their weights. A rate of 0 means unlimited. A transfer's weight is its user's priority
+// plus one, so a priority 1 user gets twice the bandwidth of a priority 0
+// user while both are transferring.
+type bandwidthShare struct {
+	rate float64
+
+	mu     sync.Mutex
+	weight int
+}
+
+func (share *bandwidthShare) join(weight int) {
+	share.mu.Lock()
+	share.weight += weight
+	share.mu.Unlock()
+}
+
+func (share *bandwidthShare) leave(weight int) {
+	share.mu.Lock()
+	share.weight -= weight
+	share.mu.Unlock()
+}
+
+func (share *bandwidthShare) setRate(rate float64) {
+	share.mu.Lock()
+	share.rate = rate
+	share.mu.Unlock()
+}
+
+// rateFor returns the bytes per second currently allowed for a transfer with
+// the given weight, or 0 if there's no limit.
+func (share *bandwidthShare) rateFor(weight int) float64 {
+	share.mu.Lock()
+	defer share.mu.Unlock()
+	if share.weight <= 0 {
+		return share.rate
+	}
+	return share.rate * float64(weight) / float64(share.weight)
+}
+
+// pacedReader slows reads down to a transfer's share of the bandwidth.
+type pacedReader struct {
+	reader io.Reader
+	share  *bandwidthShare
+	weight int
+	clock  Clock
+	next   time.Time
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	if len(p) > pacedChunkSize {
+		p = p[:pacedChunkSize]
+	}
+	n, err := r.reader.Read(p)
+	rate := r.share.rateFor(r.weight)
+	if n > 0 && rate > 0 {
+		now := r.clock.Now()
+		if r.next.Before(now) {
+			r.next = now
+		}
+		r.next = r.next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+		clockSleep(r.clock, r.next.Sub(now))
+	}
+	return n, err
+}
+
+// acquireTransfer reserves one of the server's transfer slots for a user with
+// the given priority, if MaxTransfers is set. It returns false if there are
+// none available, otherwise the caller must call releaseTransfer once the
+// transfer is over.
+func (ftpServer *FTPServer) acquireTransfer(priority int) bool {
+	if ftpServer.transferSlots == nil {
+		return true
+	}
+	return ftpServer.transferSlots.acquire(priority)
+}
+
+// releaseTransfer frees a slot taken by acquireTransfer.
+func (ftpServer *FTPServer) releaseTransfer() {
+	if ftpServer.transferSlots != nil {
+		ftpServer.transferSlots.release()
+	}
+}
+
+// pace slows reader down to the transfer's share of MaxBandwidth, if it's
+// set. The limit can be changed with SetMaxBandwidth while the transfer is
+// running.
+func (t *transfer) pace(reader io.Reader) io.Reader {
+	return &pacedReader{reader: reader, share: t.conn.server.bandwidth, weight: t.weight, clock: t.conn.server.clock}
+}
@@ -0,0 +1,60 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestTransferSlots(t *testing.T) {
+	slots := &transferSlots{max: 3, reserved: 1}
+	first := slots.acquire(0)
+	second := slots.acquire(0)
+	third := slots.acquire(0)
+	priority := slots.acquire(1)
+	full := slots.acquire(1)
+	slots.release()
+	released := slots.acquire(1)
+
+	Convey("Transfer slots", t, func() {
+		Convey("Will hold back reserved slots from normal users", func() {
+			So(first, ShouldBeTrue)
+			So(second, ShouldBeTrue)
+			So(third, ShouldBeFalse)
+		})
+
+		Convey("Will give reserved slots to priority users", func() {
+			So(priority, ShouldBeTrue)
+			So(full, ShouldBeFalse)
+			So(released, ShouldBeTrue)
+		})
+	})
+}
+
+func TestBandwidthShare(t *testing.T) {
+	share := &bandwidthShare{rate: 900}
+	alone := share.rateFor(1)
+	share.join(1)
+	share.join(2)
+	normal := share.rateFor(1)
+	premium := share.rateFor(2)
+	share.leave(2)
+	afterLeaving := share.rateFor(1)
+	share.setRate(0)
+	unlimited := share.rateFor(1)
+
+	Convey("The bandwidth share", t, func() {
+		Convey("Will give all the bandwidth to a single transfer", func() {
+			So(alone, ShouldEqual, 900)
+			So(afterLeaving, ShouldEqual, 900)
+		})
+
+		Convey("Will divide the bandwidth by weight", func() {
+			So(normal, ShouldEqual, 300)
+			So(premium, ShouldEqual, 600)
+		})
+
+		Convey("Will allow the rate to be changed to unlimited", func() {
+			So(unlimited, ShouldEqual, 0)
+		})
+	})
+}
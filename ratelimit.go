@@ -0,0 +1,103 @@
+package graval
+
+import (
+	"sync"
+	"time"
+)
+
+// how often idle buckets are swept out of a rateLimiter
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter is a set of token buckets, one per client IP or user, shared by
+// every session on a server. Each command takes a token. A client that has
+// run out of tokens is slowed down until one is available, and one that runs
+// up a debt of more than burst tokens is over the limit.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	clock Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		clock:     clock,
+		buckets:   map[string]*rateBucket{},
+		lastSweep: clock.Now(),
+	}
+}
+
+// take removes a token from the bucket for key. It returns how long the
+// caller should wait before going ahead, and false if the client has gone so
+// far over the limit that it should be disconnected.
+func (limiter *rateLimiter) take(key string) (time.Duration, bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := limiter.clock.Now()
+	if now.Sub(limiter.lastSweep) > rateLimitSweepInterval {
+		limiter.sweep(now)
+	}
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		bucket = &rateBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * limiter.rate
+	if bucket.tokens > limiter.burst {
+		bucket.tokens = limiter.burst
+	}
+	bucket.updated = now
+	if bucket.tokens-1 < -limiter.burst {
+		return 0, false
+	}
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-bucket.tokens / limiter.rate * float64(time.Second)), true
+}
+
+// sweep forgets buckets that have refilled, since they're no different to a
+// new one. The caller must hold mu.
+func (limiter *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastSweep = now
+}
+
+// throttle applies the server's command rate limit before a command is run,
+// to both the client's IP and, once logged in, the user. It sleeps if the
+// client is over the limit, and returns false if the client is so far over
+// it that the session should end.
+func (ftpConn *ftpConn) throttle() bool {
+	limiter := ftpConn.server.cmdLimiter
+	if limiter == nil {
+		return true
+	}
+	wait, ok := limiter.take("ip:" + ftpConn.remoteIP())
+	if ftpConn.user != "" {
+		userWait, userOk := limiter.take("user:" + ftpConn.account)
+		if userWait > wait {
+			wait = userWait
+		}
+		ok = ok && userOk
+	}
+	if !ok {
+		return false
+	}
+	clockSleep(ftpConn.server.clock, wait)
+	return true
+}
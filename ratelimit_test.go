@@ -0,0 +1,43 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 2, systemClock{})
+	var waits []time.Duration
+	var oks []bool
+	for i := 0; i < 5; i++ {
+		wait, ok := limiter.take("ip:192.0.2.1")
+		waits = append(waits, wait)
+		oks = append(oks, ok)
+	}
+	otherWait, otherOk := limiter.take("ip:192.0.2.2")
+
+	Convey("The rate limiter", t, func() {
+		Convey("Will allow a burst without waiting", func() {
+			So(waits[0], ShouldEqual, 0)
+			So(waits[1], ShouldEqual, 0)
+			So(oks[1], ShouldBeTrue)
+		})
+
+		Convey("Will slow down clients over the rate", func() {
+			So(oks[2], ShouldBeTrue)
+			So(waits[2], ShouldBeGreaterThan, 900*time.Millisecond)
+			So(oks[3], ShouldBeTrue)
+			So(waits[3], ShouldBeGreaterThan, waits[2])
+		})
+
+		Convey("Will refuse clients a burst ahead of the rate", func() {
+			So(oks[4], ShouldBeFalse)
+		})
+
+		Convey("Will limit each key separately", func() {
+			So(otherWait, ShouldEqual, 0)
+			So(otherOk, ShouldBeTrue)
+		})
+	})
+}
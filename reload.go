@@ -0,0 +1,114 @@
+package graval
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+)
+
+// sessionSettings are the options that can be changed with Reload. Each
+// session takes the server's settings when it connects and keeps them until
+// it ends, so a reload never changes the rules for a session part way
+// through.
+type sessionSettings struct {
+	driverFactory   FTPDriverFactory
+	serverName      string
+	welcomeMessage  string
+	maxConnections  int64
+	idleTimeout     time.Duration
+	dataConnTimeout time.Duration
+	maxUploadSize   int64
+	userMaxUpload   func(string) int64
+	userPriority    func(string) int
+	userTreeDelete  func(string) bool
+	userXferCap     func(string) int64
+	authFailDelay   time.Duration
+	authTarpitMax   time.Duration
+	tlsConfig       *tls.Config
+	dataTLS         *tls.Config
+}
+
+// newSessionSettings takes the reloadable settings from opts, which should
+// already have defaults applied.
+func newSessionSettings(opts *FTPServerOpts) *sessionSettings {
+	return &sessionSettings{
+		driverFactory:   opts.Factory,
+		serverName:      opts.ServerName,
+		welcomeMessage:  opts.WelcomeMessage,
+		maxConnections:  int64(opts.MaxConnections),
+		idleTimeout:     opts.IdleTimeout,
+		dataConnTimeout: opts.DataConnTimeout,
+		maxUploadSize:   opts.MaxUploadSize,
+		userMaxUpload:   opts.UserMaxUploadSize,
+		userPriority:    opts.UserPriority,
+		userTreeDelete:  opts.UserRecursiveDelete,
+		userXferCap:     opts.UserTransferCap,
+		authFailDelay:   opts.AuthFailureDelay,
+		authTarpitMax:   opts.AuthTarpitMax,
+		tlsConfig:       opts.TLSConfig,
+		dataTLS:         dataTLSConfig(opts.TLSConfig, opts.DataTLSConfig),
+	}
+}
+
+// dataTLSConfig returns the configuration for protected data connections:
+// data if it's set, with the certificates from config if it has none, or
+// config.
+func dataTLSConfig(config *tls.Config, data *tls.Config) *tls.Config {
+	if data == nil {
+		return config
+	}
+	if len(data.Certificates) == 0 && data.GetCertificate == nil && config != nil {
+		data = data.Clone()
+		data.Certificates = config.Certificates
+		data.GetCertificate = config.GetCertificate
+	}
+	return data
+}
+
+// Reload applies new options to a running server, for example after its
+// config file has changed, without closing its listeners. The options are
+// checked with Validate first, and nothing changes if they're invalid.
+//
+// Only these options are reloaded: Factory, ServerName, WelcomeMessage,
+// MaxConnections, IdleTimeout, DataConnTimeout, MaxUploadSize,
+// UserMaxUploadSize, UserPriority, UserRecursiveDelete, UserTransferCap,
+// AuthFailureDelay, AuthTarpitMax, TLSConfig and DataTLSConfig. The rest keep
+// the values the server was created with. New sessions use the new options,
+// while established sessions keep the options and driver they started with
+// until they end.
+//
+// Reloading TLSConfig lets a renewed certificate be served without a
+// restart, but it can't turn TLS on or off: a server created without a
+// TLSConfig can't be given one, and one created with a TLSConfig can't lose
+// it.
+func (ftpServer *FTPServer) Reload(opts *FTPServerOpts) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if (opts.TLSConfig == nil) != (ftpServer.tlsConfig == nil) {
+		return errors.New("graval: TLS can't be turned on or off by a reload")
+	}
+	settings := newSessionSettings(serverOptsWithDefaults(opts))
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	ftpServer.settings = settings
+	return nil
+}
+
+// SetDriverFactory replaces the factory that creates a driver for each new
+// session, for example after reloading a list of users. Sessions that are
+// already established keep the driver they have until they end.
+func (ftpServer *FTPServer) SetDriverFactory(factory FTPDriverFactory) {
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	settings := *ftpServer.settings
+	settings.driverFactory = factory
+	ftpServer.settings = &settings
+}
+
+// currentSettings returns the settings for a new session.
+func (ftpServer *FTPServer) currentSettings() *sessionSettings {
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	return ftpServer.settings
+}
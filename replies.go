@@ -0,0 +1,164 @@
+package graval
+
+import (
+	"fmt"
+	"strings"
+)
+
+// replySequence checks that each command gets exactly one completion reply,
+// optionally preceded by preliminary 1yz replies, as RFC 959 requires.
+// Breaking the sequence is always a bug in a command, so mistakes are logged
+// and counted in FTPServerStats.ReplyErrors, where tests can catch them.
+//
+// A 421 can be sent at any time, since it's the reply to whatever the client
+// sends next and the connection is closed straight after.
+type replySequence struct {
+	command   string
+	completed int
+}
+
+// begin starts tracking the replies to a new command.
+func (seq *replySequence) begin(command string) {
+	seq.command = command
+	seq.completed = 0
+}
+
+// reply checks a reply about to be sent, returning an error if it's out of
+// sequence.
+func (seq *replySequence) reply(code int) error {
+	switch {
+	case seq.command == "" || code == 421:
+		return nil
+	case code < 200 && seq.completed != 0:
+		return fmt.Errorf("preliminary reply %d to %s after it completed with %d", code, seq.command, seq.completed)
+	case code < 200:
+		return nil
+	case seq.completed != 0:
+		return fmt.Errorf("second reply %d to %s after it completed with %d", code, seq.command, seq.completed)
+	}
+	seq.completed = code
+	return nil
+}
+
+// end finishes tracking the current command, returning an error if it was
+// never answered.
+func (seq *replySequence) end() error {
+	command := seq.command
+	seq.command = ""
+	if command != "" && seq.completed == 0 {
+		return fmt.Errorf("no reply to %s", command)
+	}
+	return nil
+}
+
+// beginReplies starts checking the replies to command.
+func (ftpConn *ftpConn) beginReplies(command string) {
+	ftpConn.replyMu.Lock()
+	ftpConn.replySeq.begin(command)
+	ftpConn.replyMu.Unlock()
+}
+
+// endReplies checks that the command that just ran was answered.
+func (ftpConn *ftpConn) endReplies() {
+	ftpConn.replyMu.Lock()
+	defer ftpConn.replyMu.Unlock()
+	ftpConn.replySequenceError(ftpConn.replySeq.end())
+}
+
+// checkReply checks the sequence of replies. The caller must hold replyMu.
+func (ftpConn *ftpConn) checkReply(code int) {
+	ftpConn.replySequenceError(ftpConn.replySeq.reply(code))
+}
+
+func (ftpConn *ftpConn) replySequenceError(err error) {
+	if err != nil {
+		ftpConn.logger.Printf("Reply sequence error: %s", err)
+		ftpConn.server.stats.replyError()
+	}
+}
+
+// Reply is a reply about to be sent to a client, given to a ReplyFilter.
+type Reply struct {
+	// The session and, once logged in, the user the reply is going to
+	SessionId string
+	User      string
+
+	// The command being answered, or empty for the greeting and replies
+	// that aren't to a command
+	Command string
+
+	Code int
+
+	// The text of a single line reply
+	Message string
+
+	// Every line of a multiline reply, as sent without line endings, with
+	// the code at the start of the first and last lines. Message is empty
+	// when Lines is set.
+	Lines []string
+}
+
+// ReplyFilter can change each reply before it's sent, for example to remove
+// the server's name, add a tracking ID or translate the text. Changing Code
+// to one that means something else confuses clients, and for a multiline
+// reply the codes in Lines must be changed to match.
+type ReplyFilter func(reply *Reply)
+
+// filterReply passes a reply to command through the server's ReplyFilter, if
+// it has one, and returns the reply to send.
+func (ftpConn *ftpConn) filterReply(command string, code int, message string, lines []string) (int, string, []string) {
+	if ftpConn.server.replyFilter == nil {
+		return code, message, lines
+	}
+	ftpConn.mu.Lock()
+	user := ftpConn.user
+	ftpConn.mu.Unlock()
+	reply := &Reply{
+		SessionId: ftpConn.sessionId,
+		User:      user,
+		Command:   command,
+		Code:      code,
+		Message:   message,
+		Lines:     lines,
+	}
+	ftpConn.server.replyFilter(reply)
+	return reply.Code, reply.Message, reply.Lines
+}
+
+// replyEscaper replaces the characters that would let text in a reply, like a
+// path sent by the client, break out of its line.
+var replyEscaper = strings.NewReplacer("\r", " ", "\n", " ", "\x00", " ")
+
+// formatReply formats a single line reply for the wire.
+func formatReply(code int, message string) string {
+	return fmt.Sprintf("%d %s\r\n", code, replyEscaper.Replace(message))
+}
+
+// formatReplyLines formats a multiline reply for the wire. The first and last
+// lines must start with the code. Lines in between that look like the end of
+// the reply, by starting with three digits and a space, are indented so
+// clients don't stop reading at them.
+func formatReplyLines(lines []string) string {
+	var reply strings.Builder
+	for i, line := range lines {
+		line = replyEscaper.Replace(line)
+		if i > 0 && i < len(lines)-1 && looksLikeReplyEnd(line) {
+			line = " " + line
+		}
+		reply.WriteString(line)
+		reply.WriteString("\r\n")
+	}
+	return reply.String()
+}
+
+func looksLikeReplyEnd(line string) bool {
+	if len(line) < 4 || line[3] != ' ' {
+		return false
+	}
+	for _, c := range line[:3] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
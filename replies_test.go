@@ -0,0 +1,63 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestReplySequence(t *testing.T) {
+	var seq replySequence
+	seq.begin("RETR")
+	preliminary := seq.reply(150)
+	completion := seq.reply(226)
+	second := seq.reply(226)
+	late := seq.reply(150)
+	closing := seq.reply(421)
+	answered := seq.end()
+
+	seq.begin("NOOP")
+	missing := seq.end()
+	unsolicited := seq.reply(421)
+
+	Convey("The reply sequence", t, func() {
+		Convey("Will allow a preliminary reply before the completion", func() {
+			So(preliminary, ShouldBeNil)
+			So(completion, ShouldBeNil)
+			So(answered, ShouldBeNil)
+		})
+
+		Convey("Will catch a second completion reply", func() {
+			So(second, ShouldNotBeNil)
+		})
+
+		Convey("Will catch a preliminary reply after the completion", func() {
+			So(late, ShouldNotBeNil)
+		})
+
+		Convey("Will allow a 421 at any time", func() {
+			So(closing, ShouldBeNil)
+			So(unsolicited, ShouldBeNil)
+		})
+
+		Convey("Will catch a command with no reply", func() {
+			So(missing, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFormatReply(t *testing.T) {
+	Convey("Formatting replies", t, func() {
+		Convey("Will end a reply with CRLF", func() {
+			So(formatReply(200, "OK"), ShouldEqual, "200 OK\r\n")
+		})
+
+		Convey("Will keep text from breaking out of its line", func() {
+			So(formatReply(250, "Directory changed to /a\r\n226 b\x00"), ShouldEqual, "250 Directory changed to /a  226 b \r\n")
+		})
+
+		Convey("Will indent lines that look like the end of a multiline reply", func() {
+			lines := []string{"211-Status:", "211 not the end", " fine", "211 End"}
+			So(formatReplyLines(lines), ShouldEqual, "211-Status:\r\n 211 not the end\r\n fine\r\n211 End\r\n")
+		})
+	})
+}
@@ -0,0 +1,34 @@
+package graval
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// parseCRC reads a CRC-32 given in hex, as clients print them, and returns it
+// in the form resumeMatches compares against.
+func parseCRC(param string) (string, bool) {
+	crc, err := strconv.ParseUint(param, 16, 32)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%08x", crc), true
+}
+
+// resumeMatches reports whether the first offset bytes of the file at path
+// have the CRC-32 crc, so a resumed upload can be refused when the data
+// already on the server isn't what the client has.
+func (ftpConn *ftpConn) resumeMatches(path string, offset int64, crc string) bool {
+	reader, err := ftpConn.driver.GetFile(path)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	hash := crc32.NewIEEE()
+	if _, err := io.CopyN(hash, reader, offset); err != nil {
+		return false
+	}
+	return fmt.Sprintf("%08x", hash.Sum32()) == crc
+}
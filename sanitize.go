@@ -0,0 +1,81 @@
+package graval
+
+import (
+	"strings"
+	"unicode"
+)
+
+// FilenamePolicy cleans up the paths sent by clients before they reach the
+// driver. Each element of the path is processed separately. Paths that break
+// the policy are refused with a 553 reply.
+type FilenamePolicy struct {
+	// Remove control characters, which are never wanted in filenames and can
+	// cause trouble in logs and terminals.
+	StripControl bool
+
+	// A function to normalise the Unicode in each name, so that names typed
+	// on different systems match. graval has no normalisation tables of its
+	// own; to normalise to NFC, set this to norm.NFC.String from
+	// golang.org/x/text/unicode/norm.
+	Normalize func(string) string
+
+	// Convert names to lower case, for backends that are case insensitive.
+	Lowercase bool
+
+	// Refuse names that can't be created on Windows, like CON, NUL or LPT1,
+	// with or without an extension.
+	RejectWindowsReserved bool
+}
+
+// the device names reserved by Windows, in any case and with any extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Apply returns the cleaned up version of a path from a client, and false if
+// the path isn't allowed.
+func (policy *FilenamePolicy) Apply(path string) (string, bool) {
+	elements := strings.Split(path, "/")
+	for i, name := range elements {
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+		cleaned, ok := policy.applyName(name)
+		if !ok {
+			return "", false
+		}
+		elements[i] = cleaned
+	}
+	return strings.Join(elements, "/"), true
+}
+
+func (policy *FilenamePolicy) applyName(name string) (string, bool) {
+	if policy.StripControl {
+		name = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, name)
+		if name == "" {
+			return "", false
+		}
+	}
+	if policy.Normalize != nil {
+		name = policy.Normalize(name)
+	}
+	if policy.Lowercase {
+		name = strings.ToLower(name)
+	}
+	if policy.RejectWindowsReserved {
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if windowsReservedNames[strings.TrimRight(base, " ")] {
+			return "", false
+		}
+	}
+	return name, true
+}
@@ -0,0 +1,53 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestFilenamePolicy(t *testing.T) {
+	policy := &FilenamePolicy{
+		StripControl:          true,
+		Lowercase:             true,
+		RejectWindowsReserved: true,
+		Normalize:             func(name string) string { return strings.Replace(name, "e\u0301", "\u00e9", -1) },
+	}
+
+	Convey("A filename policy", t, func() {
+		Convey("Will strip control characters", func() {
+			path, ok := policy.Apply("/dir/bad\x07name\x1b.txt")
+			So(ok, ShouldBeTrue)
+			So(path, ShouldEqual, "/dir/badname.txt")
+		})
+
+		Convey("Will reject names that are only control characters", func() {
+			_, ok := policy.Apply("/dir/\x01\x02")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Will normalise and lowercase each name", func() {
+			path, ok := policy.Apply("Cafe\u0301/MENU.TXT")
+			So(ok, ShouldBeTrue)
+			So(path, ShouldEqual, "caf\u00e9/menu.txt")
+		})
+
+		Convey("Will reject reserved Windows names", func() {
+			for _, name := range []string{"/CON", "/dir/nul.txt", "/com1", "/lpt9.tar.gz", "aux /file"} {
+				_, ok := policy.Apply(name)
+				So(ok, ShouldBeFalse)
+			}
+		})
+
+		Convey("Will allow names that only start like reserved names", func() {
+			_, ok := policy.Apply("/console/com10.txt")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Will leave relative elements alone", func() {
+			path, ok := policy.Apply("../dir/./file")
+			So(ok, ShouldBeTrue)
+			So(path, ShouldEqual, "../dir/./file")
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package graval
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// The types of SecurityEvent.
+const (
+	// A client gave the wrong password. Detail is the user name.
+	SecurityAuthFailure = "auth_failure"
+
+	// A client sent a path that tries to climb above the root with "..".
+	// Detail is the path as sent. The path is still confined to the root.
+	SecurityPathTraversal = "path_traversal"
+
+	// A client asked for an active data connection to an address other than
+	// its own, as in an FTP bounce attack. Detail is the address. It's
+	// refused unless the server has AllowFXP set.
+	SecurityBounceAttempt = "bounce_attempt"
+
+	// A client was disconnected for going over CommandRateLimit.
+	SecurityRateLimited = "rate_limited"
+
+	// A client IP was banned. Detail is how long for.
+	SecurityBanned = "banned"
+
+	// A user's transfer was cut off for going over UserTransferCap. Detail
+	// is the cap in bytes.
+	SecurityTransferCap = "transfer_cap"
+
+	// A user gave the right password but their FTPAccountDriver account
+	// doesn't allow the login. Detail is why, like "expired".
+	SecurityAccountRestricted = "account_restricted"
+
+	// A TLS handshake with a client failed, after AUTH TLS on the control
+	// connection or on a data connection protected with PROT P. Detail is
+	// "control: " or "data: " followed by the reason.
+	SecurityTLSFailure = "tls_failure"
+)
+
+// SecurityEvent describes suspicious behaviour by a client, for forwarding to
+// an intrusion detection system or SIEM.
+type SecurityEvent struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	SessionId string    `json:"session,omitempty"`
+	User      string    `json:"user,omitempty"`
+	RemoteIP  string    `json:"remote_ip"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// SecurityNotifier receives security events. Provide an implementation via
+// FTPServerOpts. Notify is called concurrently from many client connections,
+// and holds up the client while it runs, so slow work should be handed off.
+type SecurityNotifier interface {
+	Notify(*SecurityEvent)
+}
+
+// SecurityNotifierFunc adapts an ordinary function to a SecurityNotifier.
+type SecurityNotifierFunc func(*SecurityEvent)
+
+// Notify calls f(event).
+func (f SecurityNotifierFunc) Notify(event *SecurityEvent) {
+	f(event)
+}
+
+// notify sends a security event to the server's notifier, if it has one.
+func (ftpServer *FTPServer) notify(event *SecurityEvent) {
+	if ftpServer.notifier == nil {
+		return
+	}
+	event.Time = ftpServer.clock.Now().UTC()
+	ftpServer.notifier.Notify(event)
+}
+
+// securityEvent reports a security event caused by this session's client.
+func (ftpConn *ftpConn) securityEvent(eventType string, detail string) {
+	user := ftpConn.user
+	if user == "" {
+		user = ftpConn.reqUser
+	}
+	ftpConn.server.notify(&SecurityEvent{
+		Type:      eventType,
+		SessionId: ftpConn.sessionId,
+		User:      user,
+		RemoteIP:  ftpConn.remoteIP(),
+		Detail:    detail,
+	})
+}
+
+// checkTraversal reports a path from the client that climbs above the root.
+// A lone ".." is ignored, since clients send it to go up from the root
+// without meaning any harm.
+func (ftpConn *ftpConn) checkTraversal(filename string) {
+	if filename == ".." || !strings.Contains(filename, "..") {
+		return
+	}
+	depth := 0
+	if !strings.HasPrefix(filename, "/") {
+		depth = len(strings.FieldsFunc(ftpConn.namePrefix, func(r rune) bool { return r == '/' }))
+	}
+	for _, name := range strings.Split(filename, "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				ftpConn.securityEvent(SecurityPathTraversal, filename)
+				return
+			}
+		default:
+			depth++
+		}
+	}
+}
+
+// checkBounce reports an active data connection to a host other than the
+// client's own, and returns false if the server doesn't allow FXP, so the
+// connection should be refused.
+func (ftpConn *ftpConn) checkBounce(host string, port int) bool {
+	ip := net.ParseIP(host)
+	if ip != nil && ip.Equal(net.ParseIP(ftpConn.remoteIP())) {
+		return true
+	}
+	ftpConn.securityEvent(SecurityBounceAttempt, net.JoinHostPort(host, fmt.Sprint(port)))
+	return ftpConn.server.allowFXP
+}
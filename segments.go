@@ -0,0 +1,150 @@
+package graval
+
+import (
+	"io"
+	"sync"
+)
+
+// DownloadSegment is the part of a file one download in a DownloadGroup is
+// fetching, as set by REST or RANG.
+type DownloadSegment struct {
+	Offset int64
+	// -1 for the rest of the file
+	Length int64
+}
+
+// DownloadGroup is the downloads of one file by one user that are running at
+// once, as when a segmented downloader fetches ranges of a file over several
+// connections. It's given to drivers that implement FTPSegmentDriver, so they
+// can serve every segment from a single backend handle. It's safe to use from
+// more than one goroutine.
+type DownloadGroup struct {
+	user string
+	path string
+
+	mu       sync.Mutex
+	segments []*DownloadSegment
+	shared   interface{}
+}
+
+// User returns the user downloading the file.
+func (group *DownloadGroup) User() string {
+	return group.user
+}
+
+// Path returns the path of the file.
+func (group *DownloadGroup) Path() string {
+	return group.path
+}
+
+// Segments returns the parts of the file being downloaded, in the order the
+// downloads started.
+func (group *DownloadGroup) Segments() []DownloadSegment {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	segments := make([]DownloadSegment, len(group.segments))
+	for i, segment := range group.segments {
+		segments[i] = *segment
+	}
+	return segments
+}
+
+// Shared returns the value shared by the group's downloads, calling create
+// to make it for the first one that asks. Other downloads wait while it's
+// created. If the value is an io.Closer, it's closed once the last download
+// in the group finishes.
+func (group *DownloadGroup) Shared(create func() (interface{}, error)) (interface{}, error) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	if group.shared == nil {
+		value, err := create()
+		if err != nil {
+			return nil, err
+		}
+		group.shared = value
+	}
+	return group.shared, nil
+}
+
+type downloadKey struct {
+	user string
+	path string
+}
+
+// downloadGroups tracks the downloads running on a server, grouped by user
+// and file.
+type downloadGroups struct {
+	mu     sync.Mutex
+	groups map[downloadKey]*DownloadGroup
+}
+
+func newDownloadGroups() *downloadGroups {
+	return &downloadGroups{groups: map[downloadKey]*DownloadGroup{}}
+}
+
+// join adds a download of path by user to its group, creating the group if
+// it's the only one.
+func (groups *downloadGroups) join(user, path string, segment *DownloadSegment) *DownloadGroup {
+	key := downloadKey{user: user, path: path}
+	groups.mu.Lock()
+	defer groups.mu.Unlock()
+	group := groups.groups[key]
+	if group == nil {
+		group = &DownloadGroup{user: user, path: path}
+		groups.groups[key] = group
+	}
+	group.mu.Lock()
+	group.segments = append(group.segments, segment)
+	group.mu.Unlock()
+	return group
+}
+
+// leave removes a finished download from its group. When it's the last one,
+// the group is forgotten and its shared value closed.
+func (groups *downloadGroups) leave(group *DownloadGroup, segment *DownloadSegment) {
+	groups.mu.Lock()
+	group.mu.Lock()
+	for i, s := range group.segments {
+		if s == segment {
+			group.segments = append(group.segments[:i], group.segments[i+1:]...)
+			break
+		}
+	}
+	var shared interface{}
+	if len(group.segments) == 0 {
+		delete(groups.groups, downloadKey{user: group.user, path: group.path})
+		shared, group.shared = group.shared, nil
+	}
+	group.mu.Unlock()
+	groups.mu.Unlock()
+	if closer, ok := shared.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// segmentReadCloser leaves its download group when it's closed.
+type segmentReadCloser struct {
+	io.ReadCloser
+	leave sync.Once
+	done  func()
+}
+
+func (r *segmentReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.leave.Do(r.done)
+	return err
+}
+
+// openSegment opens a download with the driver's FTPSegmentDriver, in the
+// group of downloads of the same file by the same user.
+func (ftpConn *ftpConn) openSegment(driver FTPSegmentDriver, path string, offset, length int64) (io.ReadCloser, error) {
+	groups := ftpConn.server.downloads
+	segment := &DownloadSegment{Offset: offset, Length: length}
+	group := groups.join(ftpConn.account, path, segment)
+	reader, err := driver.GetFileSegment(path, offset, length, group)
+	if err != nil {
+		groups.leave(group, segment)
+		return nil, err
+	}
+	return &segmentReadCloser{ReadCloser: reader, done: func() { groups.leave(group, segment) }}, nil
+}
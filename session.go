@@ -0,0 +1,72 @@
+package graval
+
+import (
+	"context"
+	"net"
+)
+
+// Session is a client's connection to the server, for hooks, registered
+// commands and drivers that need to know about it. Its methods report the
+// session as it is when they're called.
+type Session struct {
+	conn *ftpConn
+}
+
+// Id returns the session ID, as used in graval's logs and Sessions.
+func (session *Session) Id() string {
+	return session.conn.sessionId
+}
+
+// RemoteAddr returns the client's address.
+func (session *Session) RemoteAddr() net.Addr {
+	return session.conn.conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to.
+func (session *Session) LocalAddr() net.Addr {
+	return session.conn.conn.LocalAddr()
+}
+
+// User returns the user the session is logged in as, or an empty string
+// before login.
+func (session *Session) User() string {
+	session.conn.mu.Lock()
+	defer session.conn.mu.Unlock()
+	return session.conn.user
+}
+
+// AffinityToken returns the token that names the session to a balancer or
+// proxy, as in SessionAffinity.
+func (session *Session) AffinityToken() string {
+	return session.conn.affinityToken()
+}
+
+// Account returns the account the session's user belongs to, which is the
+// user unless an FTPAliasDriver says otherwise, or an empty string before
+// login.
+func (session *Session) Account() string {
+	session.conn.mu.Lock()
+	defer session.conn.mu.Unlock()
+	return session.conn.account
+}
+
+// CWD returns the session's working directory. Only call it while the
+// session is running a command, from a hook, interceptor, registered command
+// or the driver.
+func (session *Session) CWD() string {
+	return session.conn.namePrefix
+}
+
+// Values returns the values stored for the session.
+func (session *Session) Values() *SessionValues {
+	return session.conn.values
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the session that ctx belongs to, like the
+// context given to FTPTracedDriver, or nil if it doesn't belong to one.
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
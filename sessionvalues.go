@@ -0,0 +1,56 @@
+package graval
+
+import (
+	"context"
+	"sync"
+)
+
+// SessionValues holds values for the length of a session, so the parts of an
+// application that handle it can pass things to each other. For example an
+// authentication middleware can note the user's tenant for the driver to
+// read later. The same SessionValues is given to the driver, if it
+// implements FTPValuesDriver, to CommandInterceptors, CommandHooks,
+// UploadHooks and registered commands, and can be found in the context given
+// to FTPTracedDriver.
+//
+// As with context values, keys should be of an unexported type of the
+// package that uses them, so they can't collide. It's safe to use from more
+// than one goroutine.
+type SessionValues struct {
+	mu     sync.RWMutex
+	values map[interface{}]interface{}
+}
+
+func newSessionValues() *SessionValues {
+	return &SessionValues{values: map[interface{}]interface{}{}}
+}
+
+// Get returns the value for key, or nil if there isn't one.
+func (values *SessionValues) Get(key interface{}) interface{} {
+	values.mu.RLock()
+	defer values.mu.RUnlock()
+	return values.values[key]
+}
+
+// Set stores value for key, replacing any value it had.
+func (values *SessionValues) Set(key interface{}, value interface{}) {
+	values.mu.Lock()
+	defer values.mu.Unlock()
+	values.values[key] = value
+}
+
+// Delete removes the value for key.
+func (values *SessionValues) Delete(key interface{}) {
+	values.mu.Lock()
+	defer values.mu.Unlock()
+	delete(values.values, key)
+}
+
+type sessionValuesKey struct{}
+
+// SessionValuesFromContext returns the values of the session that ctx
+// belongs to, or nil if it doesn't belong to one.
+func SessionValuesFromContext(ctx context.Context) *SessionValues {
+	values, _ := ctx.Value(sessionValuesKey{}).(*SessionValues)
+	return values
+}
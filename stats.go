@@ -0,0 +1,160 @@
+package graval
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// the number of whole seconds BytesPerSecond is averaged over
+const statsRateWindow = 10
+
+// FTPServerStats is a snapshot of the live counters for an FTPServer.
+type FTPServerStats struct {
+	ActiveConnections int64   `json:"active_connections"`
+	TotalConnections  int64   `json:"total_connections"`
+	ActiveTransfers   int64   `json:"active_transfers"`
+	TotalTransfers    int64   `json:"total_transfers"`
+	FailedTransfers   int64   `json:"failed_transfers"`
+	BytesSent         int64   `json:"bytes_sent"`
+	BytesReceived     int64   `json:"bytes_received"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+
+	// Replies sent out of sequence, like a second reply to a command. This
+	// should always be zero; anything else is a bug.
+	ReplyErrors int64 `json:"reply_errors"`
+
+	// The bytes moved by each user, as returned by FTPServer.Usage.
+	Users []UserUsage `json:"users"`
+}
+
+// serverStats holds the counters behind FTPServerStats. Methods are safe to
+// call from many connections at once.
+type serverStats struct {
+	activeConnections int64
+	totalConnections  int64
+	activeTransfers   int64
+	totalTransfers    int64
+	failedTransfers   int64
+	bytesSent         int64
+	bytesReceived     int64
+	replyErrors       int64
+
+	clock Clock
+
+	// bytes moved in each of the most recent seconds, indexed by unix time
+	// modulo the window size
+	mu          sync.Mutex
+	rateBuckets [statsRateWindow]int64
+	rateSeconds [statsRateWindow]int64
+}
+
+func (stats *serverStats) connectionOpened() {
+	atomic.AddInt64(&stats.activeConnections, 1)
+	atomic.AddInt64(&stats.totalConnections, 1)
+}
+
+func (stats *serverStats) connectionClosed() {
+	atomic.AddInt64(&stats.activeConnections, -1)
+}
+
+// active returns the number of connections currently open.
+func (stats *serverStats) active() int64 {
+	return atomic.LoadInt64(&stats.activeConnections)
+}
+
+func (stats *serverStats) transferStarted() {
+	atomic.AddInt64(&stats.activeTransfers, 1)
+	atomic.AddInt64(&stats.totalTransfers, 1)
+}
+
+func (stats *serverStats) transferFinished() {
+	atomic.AddInt64(&stats.activeTransfers, -1)
+}
+
+func (stats *serverStats) transferFailed() {
+	atomic.AddInt64(&stats.failedTransfers, 1)
+}
+
+func (stats *serverStats) addSent(n int64) {
+	atomic.AddInt64(&stats.bytesSent, n)
+	stats.addRate(n)
+}
+
+func (stats *serverStats) addReceived(n int64) {
+	atomic.AddInt64(&stats.bytesReceived, n)
+	stats.addRate(n)
+}
+
+func (stats *serverStats) replyError() {
+	atomic.AddInt64(&stats.replyErrors, 1)
+}
+
+func (stats *serverStats) addRate(n int64) {
+	now := stats.clock.Now().Unix()
+	i := now % statsRateWindow
+	stats.mu.Lock()
+	if stats.rateSeconds[i] != now {
+		stats.rateSeconds[i] = now
+		stats.rateBuckets[i] = 0
+	}
+	stats.rateBuckets[i] += n
+	stats.mu.Unlock()
+}
+
+// bytesPerSecond averages the bytes moved over the last statsRateWindow
+// complete seconds.
+func (stats *serverStats) bytesPerSecond() float64 {
+	now := stats.clock.Now().Unix()
+	var total int64
+	stats.mu.Lock()
+	for i := range stats.rateBuckets {
+		age := now - stats.rateSeconds[i]
+		if age > 0 && age <= statsRateWindow {
+			total += stats.rateBuckets[i]
+		}
+	}
+	stats.mu.Unlock()
+	return float64(total) / statsRateWindow
+}
+
+func (stats *serverStats) snapshot() FTPServerStats {
+	return FTPServerStats{
+		ActiveConnections: atomic.LoadInt64(&stats.activeConnections),
+		TotalConnections:  atomic.LoadInt64(&stats.totalConnections),
+		ActiveTransfers:   atomic.LoadInt64(&stats.activeTransfers),
+		TotalTransfers:    atomic.LoadInt64(&stats.totalTransfers),
+		FailedTransfers:   atomic.LoadInt64(&stats.failedTransfers),
+		BytesSent:         atomic.LoadInt64(&stats.bytesSent),
+		BytesReceived:     atomic.LoadInt64(&stats.bytesReceived),
+		BytesPerSecond:    stats.bytesPerSecond(),
+		ReplyErrors:       atomic.LoadInt64(&stats.replyErrors),
+	}
+}
+
+// Stats returns a snapshot of the live counters for this server.
+func (ftpServer *FTPServer) Stats() FTPServerStats {
+	stats := ftpServer.stats.snapshot()
+	stats.Users = ftpServer.Usage()
+	return stats
+}
+
+// StatsHandler returns an http.Handler that responds with the current Stats()
+// encoded as JSON, suitable for mounting on a status page.
+func (ftpServer *FTPServer) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ftpServer.Stats())
+	})
+}
+
+// PublishExpvar publishes the server's Stats() as an expvar variable with the
+// given name, so they appear on /debug/vars. Like expvar.Publish, it panics if
+// the name is already in use.
+func (ftpServer *FTPServer) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return ftpServer.Stats()
+	}))
+}
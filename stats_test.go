@@ -0,0 +1,49 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestServerStats(t *testing.T) {
+	stats := &serverStats{clock: systemClock{}}
+	stats.connectionOpened()
+	stats.connectionOpened()
+	stats.connectionClosed()
+	stats.transferStarted()
+	stats.addSent(100)
+	stats.addReceived(50)
+	snapshot := stats.snapshot()
+	Convey("The server stats", t, func() {
+		Convey("Will count active and total connections", func() {
+			So(snapshot.ActiveConnections, ShouldEqual, 1)
+			So(snapshot.TotalConnections, ShouldEqual, 2)
+		})
+
+		Convey("Will count transfers in flight", func() {
+			So(snapshot.ActiveTransfers, ShouldEqual, 1)
+			So(snapshot.TotalTransfers, ShouldEqual, 1)
+		})
+
+		Convey("Will count bytes in each direction", func() {
+			So(snapshot.BytesSent, ShouldEqual, 100)
+			So(snapshot.BytesReceived, ShouldEqual, 50)
+		})
+	})
+}
+
+func TestFormatSize(t *testing.T) {
+	Convey("Sizes in transfer stats", t, func() {
+		Convey("Will be given in bytes when they're small", func() {
+			So(formatSize(0), ShouldEqual, "0 B")
+			So(formatSize(999), ShouldEqual, "999 B")
+		})
+
+		Convey("Will be given to three significant figures", func() {
+			So(formatSize(10400000), ShouldEqual, "10.4 MB")
+			So(formatSize(4950000), ShouldEqual, "4.95 MB")
+			So(formatSize(1000), ShouldEqual, "1 kB")
+			So(formatSize(123456), ShouldEqual, "123 kB")
+		})
+	})
+}
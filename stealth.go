@@ -0,0 +1,27 @@
+package graval
+
+// stealthFeatures returns the FEAT reply for a server in Stealth mode. It
+// leaves out the extensions few servers have, like RANG and MFF, and the
+// graval specific facts in MLST, though the commands still work for clients
+// that try them. AUTH TLS is listed when the server has a TLSConfig, since
+// most servers offer it, and REST STREAM when the driver can resume uploads.
+func stealthFeatures(driver FTPDriver, offersTLS bool) []string {
+	lines := []string{"211-Features:"}
+	if offersTLS {
+		lines = append(lines, " AUTH TLS", " PBSZ", " PROT")
+	}
+	lines = append(lines,
+		" EPRT",
+		" EPSV",
+		" MDTM",
+		" MLST type*;size*;modify*;",
+	)
+	if DriverAs(driver, new(FTPResumableDriver)) {
+		lines = append(lines, " REST STREAM")
+	}
+	return append(lines,
+		" SIZE",
+		" UTF8",
+		"211 End",
+	)
+}
@@ -0,0 +1,95 @@
+package graval
+
+import (
+	"os"
+	"path"
+)
+
+// SymlinkMode controls how symlinks reported by a driver's DirContents are
+// shown in directory listings.
+type SymlinkMode int
+
+const (
+	// ListSymlinks shows symlinks as links, with their targets if the driver
+	// knows them.
+	ListSymlinks SymlinkMode = iota
+
+	// ResolveSymlinks shows symlinks as the file or directory they point to,
+	// so clients that don't understand links can still use them. Links whose
+	// target can't be found are left out.
+	ResolveSymlinks
+
+	// HideSymlinks leaves symlinks out of listings altogether.
+	HideSymlinks
+)
+
+// dirContents lists a directory, presenting any symlinks in it according to
+// the server's SymlinkMode. A blind drop box is always empty.
+func (ftpConn *ftpConn) dirContents(dir string) []os.FileInfo {
+	result := []os.FileInfo{}
+	ftpConn.eachDirEntry(dir, func(file os.FileInfo) bool {
+		result = append(result, file)
+		return true
+	})
+	return result
+}
+
+// eachDirEntry calls fn with each entry of a directory in turn, presenting
+// any symlinks according to the server's SymlinkMode, until fn returns
+// false. Drivers that implement FTPDirIterDriver are asked for one entry at
+// a time, so the whole directory is never held in memory.
+func (ftpConn *ftpConn) eachDirEntry(dir string, fn func(os.FileInfo) bool) {
+	if ftpConn.blindDrop(dir) {
+		return
+	}
+	mode := ftpConn.server.symlinks
+	present := func(file os.FileInfo) bool {
+		if file.Mode()&os.ModeSymlink == 0 || mode == ListSymlinks {
+			return fn(file)
+		}
+		if mode == ResolveSymlinks {
+			if resolved := ftpConn.resolveSymlink(dir, file); resolved != nil {
+				return fn(resolved)
+			}
+		}
+		return true
+	}
+	var iterDriver FTPDirIterDriver
+	if DriverAs(ftpConn.driver, &iterDriver) {
+		if err := iterDriver.DirContentsIter(dir, present); err != nil {
+			ftpConn.logger.Printf("Unable to list %s: %s", dir, err)
+		}
+		return
+	}
+	for _, file := range ftpConn.driver.DirContents(dir) {
+		if !present(file) {
+			return
+		}
+	}
+}
+
+// resolveSymlink describes what the link in dir points to, under the link's
+// own name, or returns nil if the target can't be found. Without a known
+// target the link's own path is looked up, which works for drivers that
+// follow links themselves.
+func (ftpConn *ftpConn) resolveSymlink(dir string, link os.FileInfo) os.FileInfo {
+	target := path.Join(dir, link.Name())
+	if linkTarget, ok := symlinkTarget(link); ok {
+		if path.IsAbs(linkTarget) {
+			target = path.Clean(linkTarget)
+		} else {
+			target = path.Join(dir, linkTarget)
+		}
+	}
+	modTime, err := ftpConn.driver.ModifiedTime(target)
+	if err != nil {
+		return nil
+	}
+	if ftpConn.driver.ChangeDir(target) {
+		return NewDirItem(link.Name(), modTime)
+	}
+	if size := ftpConn.driver.Bytes(target); isFileSize(size) {
+		return NewFileItem(link.Name(), size, modTime)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package graval
+
+import (
+	"sync"
+	"time"
+)
+
+// failed logins older than this are forgotten by the tarpit
+const loginFailureWindow = 15 * time.Minute
+
+// loginFailures counts recent failed logins from each client IP, so repeat
+// offenders can be made to wait longer for each reply.
+type loginFailures struct {
+	clock     Clock
+	mu        sync.Mutex
+	failures  map[string]*loginFailure
+	lastSweep time.Time
+}
+
+type loginFailure struct {
+	count int
+	last  time.Time
+}
+
+func newLoginFailures(clock Clock) *loginFailures {
+	return &loginFailures{clock: clock, failures: map[string]*loginFailure{}, lastSweep: clock.Now()}
+}
+
+// add records a failed login from ip and returns the number of recent
+// failures, including this one.
+func (failures *loginFailures) add(ip string) int {
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	now := failures.clock.Now()
+	if now.Sub(failures.lastSweep) > loginFailureWindow {
+		for key, failure := range failures.failures {
+			if now.Sub(failure.last) > loginFailureWindow {
+				delete(failures.failures, key)
+			}
+		}
+		failures.lastSweep = now
+	}
+	failure := failures.failures[ip]
+	if failure == nil || now.Sub(failure.last) > loginFailureWindow {
+		failure = &loginFailure{}
+		failures.failures[ip] = failure
+	}
+	failure.count++
+	failure.last = now
+	return failure.count
+}
+
+// reset forgets the failures from ip, after it logs in successfully.
+func (failures *loginFailures) reset(ip string) {
+	failures.mu.Lock()
+	delete(failures.failures, ip)
+	failures.mu.Unlock()
+}
+
+// tarpitDelay returns how long to wait before replying to the given number
+// of recent failed logins. The delay doubles with each failure, up to max.
+// With a max of 0 the delay is always the same.
+func tarpitDelay(delay time.Duration, max time.Duration, count int) time.Duration {
+	if max <= 0 {
+		return delay
+	}
+	for i := 1; i < count && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// authFailed delays the reply to a failed login, as set by AuthFailureDelay
+// and AuthTarpitMax, and bans the client if it has failed too many times.
+func (ftpConn *ftpConn) authFailed() {
+	server := ftpConn.server
+	count := server.loginFailures.add(ftpConn.remoteIP())
+	if server.banAfterFails > 0 && count >= server.banAfterFails {
+		server.loginFailures.reset(ftpConn.remoteIP())
+		server.ban(ftpConn.remoteIP(), server.banDuration, ftpConn)
+		return
+	}
+	settings := ftpConn.settings
+	if settings.authFailDelay <= 0 {
+		return
+	}
+	clockSleep(server.clock, tarpitDelay(settings.authFailDelay, settings.authTarpitMax, count))
+}
@@ -0,0 +1,37 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestTarpit(t *testing.T) {
+	failures := newLoginFailures(systemClock{})
+	failures.add("192.0.2.1")
+	repeated := failures.add("192.0.2.1")
+	other := failures.add("192.0.2.2")
+	failures.reset("192.0.2.1")
+	afterReset := failures.add("192.0.2.1")
+
+	Convey("Failed logins", t, func() {
+		Convey("Will be counted for each IP", func() {
+			So(repeated, ShouldEqual, 2)
+			So(other, ShouldEqual, 1)
+		})
+
+		Convey("Will be forgotten after a successful login", func() {
+			So(afterReset, ShouldEqual, 1)
+		})
+
+		Convey("Will be delayed by the same amount without a tarpit", func() {
+			So(tarpitDelay(time.Second, 0, 5), ShouldEqual, time.Second)
+		})
+
+		Convey("Will be delayed longer for each failure in the tarpit", func() {
+			So(tarpitDelay(time.Second, time.Minute, 1), ShouldEqual, time.Second)
+			So(tarpitDelay(time.Second, time.Minute, 3), ShouldEqual, 4*time.Second)
+			So(tarpitDelay(time.Second, time.Minute, 100), ShouldEqual, time.Minute)
+		})
+	})
+}
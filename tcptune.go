@@ -0,0 +1,32 @@
+package graval
+
+import (
+	"net"
+	"time"
+)
+
+// tuneControlConn applies the KeepAlivePeriod option to a new control
+// connection. Connections that aren't TCP are left alone.
+func tuneControlConn(conn net.Conn, keepAlive time.Duration) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || keepAlive == 0 {
+		return
+	}
+	if keepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(keepAlive)
+}
+
+// tuneDataConn sets up a new data connection for bulk transfer. Nagle's
+// algorithm only ever delays the last segment of a transfer, so it's always
+// disabled. bufferSize sets the socket buffers if it's greater than zero.
+func tuneDataConn(conn *net.TCPConn, bufferSize int) {
+	conn.SetNoDelay(true)
+	if bufferSize > 0 {
+		conn.SetReadBuffer(bufferSize)
+		conn.SetWriteBuffer(bufferSize)
+	}
+}
@@ -0,0 +1,88 @@
+package graval
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tracer creates spans for the work graval does on behalf of a client. Each
+// session is a root span, each command is a child of its session and each
+// data transfer is a child of the command that started it.
+//
+// Spans are named "ftp.session", "ftp.command <COMMAND>" and "ftp.transfer".
+// Session spans carry ftp.session_id and net.peer.ip, command spans carry
+// ftp.user, ftp.path and ftp.reply_code, and transfer spans carry
+// ftp.direction, ftp.path and ftp.bytes.
+// A command span ends with an error when its reply code is 400 or above.
+//
+// graval doesn't depend on any particular tracing library. To report traces
+// to OpenTelemetry, wrap a trace.Tracer from go.opentelemetry.io/otel in a
+// small adapter in your own program:
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, graval.Span) {
+//		ctx, span := t.tracer.Start(ctx, name)
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ span trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key string, value interface{}) {
+//		s.span.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+//	}
+//
+//	func (s otelSpan) End(err error) {
+//		if err != nil {
+//			s.span.RecordError(err)
+//			s.span.SetStatus(codes.Error, err.Error())
+//		}
+//		s.span.End()
+//	}
+//
+// and pass otelTracer{otel.Tracer("graval")} as FTPServerOpts.Tracer. Since
+// the OpenTelemetry tracer keeps the span in the context it returns, the
+// parentage graval builds carries over unchanged.
+type Tracer interface {
+	// params  - the parent context, the span name
+	// returns - a context carrying the new span, and the span itself
+	Start(context.Context, string) (context.Context, Span)
+}
+
+// Span is a single unit of traced work, created by a Tracer.
+type Span interface {
+	// params  - an attribute name and value
+	SetAttribute(string, interface{})
+
+	// params  - an error if the work failed, nil otherwise
+	End(error)
+}
+
+// FTPTracedDriver may optionally be implemented by an FTPDriver that wants
+// to add its own spans to a trace, for example around calls to a storage
+// backend. SetTraceContext is called before each command is handed to the
+// driver, with a context carrying the span for that command.
+type FTPTracedDriver interface {
+	SetTraceContext(context.Context)
+}
+
+type noopTracer struct{}
+
+func (tracer noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (span noopSpan) SetAttribute(key string, value interface{}) {}
+
+func (span noopSpan) End(err error) {}
+
+// replyError converts a reply code into an error suitable for ending a span.
+// Positive completion and intermediate replies are not errors.
+func replyError(code int) error {
+	if code < 400 {
+		return nil
+	}
+	return fmt.Errorf("ftp reply %d", code)
+}
@@ -0,0 +1,65 @@
+package graval
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// transcriptWriter records the control channel dialogue of a single session
+// in a plain text format. Each line sent by the client is prefixed with "> "
+// and each line sent by the server is prefixed with "< ". Passwords are
+// redacted, in the same way as the debug log.
+//
+//	< 220 Go FTP Server
+//	> USER test
+//	< 331 User name ok, password required
+//	> PASS ****
+//	< 230 Password ok, continue
+//
+// gravaltest can parse and replay transcripts in this format.
+type transcriptWriter struct {
+	writer io.Writer
+}
+
+func newTranscriptWriter(w io.Writer) *transcriptWriter {
+	t := new(transcriptWriter)
+	t.writer = w
+	return t
+}
+
+// openSessionTranscript creates the transcript file for a session inside
+// dir.
+func openSessionTranscript(dir string, sessionId string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, sessionId+".txt"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (t *transcriptWriter) Command(command string, param string) {
+	if t == nil {
+		return
+	}
+	param = redactParam(command, param)
+	if param == "" {
+		fmt.Fprintf(t.writer, "> %s\n", command)
+	} else {
+		fmt.Fprintf(t.writer, "> %s %s\n", command, param)
+	}
+}
+
+func (t *transcriptWriter) Reply(code int, message string) {
+	if t == nil {
+		return
+	}
+	fmt.Fprintf(t.writer, "< %d %s\n", code, message)
+}
+
+func (t *transcriptWriter) ReplyLines(lines []string) {
+	if t == nil {
+		return
+	}
+	for _, line := range lines {
+		fmt.Fprintf(t.writer, "< %s\n", strings.TrimRight(line, "\r\n"))
+	}
+}
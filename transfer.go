@@ -0,0 +1,212 @@
+package graval
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	transferUpload   = "upload"
+	transferDownload = "download"
+)
+
+// TransferState describes a file transfer that is currently in progress.
+type TransferState struct {
+	SessionId string    `json:"session"`
+	User      string    `json:"user"`
+	RemoteIP  string    `json:"remote_ip"`
+	Direction string    `json:"direction"`
+	Path      string    `json:"path"`
+	Bytes     int64     `json:"bytes"`
+	Started   time.Time `json:"started"`
+}
+
+// FailedTransfer describes a transfer that stopped part way through, so
+// operators can tell what went wrong and whether the client can resume it.
+type FailedTransfer struct {
+	TransferState
+
+	// The offset the transfer started at, given by REST
+	Offset int64 `json:"offset"`
+
+	// Whether the client can carry on where it left off by sending REST
+	// with ResumeFrom before trying again
+	Resumable  bool  `json:"resumable"`
+	ResumeFrom int64 `json:"resume_from"`
+
+	Error string `json:"error"`
+}
+
+// TransferFailureHook is called whenever a transfer fails after it has
+// started, for example because the client went away or the driver failed.
+type TransferFailureHook func(failure *FailedTransfer)
+
+var errSessionClosed = errors.New("session closed during transfer")
+
+// transfer tracks a single file upload or download over the data socket, so
+// the various logs, traces and counters can be updated in one place when it
+// finishes. While it's running it's also the session's current transfer, which
+// STAT and FTPServer.Transfers report on.
+type transfer struct {
+	conn      *ftpConn
+	direction string
+	path      string
+	started   time.Time
+	span      Span
+	bytes     int64
+	offset    int64
+	ranged    bool
+	discarded bool
+	weight    int
+	rate      *rateWatch
+}
+
+// beginTransfer should be called immediately before file data starts moving
+// over the data socket. direction is transferUpload or transferDownload.
+func (ftpConn *ftpConn) beginTransfer(direction string, path string) *transfer {
+	t := new(transfer)
+	t.conn = ftpConn
+	t.direction = direction
+	t.path = path
+	t.started = ftpConn.server.clock.Now()
+	t.offset = ftpConn.restOffset
+	t.ranged = ftpConn.rangeSet
+	_, t.span = ftpConn.server.tracer.Start(ftpConn.cmdCtx, "ftp.transfer")
+	t.span.SetAttribute("ftp.direction", direction)
+	t.span.SetAttribute("ftp.path", path)
+	ftpConn.server.stats.transferStarted()
+	t.weight = ftpConn.priority + 1
+	ftpConn.server.bandwidth.join(t.weight)
+	ftpConn.mu.Lock()
+	ftpConn.current = t
+	ftpConn.mu.Unlock()
+	t.watchRate()
+	return t
+}
+
+// tally records n more bytes moved by the transfer. It's safe to call while
+// the transfer state is being read from another goroutine.
+func (t *transfer) tally(n int64) {
+	atomic.AddInt64(&t.bytes, n)
+	if t.direction == transferUpload {
+		t.conn.server.stats.addReceived(n)
+	} else {
+		t.conn.server.stats.addSent(n)
+	}
+}
+
+func (t *transfer) state() TransferState {
+	return TransferState{
+		SessionId: t.conn.sessionId,
+		User:      t.conn.user,
+		RemoteIP:  t.conn.remoteIP(),
+		Direction: t.direction,
+		Path:      t.path,
+		Bytes:     atomic.LoadInt64(&t.bytes),
+		Started:   t.started,
+	}
+}
+
+// currentTransfer returns the transfer in progress on this session, or nil.
+func (ftpConn *ftpConn) currentTransfer() *transfer {
+	ftpConn.mu.Lock()
+	defer ftpConn.mu.Unlock()
+	return ftpConn.current
+}
+
+// Transfers returns the state of every file transfer in progress on the
+// server.
+func (ftpServer *FTPServer) Transfers() []TransferState {
+	ftpServer.mu.Lock()
+	defer ftpServer.mu.Unlock()
+	transfers := []TransferState{}
+	for conn := range ftpServer.sessions {
+		if t := conn.currentTransfer(); t != nil {
+			transfers = append(transfers, t.state())
+		}
+	}
+	return transfers
+}
+
+// resumable reports whether the transfer can be resumed with REST after it
+// has failed with err.
+func (t *transfer) resumable(err error) bool {
+	if t.ranged || t.discarded || err == errUploadTooLarge || err == errTransferCapExceeded {
+		return false
+	}
+	if t.direction == transferUpload {
+		if !DriverAs(t.conn.driver, new(FTPResumableDriver)) {
+			return false
+		}
+		// an atomic upload's temporary file is only kept to be resumed if
+		// there's an UploadStateFile
+		return !t.conn.server.atomicUploads || t.conn.server.uploadState != nil
+	}
+	// only a real file can be resumed, not an archive or a virtual file
+	return t.conn.driver.Bytes(t.path) >= 0
+}
+
+// resumeFrom returns the offset to resume the transfer at with REST.
+func (t *transfer) resumeFrom() int64 {
+	return t.offset + atomic.LoadInt64(&t.bytes)
+}
+
+// failureDetail describes how far a failed transfer got, for its 426 or 451
+// reply.
+func (t *transfer) failureDetail(err error) string {
+	moved := atomic.LoadInt64(&t.bytes)
+	if t.resumable(err) {
+		return fmt.Sprintf(" after %d bytes; resume with REST %d", moved, t.resumeFrom())
+	}
+	return fmt.Sprintf(" after %d bytes", moved)
+}
+
+// finish records the outcome of the transfer. err should be nil if all data
+// was moved successfully.
+func (t *transfer) finish(err error) {
+	conn := t.conn
+	t.rate.stop()
+	conn.mu.Lock()
+	conn.current = nil
+	conn.mu.Unlock()
+	conn.server.stats.transferFinished()
+	conn.server.bandwidth.leave(t.weight)
+	t.span.SetAttribute("ftp.bytes", conn.cmdBytes)
+	t.span.End(err)
+	if err != nil {
+		conn.server.stats.transferFailed()
+		if hook := conn.server.failureHook; hook != nil {
+			failure := &FailedTransfer{
+				TransferState: t.state(),
+				Offset:        t.offset,
+				Error:         err.Error(),
+			}
+			if failure.Resumable = t.resumable(err); failure.Resumable {
+				failure.ResumeFrom = t.resumeFrom()
+			}
+			hook(failure)
+		}
+	} else {
+		t.completed()
+	}
+
+	if conn.server.xferLog != nil {
+		direction := "o"
+		if t.direction == transferUpload {
+			direction = "i"
+		}
+		conn.server.xferLog.Log(&xferRecord{
+			time:      conn.server.clock.Now(),
+			duration:  conn.server.clock.Now().Sub(t.started),
+			remoteIP:  conn.remoteIP(),
+			bytes:     conn.cmdBytes,
+			path:      t.path,
+			binary:    conn.transferType == "I",
+			direction: direction,
+			user:      conn.user,
+			complete:  err == nil,
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package graval
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// CompletedTransfer describes a transfer that finished successfully, with how
+// fast it went.
+type CompletedTransfer struct {
+	TransferState
+
+	// The offset the transfer started at, given by REST
+	Offset int64 `json:"offset"`
+
+	// How long the data took to move, and the average speed
+	Duration       time.Duration `json:"duration"`
+	BytesPerSecond float64       `json:"bytes_per_second"`
+}
+
+// TransferCompleteHook is called whenever a transfer finishes successfully.
+type TransferCompleteHook func(transfer *CompletedTransfer)
+
+// speed returns how many bytes the transfer has moved so far, how long it's
+// taken and the average bytes a second.
+func (t *transfer) speed() (int64, time.Duration, float64) {
+	moved := atomic.LoadInt64(&t.bytes)
+	elapsed := t.conn.server.clock.Now().Sub(t.started)
+	if elapsed <= 0 {
+		return moved, 0, 0
+	}
+	return moved, elapsed, float64(moved) / elapsed.Seconds()
+}
+
+// completed passes a finished transfer to the server's TransferCompleteHook.
+func (t *transfer) completed() {
+	hook := t.conn.server.completeHook
+	if hook == nil {
+		return
+	}
+	completed := &CompletedTransfer{TransferState: t.state(), Offset: t.offset}
+	_, completed.Duration, completed.BytesPerSecond = t.speed()
+	hook(completed)
+}
+
+// completeMessage is the text of the 226 reply to a transfer, which includes
+// how fast it went if the server has TransferStatsInReplies.
+func (ftpConn *ftpConn) completeMessage(xfer *transfer) string {
+	if xfer == nil || !ftpConn.server.statsInReplies {
+		return "Transfer complete."
+	}
+	moved, elapsed, rate := xfer.speed()
+	return fmt.Sprintf("Transfer complete. %s in %.1f s, %s/s", formatSize(float64(moved)), elapsed.Seconds(), formatSize(rate))
+}
+
+// formatSize describes a number of bytes to three significant figures, like
+// "10.4 MB".
+func formatSize(bytes float64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	unit := 0
+	for bytes >= 999.5 && unit < len(units)-1 {
+		bytes /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f B", bytes)
+	}
+	return fmt.Sprintf("%.3g %s", bytes, units[unit])
+}
@@ -0,0 +1,257 @@
+package graval
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+)
+
+// the suffix added to the names of uploads in progress, unless the driver
+// chooses its own temporary name
+const defaultUploadTempSuffix = ".in-progress"
+
+// the suffix, followed by the session ID, of the name a file is moved to while
+// an upload replaces it
+const replacedFileSuffix = ".replaced-"
+
+// CompletedUpload describes a file that has been received in full but hasn't
+// yet been moved to its final name.
+type CompletedUpload struct {
+	SessionId string
+	User      string
+	Values    *SessionValues
+
+	// The name the client asked to store the file as
+	Path string
+
+	// The name the data was written to, which the driver can read it back
+	// from
+	TempPath string
+
+	Bytes int64
+
+	// The MIME type detected from the first bytes of the file, like
+	// "image/png" or "application/x-executable". It's only filled in when
+	// there are UploadHooks or a ContentTypePolicy.
+	ContentType string
+}
+
+// UploadHook is called after an upload has been received and before it's
+// renamed to its final name. Returning an error rejects the upload: the
+// temporary file is deleted and the client receives a 451 reply that includes
+// the error message.
+type UploadHook func(upload *CompletedUpload) error
+
+// ContentTypePolicy decides whether an upload may be committed based on its
+// ContentType, for example to refuse executables. It's called before any
+// UploadHooks. Returning an error rejects the upload: the temporary file is
+// deleted and the client receives a 550 reply that includes the error
+// message.
+type ContentTypePolicy func(upload *CompletedUpload) error
+
+// how much of a file is read to detect its type, the most that
+// http.DetectContentType considers
+const sniffLen = 512
+
+// executableSignatures are the magic numbers of executables, which
+// http.DetectContentType doesn't recognise.
+var executableSignatures = []struct {
+	magic       string
+	contentType string
+}{
+	{"\x7fELF", "application/x-executable"},
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+}
+
+// detectContentType returns the MIME type of a file that starts with head.
+func detectContentType(head []byte) string {
+	for _, signature := range executableSignatures {
+		if bytes.HasPrefix(head, []byte(signature.magic)) {
+			return signature.contentType
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+// uploadContentType detects the type of the file at filePath, reading it
+// back from the driver so that a resumed upload is judged by its start.
+func (ftpConn *ftpConn) uploadContentType(filePath string) string {
+	reader, err := ftpConn.driver.GetFile(filePath)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	head, _ := ioutil.ReadAll(io.LimitReader(reader, sniffLen))
+	return detectContentType(head)
+}
+
+// UploadInterceptor sees the data of every upload on its way to the driver,
+// for example to scan it for viruses or check it against a content policy,
+// and gets the final say on whether it's committed.
+type UploadInterceptor interface {
+	// Intercept is called when an upload to path starts. It returns the
+	// reader to hand to the driver in place of data - data itself, a wrapper
+	// that transforms it, or an io.TeeReader that copies it somewhere for
+	// inspection - and a function that's called once the driver has stored
+	// the file. If that function returns an error, the upload is rejected:
+	// the temporary file is deleted and the client receives a 451 reply that
+	// includes the error message.
+	Intercept(path string, data io.Reader) (io.Reader, func() error)
+}
+
+// FTPTempUploadDriver is an optional interface for drivers that want to choose
+// where uploads are written before they're committed, for example to keep
+// them in a separate staging directory. When AtomicUploads is enabled and the
+// driver doesn't implement it, the temporary name is the final name with
+// UploadTempSuffix appended.
+type FTPTempUploadDriver interface {
+	// params  - the final path of the upload
+	// returns - the path to write the upload to until it's complete
+	TempUploadPath(string) string
+}
+
+// uploadTempPath returns the name to write an upload to before it's
+// committed.
+func (ftpConn *ftpConn) uploadTempPath(path string) string {
+	var driver FTPTempUploadDriver
+	if DriverAs(ftpConn.driver, &driver) {
+		return driver.TempUploadPath(path)
+	}
+	return path + ftpConn.server.uploadTempSuffix
+}
+
+// makeParentDirs creates any missing directories above filePath, returning
+// false if one can't be created.
+func (ftpConn *ftpConn) makeParentDirs(filePath string) bool {
+	dir := path.Dir(filePath)
+	if dir == "/" || ftpConn.driver.ChangeDir(dir) {
+		return true
+	}
+	return ftpConn.makeParentDirs(dir) && ftpConn.driver.MakeDir(dir)
+}
+
+var errUploadTooLarge = errors.New("upload exceeds the maximum size")
+
+// maxUploadSize returns the largest file the current user may upload, or 0 if
+// there's no limit.
+func (ftpConn *ftpConn) maxUploadSize() int64 {
+	if ftpConn.settings.userMaxUpload != nil {
+		if max := ftpConn.settings.userMaxUpload(ftpConn.account); max != 0 {
+			return max
+		}
+	}
+	return ftpConn.settings.maxUploadSize
+}
+
+// uploadLimitReader fails with errUploadTooLarge once more than remaining
+// bytes have been read through it. A negative remaining means no limit.
+type uploadLimitReader struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (r *uploadLimitReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return r.reader.Read(p)
+	}
+	if r.exceeded {
+		return 0, errUploadTooLarge
+	}
+	// read one byte more than allowed, to tell a file that's exactly the
+	// limit from one that's too large
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	if int64(n) > r.remaining {
+		r.exceeded = true
+		return int(r.remaining), errUploadTooLarge
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// interceptUpload passes the data for an upload to path through each of the
+// server's interceptors in turn. It returns the reader to give to the driver,
+// and the verdicts to check before the upload is committed.
+func (ftpConn *ftpConn) interceptUpload(path string, data io.Reader) (io.Reader, []func() error) {
+	var verdicts []func() error
+	for _, interceptor := range ftpConn.server.uploadIntercepts {
+		var verdict func() error
+		data, verdict = interceptor.Intercept(path, data)
+		if verdict != nil {
+			verdicts = append(verdicts, verdict)
+		}
+	}
+	return data, verdicts
+}
+
+// commitUpload checks the verdicts of the upload interceptors, the content
+// type policy and the upload hooks for a file that has been written to tempPath, then moves it to
+// path, replacing any existing file. If the upload is rejected or can't be
+// moved, the temporary file is deleted, any existing file is left in place,
+// and the returned code and error describe why.
+func (ftpConn *ftpConn) commitUpload(tempPath string, path string, size int64, verdicts []func() error) (int, error) {
+	for _, verdict := range verdicts {
+		if err := verdict(); err != nil {
+			ftpConn.driver.DeleteFile(tempPath)
+			return 451, err
+		}
+	}
+	upload := &CompletedUpload{
+		SessionId: ftpConn.sessionId,
+		User:      ftpConn.user,
+		Values:    ftpConn.values,
+		Path:      path,
+		TempPath:  tempPath,
+		Bytes:     size,
+	}
+	if ftpConn.server.typePolicy != nil || len(ftpConn.server.uploadHooks) > 0 {
+		upload.ContentType = ftpConn.uploadContentType(tempPath)
+	}
+	if policy := ftpConn.server.typePolicy; policy != nil {
+		if err := policy(upload); err != nil {
+			ftpConn.driver.DeleteFile(tempPath)
+			return 550, err
+		}
+	}
+	for _, hook := range ftpConn.server.uploadHooks {
+		if err := hook(upload); err != nil {
+			ftpConn.driver.DeleteFile(tempPath)
+			return 451, err
+		}
+	}
+	// the existing file is moved aside rather than deleted, into the
+	// archive if it's being versioned, so it can be put back if the upload
+	// can't be moved into its place
+	archived, ok := ftpConn.archiveExisting(path)
+	if !ok {
+		ftpConn.driver.DeleteFile(tempPath)
+		return 451, errors.New("unable to archive existing file")
+	}
+	replaced := archived
+	if archived == "" && isFileSize(ftpConn.driver.Bytes(path)) {
+		replaced = path + replacedFileSuffix + ftpConn.sessionId
+		if !ftpConn.driver.Rename(path, replaced) {
+			ftpConn.driver.DeleteFile(tempPath)
+			return 451, errors.New("unable to replace existing file")
+		}
+	}
+	if !ftpConn.driver.Rename(tempPath, path) {
+		ftpConn.restoreArchived(replaced, path)
+		ftpConn.driver.DeleteFile(tempPath)
+		return 451, errors.New("unable to commit upload")
+	}
+	if replaced != archived {
+		ftpConn.driver.DeleteFile(replaced)
+	}
+	return 0, nil
+}
@@ -0,0 +1,177 @@
+package graval
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// uploadRecord is an atomic upload that's in progress or was interrupted,
+// and whose temporary file is kept so it can be resumed.
+type uploadRecord struct {
+	User     string    `json:"user"`
+	Path     string    `json:"path"`
+	TempPath string    `json:"temp_path"`
+	Updated  time.Time `json:"updated"`
+}
+
+// uploadState keeps track of atomic uploads in a file, so their temporary
+// files can be found again after the session or the whole server has gone
+// away. A nil *uploadState keeps track of nothing.
+type uploadState struct {
+	file   string
+	expiry time.Duration
+	clock  Clock
+
+	mu      sync.Mutex
+	records map[string]*uploadRecord
+}
+
+// loadUploadState reads the records left in file by an earlier run. A
+// missing file is the same as an empty one. Records are dated, and expire,
+// by clock.
+func loadUploadState(file string, expiry time.Duration, clock Clock) (*uploadState, error) {
+	state := &uploadState{file: file, expiry: expiry, clock: clock, records: map[string]*uploadRecord{}}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []*uploadRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		state.records[uploadKey(record.User, record.Path)] = record
+	}
+	return state, nil
+}
+
+func uploadKey(user string, path string) string {
+	return user + "\x00" + path
+}
+
+// find returns the record of an upload by user to path, or nil.
+func (state *uploadState) find(user string, path string) *uploadRecord {
+	if state == nil {
+		return nil
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if record := state.records[uploadKey(user, path)]; record != nil {
+		copied := *record
+		return &copied
+	}
+	return nil
+}
+
+// update records that user is uploading to path by way of tempPath.
+func (state *uploadState) update(user string, path string, tempPath string) {
+	if state == nil {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.records[uploadKey(user, path)] = &uploadRecord{
+		User:     user,
+		Path:     path,
+		TempPath: tempPath,
+		Updated:  state.clock.Now().UTC(),
+	}
+	state.save()
+}
+
+// remove forgets the upload by user to path, once it has been committed or
+// its temporary file deleted.
+func (state *uploadState) remove(user string, path string) {
+	if state == nil {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	delete(state.records, uploadKey(user, path))
+	state.save()
+}
+
+// removeTemp forgets the upload whose temporary file is tempPath, once the
+// file has been deleted.
+func (state *uploadState) removeTemp(tempPath string) {
+	if state == nil {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for key, record := range state.records {
+		if record.TempPath == tempPath {
+			delete(state.records, key)
+			state.save()
+			return
+		}
+	}
+}
+
+// expired removes and returns the records of user's uploads that haven't
+// been resumed within the expiry time.
+func (state *uploadState) expired(user string) []*uploadRecord {
+	if state == nil {
+		return nil
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var expired []*uploadRecord
+	for key, record := range state.records {
+		if record.User == user && state.clock.Now().Sub(record.Updated) > state.expiry {
+			expired = append(expired, record)
+			delete(state.records, key)
+		}
+	}
+	if len(expired) > 0 {
+		state.save()
+	}
+	return expired
+}
+
+// save writes the records to the state file, replacing it in one step so a
+// crash can't leave it half written. The caller must hold mu. Errors are
+// ignored, since the records are only lost if the server also restarts.
+func (state *uploadState) save() {
+	records := make([]*uploadRecord, 0, len(state.records))
+	for _, record := range state.records {
+		records = append(records, record)
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return
+	}
+	temp := state.file + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		return
+	}
+	os.Rename(temp, state.file)
+}
+
+// collectStaleUploads deletes the temporary files of the logged in user's
+// interrupted uploads that are too old to be resumed. It's run at login,
+// since that's when there's a driver that can reach the user's files.
+func (ftpConn *ftpConn) collectStaleUploads() {
+	for _, record := range ftpConn.server.uploadState.expired(ftpConn.account) {
+		ftpConn.logger.Printf("Deleting stale upload %s", record.TempPath)
+		ftpConn.driver.DeleteFile(record.TempPath)
+	}
+}
+
+// discardUpload cleans up after an atomic upload to path that failed. If it
+// was interrupted and UploadStateFile is set, the temporary file is kept so
+// the upload can be resumed. Otherwise it's deleted.
+func (ftpConn *ftpConn) discardUpload(path string, tempPath string, interrupted bool) {
+	state := ftpConn.server.uploadState
+	if interrupted && state != nil {
+		state.update(ftpConn.account, path, tempPath)
+		return
+	}
+	ftpConn.driver.DeleteFile(tempPath)
+	state.remove(ftpConn.account, path)
+}
@@ -0,0 +1,183 @@
+package graval
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var errTransferCapExceeded = errors.New("transfer cap exceeded")
+
+// UserUsage is the number of bytes a user has moved in file transfers, across
+// every session since the server started or ResetUsage was last called.
+type UserUsage struct {
+	User            string `json:"user"`
+	BytesUploaded   int64  `json:"bytes_uploaded"`
+	BytesDownloaded int64  `json:"bytes_downloaded"`
+}
+
+// Total returns the bytes moved in both directions.
+func (usage UserUsage) Total() int64 {
+	return usage.BytesUploaded + usage.BytesDownloaded
+}
+
+// usageCounters holds the per-user counters behind UserUsage. Methods are
+// safe to call from many connections at once.
+type usageCounters struct {
+	mu    sync.Mutex
+	users map[string]*userCounter
+}
+
+type userCounter struct {
+	uploaded   int64
+	downloaded int64
+}
+
+// counter returns the counters for user, creating them if needed.
+func (usage *usageCounters) counter(user string) *userCounter {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	if usage.users == nil {
+		usage.users = map[string]*userCounter{}
+	}
+	counter := usage.users[user]
+	if counter == nil {
+		counter = new(userCounter)
+		usage.users[user] = counter
+	}
+	return counter
+}
+
+// user returns the usage of a single user, without creating counters for
+// users that haven't transferred anything.
+func (usage *usageCounters) user(user string) UserUsage {
+	usage.mu.Lock()
+	counter := usage.users[user]
+	usage.mu.Unlock()
+	if counter == nil {
+		return UserUsage{User: user}
+	}
+	return counter.snapshot(user)
+}
+
+func (counter *userCounter) snapshot(user string) UserUsage {
+	return UserUsage{
+		User:            user,
+		BytesUploaded:   atomic.LoadInt64(&counter.uploaded),
+		BytesDownloaded: atomic.LoadInt64(&counter.downloaded),
+	}
+}
+
+// snapshot returns the usage of every user that has transferred a file,
+// sorted by name. If reset is true, the counters start again from zero.
+func (usage *usageCounters) snapshot(reset bool) []UserUsage {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	users := make([]UserUsage, 0, len(usage.users))
+	for user, counter := range usage.users {
+		users = append(users, counter.snapshot(user))
+	}
+	if reset {
+		// sessions hold on to their counters, so they're cleared rather
+		// than dropped
+		for _, counter := range usage.users {
+			atomic.StoreInt64(&counter.uploaded, 0)
+			atomic.StoreInt64(&counter.downloaded, 0)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+	return users
+}
+
+// Usage returns the bytes uploaded and downloaded by each user that has
+// transferred a file, sorted by user name. Users of an FTPAliasDriver are
+// counted under their account.
+func (ftpServer *FTPServer) Usage() []UserUsage {
+	return ftpServer.usage.snapshot(false)
+}
+
+// UserUsage returns the bytes uploaded and downloaded by a single user.
+func (ftpServer *FTPServer) UserUsage(user string) UserUsage {
+	return ftpServer.usage.user(user)
+}
+
+// ResetUsage returns the same as Usage and sets every counter back to zero,
+// for example at the end of a billing period. Users cut off by
+// UserTransferCap can transfer files again afterwards.
+func (ftpServer *FTPServer) ResetUsage() []UserUsage {
+	return ftpServer.usage.snapshot(true)
+}
+
+// transferCap returns the most bytes the current user may move in total, or 0
+// if there's no cap.
+func (ftpConn *ftpConn) transferCap() int64 {
+	if ftpConn.settings.userXferCap == nil {
+		return 0
+	}
+	return ftpConn.settings.userXferCap(ftpConn.account)
+}
+
+// overTransferCap reports whether the current user has used up their
+// transfer cap, replying 552 if they have.
+func (ftpConn *ftpConn) overTransferCap() bool {
+	max := ftpConn.transferCap()
+	if max <= 0 || ftpConn.server.UserUsage(ftpConn.account).Total() < max {
+		return false
+	}
+	ftpConn.writeMessage(552, "Transfer cap exceeded")
+	return true
+}
+
+// meter counts the bytes read through reader against the user's usage, and
+// cuts the transfer off with errTransferCapExceeded once they go over their
+// transfer cap.
+func (t *transfer) meter(reader io.Reader) io.Reader {
+	return &meteredReader{
+		reader:  reader,
+		conn:    t.conn,
+		upload:  t.direction == transferUpload,
+		counter: t.conn.server.usage.counter(t.conn.account),
+		max:     t.conn.transferCap(),
+	}
+}
+
+type meteredReader struct {
+	reader   io.Reader
+	conn     *ftpConn
+	upload   bool
+	counter  *userCounter
+	max      int64
+	exceeded bool
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, errTransferCapExceeded
+	}
+	if r.max > 0 {
+		remaining := r.max - r.counter.snapshot("").Total()
+		if remaining <= 0 {
+			// read a byte more than allowed, to tell a transfer that ends
+			// exactly at the cap from one that goes over it
+			if n, err := r.reader.Read(p[:1]); n == 0 && err == io.EOF {
+				return 0, io.EOF
+			}
+			r.exceeded = true
+			r.conn.securityEvent(SecurityTransferCap, fmt.Sprint(r.max))
+			return 0, errTransferCapExceeded
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := r.reader.Read(p)
+	if r.upload {
+		atomic.AddInt64(&r.counter.uploaded, int64(n))
+	} else {
+		atomic.AddInt64(&r.counter.downloaded, int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,85 @@
+package graval
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WireTap chooses where to mirror the control channel of a new session, for
+// debugging problems with particular clients without access to the network.
+// Returning nil leaves the session untapped. If the writer is also an
+// io.Closer, it's closed when the session ends.
+//
+// Every line is written exactly as it crossed the wire, quoted so line
+// endings and other control characters show, with the time and its
+// direction:
+//
+//	15:04:05.000000 < "220 Go FTP Server\r\n"
+//	15:04:05.000153 > "USER test\r\n"
+//	15:04:05.000190 < "331 User name ok, password required\r\n"
+//	15:04:05.000247 > "PASS ****\r\n"
+//
+// Passwords are redacted, as in the debug log.
+type WireTap func(sessionId string, remoteIP string) io.Writer
+
+// wireTap writes a session's control channel to a WireTap's writer. Lines
+// are read and written on different goroutines, hence the lock.
+type wireTap struct {
+	mu     sync.Mutex
+	writer io.Writer
+	closed bool
+}
+
+func (tap *wireTap) write(direction string, data string) {
+	if tap == nil {
+		return
+	}
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	if tap.closed {
+		return
+	}
+	fmt.Fprintf(tap.writer, "%s %s %q\n", time.Now().Format("15:04:05.000000"), direction, data)
+}
+
+// client records a line from the client.
+func (tap *wireTap) client(line string) {
+	tap.write(">", redactPassword(line))
+}
+
+// server records a reply, which may be several lines, from the server.
+func (tap *wireTap) server(reply string) {
+	for _, line := range strings.SplitAfter(reply, "\n") {
+		if line != "" {
+			tap.write("<", line)
+		}
+	}
+}
+
+// close stops the tap, since the session may still be writing a last reply
+// as it ends.
+func (tap *wireTap) close() {
+	if tap == nil {
+		return
+	}
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	tap.closed = true
+	if closer, ok := tap.writer.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// redactPassword hides the passwords of a PASS, SITE PSWD or SITE CPWD
+// command in a raw line from the client, keeping its line ending.
+func redactPassword(line string) string {
+	command, param := parseCommandLine(line)
+	redacted := redactParam(command, param)
+	if redacted == param {
+		return line
+	}
+	return command + " " + redacted + line[len(strings.TrimRight(line, "\r\n")):]
+}
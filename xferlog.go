@@ -0,0 +1,68 @@
+package graval
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xferRecord is a single file transfer, as described by a line in an xferlog.
+type xferRecord struct {
+	time      time.Time
+	duration  time.Duration
+	remoteIP  string
+	bytes     int64
+	path      string
+	binary    bool
+	direction string
+	user      string
+	complete  bool
+}
+
+// xferLogger writes transfer records in the xferlog format used by wu-ftpd and
+// vsftpd. See xferlog(5) for a description of the fields.
+type xferLogger struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func newXferLogger(w io.Writer) *xferLogger {
+	l := new(xferLogger)
+	l.writer = w
+	return l
+}
+
+func (logger *xferLogger) Log(record *xferRecord) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	io.WriteString(logger.writer, record.String()+"\n")
+}
+
+// String formats the record as a single xferlog line, without a trailing
+// newline.
+func (record *xferRecord) String() string {
+	transferType := "a"
+	if record.binary {
+		transferType = "b"
+	}
+	status := "i"
+	if record.complete {
+		status = "c"
+	}
+	// fields are space separated, so spaces in the filename are replaced the
+	// same way vsftpd does
+	path := strings.Replace(record.path, " ", "_", -1)
+	return fmt.Sprintf("%s %d %s %d %s %s _ %s r %s ftp 0 * %s",
+		record.time.Format("Mon Jan _2 15:04:05 2006"),
+		int64(record.duration.Seconds()+0.5),
+		record.remoteIP,
+		record.bytes,
+		path,
+		transferType,
+		record.direction,
+		record.user,
+		status,
+	)
+}
@@ -0,0 +1,33 @@
+package graval
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestXferRecordFormat(t *testing.T) {
+	record := &xferRecord{
+		time:      time.Date(2019, 8, 5, 13, 0, 0, 0, time.UTC),
+		duration:  2 * time.Second,
+		remoteIP:  "127.0.0.1",
+		bytes:     99,
+		path:      "/files/two words.txt",
+		binary:    true,
+		direction: "o",
+		user:      "test",
+		complete:  true,
+	}
+	Convey("The xferlog format", t, func() {
+		Convey("Will display a completed binary download correctly", func() {
+			So(record.String(), ShouldEqual, "Mon Aug  5 13:00:00 2019 2 127.0.0.1 99 /files/two_words.txt b _ o r test ftp 0 * c")
+		})
+
+		Convey("Will display an incomplete ascii upload correctly", func() {
+			record.binary = false
+			record.direction = "i"
+			record.complete = false
+			So(record.String(), ShouldEqual, "Mon Aug  5 13:00:00 2019 2 127.0.0.1 99 /files/two_words.txt a _ i r test ftp 0 * i")
+		})
+	})
+}